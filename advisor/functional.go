@@ -0,0 +1,301 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"strings"
+
+	"github.com/laojianzi/soar/ast"
+	"github.com/laojianzi/soar/common"
+	"github.com/laojianzi/soar/database"
+
+	tidb "github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/format"
+	"github.com/pingcap/parser/opcode"
+	driver "github.com/pingcap/tidb/types/parser_driver"
+)
+
+// https://dev.mysql.com/doc/refman/8.0/en/create-index.html#create-index-functional-key-parts
+
+// funcFilter WHERE 条件中对单列使用函数后的过滤，如：LOWER(email) = 'abc'
+type funcFilter struct {
+	Qualifier string // 列前缀，表名或表别名
+	Column    string
+	Func      string // 最外层的函数名
+	Expr      string // 去掉列前缀后的表达式，用于函数索引
+}
+
+// funcFilterFinder 查找 WHERE 条件中可以使用函数索引的过滤
+type funcFilterFinder struct {
+	filters []funcFilter
+}
+
+// nonDeterministicFuncs 函数索引中不允许使用的不确定性函数
+var nonDeterministicFuncs = map[string]bool{
+	tidb.Now:              true,
+	tidb.CurrentTimestamp: true,
+	tidb.CurrentDate:      true,
+	tidb.CurrentTime:      true,
+	tidb.Curdate:          true,
+	tidb.Curtime:          true,
+	tidb.Sysdate:          true,
+	tidb.UnixTimestamp:    true,
+	tidb.UTCDate:          true,
+	tidb.UTCTime:          true,
+	tidb.UTCTimestamp:     true,
+	tidb.Rand:             true,
+	tidb.UUID:             true,
+	tidb.UUIDShort:        true,
+	tidb.ConnectionID:     true,
+	tidb.CurrentUser:      true,
+	tidb.User:             true,
+	tidb.Database:         true,
+	tidb.LastInsertId:     true,
+	tidb.FoundRows:        true,
+	tidb.RowCount:         true,
+}
+
+// isConstExpr 是否为常量或预处理参数
+func isConstExpr(expr tidb.ExprNode) bool {
+	switch expr.(type) {
+	case *driver.ValueExpr, *driver.ParamMarkerExpr:
+		return true
+	}
+	return false
+}
+
+// funcColumnsFinder 获取函数参数中用到的列，遇到不能用于函数索引的表达式时 invalid 为 true
+type funcColumnsFinder struct {
+	columns []*tidb.ColumnNameExpr
+	invalid bool
+}
+
+// Enter implements ast.Visitor interface
+func (v *funcColumnsFinder) Enter(in tidb.Node) (tidb.Node, bool) {
+	switch node := in.(type) {
+	case *tidb.ColumnNameExpr:
+		v.columns = append(v.columns, node)
+	case *tidb.SubqueryExpr, *tidb.VariableExpr, *tidb.AggregateFuncExpr, *tidb.WindowFuncExpr:
+		v.invalid = true
+		return in, true
+	case *tidb.FuncCallExpr:
+		if nonDeterministicFuncs[node.FnName.L] {
+			v.invalid = true
+			return in, true
+		}
+	}
+	return in, false
+}
+
+// Leave implements ast.Visitor interface
+func (v *funcColumnsFinder) Leave(in tidb.Node) (tidb.Node, bool) {
+	return in, true
+}
+
+// newFuncFilter 只对单列使用函数时返回过滤条件，JSON 路径由 JSN.001 单独给出索引建议
+func newFuncFilter(expr tidb.ExprNode) (funcFilter, bool) {
+	fn, ok := expr.(*tidb.FuncCallExpr)
+	if !ok || strings.HasPrefix(fn.FnName.L, "json_") {
+		return funcFilter{}, false
+	}
+
+	v := &funcColumnsFinder{}
+	fn.Accept(v)
+	if v.invalid || len(v.columns) == 0 {
+		return funcFilter{}, false
+	}
+	col := v.columns[0].Name
+	for _, c := range v.columns[1:] {
+		if !strings.EqualFold(c.Name.Name.O, col.Name.O) || !strings.EqualFold(c.Name.Table.O, col.Table.O) {
+			return funcFilter{}, false
+		}
+	}
+
+	// 函数索引中的列不能带表名前缀，Restore 时临时去掉
+	var qualifiers []tidb.ColumnName
+	for _, c := range v.columns {
+		qualifiers = append(qualifiers, *c.Name)
+		c.Name.Schema.O, c.Name.Schema.L = "", ""
+		c.Name.Table.O, c.Name.Table.L = "", ""
+	}
+	var sb strings.Builder
+	err := fn.Restore(format.NewRestoreCtx(format.DefaultRestoreFlags, &sb))
+	for i, c := range v.columns {
+		c.Name.Schema, c.Name.Table = qualifiers[i].Schema, qualifiers[i].Table
+	}
+	if err != nil {
+		return funcFilter{}, false
+	}
+
+	return funcFilter{
+		Qualifier: col.Table.O,
+		Column:    col.Name.O,
+		Func:      fn.FnName.L,
+		Expr:      sb.String(),
+	}, true
+}
+
+// Enter implements ast.Visitor interface
+func (v *funcFilterFinder) Enter(in tidb.Node) (tidb.Node, bool) {
+	var candidates []tidb.ExprNode
+	switch node := in.(type) {
+	case *tidb.SubqueryExpr:
+		// 子查询的 WHERE 条件单独查找
+		return in, true
+	case *tidb.BinaryOperationExpr:
+		switch node.Op {
+		case opcode.EQ, opcode.LT, opcode.LE, opcode.GT, opcode.GE, opcode.NullEQ:
+			if isConstExpr(node.R) {
+				candidates = append(candidates, node.L)
+			}
+			if isConstExpr(node.L) {
+				candidates = append(candidates, node.R)
+			}
+		}
+	case *tidb.PatternInExpr:
+		if !node.Not && node.Sel == nil {
+			allConst := true
+			for _, item := range node.List {
+				allConst = allConst && isConstExpr(item)
+			}
+			if allConst {
+				candidates = append(candidates, node.Expr)
+			}
+		}
+	case *tidb.PatternLikeExpr:
+		if !node.Not && isConstExpr(node.Pattern) {
+			candidates = append(candidates, node.Expr)
+		}
+	case *tidb.BetweenExpr:
+		if !node.Not && isConstExpr(node.Left) && isConstExpr(node.Right) {
+			candidates = append(candidates, node.Expr)
+		}
+	}
+
+	for _, expr := range candidates {
+		if filter, ok := newFuncFilter(expr); ok {
+			v.add(filter)
+		}
+	}
+	return in, false
+}
+
+// Leave implements ast.Visitor interface
+func (v *funcFilterFinder) Leave(in tidb.Node) (tidb.Node, bool) {
+	return in, true
+}
+
+// add 添加过滤条件，相同的条件只保留一个
+func (v *funcFilterFinder) add(filter funcFilter) {
+	for _, f := range v.filters {
+		if f == filter {
+			return
+		}
+	}
+	v.filters = append(v.filters, filter)
+}
+
+// findFuncFilters 获取语句 WHERE 及 JOIN ON 条件中对单列使用函数的过滤
+func findFuncFilters(node tidb.Node) []funcFilter {
+	wf := &whereFinder{}
+	node.Accept(wf)
+
+	v := &funcFilterFinder{}
+	for _, cond := range wf.conditions {
+		cond.Accept(v)
+	}
+	return v.filters
+}
+
+// funcExprIndexed 根据 SHOW CREATE TABLE 判断是否已存在相同表达式的函数索引
+func funcExprIndexed(ddl string, expr string) bool {
+	target := normalizeDDLLine("(" + expr + ")")
+	for _, line := range strings.Split(ddl, "\n") {
+		if isKeyLine(line) && strings.Contains(normalizeDDLLine(line), target) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildFuncIndex 为函数过滤生成函数索引建议
+func buildFuncIndex(db, tb string, f funcFilter) IndexInfo {
+	idxName := common.Config.IdxPrefix + f.Func + "_" + f.Column
+	if len(idxName) > IndexNameMaxLength {
+		idxName = strings.TrimRight(idxName[:IndexNameMaxLength], "_")
+	}
+
+	info := IndexInfo{
+		Name:          idxName,
+		Database:      db,
+		Table:         tb,
+		ColumnDetails: []*common.Column{{Name: f.Expr, Table: tb, DB: db}},
+		KeyParts:      []database.IndexKeyPart{{Expression: f.Expr}},
+	}
+	info.DDL = info.addIndexDDL()
+	return info
+}
+
+// funcIndexAdvise 对 WHERE 条件中对单列使用函数的过滤给出函数索引建议，需要 MySQL 8.0.13 及以上版本
+func (idxAdv *IndexAdvisor) funcIndexAdvise() IndexAdvises {
+	version := common.Config.OnlineDSN.Version
+	if version == 0 {
+		version = common.Config.TestDSN.Version
+	}
+
+	var indexes IndexAdvises
+	if version < 80013 {
+		return indexes
+	}
+
+	for _, stmt := range idxAdv.tiStmt {
+		filters := findFuncFilters(stmt)
+		if len(filters) == 0 {
+			continue
+		}
+
+		meta := ast.GetTiMeta(stmt, nil)
+		ddls := make(map[string]string)
+		for _, f := range filters {
+			for db := range meta {
+				for _, tb := range meta[db].Table {
+					if tb.TableName == "" {
+						continue
+					}
+					if f.Qualifier != "" && !tableMatches(tb, f.Qualifier) {
+						continue
+					}
+
+					key := db + "." + tb.TableName
+					if _, ok := ddls[key]; !ok {
+						ddls[key] = idxAdv.tableDDL(db, tb.TableName)
+					}
+					if ddlColumnType(ddls[key], f.Column) == "" || funcExprIndexed(ddls[key], f.Expr) {
+						continue
+					}
+
+					realDB := db
+					if realDB == "" {
+						realDB = idxAdv.rEnv.Database
+					}
+					indexes = mergeAdvices(indexes, buildFuncIndex(realDB, tb.TableName, f))
+				}
+			}
+		}
+	}
+	return indexes
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"testing"
+
+	"github.com/laojianzi/soar/ast"
+	"github.com/laojianzi/soar/common"
+)
+
+func TestFindFuncFilters(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	cases := map[string][]funcFilter{
+		"SELECT * FROM tbl WHERE LOWER(email) = 'abc@example.com'": {
+			{Column: "email", Func: "lower", Expr: "LOWER(`email`)"},
+		},
+		"SELECT * FROM tbl t WHERE SUBSTRING(t.name, 1, 3) IN ('abc', 'def')": {
+			{Qualifier: "t", Column: "name", Func: "substring", Expr: "SUBSTRING(`name`, 1, 3)"},
+		},
+		"DELETE FROM tbl WHERE DATE(created_at) BETWEEN '2020-01-01' AND '2020-01-31'": {
+			{Column: "created_at", Func: "date", Expr: "DATE(`created_at`)"},
+		},
+		"SELECT * FROM tbl WHERE 'abc' = UPPER(TRIM(name))": {
+			{Column: "name", Func: "upper", Expr: "UPPER(TRIM(`name`))"},
+		},
+		"SELECT * FROM tbl WHERE CONCAT(first_name, last_name) = 'abc'":        nil,
+		"SELECT * FROM tbl WHERE DATE(created_at) = CURDATE()":                 nil,
+		"SELECT * FROM tbl WHERE created_at > DATE_SUB(NOW(), INTERVAL 1 DAY)": nil,
+		"SELECT * FROM tbl WHERE data->>'$.name' = 'abc'":                      nil,
+	}
+	for sql, want := range cases {
+		stmts, err := ast.TiParse(sql, "", "")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		got := findFuncFilters(stmts[0])
+		if len(got) != len(want) {
+			t.Errorf("SQL: %s, want: %v, got: %v", sql, want, got)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("SQL: %s, want: %v, got: %v", sql, want[i], got[i])
+			}
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestBuildFuncIndex(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	ddl := "CREATE TABLE `tbl` (\n" +
+		"  `id` int(11) NOT NULL,\n" +
+		"  `email` varchar(64) DEFAULT NULL,\n" +
+		"  `name` varchar(64) DEFAULT NULL,\n" +
+		"  PRIMARY KEY (`id`),\n" +
+		"  KEY `idx_lower_email` ((lower(`email`)))\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+	if !funcExprIndexed(ddl, "LOWER(`email`)") {
+		t.Error("LOWER(`email`) should be indexed")
+	}
+	if funcExprIndexed(ddl, "LOWER(`name`)") {
+		t.Error("LOWER(`name`) should not be indexed")
+	}
+
+	idx := buildFuncIndex("db", "tbl", funcFilter{Column: "name", Func: "lower", Expr: "LOWER(`name`)"})
+	want := "ALTER TABLE `db`.`tbl` ADD INDEX `idx_lower_name` ((LOWER(`name`)))"
+	if idx.DDL != want {
+		t.Errorf("want: %s, got: %s", want, idx.DDL)
+	}
+	// 函数索引需要能够被 TiDB 解析用于合并 ALTER 语句
+	if _, err := ast.TiParse(idx.DDL, "", ""); err != nil {
+		t.Error(idx.DDL, err)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
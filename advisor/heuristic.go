@@ -22,6 +22,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/laojianzi/soar/ast"
@@ -319,6 +320,10 @@ func (idxAdv *IndexAdvisor) RuleImplicitConversion() Rule {
 
 			// 列与值比较
 			for _, val := range values {
+				// 预处理语句的参数在绑定后检查
+				if val.Type == sqlparser.ValArg {
+					continue
+				}
 				if colList[0].DataType == "" {
 					common.Log.Warn("Can't get %s data type", colList[0].Name)
 					break
@@ -1250,6 +1255,15 @@ func (q *Query4Audit) RuleImpossibleWhere() Rule {
 				}
 			}
 		case *sqlparser.ComparisonExpr:
+			// NOT IN (1, NULL) 的结果只可能是 FALSE 或 NULL
+			if tuple, ok := n.Right.(sqlparser.ValTuple); ok && n.Operator == sqlparser.NotInStr {
+				for _, v := range tuple {
+					if _, ok := v.(*sqlparser.NullVal); ok {
+						rule = HeuristicRules["RES.006"]
+						return false, nil
+					}
+				}
+			}
 			factor := false
 			switch n.Operator {
 			case "!=", "<>":
@@ -1355,6 +1369,15 @@ func (q *Query4Audit) RuleMeaninglessWhere() Rule {
 			}
 		// 1=1, 0=0
 		case *sqlparser.ComparisonExpr:
+			// NOT IN (1, NULL) 的结果只可能是 FALSE 或 NULL
+			if tuple, ok := n.Right.(sqlparser.ValTuple); ok && n.Operator == sqlparser.NotInStr {
+				for _, v := range tuple {
+					if _, ok := v.(*sqlparser.NullVal); ok {
+						rule = HeuristicRules["RES.006"]
+						return false, nil
+					}
+				}
+			}
 			factor := false
 			switch n.Operator {
 			case "!=", "<>":
@@ -1526,6 +1549,50 @@ func (idxAdv *IndexAdvisor) RuleUpdateOnUpdate() Rule {
 	return rule
 }
 
+// RuleNotInNullable RES.012
+func (idxAdv *IndexAdvisor) RuleNotInNullable() Rule {
+	rule := HeuristicRules["OK"]
+	// 未开启测试环境不进行检查
+	if common.Config.TestDSN.Disable {
+		return rule
+	}
+	var columns common.TableColumns
+	err := sqlparser.Walk(func(node sqlparser.SQLNode) (kontinue bool, err error) {
+		sel, ok := node.(*sqlparser.Select)
+		if !ok || sel.Where == nil {
+			return true, nil
+		}
+		// 只检查当前 SELECT 的条件，子查询中的 SELECT 由外层 Walk 处理
+		return true, sqlparser.Walk(func(node sqlparser.SQLNode) (kontinue bool, err error) {
+			cmp, ok := node.(*sqlparser.ComparisonExpr)
+			if !ok || cmp.Operator != sqlparser.NotInStr {
+				_, isSubquery := node.(*sqlparser.Subquery)
+				return !isSubquery, nil
+			}
+			if _, ok := cmp.Right.(*sqlparser.Subquery); !ok {
+				return false, nil
+			}
+			if columns == nil {
+				columns = idxAdv.vEnv.GenTableColumns(ast.GetMeta(idxAdv.Ast, nil))
+			}
+			if !ast.NotInNullable(cmp, columns) {
+				return false, nil
+			}
+			if rule.Item == "OK" {
+				rule = HeuristicRules["RES.012"]
+			}
+			if exists, ok := ast.NotIn2NotExists(sel, cmp, columns); ok {
+				rule.Content += fmt.Sprintf("可改写为：%s。", sqlparser.String(exists))
+			} else {
+				rule.Content += fmt.Sprintf("%s NOT IN 子查询无法自动改写，请人工确认。", sqlparser.String(cmp.Left))
+			}
+			return false, nil
+		}, sel.Where)
+	}, idxAdv.Ast)
+	common.LogIfError(err, "")
+	return rule
+}
+
 // RuleStandardINEQ STA.001
 func (q *Query4Audit) RuleStandardINEQ() Rule {
 	var rule = q.RuleOK()
@@ -1794,6 +1861,328 @@ func (q *Query4Audit) RuleUNIONLimit() Rule {
 	return rule
 }
 
+// RuleRecursiveCTE CTE.001
+func (q *Query4Audit) RuleRecursiveCTE() Rule {
+	var rule = q.RuleOK()
+	for _, tiStmt := range q.TiStmt {
+		for _, cte := range ast.FindCTEs(tiStmt) {
+			if !cte.Recursive {
+				continue
+			}
+			union, ok := cte.Query.Query.(*tidb.SetOprStmt)
+			// LIMIT 可以终止递归（MySQL 8.0.19+）
+			if !ok || union.SelectList == nil || union.Limit != nil {
+				continue
+			}
+			for _, node := range union.SelectList.Selects {
+				sel, ok := node.(*tidb.SelectStmt)
+				if !ok || sel.Where != nil || sel.Limit != nil || sel.From == nil {
+					continue
+				}
+				// 递归部分只引用了 CTE 自身且没有 WHERE 条件，只能依靠 cte_max_recursion_depth 终止
+				if join := sel.From.TableRefs; join != nil && join.Right == nil {
+					if source, ok := join.Left.(*tidb.TableSource); ok {
+						if table, ok := source.Source.(*tidb.TableName); ok && table.Schema.O == "" && table.Name.L == strings.ToLower(cte.Name) {
+							rule = HeuristicRules["CTE.001"]
+						}
+					}
+				}
+			}
+		}
+	}
+	return rule
+}
+
+// RuleCTEMultiReference CTE.002
+func (q *Query4Audit) RuleCTEMultiReference() Rule {
+	var rule = q.RuleOK()
+	for _, tiStmt := range q.TiStmt {
+		for _, cte := range ast.FindCTEs(tiStmt) {
+			if cte.References > 1 {
+				rule = HeuristicRules["CTE.002"]
+				rule.Content = fmt.Sprintf("CTE `%s` 被引用了 %d 次。", cte.Name, cte.References) + rule.Content
+				return rule
+			}
+		}
+	}
+	return rule
+}
+
+// RuleWindowOrderBy WIN.002
+func (q *Query4Audit) RuleWindowOrderBy() Rule {
+	var rule = q.RuleOK()
+	for _, tiStmt := range q.TiStmt {
+		for _, sel := range ast.FindSelects(tiStmt) {
+			if sel.OrderBy == nil {
+				continue
+			}
+			orderBy := restoreByItems(sel.OrderBy.Items)
+			for _, f := range ast.FindWindowFuncs(sel) {
+				if len(f.PartitionBy) == 0 && len(f.OrderBy) > 0 && restoreByItems(f.OrderBy) == orderBy {
+					rule = HeuristicRules["WIN.002"]
+				}
+			}
+		}
+	}
+	return rule
+}
+
+// restoreByItems 将 ORDER BY, PARTITION BY 中的列还原为 SQL 用于比较
+func restoreByItems(items []*tidb.ByItem) string {
+	var sb strings.Builder
+	ctx := format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)
+	for i, item := range items {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		if err := item.Restore(ctx); err != nil {
+			return ""
+		}
+	}
+	return sb.String()
+}
+
+// RuleWindowNoPartition WIN.001
+func (idxAdv *IndexAdvisor) RuleWindowNoPartition(q Query4Audit) Rule {
+	rule := HeuristicRules["OK"]
+	for _, tiStmt := range q.TiStmt {
+		for _, sel := range ast.FindSelects(tiStmt) {
+			noPartition := false
+			for _, f := range ast.FindWindowFuncs(sel) {
+				if len(f.PartitionBy) == 0 {
+					noPartition = true
+				}
+			}
+			if !noPartition || sel.From == nil {
+				continue
+			}
+
+			// 检查当前 SELECT 的 FROM 子句中引用的表
+			meta := ast.GetTiMeta(sel.From, nil)
+			for db := range meta {
+				for _, tb := range meta[db].Table {
+					if tb.TableName == "" {
+						continue
+					}
+					rows, ok := idxAdv.tableRows(db, tb.TableName)
+					if ok && rows > common.Config.MaxTotalRows {
+						rule = HeuristicRules["WIN.001"]
+						rule.Content = fmt.Sprintf("表 `%s` 约有 %d 行数据。", tb.TableName, rows) + rule.Content
+						return rule
+					}
+				}
+			}
+		}
+	}
+	return rule
+}
+
+// tableRows 获取线上表的行数，优先使用库表结构快照
+func (idxAdv *IndexAdvisor) tableRows(dbName, tbName string) (uint64, bool) {
+	if dbName == "" {
+		dbName = idxAdv.rEnv.Database
+	}
+
+	if idxAdv.vEnv.Snapshot != nil {
+		if tb := idxAdv.vEnv.Snapshot.Table(dbName, tbName); tb != nil {
+			return tb.Rows, true
+		}
+		return 0, false
+	}
+	if common.Config.OnlineDSN.Disable {
+		return 0, false
+	}
+
+	// 复制一份 online connector，防止环境切换影响其他功能的使用
+	conn := idxAdv.rEnv
+	conn.Database = dbName
+	status, err := conn.ShowTableStatus(tbName)
+	if err != nil || len(status.Rows) == 0 {
+		common.LogIfWarn(err, "tableRows")
+		return 0, false
+	}
+	rows, err := strconv.ParseUint(string(status.Rows[0].Rows), 10, 64)
+	return rows, err == nil
+}
+
+// RuleJSONPathFilter JSN.001
+func (idxAdv *IndexAdvisor) RuleJSONPathFilter(q Query4Audit) Rule {
+	return idxAdv.ruleJSONIndex(q, "JSN.001", false)
+}
+
+// RuleJSONContains JSN.002
+func (idxAdv *IndexAdvisor) RuleJSONContains(q Query4Audit) Rule {
+	return idxAdv.ruleJSONIndex(q, "JSN.002", true)
+}
+
+// ruleJSONIndex JSON 列上没有可用索引的路径过滤，contains 为 true 时检查需要多值索引的 JSON_CONTAINS 等函数
+func (idxAdv *IndexAdvisor) ruleJSONIndex(q Query4Audit, item string, contains bool) Rule {
+	rule := HeuristicRules["OK"]
+	version := common.Config.OnlineDSN.Version
+	if version == 0 {
+		version = common.Config.TestDSN.Version
+	}
+
+	var contents []string
+	for _, f := range idxAdv.jsonTableFilters(q.TiStmt) {
+		if f.Indexed || f.Contains != contains {
+			continue
+		}
+		content := fmt.Sprintf("%s.%s 没有可用的索引", f.Table, f.expr())
+		if f.Contains && f.Path == "$" {
+			content = fmt.Sprintf("%s.`%s` 没有可用的多值索引", f.Table, f.Column)
+		}
+		if idx, ok := buildJSONIndex(f.DB, f.Table, f.jsonPathFilter, version); ok {
+			content += "，建议：" + idx.DDL
+		} else if f.Contains {
+			content += "，多值索引需要 MySQL 8.0.17 及以上版本"
+		}
+		contents = append(contents, content)
+	}
+	if len(contents) > 0 {
+		rule = HeuristicRules[item]
+		rule.Content = strings.Join(contents, "；") + "。" + rule.Content
+	}
+	return rule
+}
+
+var jsonValidRe = regexp.MustCompile("(?i)json_valid\\(`([^`]+)`\\)")
+
+// RuleJSONInText JSN.003
+func (q *Query4Audit) RuleJSONInText() Rule {
+	var rule = q.RuleOK()
+	for _, tiStmt := range q.TiStmt {
+		var cols []*tidb.ColumnDef
+		var checks []tidb.ExprNode
+		switch node := tiStmt.(type) {
+		case *tidb.CreateTableStmt:
+			cols = node.Cols
+			for _, constraint := range node.Constraints {
+				if constraint.Tp == tidb.ConstraintCheck {
+					checks = append(checks, constraint.Expr)
+				}
+			}
+		case *tidb.AlterTableStmt:
+			for _, spec := range node.Specs {
+				switch spec.Tp {
+				case tidb.AlterTableAddColumns, tidb.AlterTableModifyColumn, tidb.AlterTableChangeColumn:
+					cols = append(cols, spec.NewColumns...)
+				case tidb.AlterTableAddConstraint:
+					if spec.Constraint != nil && spec.Constraint.Tp == tidb.ConstraintCheck {
+						checks = append(checks, spec.Constraint.Expr)
+					}
+				}
+			}
+		default:
+			continue
+		}
+
+		// CHECK (JSON_VALID(col)) 中的列
+		jsonValid := make(map[string]bool)
+		for _, col := range cols {
+			for _, opt := range col.Options {
+				if opt.Tp == tidb.ColumnOptionCheck {
+					checks = append(checks, opt.Expr)
+				}
+			}
+		}
+		for _, check := range checks {
+			var sb strings.Builder
+			if err := check.Restore(format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)); err != nil {
+				continue
+			}
+			for _, m := range jsonValidRe.FindAllStringSubmatch(sb.String(), -1) {
+				jsonValid[strings.ToLower(m[1])] = true
+			}
+		}
+
+		for _, col := range cols {
+			if col.Tp == nil {
+				continue
+			}
+			switch col.Tp.Tp {
+			case mysql.TypeVarchar, mysql.TypeVarString, mysql.TypeBlob, mysql.TypeTinyBlob, mysql.TypeMediumBlob, mysql.TypeLongBlob:
+			default:
+				continue
+			}
+
+			isJSON := jsonValid[col.Name.Name.L] || strings.Contains(col.Name.Name.L, "json")
+			for _, opt := range col.Options {
+				if opt.Tp != tidb.ColumnOptionComment {
+					continue
+				}
+				var sb strings.Builder
+				if err := opt.Expr.Restore(format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)); err == nil &&
+					strings.Contains(strings.ToLower(sb.String()), "json") {
+					isJSON = true
+				}
+			}
+			if isJSON {
+				rule = HeuristicRules["JSN.003"]
+				return rule
+			}
+		}
+	}
+	return rule
+}
+
+// jsonPartialUpdateFuncs 支持原地部分更新的 JSON 函数
+var jsonPartialUpdateFuncs = map[string]bool{
+	tidb.JSONSet:     true,
+	tidb.JSONReplace: true,
+	tidb.JSONRemove:  true,
+}
+
+// jsonModifyFuncs 修改 JSON 文档的函数
+var jsonModifyFuncs = map[string]bool{
+	tidb.JSONSet:           true,
+	tidb.JSONReplace:       true,
+	tidb.JSONRemove:        true,
+	tidb.JSONInsert:        true,
+	tidb.JSONArrayAppend:   true,
+	tidb.JSONArrayInsert:   true,
+	tidb.JSONMerge:         true,
+	tidb.JSONMergePatch:    true,
+	tidb.JSONMergePreserve: true,
+}
+
+// jsonPartialUpdate 判断 SET col = expr 能否原地部分更新，JSON_SET, JSON_REPLACE, JSON_REMOVE 的第一个参数必须是被更新的列，可以嵌套
+func jsonPartialUpdate(col *tidb.ColumnName, expr tidb.ExprNode) bool {
+	switch node := expr.(type) {
+	case *tidb.ColumnNameExpr:
+		return strings.EqualFold(node.Name.Name.O, col.Name.O) &&
+			(node.Name.Table.O == "" || col.Table.O == "" || strings.EqualFold(node.Name.Table.O, col.Table.O))
+	case *tidb.FuncCallExpr:
+		if !jsonPartialUpdateFuncs[node.FnName.L] || len(node.Args) == 0 {
+			return false
+		}
+		return jsonPartialUpdate(col, node.Args[0])
+	}
+	return false
+}
+
+// RuleJSONPartialUpdate JSN.004
+func (q *Query4Audit) RuleJSONPartialUpdate() Rule {
+	var rule = q.RuleOK()
+	for _, tiStmt := range q.TiStmt {
+		node, ok := tiStmt.(*tidb.UpdateStmt)
+		if !ok {
+			continue
+		}
+		for _, assign := range node.List {
+			fn, ok := assign.Expr.(*tidb.FuncCallExpr)
+			if !ok || !jsonModifyFuncs[fn.FnName.L] {
+				continue
+			}
+			if !jsonPartialUpdate(assign.Column, assign.Expr) {
+				rule = HeuristicRules["JSN.004"]
+				return rule
+			}
+		}
+	}
+	return rule
+}
+
 // RuleMultiValueAttribute LIT.003
 func (q *Query4Audit) RuleMultiValueAttribute() Rule {
 	var rule = q.RuleOK()
@@ -2675,7 +3064,7 @@ func (q *Query4Audit) RuleIn() Rule {
 					for _, v := range r {
 						switch v.(type) {
 						case *sqlparser.NullVal:
-							rule = HeuristicRules["ARG.004"]
+							rule = ruleInNull(n)
 							return false, nil
 
 						case *sqlparser.ColName:
@@ -2698,7 +3087,7 @@ func (q *Query4Audit) RuleIn() Rule {
 					for _, v := range r {
 						switch v.(type) {
 						case *sqlparser.NullVal:
-							rule = HeuristicRules["ARG.004"]
+							rule = ruleInNull(n)
 							return false, nil
 						}
 					}
@@ -2711,6 +3100,16 @@ func (q *Query4Audit) RuleIn() Rule {
 	return rule
 }
 
+// ruleInNull ARG.004，给出符合预期的写法，改写会改变查询结果，不作为重写规则自动改写
+func ruleInNull(cmp *sqlparser.ComparisonExpr) Rule {
+	rule := HeuristicRules["ARG.004"]
+	if suggest, ok := ast.InNullSuggest(cmp); ok {
+		rule.Content += fmt.Sprintf("。%s 符合预期的写法可能是：%s，两种写法的查询结果不同，请人工确认。",
+			sqlparser.String(cmp), sqlparser.String(suggest))
+	}
+	return rule
+}
+
 // RuleIsNullIsNotNull ARG.006
 func (q *Query4Audit) RuleIsNullIsNotNull() Rule {
 	var rule = q.RuleOK()
@@ -2863,6 +3262,65 @@ func (q *Query4Audit) RuleAlterDropKey() Rule {
 	return rule
 }
 
+// RuleOnlineDDL ALT.005
+func (idxAdv *IndexAdvisor) RuleOnlineDDL(q Query4Audit) Rule {
+	rule := HeuristicRules["OK"]
+	for _, tiStmt := range q.TiStmt {
+		node, ok := tiStmt.(*tidb.AlterTableStmt)
+		if !ok || node.Table == nil {
+			continue
+		}
+
+		table, size, sizeKnown := idxAdv.alterTableInfo(node.Table)
+		impact := AnalyzeAlterTable(node, common.Config.OnlineDSN.Version, table)
+		if impact.Algorithm == DDLInstant && len(impact.Conflicts) == 0 {
+			continue
+		}
+
+		rule = HeuristicRules["ALT.005"]
+		switch {
+		case impact.Algorithm == DDLCopy || impact.Lock > DDLLockNone:
+			rule.Severity = "L3"
+		case impact.Rebuild:
+			rule.Severity = "L2"
+		default:
+			rule.Severity = "L1"
+		}
+
+		content := fmt.Sprintf("预计执行方式为 ALGORITHM=%s, LOCK=%s", impact.Algorithm, impact.Lock)
+		if impact.Rebuild {
+			content += "，需要重建表"
+		}
+		if sizeKnown {
+			content += fmt.Sprintf("，表大小约 %.2f MB，预计耗时约 %s", float64(size)/1024/1024,
+				time.Duration(size/ddlRebuildThroughput+1)*time.Second)
+		}
+		content += "。判断依据：" + strings.Join(impact.Reasons, "；") + "。"
+		if len(impact.Conflicts) > 0 {
+			rule.Severity = "L4"
+			content += strings.Join(impact.Conflicts, "；") + "，MySQL 会拒绝执行该语句。"
+		}
+
+		largeTable := sizeKnown && size > uint64(common.Config.MaxDDLRebuildSize)*1024*1024
+		switch {
+		case (impact.Rebuild || impact.Algorithm == DDLCopy) && largeTable:
+			rule.Severity = "L4"
+			content += fmt.Sprintf("表大小超过 %d MB，建议使用 gh-ost 或 pt-online-schema-change 进行变更。", common.Config.MaxDDLRebuildSize)
+		case impact.Algorithm == DDLCopy:
+			content += "COPY 期间会阻塞写入，建议使用 gh-ost 或 pt-online-schema-change 进行变更。"
+		default:
+			algorithm := impact.Algorithm
+			// ALGORITHM=INSTANT 需要 8.0.12 及以上版本
+			if algorithm == DDLInstant && common.Config.OnlineDSN.Version < 80012 {
+				algorithm = DDLInplace
+			}
+			content += fmt.Sprintf("建议在 ALTER 语句中显式指定 ALGORITHM=%s, LOCK=%s。", algorithm, impact.Lock)
+		}
+		rule.Content = content
+	}
+	return rule
+}
+
 // RuleBLOBNotNull COL.012
 func (q *Query4Audit) RuleBLOBNotNull() Rule {
 	var rule = q.RuleOK()
@@ -4084,6 +4542,14 @@ func RuleMySQLError(item string, err error) Rule {
 			Severity: "L8",
 			Content:  err.Error(),
 		}
+	case "ERR.004":
+		// 线上环境负载过高时跳过的查询
+		return Rule{
+			Item:     item,
+			Summary:  "线上环境负载过高，跳过了 EXPLAIN、数据采样等查询，建议结果可能不准确",
+			Severity: "L1",
+			Content:  err.Error(),
+		}
 	}
 
 	errStr := err.Error()
@@ -19,6 +19,7 @@ package advisor
 import (
 	"errors"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/kr/pretty"
@@ -956,10 +957,12 @@ func TestRuleImpossibleWhere(t *testing.T) {
 			"SELECT * FROM tbl WHERE 1 != 1;",
 			"SELECT * FROM tbl WHERE 'a' != 'a';",
 			"select * from tbl where col between 10 AND 5;",
+			"select * from tbl where col not in (1, NULL);",
 		},
 		{
 			"select * from tbl where 1 = 1;",
 			"select * from tbl where 'a' != 1;",
+			"select * from tbl where col in (1, NULL);",
 		},
 	}
 	for _, sql := range sqls[0] {
@@ -1223,6 +1226,46 @@ func TestRuleUpdateOnUpdate(t *testing.T) {
 	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
 }
 
+// RES.012
+func TestRuleNotInNullable(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	sqls := [][]string{
+		{
+			"SELECT name FROM language WHERE language_id NOT IN (SELECT original_language_id FROM film)",
+			"SELECT name FROM language WHERE language_id NOT IN (SELECT original_language_id FROM film GROUP BY original_language_id)",
+		},
+		{
+			"SELECT name FROM language WHERE language_id NOT IN (SELECT language_id FROM film)",
+			"SELECT name FROM language WHERE language_id IN (SELECT original_language_id FROM film)",
+			"SELECT name FROM language WHERE language_id NOT IN (1, 2)",
+		},
+	}
+
+	for i, expect := range []string{"RES.012", "OK"} {
+		for _, sql := range sqls[i] {
+			vEnv.BuildVirtualEnv(rEnv, sql)
+			stmt, syntaxErr := sqlparser.Parse(sql)
+			if syntaxErr != nil {
+				t.Error(syntaxErr)
+			}
+
+			q := &Query4Audit{Query: sql, Stmt: stmt}
+			idxAdvisor, err := NewAdvisor(vEnv, *rEnv, *q)
+			if err != nil {
+				t.Error("NewAdvisor Error: ", err, "SQL: ", sql)
+			}
+
+			if idxAdvisor != nil {
+				rule := idxAdvisor.RuleNotInNullable()
+				if rule.Item != expect {
+					t.Error("Rule not match:", rule.Item, "Expect :", expect, ", SQL:", sql)
+				}
+			}
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
 // STA.001
 func TestRuleStandardINEQ(t *testing.T) {
 	common.Log.Debug("Entering function: %s", common.GetFunctionName())
@@ -2499,6 +2542,207 @@ func TestRuleUNIONLimit(t *testing.T) {
 	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
 }
 
+// CTE.001
+func TestRuleRecursiveCTE(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	sqls := [][]string{
+		{
+			`WITH RECURSIVE seq(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM seq) SELECT * FROM seq;`,
+			`WITH RECURSIVE seq AS (SELECT 1 AS n UNION ALL SELECT n + 1 FROM seq AS s) SELECT * FROM seq LIMIT 10;`,
+		},
+		{
+			`WITH RECURSIVE seq(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM seq WHERE n < 100) SELECT * FROM seq;`,
+			`WITH RECURSIVE seq(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM seq LIMIT 100) SELECT * FROM seq;`,
+			`WITH RECURSIVE tree AS (SELECT id, pid FROM tbl WHERE pid = 0 UNION ALL SELECT t.id, t.pid FROM tbl t JOIN tree ON t.pid = tree.id) SELECT * FROM tree;`,
+			`WITH seq(n) AS (SELECT 1 UNION ALL SELECT 2) SELECT * FROM seq;`,
+		},
+	}
+	for _, sql := range sqls[0] {
+		q, err := NewQuery4Audit(sql)
+		if err == nil {
+			rule := q.RuleRecursiveCTE()
+			if rule.Item != "CTE.001" {
+				t.Error("Rule not match:", rule.Item, "Expect : CTE.001", sql)
+			}
+		} else {
+			t.Error("sqlparser.Parse Error:", err)
+		}
+	}
+	for _, sql := range sqls[1] {
+		q, err := NewQuery4Audit(sql)
+		if err == nil {
+			rule := q.RuleRecursiveCTE()
+			if rule.Item != "OK" {
+				t.Error("Rule not match:", rule.Item, "Expect : OK", sql)
+			}
+		} else {
+			t.Error("sqlparser.Parse Error:", err)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+// CTE.002
+func TestRuleCTEMultiReference(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	sqls := [][]string{
+		{
+			`WITH t AS (SELECT * FROM tbl) SELECT * FROM t a JOIN t b ON a.pid = b.id;`,
+			`WITH t AS (SELECT * FROM tbl) SELECT * FROM t WHERE id IN (SELECT pid FROM t);`,
+		},
+		{
+			`WITH t AS (SELECT * FROM tbl) SELECT * FROM t;`,
+			`WITH t AS (SELECT * FROM tbl) SELECT * FROM t JOIN db.t ON t.id = db.t.id;`,
+		},
+	}
+	for _, sql := range sqls[0] {
+		q, err := NewQuery4Audit(sql)
+		if err == nil {
+			rule := q.RuleCTEMultiReference()
+			if rule.Item != "CTE.002" {
+				t.Error("Rule not match:", rule.Item, "Expect : CTE.002", sql)
+			}
+		} else {
+			t.Error("sqlparser.Parse Error:", err)
+		}
+	}
+	for _, sql := range sqls[1] {
+		q, err := NewQuery4Audit(sql)
+		if err == nil {
+			rule := q.RuleCTEMultiReference()
+			if rule.Item != "OK" {
+				t.Error("Rule not match:", rule.Item, "Expect : OK", sql)
+			}
+		} else {
+			t.Error("sqlparser.Parse Error:", err)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+// WIN.002
+func TestRuleWindowOrderBy(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	sqls := [][]string{
+		{
+			`SELECT id, SUM(amount) OVER (ORDER BY id) FROM tbl ORDER BY id;`,
+			`SELECT id, RANK() OVER w FROM tbl WINDOW w AS (ORDER BY score DESC, id) ORDER BY score DESC, id;`,
+		},
+		{
+			`SELECT id, SUM(amount) OVER (PARTITION BY uid ORDER BY id) FROM tbl ORDER BY id;`,
+			`SELECT id, RANK() OVER (ORDER BY score DESC) FROM tbl ORDER BY score;`,
+			`SELECT id, SUM(amount) OVER () FROM tbl ORDER BY id;`,
+		},
+	}
+	for _, sql := range sqls[0] {
+		q, err := NewQuery4Audit(sql)
+		if err == nil {
+			rule := q.RuleWindowOrderBy()
+			if rule.Item != "WIN.002" {
+				t.Error("Rule not match:", rule.Item, "Expect : WIN.002", sql)
+			}
+		} else {
+			t.Error("sqlparser.Parse Error:", err)
+		}
+	}
+	for _, sql := range sqls[1] {
+		q, err := NewQuery4Audit(sql)
+		if err == nil {
+			rule := q.RuleWindowOrderBy()
+			if rule.Item != "OK" {
+				t.Error("Rule not match:", rule.Item, "Expect : OK", sql)
+			}
+		} else {
+			t.Error("sqlparser.Parse Error:", err)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+// JSN.003
+func TestRuleJSONInText(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	sqls := [][]string{
+		{
+			`CREATE TABLE tbl (id INT, data TEXT CHECK (JSON_VALID(data)));`,
+			`CREATE TABLE tbl (id INT, data LONGTEXT, CONSTRAINT chk_data CHECK (JSON_VALID(data)));`,
+			`CREATE TABLE tbl (id INT, ext_json VARCHAR(1024));`,
+			`CREATE TABLE tbl (id INT, ext TEXT COMMENT 'json 格式的扩展信息');`,
+			`ALTER TABLE tbl ADD COLUMN attr_json TEXT;`,
+		},
+		{
+			`CREATE TABLE tbl (id INT, data JSON);`,
+			`CREATE TABLE tbl (id INT, content TEXT COMMENT '正文');`,
+			`CREATE TABLE tbl (id INT, json_id INT);`,
+			`ALTER TABLE tbl ADD COLUMN data JSON;`,
+		},
+	}
+	for _, sql := range sqls[0] {
+		q, err := NewQuery4Audit(sql)
+		if err == nil {
+			rule := q.RuleJSONInText()
+			if rule.Item != "JSN.003" {
+				t.Error("Rule not match:", rule.Item, "Expect : JSN.003", sql)
+			}
+		} else {
+			t.Error("sqlparser.Parse Error:", err)
+		}
+	}
+	for _, sql := range sqls[1] {
+		q, err := NewQuery4Audit(sql)
+		if err == nil {
+			rule := q.RuleJSONInText()
+			if rule.Item != "OK" {
+				t.Error("Rule not match:", rule.Item, "Expect : OK", sql)
+			}
+		} else {
+			t.Error("sqlparser.Parse Error:", err)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+// JSN.004
+func TestRuleJSONPartialUpdate(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	sqls := [][]string{
+		{
+			`UPDATE tbl SET data = JSON_ARRAY_APPEND(data, '$.tags', 3) WHERE id = 1;`,
+			`UPDATE tbl SET data = JSON_SET(ext, '$.name', 'abc') WHERE id = 1;`,
+			`UPDATE tbl SET data = JSON_MERGE_PATCH(data, '{"a": 1}') WHERE id = 1;`,
+			`UPDATE tbl SET data = JSON_SET(JSON_INSERT(data, '$.a', 1), '$.b', 2) WHERE id = 1;`,
+		},
+		{
+			`UPDATE tbl SET data = JSON_SET(data, '$.name', 'abc') WHERE id = 1;`,
+			`UPDATE tbl SET data = JSON_REPLACE(JSON_REMOVE(data, '$.a'), '$.b', 2) WHERE id = 1;`,
+			`UPDATE tbl SET name = 'abc' WHERE id = 1;`,
+		},
+	}
+	for _, sql := range sqls[0] {
+		q, err := NewQuery4Audit(sql)
+		if err == nil {
+			rule := q.RuleJSONPartialUpdate()
+			if rule.Item != "JSN.004" {
+				t.Error("Rule not match:", rule.Item, "Expect : JSN.004", sql)
+			}
+		} else {
+			t.Error("sqlparser.Parse Error:", err)
+		}
+	}
+	for _, sql := range sqls[1] {
+		q, err := NewQuery4Audit(sql)
+		if err == nil {
+			rule := q.RuleJSONPartialUpdate()
+			if rule.Item != "OK" {
+				t.Error("Rule not match:", rule.Item, "Expect : OK", sql)
+			}
+		} else {
+			t.Error("sqlparser.Parse Error:", err)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
 // SEC.002
 func TestRuleReadablePasswords(t *testing.T) {
 	common.Log.Debug("Entering function: %s", common.GetFunctionName())
@@ -2694,6 +2938,15 @@ func TestRuleIn(t *testing.T) {
 			t.Error("sqlparser.Parse Error:", err)
 		}
 	}
+
+	// ARG.004 给出符合预期的写法
+	q, err := NewQuery4Audit("SELECT * FROM tbl WHERE col NOT IN (1, NULL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule := q.RuleIn(); rule.Item != "ARG.004" || !strings.Contains(rule.Content, "col not in (1)，") {
+		t.Error("Rule not match:", rule.Item, rule.Content)
+	}
 	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
 }
 
@@ -19,6 +19,7 @@ package advisor
 import (
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/laojianzi/soar/ast"
@@ -27,6 +28,7 @@ import (
 	"github.com/laojianzi/soar/env"
 
 	"github.com/dchest/uniuri"
+	tidb "github.com/pingcap/parser/ast"
 	"vitess.io/vitess/go/vt/sqlparser"
 )
 
@@ -47,6 +49,10 @@ type IndexAdvisor struct {
 	orderBy   []*common.Column    // order by可以加索引列
 	joinCond  [][]*common.Column  // 由于join condition跨层级间索引不可共用，需要多一个维度用来维护层级关系
 	IndexMeta map[string]map[string]*database.TableIndexInfo
+
+	cteQueries []string        // vitess 不支持 WITH 子句，含有 CTE 的查询拆分后的每条查询
+	cteNames   map[string]bool // CTE 名称，不为其添加索引
+	tiStmt     []tidb.StmtNode // TiDB Parser生成的抽象语法树，用于 JSON 路径的索引建议
 }
 
 // IndexInfo 创建一条索引需要的信息
@@ -56,6 +62,26 @@ type IndexInfo struct {
 	Table         string           `json:"table"`          // 表名
 	DDL           string           `json:"ddl"`            // ALTER, CREATE 等类型的 DDL 语句
 	ColumnDetails []*common.Column `json:"column_details"` // 列详情
+
+	KeyParts  []database.IndexKeyPart `json:"key_parts,omitempty"` // 函数索引、前缀索引、降序索引等列详情无法表示的索引列
+	Invisible bool                    `json:"invisible,omitempty"` // 不可见索引
+}
+
+// addIndexDDL 根据 KeyParts 生成添加索引的 DDL
+func (idx IndexInfo) addIndexDDL() string {
+	var parts []string
+	for _, part := range idx.KeyParts {
+		parts = append(parts, part.String())
+	}
+	table := fmt.Sprintf("`%s`", idx.Table)
+	if idx.Database != "" {
+		table = fmt.Sprintf("`%s`.`%s`", idx.Database, idx.Table)
+	}
+	ddl := fmt.Sprintf("ALTER TABLE %s ADD INDEX `%s` (%s)", table, idx.Name, strings.Join(parts, ", "))
+	if idx.Invisible {
+		ddl += " INVISIBLE"
+	}
+	return ddl
 }
 
 // IndexAdvises IndexAdvises列表
@@ -128,6 +154,24 @@ func NewAdvisor(env *env.VirtualEnv, rEnv database.Connector, q Query4Audit) (*I
 		return nil, nil
 	}
 
+	// vitess 不支持 WITH 子句，将 CTE 拆分为多条独立的查询分别给出索引建议
+	if q.Stmt == nil && len(q.TiStmt) == 1 {
+		if queries := ast.SplitCTE(q.TiStmt[0]); len(queries) > 0 {
+			cteNames := make(map[string]bool)
+			for _, cte := range ast.FindCTEs(q.TiStmt[0]) {
+				cteNames[strings.ToLower(cte.Name)] = true
+			}
+			return &IndexAdvisor{
+				vEnv:       env,
+				rEnv:       rEnv,
+				IndexMeta:  make(map[string]map[string]*database.TableIndexInfo),
+				cteQueries: queries,
+				cteNames:   cteNames,
+				tiStmt:     q.TiStmt,
+			}, nil
+		}
+	}
+
 	return &IndexAdvisor{
 		vEnv: env,
 		rEnv: rEnv,
@@ -142,6 +186,7 @@ func NewAdvisor(env *env.VirtualEnv, rEnv database.Connector, q Query4Audit) (*I
 		orderBy:   ast.FindOrderByCols(q.Stmt),
 		where:     ast.FindAllCols(q.Stmt, ast.WhereExpression),
 		IndexMeta: make(map[string]map[string]*database.TableIndexInfo),
+		tiStmt:    q.TiStmt,
 	}, nil
 }
 
@@ -186,6 +231,11 @@ func (idxAdv *IndexAdvisor) IndexAdvise() IndexAdvises {
 		common.Log.Warn("TestDSN.Disable = true")
 	}
 
+	// 含有 CTE 的查询对拆分后的每条查询单独评审
+	if len(idxAdv.cteQueries) > 0 {
+		return idxAdv.cteIndexAdvise()
+	}
+
 	// 检查否是否含有子查询
 	subQueries := ast.FindSubquery(0, idxAdv.Ast)
 	var subQueryAdvises []IndexInfo
@@ -354,7 +404,11 @@ func (idxAdv *IndexAdvisor) IndexAdvise() IndexAdvises {
 
 	// 在开启 env 的情况下，会对索引进行检查，对全索引进行过滤
 	// 在前几步都不会对 idx 生成 DDL 语句，DDL语句在这里生成
-	return idxAdv.mergeIndexes(indexes)
+	indexes = idxAdv.mergeIndexes(indexes)
+
+	// JSON 路径需要虚拟列或函数索引，对列使用函数的过滤需要函数索引，不参与上面的索引检查
+	indexes = mergeAdvices(indexes, idxAdv.jsonIndexAdvise()...)
+	return mergeAdvices(indexes, idxAdv.funcIndexAdvise()...)
 }
 
 // idxColsTypeCheck 对超长的字段添加前缀索引，剔除无法添索引字段的列
@@ -514,10 +568,16 @@ func (idxAdv *IndexAdvisor) mergeIndexes(idxList []IndexInfo) []IndexInfo {
 				var colsDetail []*common.Column
 
 				// 把已经存在的 key 摘出来遍历一遍对比是否是包含关系
-				for _, col := range indexMeta.FindIndex(database.IndexKeyName, existedIdx.KeyName) {
-					cols = append(cols, col.ColumnName)
+				// 函数索引没有列名，使用表达式作为名称，不会与列名相同
+				keyParts := indexMeta.KeyParts(existedIdx.KeyName)
+				for _, part := range keyParts {
+					name := part.Column
+					if part.Expression != "" {
+						name = part.String()
+					}
+					cols = append(cols, name)
 					colsDetail = append(colsDetail, &common.Column{
-						Name:  col.ColumnName,
+						Name:  name,
 						Table: idx.Table,
 						DB:    idx.ColumnDetails[0].DB,
 					})
@@ -538,6 +598,17 @@ func (idxAdv *IndexAdvisor) mergeIndexes(idxList []IndexInfo) []IndexInfo {
 						common.Log.Info(" `%s`.`%s` %s already had a index `%s`",
 							idx.Database, idx.Table, strings.Join(cols, ","), idxName)
 						isExisted = true
+						// 不可见索引不会被优化器使用，建议改为可见而不是重复添加
+						if existedIdx.Invisible() {
+							indexes = mergeAdvices(indexes, IndexInfo{
+								Name:          idxName,
+								Database:      idx.Database,
+								Table:         idx.Table,
+								DDL:           fmt.Sprintf("ALTER TABLE `%s`.`%s` ALTER INDEX `%s` VISIBLE", idx.Database, idx.Table, idxName),
+								ColumnDetails: colsDetail,
+								KeyParts:      keyParts,
+							})
+						}
 						continue
 					}
 
@@ -552,11 +623,13 @@ func (idxAdv *IndexAdvisor) mergeIndexes(idxList []IndexInfo) []IndexInfo {
 								Table:         idx.Table,
 								DDL:           alterSQL,
 								ColumnDetails: colsDetail,
+								KeyParts:      keyParts,
+								Invisible:     existedIdx.Invisible(),
 							})
 						} else {
-							common.Log.Warning("In table `%s`, the new index of column `%s` contains index `%s`,"+
+							common.Log.Warning("In table `%s`, the new index of column `%s` contains index %s,"+
 								" maybe you could drop one of them.", existedIdx.Table,
-								strings.Join(cols, ","), idxName)
+								strings.Join(cols, ","), indexMeta.KeyDefinition(idxName))
 						}
 					}
 				}
@@ -764,6 +837,30 @@ func (idxAdv *IndexAdvisor) mergeIndex(idxList map[string]map[string][]*common.C
 	}
 }
 
+// cteIndexAdvise 对 CTE 拆分后的每条查询给出索引建议，忽略为 CTE 添加的索引
+func (idxAdv *IndexAdvisor) cteIndexAdvise() IndexAdvises {
+	var indexes IndexAdvises
+	for _, sql := range idxAdv.cteQueries {
+		stmt, err := sqlparser.Parse(sql)
+		if err != nil {
+			common.Log.Debug("cteIndexAdvise vitess parse Error: %s, Query: %s", err.Error(), sql)
+			continue
+		}
+		subIdxAdv, err := NewAdvisor(idxAdv.vEnv, idxAdv.rEnv, Query4Audit{Query: sql, Stmt: stmt})
+		if err != nil || subIdxAdv == nil {
+			continue
+		}
+		for _, idx := range subIdxAdv.IndexAdvise() {
+			if idxAdv.cteNames[strings.ToLower(idx.Table)] {
+				continue
+			}
+			indexes = mergeAdvices(indexes, idx)
+		}
+	}
+	indexes = mergeAdvices(indexes, idxAdv.jsonIndexAdvise()...)
+	return mergeAdvices(indexes, idxAdv.funcIndexAdvise()...)
+}
+
 // CompleteColumnsInfo 补全索引可能会用到列的所属库名、表名等信息
 func CompleteColumnsInfo(stmt sqlparser.Statement, cols []*common.Column, env *env.VirtualEnv) []*common.Column {
 	// 如果传过来的列是空的，没必要跑逻辑
@@ -953,7 +1050,25 @@ func (idxAdv *IndexAdvisor) calcCardinality(cols []*common.Column) []*common.Col
 
 		// 给非 PRIMARY、UNIQUE 的列计算散粒度
 		if col.Cardinality != 1 {
-			col.Cardinality = idxAdv.vEnv.ColumnCardinality(col.Table, col.Name)
+			// 使用快照时直接使用快照中记录的线上散粒度
+			if cardinality, ok := idxAdv.vEnv.Snapshot.ColumnCardinality(idxAdv.vEnv.RealDB(realDB), col.Table, col.Name); ok {
+				col.Cardinality = cardinality
+				continue
+			}
+			// 统计信息采样模式下测试环境中没有数据，优先使用同步过来的统计信息
+			if common.Config.SamplingStatistics {
+				tmpDB.Database = realDB
+				if cardinality, ok := tmpDB.StatisticsCardinality(col.Table, col.Name); ok {
+					col.Cardinality = cardinality
+					continue
+				}
+			}
+			cardinality, err := idxAdv.vEnv.ColumnCardinality(col.Table, col.Name)
+			// 线上环境负载过高时使用估算的散粒度，记录下来给出 ERR.004 提示
+			if _, ok := err.(*database.ServerBusyError); ok {
+				idxAdv.vEnv.ServerBusy = err
+			}
+			col.Cardinality = cardinality
 		}
 	}
 
@@ -1048,6 +1163,7 @@ func (idxAdv *IndexAdvisor) HeuristicCheck(q Query4Audit) map[string]Rule {
 		(*IndexAdvisor).RuleGroupByConst,       // CLA.004
 		(*IndexAdvisor).RuleOrderByConst,       // CLA.005
 		(*IndexAdvisor).RuleUpdatePrimaryKey,   // CLA.016
+		(*IndexAdvisor).RuleNotInNullable,      // RES.012
 		// (*IndexAdvisor).RuleImpossibleOuterJoin, // TODO: JOI.003, JOI.004
 	}
 
@@ -1057,10 +1173,24 @@ func (idxAdv *IndexAdvisor) HeuristicCheck(q Query4Audit) map[string]Rule {
 			heuristicSuggest[rule.Item] = rule
 		}
 	}
+
+	// ALT.005, WIN.001, JSN.001, JSN.002 需要使用 TiDB 解析的语法树
+	for _, f := range []func(Query4Audit) Rule{
+		idxAdv.RuleOnlineDDL,         // ALT.005
+		idxAdv.RuleWindowNoPartition, // WIN.001
+		idxAdv.RuleJSONPathFilter,    // JSN.001
+		idxAdv.RuleJSONContains,      // JSN.002
+	} {
+		rule = f(q)
+		if rule.Item != "OK" {
+			heuristicSuggest[rule.Item] = rule
+		}
+	}
 	return heuristicSuggest
 }
 
-// DuplicateKeyChecker 对所有用到的库表检查是否存在重复索引
+// DuplicateKeyChecker 对所有用到的库表进行索引检查，包括重复索引、主键最左前缀冗余的索引、未使用的索引及散粒度过低的索引
+// 外键依赖的索引需要保留，开启 allow-drop-index 时给出删除索引的 DDL
 func DuplicateKeyChecker(conn *database.Connector, databases ...string) map[string]Rule {
 	common.Log.Debug("Enter:  DuplicateKeyChecker, Caller: %s", common.Caller())
 	// 复制一份online connector,防止环境切换影响其他功能的使用
@@ -1088,6 +1218,16 @@ func DuplicateKeyChecker(conn *database.Connector, databases ...string) map[stri
 		databases = append(databases, tmpOnline.Database)
 	}
 
+	// 索引使用情况来自 performance_schema，MySQL 重启后清零
+	usage := indexUsage{enabled: tmpOnline.PerformanceSchemaEnabled()}
+	if usage.enabled {
+		uptime, err := tmpOnline.Uptime()
+		common.LogIfError(err, "")
+		usage.uptime = uptime
+	}
+	version, err := tmpOnline.Version()
+	common.LogIfError(err, "")
+
 	for _, db := range databases {
 		// 获取所有的表
 		tmpOnline.Database = db
@@ -1102,7 +1242,6 @@ func DuplicateKeyChecker(conn *database.Connector, databases ...string) map[stri
 
 		for _, tb := range tables {
 			// 获取表中所有的索引
-			idxMap := make(map[string][]*common.Column)
 			idxInfo, err := tmpOnline.ShowIndex(tb)
 			if err != nil {
 				funcErrCheck(err)
@@ -1111,52 +1250,43 @@ func DuplicateKeyChecker(conn *database.Connector, databases ...string) map[stri
 				}
 			}
 
-			// 枚举所有的索引信息，提取用到的列
-			for _, idx := range idxInfo.Rows {
-				if _, ok := idxMap[idx.KeyName]; !ok {
-					idxMap[idx.KeyName] = make([]*common.Column, 0)
-					for _, col := range idxInfo.FindIndex(database.IndexKeyName, idx.KeyName) {
-						idxMap[idx.KeyName] = append(idxMap[idx.KeyName], &common.Column{
-							Name:  col.ColumnName,
-							Table: tb,
-							DB:    db,
-						})
-					}
-				}
+			// 以下信息获取失败时只影响对应的检查项
+			tbUsage := usage
+			if usage.enabled {
+				tbUsage.unused, err = tmpOnline.ShowUnusedIndexes(tb)
+				common.LogIfError(err, "")
+			}
+			fks, err := tmpOnline.ShowForeignKeys(tb)
+			common.LogIfError(err, "")
+			var rows uint64
+			if status, err := tmpOnline.ShowTableStatus(tb); err == nil && len(status.Rows) > 0 {
+				rows, _ = strconv.ParseUint(string(status.Rows[0].Rows), 10, 64)
 			}
 
-			// 对索引进行重复检查
-			hasDup := false
-			content := ""
+			health := checkIndexHealth(db, tb, idxInfo, tbUsage, fks, rows)
+			if len(health.content) == 0 {
+				continue
+			}
 
-			for k1, cl1 := range idxMap {
-				for k2, cl2 := range idxMap {
-					if k1 != k2 && common.IsColsPart(cl1, cl2) {
-						// by pass primary key
-						if k1 == "PRIMARY" || k2 == "PRIMARY" {
-							continue
-						}
-						hasDup = true
-						col1Str := common.JoinColumnsName(cl1, ", ")
-						col2Str := common.JoinColumnsName(cl2, ", ")
-						content += fmt.Sprintf("索引%s(%s)与%s(%s)重复;", k1, col1Str, k2, col2Str)
-						common.Log.Debug(" %s.%s has duplicate index %s(%s) <--> %s(%s)", db, tb, k1, col1Str, k2, col2Str)
-					}
-				}
-				delete(idxMap, k1)
+			ddl, _ := tmpOnline.ShowCreateTable(tb)
+			key := fmt.Sprintf("IDX.%03d", number)
+			ruleMap[key] = Rule{
+				Item:     key,
+				Severity: health.severity,
+				Summary:  fmt.Sprintf("%s.%s存在需要优化的索引", db, tb),
+				Content:  strings.Join(health.content, ""),
+				Case:     ddl,
 			}
+			number++
 
-			// TODO 重复索引检查添加对约束及索引的判断，提供重复索引的删除功能
-			if hasDup {
-				tmpOnline.Database = db
-				ddl, _ := tmpOnline.ShowCreateTable(tb)
-				key := fmt.Sprintf("IDX.%03d", number)
+			if common.Config.AllowDropIndex && len(health.drops) > 0 {
+				key = fmt.Sprintf("IDX.%03d", number)
 				ruleMap[key] = Rule{
 					Item:     key,
-					Severity: "L2",
-					Summary:  fmt.Sprintf("%s.%s存在重复的索引", db, tb),
-					Content:  content,
-					Case:     ddl,
+					Severity: health.severity,
+					Summary:  fmt.Sprintf("%s.%s建议删除的索引", db, tb),
+					Content:  dropIndexContent(version),
+					Case:     strings.Join(dropIndexDDL(db, tb, health.drops, version), "\n"),
 				}
 				number++
 			}
@@ -430,10 +430,14 @@ func TestIndexAdviseNoEnv(t *testing.T) {
 
 func TestDuplicateKeyChecker(t *testing.T) {
 	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	// sakila 中的小表存在散粒度较低的外键索引
+	orgMinIndexCardinality := common.Config.MinIndexCardinality
+	common.Config.MinIndexCardinality = 0
 	rule := DuplicateKeyChecker(rEnv, "sakila")
 	if len(rule) != 0 {
 		t.Errorf("got rules: %s", pretty.Sprint(rule))
 	}
+	common.Config.MinIndexCardinality = orgMinIndexCardinality
 	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
 }
 
@@ -0,0 +1,230 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/laojianzi/soar/common"
+	"github.com/laojianzi/soar/database"
+)
+
+const (
+	// lowCardinalityMinRows 表行数少于该值时不检查索引散粒度，小表的统计信息误差较大
+	lowCardinalityMinRows = 1000
+	// unusedIndexMinUptime MySQL 启动时间少于该值(秒)时，索引使用情况的统计不可信，不检查未使用的索引
+	unusedIndexMinUptime = 7 * 24 * 3600
+)
+
+// indexUsage performance_schema 中的索引使用情况
+type indexUsage struct {
+	enabled bool     // performance_schema 是否开启
+	uptime  int      // MySQL 启动以来的秒数，索引使用情况的统计在重启后清零
+	unused  []string // 启动以来未被使用过的索引
+}
+
+// indexHealth 单表索引检查的结果
+type indexHealth struct {
+	content  []string // 检查结果
+	drops    []string // 可以删除的索引
+	severity string
+}
+
+// isKeyPartsDup 判断两个索引是否重复，较短的索引为较长索引的最左前缀时认为重复
+// 列或函数表达式、排序方向需要相同，前缀索引可以被同一列的完整索引或更长的前缀索引替代
+// 被替代的一方需要是同一个索引，不能一部分列由 a 替代 b，另一部分列由 b 替代 a
+func isKeyPartsDup(a, b []database.IndexKeyPart) bool {
+	return isKeyPartsPrefix(a, b) || isKeyPartsPrefix(b, a)
+}
+
+// isKeyPartsPrefix 判断 parts 是否为 key 的最左前缀，即 key 可以替代 parts
+func isKeyPartsPrefix(parts, key []database.IndexKeyPart) bool {
+	if len(parts) == 0 || len(parts) > len(key) {
+		return false
+	}
+	for i := range parts {
+		if !key[i].Covers(parts[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// keyCoversColumns 索引能否用于外键，外键的列需要按顺序出现在索引的最左侧，且不能是前缀索引
+func keyCoversColumns(parts []database.IndexKeyPart, cols []string) bool {
+	if len(cols) == 0 || len(parts) < len(cols) {
+		return false
+	}
+	for i, col := range cols {
+		if parts[i].Expression != "" || parts[i].SubPart > 0 || !strings.EqualFold(parts[i].Column, col) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkIndexHealth 检查单表中的重复索引、主键最左前缀冗余的索引、未使用的索引及散粒度过低的索引
+// 主键、唯一索引属于约束条件不会被删除，外键依赖的索引在没有其他可用索引时需要保留
+func checkIndexHealth(db, tb string, idxInfo *database.TableIndexInfo, usage indexUsage, fks []database.ForeignKey, rows uint64) indexHealth {
+	health := indexHealth{severity: "L0"}
+	keyNames := idxInfo.KeyNames()
+	keyParts := make(map[string][]database.IndexKeyPart)
+	unique := make(map[string]bool)
+	cardinality := make(map[string]int)
+	for _, keyName := range keyNames {
+		keyParts[keyName] = idxInfo.KeyParts(keyName)
+	}
+	for _, row := range idxInfo.Rows {
+		unique[row.KeyName] = row.NonUnique == 0
+		// 复合索引取最后一列的 Cardinality，即整个索引的唯一值数量
+		if row.Cardinality > cardinality[row.KeyName] {
+			cardinality[row.KeyName] = row.Cardinality
+		}
+	}
+
+	report := func(severity, format string, args ...interface{}) {
+		health.content = append(health.content, fmt.Sprintf(format, args...))
+		if severity > health.severity {
+			health.severity = severity
+		}
+	}
+
+	// fkRequired 删除索引后外键没有其他可用的索引时返回外键名称
+	dropped := make(map[string]bool)
+	fkRequired := func(keyName string) string {
+		for _, fk := range fks {
+			cols := fk.IndexColumns(db, tb)
+			if !keyCoversColumns(keyParts[keyName], cols) {
+				continue
+			}
+			required := true
+			for _, other := range keyNames {
+				if other != keyName && !dropped[other] && keyCoversColumns(keyParts[other], cols) {
+					required = false
+					break
+				}
+			}
+			if required {
+				return fk.Name
+			}
+		}
+		return ""
+	}
+	drop := func(keyName string) {
+		if dropped[keyName] || unique[keyName] {
+			return
+		}
+		if fk := fkRequired(keyName); fk != "" {
+			report("L0", "索引%s被外键%s依赖，需要保留;", idxInfo.KeyDefinition(keyName), fk)
+			return
+		}
+		dropped[keyName] = true
+		health.drops = append(health.drops, keyName)
+	}
+
+	// 重复索引，保留可以替代另一个的索引，两个索引相同时保留唯一索引或先创建的索引
+	for i, k1 := range keyNames {
+		for _, k2 := range keyNames[i+1:] {
+			// 主键单独检查
+			if k1 == "PRIMARY" || k2 == "PRIMARY" {
+				continue
+			}
+			if !isKeyPartsDup(keyParts[k1], keyParts[k2]) {
+				continue
+			}
+			def1, def2 := idxInfo.KeyDefinition(k1), idxInfo.KeyDefinition(k2)
+			report("L2", "索引%s与%s重复;", def1, def2)
+			common.Log.Debug(" %s.%s has duplicate index %s <--> %s", db, tb, def1, def2)
+
+			redundant := k2
+			if isKeyPartsPrefix(keyParts[k1], keyParts[k2]) &&
+				(!isKeyPartsPrefix(keyParts[k2], keyParts[k1]) || (unique[k2] && !unique[k1])) {
+				redundant = k1
+			}
+			// 较短的索引为唯一索引时属于约束条件，两个索引都需要保留
+			drop(redundant)
+		}
+	}
+
+	// 二级索引中隐含了主键，主键的最左前缀作为二级索引是冗余的
+	if primary := keyParts["PRIMARY"]; len(primary) > 0 {
+		for _, keyName := range keyNames {
+			if keyName == "PRIMARY" || unique[keyName] || !isKeyPartsPrefix(keyParts[keyName], primary) {
+				continue
+			}
+			report("L2", "索引%s为主键%s的最左前缀，属于冗余索引;", idxInfo.KeyDefinition(keyName), idxInfo.KeyDefinition("PRIMARY"))
+			drop(keyName)
+		}
+	}
+
+	// 未使用的索引，MySQL 启动时间过短时统计结果不可信
+	switch {
+	case !usage.enabled:
+		common.Log.Debug("performance_schema is disabled, skip unused index check for %s.%s", db, tb)
+	case usage.uptime < unusedIndexMinUptime:
+		common.Log.Debug("uptime %d is too short, skip unused index check for %s.%s", usage.uptime, db, tb)
+	default:
+		for _, keyName := range usage.unused {
+			if _, ok := keyParts[keyName]; !ok || keyName == "PRIMARY" || unique[keyName] || dropped[keyName] {
+				continue
+			}
+			report("L1", "索引%s在 MySQL 启动以来的%d天内未被使用;", idxInfo.KeyDefinition(keyName), usage.uptime/86400)
+			drop(keyName)
+		}
+	}
+
+	// 散粒度过低的索引，只给出提示
+	if rows >= lowCardinalityMinRows {
+		for _, keyName := range keyNames {
+			if keyName == "PRIMARY" || unique[keyName] || dropped[keyName] {
+				continue
+			}
+			selectivity := float64(cardinality[keyName]) / float64(rows) * 100
+			if selectivity < common.Config.MinIndexCardinality {
+				report("L1", "索引%s的散粒度为%.2f%%，低于%.2f%%，使用该索引的查询效率较低;",
+					idxInfo.KeyDefinition(keyName), selectivity, common.Config.MinIndexCardinality)
+			}
+		}
+	}
+
+	return health
+}
+
+// dropIndexContent 删除索引的注意事项
+func dropIndexContent(version int) string {
+	content := "删除索引前请确认没有查询通过 FORCE INDEX, USE INDEX 等方式指定该索引，performance_schema 只统计 MySQL 启动以来的索引使用情况，低频的报表、定时任务中使用的索引可能被误判为未使用。"
+	if version >= 80000 {
+		content += "建议先将索引设置为不可见（INVISIBLE），观察一段时间确认没有影响后再删除，如有问题可以通过 ALTER INDEX ... VISIBLE 立即恢复。"
+	}
+	return content
+}
+
+// dropIndexDDL 生成删除索引的 DDL，MySQL 8.0 及以上版本先将索引设置为不可见
+func dropIndexDDL(db, tb string, keyNames []string, version int) []string {
+	var ddl []string
+	var invisible, drop []string
+	for _, keyName := range keyNames {
+		invisible = append(invisible, fmt.Sprintf("ALTER INDEX `%s` INVISIBLE", keyName))
+		drop = append(drop, fmt.Sprintf("DROP INDEX `%s`", keyName))
+	}
+	if version >= 80000 {
+		ddl = append(ddl, fmt.Sprintf("ALTER TABLE `%s`.`%s` %s;", db, tb, strings.Join(invisible, ", ")))
+	}
+	ddl = append(ddl, fmt.Sprintf("ALTER TABLE `%s`.`%s` %s;", db, tb, strings.Join(drop, ", ")))
+	return ddl
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/laojianzi/soar/common"
+	"github.com/laojianzi/soar/database"
+)
+
+func TestIsKeyPartsDup(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	name := database.IndexKeyPart{Column: "name"}
+	namePrefix := database.IndexKeyPart{Column: "name", SubPart: 10}
+	nameDesc := database.IndexKeyPart{Column: "name", Desc: true}
+	email := database.IndexKeyPart{Column: "email"}
+	emailPrefix := database.IndexKeyPart{Column: "email", SubPart: 5}
+	lowerEmail := database.IndexKeyPart{Expression: "lower(`email`)"}
+
+	cases := []struct {
+		a, b []database.IndexKeyPart
+		dup  bool
+	}{
+		{[]database.IndexKeyPart{name}, []database.IndexKeyPart{name, email}, true},
+		{[]database.IndexKeyPart{namePrefix}, []database.IndexKeyPart{name, email}, true},
+		{[]database.IndexKeyPart{nameDesc}, []database.IndexKeyPart{name, email}, false},
+		{[]database.IndexKeyPart{email}, []database.IndexKeyPart{lowerEmail}, false},
+		{[]database.IndexKeyPart{lowerEmail}, []database.IndexKeyPart{lowerEmail, name}, true},
+		{[]database.IndexKeyPart{email, name}, []database.IndexKeyPart{email, nameDesc}, false},
+		{[]database.IndexKeyPart{namePrefix, email}, []database.IndexKeyPart{name, email}, true},
+		// 两个索引互有前缀列，任何一个都不能替代另一个
+		{[]database.IndexKeyPart{namePrefix, email}, []database.IndexKeyPart{name, emailPrefix}, false},
+		{[]database.IndexKeyPart{name, email}, []database.IndexKeyPart{namePrefix}, true},
+	}
+	for _, c := range cases {
+		if isKeyPartsDup(c.a, c.b) != c.dup {
+			t.Errorf("%v, %v want: %v", c.a, c.b, c.dup)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestCheckIndexHealth(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	orgMinIndexCardinality := common.Config.MinIndexCardinality
+	common.Config.MinIndexCardinality = 1
+
+	// PRIMARY KEY (id, tenant_id), KEY idx_id (id), KEY idx_name (name), KEY idx_name_email (name, email),
+	// KEY idx_status (status), KEY idx_user (user_id), KEY idx_user_ctime (user_id, ctime), UNIQUE KEY uk_email (email)
+	idxInfo := &database.TableIndexInfo{
+		TableName: "orders",
+		Rows: []database.TableIndexRow{
+			{KeyName: "PRIMARY", SeqInIndex: 1, ColumnName: "id", Cardinality: 100000},
+			{KeyName: "PRIMARY", SeqInIndex: 2, ColumnName: "tenant_id", Cardinality: 100000},
+			{KeyName: "idx_id", NonUnique: 1, SeqInIndex: 1, ColumnName: "id", Cardinality: 100000},
+			{KeyName: "idx_name", NonUnique: 1, SeqInIndex: 1, ColumnName: "name", Cardinality: 50000},
+			{KeyName: "idx_name_email", NonUnique: 1, SeqInIndex: 1, ColumnName: "name", Cardinality: 50000},
+			{KeyName: "idx_name_email", NonUnique: 1, SeqInIndex: 2, ColumnName: "email", Cardinality: 100000},
+			{KeyName: "idx_status", NonUnique: 1, SeqInIndex: 1, ColumnName: "status", Cardinality: 3},
+			{KeyName: "idx_user", NonUnique: 1, SeqInIndex: 1, ColumnName: "user_id", Cardinality: 20000},
+			{KeyName: "idx_user_ctime", NonUnique: 1, SeqInIndex: 1, ColumnName: "user_id", Cardinality: 20000},
+			{KeyName: "idx_user_ctime", NonUnique: 1, SeqInIndex: 2, ColumnName: "ctime", Cardinality: 90000},
+			{KeyName: "uk_email", NonUnique: 0, SeqInIndex: 1, ColumnName: "email", Cardinality: 100000},
+		},
+	}
+	fks := []database.ForeignKey{
+		{Name: "fk_user", Schema: "db", Table: "orders", Columns: []string{"user_id"}, ReferencedSchema: "db", ReferencedTable: "users", ReferencedColumns: []string{"id"}},
+	}
+	usage := indexUsage{enabled: true, uptime: 30 * 86400, unused: []string{"idx_user_ctime", "uk_email"}}
+
+	health := checkIndexHealth("db", "orders", idxInfo, usage, fks, 100000)
+	// idx_name 与 idx_name_email 重复，idx_id 为主键的最左前缀，idx_user 与 idx_user_ctime 重复后 idx_user_ctime 被外键依赖
+	if fmt.Sprint(health.drops) != "[idx_name idx_user idx_id]" {
+		t.Error("drops got:", health.drops)
+	}
+	if health.severity != "L2" {
+		t.Error("severity got:", health.severity)
+	}
+
+	err := common.GoldenDiff(func() {
+		for _, c := range health.content {
+			fmt.Println(c)
+		}
+		for _, ddl := range dropIndexDDL("db", "orders", health.drops, 80023) {
+			fmt.Println(ddl)
+		}
+		for _, ddl := range dropIndexDDL("db", "orders", health.drops, 50730) {
+			fmt.Println(ddl)
+		}
+	}, t.Name(), update)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// KEY idx_name_email (name(10), email), KEY idx_name_email_full (name, email)，删除被替代的前缀索引
+	idxInfo = &database.TableIndexInfo{
+		TableName: "users",
+		Rows: []database.TableIndexRow{
+			{KeyName: "idx_name_email", NonUnique: 1, SeqInIndex: 1, ColumnName: "name", SubPart: 10, Cardinality: 50000},
+			{KeyName: "idx_name_email", NonUnique: 1, SeqInIndex: 2, ColumnName: "email", Cardinality: 100000},
+			{KeyName: "idx_name_email_full", NonUnique: 1, SeqInIndex: 1, ColumnName: "name", Cardinality: 50000},
+			{KeyName: "idx_name_email_full", NonUnique: 1, SeqInIndex: 2, ColumnName: "email", Cardinality: 100000},
+		},
+	}
+	health = checkIndexHealth("db", "users", idxInfo, indexUsage{}, nil, 100000)
+	if fmt.Sprint(health.drops) != "[idx_name_email]" {
+		t.Error("drops got:", health.drops)
+	}
+
+	common.Config.MinIndexCardinality = orgMinIndexCardinality
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
@@ -0,0 +1,423 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/laojianzi/soar/ast"
+	"github.com/laojianzi/soar/common"
+
+	tidb "github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/opcode"
+	"github.com/pingcap/tidb/types"
+	driver "github.com/pingcap/tidb/types/parser_driver"
+)
+
+// https://dev.mysql.com/doc/refman/8.0/en/create-table-secondary-indexes.html#json-column-indirect-index
+// https://dev.mysql.com/doc/refman/8.0/en/create-index.html#create-index-multi-valued
+
+// jsonPathFilter WHERE 条件中对 JSON 列中某个路径的过滤
+type jsonPathFilter struct {
+	Qualifier string // 列前缀，表名或表别名
+	Column    string
+	Path      string
+	Unquote   bool // 使用了 ->> 或 JSON_UNQUOTE
+	Numeric   bool // 与数值比较
+	Contains  bool // JSON_CONTAINS, JSON_OVERLAPS 等需要多值索引的查找
+}
+
+// expr 过滤条件中使用的 JSON 表达式
+func (f jsonPathFilter) expr() string {
+	if f.Unquote {
+		return fmt.Sprintf("`%s`->>'%s'", f.Column, f.Path)
+	}
+	return fmt.Sprintf("`%s`->'%s'", f.Column, f.Path)
+}
+
+// jsonPathFinder 查找 WHERE 条件中的 JSON 路径过滤
+type jsonPathFinder struct {
+	filters []jsonPathFilter
+	numeric bool // 当前比较的另一侧为数值
+}
+
+// jsonExtractArgs 获取 JSON_EXTRACT(col, 'path') 中的列及路径，不是该形式时 ok 为 false
+func jsonExtractArgs(expr tidb.ExprNode) (col *tidb.ColumnName, path string, ok bool) {
+	fn, isFunc := expr.(*tidb.FuncCallExpr)
+	if !isFunc || fn.FnName.L != tidb.JSONExtract || len(fn.Args) != 2 {
+		return nil, "", false
+	}
+	column, isCol := fn.Args[0].(*tidb.ColumnNameExpr)
+	value, isValue := fn.Args[1].(*driver.ValueExpr)
+	if !isCol || !isValue {
+		return nil, "", false
+	}
+	return column.Name, value.GetString(), true
+}
+
+// isNumericValue 是否为数值常量
+func isNumericValue(expr tidb.ExprNode) bool {
+	if value, ok := expr.(*driver.ValueExpr); ok {
+		switch value.Datum.Kind() {
+		case types.KindInt64, types.KindUint64, types.KindFloat32, types.KindFloat64, types.KindMysqlDecimal:
+			return true
+		}
+	}
+	return false
+}
+
+// Enter implements ast.Visitor interface
+func (v *jsonPathFinder) Enter(in tidb.Node) (tidb.Node, bool) {
+	switch node := in.(type) {
+	case *tidb.SubqueryExpr:
+		// 子查询的 WHERE 条件单独查找
+		return in, true
+	case *tidb.BinaryOperationExpr:
+		switch node.Op {
+		case opcode.EQ, opcode.NE, opcode.LT, opcode.LE, opcode.GT, opcode.GE, opcode.NullEQ:
+			v.numeric = isNumericValue(node.L) || isNumericValue(node.R)
+		}
+	case *tidb.PatternInExpr:
+		v.numeric = len(node.List) > 0 && isNumericValue(node.List[0])
+	case *tidb.BetweenExpr:
+		v.numeric = isNumericValue(node.Left) || isNumericValue(node.Right)
+	case *tidb.FuncCallExpr:
+		switch node.FnName.L {
+		case tidb.JSONUnquote:
+			if len(node.Args) == 1 {
+				if col, path, ok := jsonExtractArgs(node.Args[0]); ok {
+					v.add(jsonPathFilter{Qualifier: col.Table.O, Column: col.Name.O, Path: path, Unquote: true})
+					return in, true
+				}
+			}
+		case tidb.JSONExtract:
+			if col, path, ok := jsonExtractArgs(node); ok {
+				v.add(jsonPathFilter{Qualifier: col.Table.O, Column: col.Name.O, Path: path, Numeric: v.numeric})
+				return in, true
+			}
+		case tidb.JSONContains, "json_overlaps":
+			if len(node.Args) < 2 {
+				break
+			}
+			// JSON_CONTAINS(target, candidate[, path])
+			filter := jsonPathFilter{Path: "$", Contains: true, Numeric: isNumericJSON(node.Args[1])}
+			if col, path, ok := jsonExtractArgs(node.Args[0]); ok {
+				filter.Qualifier, filter.Column, filter.Path = col.Table.O, col.Name.O, path
+			} else if col, ok := node.Args[0].(*tidb.ColumnNameExpr); ok {
+				filter.Qualifier, filter.Column = col.Name.Table.O, col.Name.Name.O
+				if len(node.Args) == 3 {
+					if value, ok := node.Args[2].(*driver.ValueExpr); ok {
+						filter.Path = value.GetString()
+					}
+				}
+			} else {
+				break
+			}
+			v.add(filter)
+			return in, true
+		}
+	}
+	return in, false
+}
+
+// Leave implements ast.Visitor interface
+func (v *jsonPathFinder) Leave(in tidb.Node) (tidb.Node, bool) {
+	switch in.(type) {
+	case *tidb.BinaryOperationExpr, *tidb.PatternInExpr, *tidb.BetweenExpr:
+		v.numeric = false
+	}
+	return in, true
+}
+
+// add 添加过滤条件，相同的条件只保留一个
+func (v *jsonPathFinder) add(filter jsonPathFilter) {
+	for _, f := range v.filters {
+		if f == filter {
+			return
+		}
+	}
+	v.filters = append(v.filters, filter)
+}
+
+var jsonNumberArrayRe = regexp.MustCompile(`^\s*\[?\s*-?\d+(\s*,\s*-?\d+)*\s*\]?\s*$`)
+
+// isNumericJSON JSON_CONTAINS 中的候选值是否为数值或数值数组
+func isNumericJSON(expr tidb.ExprNode) bool {
+	if value, ok := expr.(*driver.ValueExpr); ok {
+		return isNumericValue(expr) || jsonNumberArrayRe.MatchString(value.GetString())
+	}
+	return false
+}
+
+// whereFinder 查找语句中所有的 WHERE 及 JOIN ON 条件
+type whereFinder struct {
+	conditions []tidb.ExprNode
+}
+
+// Enter implements ast.Visitor interface
+func (v *whereFinder) Enter(in tidb.Node) (tidb.Node, bool) {
+	var cond tidb.ExprNode
+	switch node := in.(type) {
+	case *tidb.SelectStmt:
+		cond = node.Where
+	case *tidb.UpdateStmt:
+		cond = node.Where
+	case *tidb.DeleteStmt:
+		cond = node.Where
+	case *tidb.OnCondition:
+		cond = node.Expr
+	}
+	if cond != nil {
+		v.conditions = append(v.conditions, cond)
+	}
+	return in, false
+}
+
+// Leave implements ast.Visitor interface
+func (v *whereFinder) Leave(in tidb.Node) (tidb.Node, bool) {
+	return in, true
+}
+
+// findJSONPathFilters 获取语句 WHERE 及 JOIN ON 条件中对 JSON 路径的过滤
+func findJSONPathFilters(node tidb.Node) []jsonPathFilter {
+	wf := &whereFinder{}
+	node.Accept(wf)
+
+	v := &jsonPathFinder{}
+	for _, cond := range wf.conditions {
+		cond.Accept(v)
+	}
+	return v.filters
+}
+
+var (
+	// 字符串前的字符集声明，如：_utf8mb4'$.name'
+	charsetIntroducerRe = regexp.MustCompile(`_[a-z0-9]+'`)
+	ddlColumnRe         = regexp.MustCompile("^`([^`]+)`\\s*([a-z]+)")
+)
+
+// normalizeDDLLine SHOW CREATE TABLE 中的单行去掉空格及字符集声明，转为小写用于比较
+func normalizeDDLLine(line string) string {
+	line = strings.ToLower(strings.TrimSpace(line))
+	line = charsetIntroducerRe.ReplaceAllString(line, "'")
+	return strings.Replace(line, " ", "", -1)
+}
+
+// isKeyLine SHOW CREATE TABLE 中的一行是否为索引定义
+func isKeyLine(line string) bool {
+	line = strings.ToLower(strings.TrimSpace(line))
+	for _, prefix := range []string{"primary key", "unique key", "key ", "index ", "unique index"} {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ddlColumnType 从 SHOW CREATE TABLE 中获取列的类型，不存在时返回空
+func ddlColumnType(ddl, column string) string {
+	for _, line := range strings.Split(ddl, "\n") {
+		m := ddlColumnRe.FindStringSubmatch(strings.TrimSpace(line))
+		if len(m) == 3 && strings.EqualFold(m[1], column) {
+			return strings.ToLower(m[2])
+		}
+	}
+	return ""
+}
+
+// jsonPathIndexed 根据 SHOW CREATE TABLE 判断 JSON 路径上是否已有可用的索引
+// 普通过滤需要函数索引或带索引的虚拟列，JSON_CONTAINS 等需要多值索引
+func jsonPathIndexed(ddl string, f jsonPathFilter) bool {
+	target := normalizeDDLLine(fmt.Sprintf("json_extract(`%s`,'%s')", f.Column, f.Path))
+
+	var keys, generated []string
+	for _, line := range strings.Split(ddl, "\n") {
+		normalized := normalizeDDLLine(line)
+		switch {
+		case isKeyLine(line):
+			keys = append(keys, normalized)
+		case strings.Contains(normalized, "generatedalwaysas") && strings.Contains(normalized, target):
+			if m := ddlColumnRe.FindStringSubmatch(strings.TrimSpace(line)); len(m) == 3 {
+				generated = append(generated, "`"+strings.ToLower(m[1])+"`")
+			}
+		}
+	}
+
+	for _, key := range keys {
+		// 多值索引为 CAST(... AS ... ARRAY)
+		if f.Contains {
+			if strings.Contains(key, "array)") && (strings.Contains(key, target) ||
+				(f.Path == "$" && strings.Contains(key, "cast(`"+strings.ToLower(f.Column)+"`as"))) {
+				return true
+			}
+			continue
+		}
+		if strings.Contains(key, target) {
+			return true
+		}
+		for _, col := range generated {
+			if strings.Contains(key, col) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var jsonPathNameRe = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// buildJSONIndex 为 JSON 路径生成索引建议，8.0.13 及以上版本对 ->> 字符串比较使用函数索引，其他情况使用虚拟列加索引
+// 多值索引需要 8.0.17 及以上版本，version 较低时不给出建议
+func buildJSONIndex(db, tb string, f jsonPathFilter, version int) (IndexInfo, bool) {
+	name := strings.Trim(jsonPathNameRe.ReplaceAllString(strings.TrimPrefix(f.Path, "$"), "_"), "_")
+	colName := f.Column
+	if name != "" {
+		colName += "_" + name
+	}
+	idxName := common.Config.IdxPrefix + colName
+	if len(idxName) > IndexNameMaxLength {
+		idxName = strings.TrimRight(idxName[:IndexNameMaxLength], "_")
+	}
+
+	table := fmt.Sprintf("`%s`", tb)
+	if db != "" {
+		table = fmt.Sprintf("`%s`.`%s`", db, tb)
+	}
+	info := IndexInfo{
+		Name:     idxName,
+		Database: db,
+		Table:    tb,
+	}
+
+	switch {
+	case f.Contains:
+		if version < 80017 {
+			return info, false
+		}
+		castType := "CHAR(64)"
+		if f.Numeric {
+			castType = "UNSIGNED"
+		}
+		path := fmt.Sprintf("`%s`->'%s'", f.Column, f.Path)
+		if f.Path == "$" {
+			path = fmt.Sprintf("`%s`", f.Column)
+		}
+		info.DDL = fmt.Sprintf("ALTER TABLE %s ADD INDEX `%s` ((CAST(%s AS %s ARRAY)))", table, idxName, path, castType)
+		info.ColumnDetails = []*common.Column{{Name: path, Table: tb, DB: db}}
+	case f.Unquote && !f.Numeric && version >= 80013:
+		// JSON_UNQUOTE 返回 utf8mb4_bin，CAST 需要指定相同的 COLLATE 才能用上索引
+		info.DDL = fmt.Sprintf("ALTER TABLE %s ADD INDEX `%s` ((CAST(%s AS CHAR(64)) COLLATE utf8mb4_bin))", table, idxName, f.expr())
+		info.ColumnDetails = []*common.Column{{Name: f.expr(), Table: tb, DB: db}}
+	default:
+		colType := "VARCHAR(64)"
+		if f.Numeric {
+			colType = "BIGINT"
+		}
+		info.DDL = fmt.Sprintf("ALTER TABLE %s ADD COLUMN `%s` %s GENERATED ALWAYS AS (%s) VIRTUAL, ADD INDEX `%s` (`%s`)",
+			table, colName, colType, f.expr(), idxName, colName)
+		info.ColumnDetails = []*common.Column{{Name: colName, Table: tb, DB: db, DataType: strings.ToLower(colType)}}
+	}
+	return info, true
+}
+
+// jsonTableFilter 确定了所在表的 JSON 路径过滤
+type jsonTableFilter struct {
+	jsonPathFilter
+	DB      string
+	Table   string
+	Indexed bool
+}
+
+// jsonTableFilters 获取 SQL 中对 JSON 列的路径过滤，并根据表结构判断是否已有可用的索引
+func (idxAdv *IndexAdvisor) jsonTableFilters(stmts []tidb.StmtNode) []jsonTableFilter {
+	var filters []jsonTableFilter
+	for _, stmt := range stmts {
+		pathFilters := findJSONPathFilters(stmt)
+		if len(pathFilters) == 0 {
+			continue
+		}
+
+		meta := ast.GetTiMeta(stmt, nil)
+		ddls := make(map[string]string)
+		for _, f := range pathFilters {
+			for db := range meta {
+				for _, tb := range meta[db].Table {
+					if tb.TableName == "" {
+						continue
+					}
+					if f.Qualifier != "" && !tableMatches(tb, f.Qualifier) {
+						continue
+					}
+
+					key := db + "." + tb.TableName
+					if _, ok := ddls[key]; !ok {
+						ddls[key] = idxAdv.tableDDL(db, tb.TableName)
+					}
+					if ddlColumnType(ddls[key], f.Column) != "json" {
+						continue
+					}
+					filters = append(filters, jsonTableFilter{
+						jsonPathFilter: f,
+						DB:             db,
+						Table:          tb.TableName,
+						Indexed:        jsonPathIndexed(ddls[key], f),
+					})
+				}
+			}
+		}
+	}
+	return filters
+}
+
+// tableMatches 列前缀是否为该表的表名或别名
+func tableMatches(tb *common.Table, qualifier string) bool {
+	if strings.EqualFold(tb.TableName, qualifier) {
+		return true
+	}
+	for _, alias := range tb.TableAliases {
+		if strings.EqualFold(alias, qualifier) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonIndexAdvise 为没有可用索引的 JSON 路径过滤生成索引建议
+func (idxAdv *IndexAdvisor) jsonIndexAdvise() IndexAdvises {
+	version := common.Config.OnlineDSN.Version
+	if version == 0 {
+		version = common.Config.TestDSN.Version
+	}
+
+	var indexes IndexAdvises
+	for _, f := range idxAdv.jsonTableFilters(idxAdv.tiStmt) {
+		// pingcap/parser 不支持多值索引的语法，无法参与 ALTER 语句合并，多值索引建议在 JSN.002 中给出
+		if f.Indexed || f.Contains {
+			continue
+		}
+		db := f.DB
+		if db == "" {
+			db = idxAdv.rEnv.Database
+		}
+		if idx, ok := buildJSONIndex(db, f.Table, f.jsonPathFilter, version); ok {
+			indexes = mergeAdvices(indexes, idx)
+		}
+	}
+	return indexes
+}
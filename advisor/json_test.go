@@ -0,0 +1,153 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"testing"
+
+	"github.com/laojianzi/soar/ast"
+	"github.com/laojianzi/soar/common"
+)
+
+func TestFindJSONPathFilters(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	cases := map[string][]jsonPathFilter{
+		"SELECT * FROM tbl WHERE data->>'$.name' = 'abc'": {
+			{Column: "data", Path: "$.name", Unquote: true},
+		},
+		"SELECT * FROM tbl t WHERE t.data->'$.age' > 18": {
+			{Qualifier: "t", Column: "data", Path: "$.age", Numeric: true},
+		},
+		"SELECT * FROM tbl WHERE JSON_EXTRACT(data, '$.age') IN (1, 2)": {
+			{Column: "data", Path: "$.age", Numeric: true},
+		},
+		"SELECT * FROM tbl WHERE JSON_CONTAINS(data, '1', '$.tags')": {
+			{Column: "data", Path: "$.tags", Numeric: true, Contains: true},
+		},
+		"SELECT * FROM tbl WHERE JSON_OVERLAPS(tags, '[\"a\", \"b\"]')": {
+			{Column: "tags", Path: "$", Contains: true},
+		},
+		"UPDATE tbl SET name = 'abc' WHERE data->>'$.name' = 'abc' AND data->>'$.name' = 'def'": {
+			{Column: "data", Path: "$.name", Unquote: true},
+		},
+		"SELECT data->>'$.name' FROM tbl WHERE id = 1": nil,
+	}
+	for sql, want := range cases {
+		stmts, err := ast.TiParse(sql, "", "")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		got := findJSONPathFilters(stmts[0])
+		if len(got) != len(want) {
+			t.Errorf("SQL: %s, want: %v, got: %v", sql, want, got)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("SQL: %s, want: %v, got: %v", sql, want[i], got[i])
+			}
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestJSONPathIndexed(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	ddl := "CREATE TABLE `tbl` (\n" +
+		"  `id` int(11) NOT NULL,\n" +
+		"  `data` json DEFAULT NULL,\n" +
+		"  `data_age` bigint(20) GENERATED ALWAYS AS (json_extract(`data`,_utf8mb4'$.age')) VIRTUAL,\n" +
+		"  PRIMARY KEY (`id`),\n" +
+		"  KEY `idx_data_age` (`data_age`),\n" +
+		"  KEY `idx_data_name` ((cast(json_unquote(json_extract(`data`,_utf8mb4'$.name')) as char(64) charset utf8mb4) collate utf8mb4_bin)),\n" +
+		"  KEY `idx_data_tags` ((cast(json_extract(`data`,_utf8mb4'$.tags') as unsigned array)))\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+	if ddlColumnType(ddl, "data") != "json" {
+		t.Error("ddlColumnType want: json, got:", ddlColumnType(ddl, "data"))
+	}
+
+	cases := map[jsonPathFilter]bool{
+		{Column: "data", Path: "$.age", Numeric: true}:                  true,
+		{Column: "data", Path: "$.name", Unquote: true}:                 true,
+		{Column: "data", Path: "$.tags", Numeric: true, Contains: true}: true,
+		{Column: "data", Path: "$.email", Unquote: true}:                false,
+		{Column: "data", Path: "$.age", Contains: true}:                 false,
+	}
+	for f, want := range cases {
+		if got := jsonPathIndexed(ddl, f); got != want {
+			t.Errorf("filter: %v, want: %v, got: %v", f, want, got)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestBuildJSONIndex(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	cases := []struct {
+		filter  jsonPathFilter
+		version int
+		ok      bool
+		ddl     string
+	}{
+		{
+			jsonPathFilter{Column: "data", Path: "$.name", Unquote: true},
+			80013, true,
+			"ALTER TABLE `db`.`tbl` ADD INDEX `idx_data_name` ((CAST(`data`->>'$.name' AS CHAR(64)) COLLATE utf8mb4_bin))",
+		},
+		{
+			jsonPathFilter{Column: "data", Path: "$.name", Unquote: true},
+			50720, true,
+			"ALTER TABLE `db`.`tbl` ADD COLUMN `data_name` VARCHAR(64) GENERATED ALWAYS AS (`data`->>'$.name') VIRTUAL, ADD INDEX `idx_data_name` (`data_name`)",
+		},
+		{
+			jsonPathFilter{Column: "data", Path: "$.age", Numeric: true},
+			80013, true,
+			"ALTER TABLE `db`.`tbl` ADD COLUMN `data_age` BIGINT GENERATED ALWAYS AS (`data`->'$.age') VIRTUAL, ADD INDEX `idx_data_age` (`data_age`)",
+		},
+		{
+			jsonPathFilter{Column: "data", Path: "$.tags", Numeric: true, Contains: true},
+			80017, true,
+			"ALTER TABLE `db`.`tbl` ADD INDEX `idx_data_tags` ((CAST(`data`->'$.tags' AS UNSIGNED ARRAY)))",
+		},
+		{
+			jsonPathFilter{Column: "data", Path: "$.tags", Contains: true},
+			80013, false, "",
+		},
+	}
+	for _, c := range cases {
+		info, ok := buildJSONIndex("db", "tbl", c.filter, c.version)
+		if ok != c.ok {
+			t.Errorf("filter: %v, version: %d, want: %v, got: %v", c.filter, c.version, c.ok, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if info.DDL != c.ddl {
+			t.Errorf("want: %s\ngot: %s", c.ddl, info.DDL)
+		}
+		// 函数索引及虚拟列的 DDL 需要能够被 TiDB 解析用于合并 ALTER 语句
+		if !c.filter.Contains {
+			if _, err := ast.TiParse(info.DDL, "", ""); err != nil {
+				t.Error(info.DDL, err)
+			}
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
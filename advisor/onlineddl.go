@@ -0,0 +1,541 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/laojianzi/soar/ast"
+	"github.com/laojianzi/soar/common"
+	"github.com/laojianzi/soar/database"
+
+	tidb "github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/parser/types"
+)
+
+// https://dev.mysql.com/doc/refman/8.0/en/innodb-online-ddl-operations.html
+// https://dev.mysql.com/doc/refman/5.7/en/innodb-online-ddl-operations.html
+
+// DDLAlgorithm ALTER TABLE 执行算法，按对线上的影响由小到大排列
+type DDLAlgorithm int
+
+// DDL 执行算法
+const (
+	DDLInstant DDLAlgorithm = iota // 只修改元数据
+	DDLInplace                     // 在存储引擎内部完成，可能需要重建表
+	DDLCopy                        // 创建临时表并复制数据，期间阻塞写入
+)
+
+// String 返回 ALGORITHM 子句中使用的名称
+func (a DDLAlgorithm) String() string {
+	return [...]string{"INSTANT", "INPLACE", "COPY"}[a]
+}
+
+// DDLLock ALTER TABLE 执行期间的锁级别，按对线上的影响由小到大排列
+type DDLLock int
+
+// DDL 锁级别
+const (
+	DDLLockNone      DDLLock = iota // 允许并发读写
+	DDLLockShared                   // 允许并发读，阻塞写
+	DDLLockExclusive                // 阻塞读写
+)
+
+// String 返回 LOCK 子句中使用的名称
+func (l DDLLock) String() string {
+	return [...]string{"NONE", "SHARED", "EXCLUSIVE"}[l]
+}
+
+// 重建表时的估算吞吐，单位为 bytes/s
+const ddlRebuildThroughput = 32 << 20
+
+// OnlineDDLImpact ALTER TABLE 对线上环境影响的预估
+type OnlineDDLImpact struct {
+	Algorithm DDLAlgorithm // 预估的执行算法
+	Lock      DDLLock      // 预估的最低锁级别
+	Rebuild   bool         // 是否需要重建表
+	Reasons   []string     // 各子操作的判断依据
+	Conflicts []string     // 与 ALTER 中指定的 ALGORITHM, LOCK 冲突的说明
+}
+
+// merge 合并子操作的影响，取影响最大的算法和锁
+func (impact *OnlineDDLImpact) merge(algorithm DDLAlgorithm, lock DDLLock, rebuild bool, reason string) {
+	if algorithm > impact.Algorithm {
+		impact.Algorithm = algorithm
+	}
+	if lock > impact.Lock {
+		impact.Lock = lock
+	}
+	impact.Rebuild = impact.Rebuild || rebuild
+	impact.Reasons = append(impact.Reasons, reason)
+}
+
+// AnalyzeAlterTable 根据线上 MySQL 版本及 ALTER 前的建表语句预估 ALTER TABLE 的执行算法及锁
+// version 格式同 common.Config.OnlineDSN.Version，table 为 nil 时按最坏情况估算
+func AnalyzeAlterTable(node *tidb.AlterTableStmt, version int, table *tidb.CreateTableStmt) OnlineDDLImpact {
+	impact := OnlineDDLImpact{Algorithm: DDLInstant, Lock: DDLLockNone}
+	specAlgorithm, specLock := tidb.AlgorithmTypeDefault, tidb.LockTypeDefault
+
+	// DROP PRIMARY KEY 与 ADD PRIMARY KEY 同时出现时可以 INPLACE
+	addPrimaryKey := false
+	for _, spec := range node.Specs {
+		if spec.Tp == tidb.AlterTableAddConstraint && spec.Constraint != nil && spec.Constraint.Tp == tidb.ConstraintPrimaryKey {
+			addPrimaryKey = true
+		}
+	}
+
+	for _, spec := range node.Specs {
+		switch spec.Tp {
+		case tidb.AlterTableAlgorithm:
+			specAlgorithm = spec.Algorithm
+		case tidb.AlterTableLock:
+			specLock = spec.LockType
+		case tidb.AlterTableAddColumns:
+			for _, col := range spec.NewColumns {
+				analyzeAddColumn(&impact, col, spec.Position, version, table)
+			}
+		case tidb.AlterTableDropColumn:
+			if version >= 80029 {
+				impact.merge(DDLInstant, DDLLockNone, false, "DROP COLUMN: 8.0.29 及以上版本支持 INSTANT")
+			} else {
+				impact.merge(DDLInplace, DDLLockNone, true, "DROP COLUMN: 需要重建表")
+			}
+		case tidb.AlterTableModifyColumn, tidb.AlterTableChangeColumn:
+			analyzeModifyColumn(&impact, spec, version, table)
+		case tidb.AlterTableAlterColumn:
+			impact.merge(DDLInstant, DDLLockNone, false, "SET/DROP DEFAULT: 只修改元数据")
+		case tidb.AlterTableRenameColumn:
+			if version >= 80028 {
+				impact.merge(DDLInstant, DDLLockNone, false, "RENAME COLUMN: 8.0.28 及以上版本支持 INSTANT")
+			} else {
+				impact.merge(DDLInplace, DDLLockNone, false, "RENAME COLUMN: 只修改元数据")
+			}
+		case tidb.AlterTableAddConstraint:
+			analyzeAddConstraint(&impact, spec.Constraint, table)
+		case tidb.AlterTableDropPrimaryKey:
+			if addPrimaryKey {
+				impact.merge(DDLInplace, DDLLockNone, true, "DROP PRIMARY KEY: 同时添加主键时需要重建表")
+			} else {
+				impact.merge(DDLCopy, DDLLockShared, true, "DROP PRIMARY KEY: 未同时添加主键时只能 COPY")
+			}
+		case tidb.AlterTableDropIndex, tidb.AlterTableDropForeignKey:
+			impact.merge(DDLInplace, DDLLockNone, false, "DROP INDEX/FOREIGN KEY: 只修改元数据")
+		case tidb.AlterTableRenameIndex, tidb.AlterTableRenameTable:
+			if version >= 80000 {
+				impact.merge(DDLInstant, DDLLockNone, false, "RENAME INDEX/TABLE: 只修改元数据")
+			} else {
+				impact.merge(DDLInplace, DDLLockNone, false, "RENAME INDEX/TABLE: 只修改元数据")
+			}
+		case tidb.AlterTableIndexInvisible:
+			impact.merge(DDLInstant, DDLLockNone, false, "ALTER INDEX VISIBLE/INVISIBLE: 只修改元数据")
+		case tidb.AlterTableOption:
+			for _, opt := range spec.Options {
+				analyzeTableOption(&impact, opt, table)
+			}
+		case tidb.AlterTableForce:
+			impact.merge(DDLInplace, DDLLockNone, true, "FORCE: 需要重建表")
+		case tidb.AlterTableAddPartitions, tidb.AlterTableDropPartition,
+			tidb.AlterTableTruncatePartition, tidb.AlterTableExchangePartition:
+			impact.merge(DDLInplace, DDLLockShared, false, "ADD/DROP/TRUNCATE/EXCHANGE PARTITION: 不需要重建表")
+		case tidb.AlterTablePartition, tidb.AlterTableRemovePartitioning, tidb.AlterTableCoalescePartitions,
+			tidb.AlterTableReorganizePartition, tidb.AlterTableRebuildPartition:
+			impact.merge(DDLCopy, DDLLockShared, true, "PARTITION BY/REMOVE PARTITIONING/REORGANIZE PARTITION: 需要复制数据")
+		case tidb.AlterTableOrderByColumns:
+			impact.merge(DDLCopy, DDLLockShared, true, "ORDER BY: 只能 COPY")
+		default:
+			impact.merge(DDLCopy, DDLLockShared, true, "未识别的 ALTER 操作，按 COPY 估算")
+		}
+	}
+
+	// 5.6 以下版本不支持 Online DDL
+	if version < 50600 && impact.Algorithm > DDLInstant {
+		impact.Algorithm, impact.Lock, impact.Rebuild = DDLCopy, DDLLockShared, true
+		impact.Reasons = append(impact.Reasons, "5.6 以下版本不支持 Online DDL")
+	}
+
+	// 检查 ALTER 中指定的 ALGORITHM, LOCK 能否满足，不满足时 MySQL 会直接报错
+	switch specAlgorithm {
+	case tidb.AlgorithmTypeInstant:
+		if impact.Algorithm > DDLInstant {
+			impact.Conflicts = append(impact.Conflicts, fmt.Sprintf("指定了 ALGORITHM=INSTANT，但该操作需要 %s", impact.Algorithm))
+		}
+	case tidb.AlgorithmTypeInplace:
+		if impact.Algorithm > DDLInplace {
+			impact.Conflicts = append(impact.Conflicts, "指定了 ALGORITHM=INPLACE，但该操作需要 COPY")
+		}
+	}
+	switch specLock {
+	case tidb.LockTypeNone:
+		if impact.Lock > DDLLockNone {
+			impact.Conflicts = append(impact.Conflicts, fmt.Sprintf("指定了 LOCK=NONE，但该操作需要 LOCK=%s", impact.Lock))
+		}
+	case tidb.LockTypeShared:
+		if impact.Lock > DDLLockShared {
+			impact.Conflicts = append(impact.Conflicts, fmt.Sprintf("指定了 LOCK=SHARED，但该操作需要 LOCK=%s", impact.Lock))
+		}
+	}
+	return impact
+}
+
+// analyzeAddColumn ADD COLUMN
+func analyzeAddColumn(impact *OnlineDDLImpact, col *tidb.ColumnDef, position *tidb.ColumnPosition, version int, table *tidb.CreateTableStmt) {
+	for _, opt := range col.Options {
+		switch opt.Tp {
+		case tidb.ColumnOptionGenerated:
+			if opt.Stored {
+				impact.merge(DDLCopy, DDLLockShared, true, fmt.Sprintf("ADD COLUMN %s: STORED 生成列只能 COPY", col.Name.Name.O))
+			} else if version >= 80012 {
+				impact.merge(DDLInstant, DDLLockNone, false, fmt.Sprintf("ADD COLUMN %s: VIRTUAL 生成列只修改元数据", col.Name.Name.O))
+			} else {
+				impact.merge(DDLInplace, DDLLockNone, false, fmt.Sprintf("ADD COLUMN %s: VIRTUAL 生成列只修改元数据", col.Name.Name.O))
+			}
+			return
+		case tidb.ColumnOptionAutoIncrement:
+			impact.merge(DDLInplace, DDLLockShared, true, fmt.Sprintf("ADD COLUMN %s: 自增列需要重建表且阻塞写入", col.Name.Name.O))
+			return
+		}
+	}
+
+	last := position == nil || position.Tp == tidb.ColumnPositionNone
+	switch {
+	case tableHasFulltext(table):
+		impact.merge(DDLInplace, DDLLockNone, true, fmt.Sprintf("ADD COLUMN %s: 表中存在 FULLTEXT 索引，不支持 INSTANT", col.Name.Name.O))
+	case tableRowFormatCompressed(table):
+		impact.merge(DDLInplace, DDLLockNone, true, fmt.Sprintf("ADD COLUMN %s: ROW_FORMAT=COMPRESSED 不支持 INSTANT", col.Name.Name.O))
+	case version >= 80029:
+		impact.merge(DDLInstant, DDLLockNone, false, fmt.Sprintf("ADD COLUMN %s: 8.0.29 及以上版本支持 INSTANT", col.Name.Name.O))
+	case version >= 80012 && last:
+		impact.merge(DDLInstant, DDLLockNone, false, fmt.Sprintf("ADD COLUMN %s: 8.0.12 及以上版本在表尾加列支持 INSTANT", col.Name.Name.O))
+	default:
+		impact.merge(DDLInplace, DDLLockNone, true, fmt.Sprintf("ADD COLUMN %s: 需要重建表", col.Name.Name.O))
+	}
+}
+
+// analyzeModifyColumn MODIFY COLUMN, CHANGE COLUMN
+func analyzeModifyColumn(impact *OnlineDDLImpact, spec *tidb.AlterTableSpec, version int, table *tidb.CreateTableStmt) {
+	if len(spec.NewColumns) == 0 {
+		return
+	}
+	newCol := spec.NewColumns[0]
+	name := newCol.Name.Name.O
+	if spec.OldColumnName != nil {
+		name = spec.OldColumnName.Name.O
+	}
+
+	oldCol := findColumnDef(table, name)
+	if oldCol == nil {
+		impact.merge(DDLCopy, DDLLockShared, true, fmt.Sprintf("MODIFY/CHANGE COLUMN %s: 无法获取原列定义，按 COPY 估算", name))
+		return
+	}
+
+	n := len(impact.Reasons)
+	if reason := fieldTypeChange(oldCol.Tp, newCol.Tp, tableCharset(table)); reason != "" {
+		impact.merge(DDLCopy, DDLLockShared, true, fmt.Sprintf("MODIFY/CHANGE COLUMN %s: %s", name, reason))
+		return
+	}
+	if varcharExtended(oldCol.Tp, newCol.Tp) {
+		impact.merge(DDLInplace, DDLLockNone, false, fmt.Sprintf("MODIFY/CHANGE COLUMN %s: 扩展 VARCHAR 长度且长度字节数不变", name))
+	}
+	if columnNullable(oldCol) != columnNullable(newCol) {
+		impact.merge(DDLInplace, DDLLockNone, true, fmt.Sprintf("MODIFY/CHANGE COLUMN %s: 修改 NULL/NOT NULL 需要重建表", name))
+	}
+	if spec.Position != nil && spec.Position.Tp != tidb.ColumnPositionNone {
+		impact.merge(DDLInplace, DDLLockNone, true, fmt.Sprintf("MODIFY/CHANGE COLUMN %s: 调整列顺序需要重建表", name))
+	}
+	if !strings.EqualFold(name, newCol.Name.Name.O) {
+		if version >= 80028 {
+			impact.merge(DDLInstant, DDLLockNone, false, fmt.Sprintf("CHANGE COLUMN %s: 8.0.28 及以上版本重命名列支持 INSTANT", name))
+		} else {
+			impact.merge(DDLInplace, DDLLockNone, false, fmt.Sprintf("CHANGE COLUMN %s: 重命名列只修改元数据", name))
+		}
+	}
+	if len(impact.Reasons) == n {
+		impact.merge(DDLInstant, DDLLockNone, false, fmt.Sprintf("MODIFY/CHANGE COLUMN %s: 只修改默认值或注释", name))
+	}
+}
+
+// analyzeAddConstraint ADD INDEX, ADD PRIMARY KEY, ADD FOREIGN KEY ...
+func analyzeAddConstraint(impact *OnlineDDLImpact, constraint *tidb.Constraint, table *tidb.CreateTableStmt) {
+	if constraint == nil {
+		return
+	}
+	switch constraint.Tp {
+	case tidb.ConstraintPrimaryKey:
+		impact.merge(DDLInplace, DDLLockNone, true, "ADD PRIMARY KEY: 需要重建表")
+	case tidb.ConstraintKey, tidb.ConstraintIndex, tidb.ConstraintUniq, tidb.ConstraintUniqKey, tidb.ConstraintUniqIndex:
+		impact.merge(DDLInplace, DDLLockNone, false, "ADD INDEX: 不需要重建表，但需要扫描全表排序")
+	case tidb.ConstraintFulltext:
+		// 第一个 FULLTEXT 索引需要添加 FTS_DOC_ID 列
+		impact.merge(DDLInplace, DDLLockShared, !tableHasFulltext(table), "ADD FULLTEXT INDEX: 阻塞写入")
+	case tidb.ConstraintForeignKey:
+		impact.merge(DDLCopy, DDLLockShared, true, "ADD FOREIGN KEY: foreign_key_checks=1 时只能 COPY")
+	case tidb.ConstraintCheck:
+		impact.merge(DDLCopy, DDLLockShared, true, "ADD CHECK: 需要校验已有数据，只能 COPY")
+	}
+}
+
+// analyzeTableOption ALTER TABLE 表属性
+func analyzeTableOption(impact *OnlineDDLImpact, opt *tidb.TableOption, table *tidb.CreateTableStmt) {
+	switch opt.Tp {
+	case tidb.TableOptionCharset, tidb.TableOptionCollate:
+		if opt.UintValue == tidb.TableOptionCharsetWithConvertTo {
+			impact.merge(DDLCopy, DDLLockShared, true, "CONVERT TO CHARACTER SET: 只能 COPY")
+		} else {
+			impact.merge(DDLInplace, DDLLockNone, false, "DEFAULT CHARSET: 只修改元数据")
+		}
+	case tidb.TableOptionEngine:
+		if engine := tableEngine(table); engine != "" && !strings.EqualFold(engine, opt.StrValue) {
+			impact.merge(DDLCopy, DDLLockShared, true, fmt.Sprintf("ENGINE: %s 转换为 %s 只能 COPY", engine, opt.StrValue))
+		} else {
+			impact.merge(DDLInplace, DDLLockNone, true, "ENGINE: 需要重建表")
+		}
+	case tidb.TableOptionAutoIncrement, tidb.TableOptionComment, tidb.TableOptionStatsPersistent,
+		tidb.TableOptionStatsAutoRecalc, tidb.TableOptionStatsSamplePages:
+		impact.merge(DDLInplace, DDLLockNone, false, "AUTO_INCREMENT/COMMENT/STATS_*: 只修改元数据")
+	default:
+		impact.merge(DDLInplace, DDLLockNone, true, "ROW_FORMAT/KEY_BLOCK_SIZE 等表属性: 需要重建表")
+	}
+}
+
+// fieldTypeChange 判断列数据类型是否改变，不需要 COPY 时返回空字符串
+func fieldTypeChange(oldTp, newTp *types.FieldType, charset string) string {
+	if oldTp == nil || newTp == nil {
+		return ""
+	}
+	if oldTp.Tp != newTp.Tp || mysql.HasUnsignedFlag(oldTp.Flag) != mysql.HasUnsignedFlag(newTp.Flag) {
+		return "修改数据类型只能 COPY"
+	}
+	// 未指定字符集时使用表的默认字符集
+	oldCharset, newCharset := oldTp.Charset, newTp.Charset
+	if oldCharset == "" {
+		oldCharset = charset
+	}
+	if newCharset == "" {
+		newCharset = charset
+	}
+	if !strings.EqualFold(oldCharset, newCharset) ||
+		(oldTp.Collate != "" && newTp.Collate != "" && !strings.EqualFold(oldTp.Collate, newTp.Collate)) {
+		return "修改字符集只能 COPY"
+	}
+
+	switch newTp.Tp {
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeInt24, mysql.TypeLong, mysql.TypeLonglong:
+		// 整型显示宽度不影响存储
+		return ""
+	case mysql.TypeEnum, mysql.TypeSet:
+		// 在末尾添加枚举值且不改变存储大小时只修改元数据
+		if len(newTp.Elems) < len(oldTp.Elems) {
+			return "删除 ENUM/SET 成员只能 COPY"
+		}
+		for i, elem := range oldTp.Elems {
+			if newTp.Elems[i] != elem {
+				return "调整 ENUM/SET 成员顺序只能 COPY"
+			}
+		}
+		if (newTp.Tp == mysql.TypeEnum && (len(oldTp.Elems) <= 255) != (len(newTp.Elems) <= 255)) ||
+			(newTp.Tp == mysql.TypeSet && (len(oldTp.Elems)+7)/8 != (len(newTp.Elems)+7)/8) {
+			return "ENUM/SET 存储大小改变只能 COPY"
+		}
+		return ""
+	case mysql.TypeVarchar, mysql.TypeVarString:
+		if newTp.Flen == oldTp.Flen {
+			return ""
+		}
+		if newTp.Flen < oldTp.Flen {
+			return "缩短 VARCHAR 长度只能 COPY"
+		}
+		// VARCHAR 长度小于 256 字节时使用 1 个字节存储长度，否则使用 2 个字节
+		bytesPerChar, ok := common.CharSets[strings.ToLower(newCharset)]
+		if !ok {
+			// 默认按 utf8mb4 计算
+			bytesPerChar = 4
+		}
+		if (oldTp.Flen*bytesPerChar < 256) != (newTp.Flen*bytesPerChar < 256) {
+			return "VARCHAR 长度字节数由 1 变为 2，只能 COPY"
+		}
+		return ""
+	}
+
+	if newTp.Flen != oldTp.Flen || newTp.Decimal != oldTp.Decimal {
+		return "修改数据类型长度只能 COPY"
+	}
+	return ""
+}
+
+// varcharExtended 判断是否为扩展 VARCHAR 长度
+func varcharExtended(oldTp, newTp *types.FieldType) bool {
+	return oldTp != nil && newTp != nil &&
+		(newTp.Tp == mysql.TypeVarchar || newTp.Tp == mysql.TypeVarString) &&
+		newTp.Flen > oldTp.Flen
+}
+
+// columnNullable 列是否允许为 NULL
+func columnNullable(col *tidb.ColumnDef) bool {
+	for _, opt := range col.Options {
+		switch opt.Tp {
+		case tidb.ColumnOptionNotNull, tidb.ColumnOptionPrimaryKey:
+			return false
+		}
+	}
+	return true
+}
+
+// findColumnDef 从建表语句中查找列定义
+func findColumnDef(table *tidb.CreateTableStmt, name string) *tidb.ColumnDef {
+	if table == nil {
+		return nil
+	}
+	for _, col := range table.Cols {
+		if strings.EqualFold(col.Name.Name.O, name) {
+			return col
+		}
+	}
+	return nil
+}
+
+// tableHasFulltext 表中是否存在 FULLTEXT 索引
+func tableHasFulltext(table *tidb.CreateTableStmt) bool {
+	if table == nil {
+		return false
+	}
+	for _, constraint := range table.Constraints {
+		if constraint.Tp == tidb.ConstraintFulltext {
+			return true
+		}
+	}
+	return false
+}
+
+// tableRowFormatCompressed 表是否为 ROW_FORMAT=COMPRESSED
+func tableRowFormatCompressed(table *tidb.CreateTableStmt) bool {
+	if table == nil {
+		return false
+	}
+	for _, opt := range table.Options {
+		if opt.Tp == tidb.TableOptionRowFormat && opt.UintValue == tidb.RowFormatCompressed {
+			return true
+		}
+	}
+	return false
+}
+
+// tableCharset 表的默认字符集
+func tableCharset(table *tidb.CreateTableStmt) string {
+	if table == nil {
+		return ""
+	}
+	for _, opt := range table.Options {
+		if opt.Tp == tidb.TableOptionCharset {
+			return opt.StrValue
+		}
+	}
+	return ""
+}
+
+// tableEngine 表的存储引擎
+func tableEngine(table *tidb.CreateTableStmt) string {
+	if table == nil {
+		return ""
+	}
+	for _, opt := range table.Options {
+		if opt.Tp == tidb.TableOptionEngine {
+			return opt.StrValue
+		}
+	}
+	return ""
+}
+
+// alterTableInfo 获取 ALTER 执行前的表结构及表大小（bytes），优先使用快照，其次使用线上环境
+// 测试环境中的表在 BuildVirtualEnv 时已经执行过该 ALTER，不能使用
+func (idxAdv *IndexAdvisor) alterTableInfo(tableName *tidb.TableName) (table *tidb.CreateTableStmt, size uint64, sizeKnown bool) {
+	dbName := tableName.Schema.O
+	if dbName == "" {
+		dbName = idxAdv.rEnv.Database
+	}
+
+	if idxAdv.vEnv.Snapshot == nil && common.Config.OnlineDSN.Disable {
+		return nil, 0, false
+	}
+	ddl := idxAdv.tableDDL(dbName, tableName.Name.O)
+	if ddl == "" {
+		return nil, 0, false
+	}
+
+	if tb := idxAdv.vEnv.Snapshot.Table(dbName, tableName.Name.O); tb != nil {
+		// 从建表语句文件中加载的表结构没有表大小
+		size = tb.DataLength + tb.IndexLength
+		sizeKnown = size > 0
+	} else {
+		// 复制一份 online connector，防止环境切换影响其他功能的使用
+		conn := idxAdv.rEnv
+		conn.Database = dbName
+		status, err := conn.ShowTableStatus(tableName.Name.O)
+		if err == nil && len(status.Rows) > 0 {
+			dataLength, _ := strconv.ParseUint(string(status.Rows[0].DataLength), 10, 64)
+			indexLength, _ := strconv.ParseUint(string(status.Rows[0].IndexLength), 10, 64)
+			size, sizeKnown = dataLength+indexLength, true
+		}
+	}
+
+	stmts, err := ast.TiParse(ddl, "", "")
+	if err != nil {
+		common.Log.Warning("alterTableInfo TiParse `%s`.`%s` Error: %v", dbName, tableName.Name.O, err)
+		return nil, size, sizeKnown
+	}
+	for _, stmt := range stmts {
+		if node, ok := stmt.(*tidb.CreateTableStmt); ok {
+			table = node
+		}
+	}
+	return table, size, sizeKnown
+}
+
+// tableDDL 获取线上表的建表语句，优先使用库表结构快照，未配置线上环境时使用测试环境中的表结构，获取失败时返回空
+func (idxAdv *IndexAdvisor) tableDDL(dbName, tbName string) string {
+	if dbName == "" {
+		dbName = idxAdv.rEnv.Database
+	}
+
+	if idxAdv.vEnv.Snapshot != nil {
+		if tb := idxAdv.vEnv.Snapshot.Table(dbName, tbName); tb != nil {
+			return tb.DDL
+		}
+		return ""
+	}
+
+	// 复制一份 connector，防止环境切换影响其他功能的使用
+	var conn database.Connector
+	switch {
+	case !common.Config.OnlineDSN.Disable:
+		conn = idxAdv.rEnv
+		conn.Database = dbName
+	case !common.Config.TestDSN.Disable && idxAdv.vEnv.Connector != nil:
+		conn = *idxAdv.vEnv.Connector
+		conn.Database = idxAdv.vEnv.DBHash(dbName)
+	default:
+		return ""
+	}
+	ddl, err := conn.ShowCreateTable(tbName)
+	if err != nil {
+		common.Log.Warning("tableDDL ShowCreateTable `%s`.`%s` Error: %v", dbName, tbName, err)
+		return ""
+	}
+	return ddl
+}
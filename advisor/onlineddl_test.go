@@ -0,0 +1,91 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"testing"
+
+	"github.com/laojianzi/soar/ast"
+	"github.com/laojianzi/soar/common"
+
+	tidb "github.com/pingcap/parser/ast"
+)
+
+func TestAnalyzeAlterTable(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	createTable := "CREATE TABLE `tbl` (`id` int NOT NULL, `name` varchar(20) DEFAULT NULL, `c` char(10), `s` enum('a','b'), PRIMARY KEY (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+	stmts, err := ast.TiParse(createTable, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := stmts[0].(*tidb.CreateTableStmt)
+
+	cases := []struct {
+		sql       string
+		version   int
+		algorithm DDLAlgorithm
+		lock      DDLLock
+		rebuild   bool
+		conflict  bool
+	}{
+		{"ALTER TABLE tbl ADD COLUMN c1 int", 80023, DDLInstant, DDLLockNone, false, false},
+		{"ALTER TABLE tbl ADD COLUMN c1 int FIRST", 80023, DDLInplace, DDLLockNone, true, false},
+		{"ALTER TABLE tbl ADD COLUMN c1 int FIRST", 80030, DDLInstant, DDLLockNone, false, false},
+		{"ALTER TABLE tbl ADD COLUMN c1 int", 50720, DDLInplace, DDLLockNone, true, false},
+		{"ALTER TABLE tbl ADD COLUMN c1 int AS (id + 1) STORED", 80023, DDLCopy, DDLLockShared, true, false},
+		{"ALTER TABLE tbl DROP COLUMN c", 80023, DDLInplace, DDLLockNone, true, false},
+		{"ALTER TABLE tbl MODIFY COLUMN name varchar(60)", 80023, DDLInplace, DDLLockNone, false, false},
+		{"ALTER TABLE tbl MODIFY COLUMN name varchar(100)", 80023, DDLCopy, DDLLockShared, true, false},
+		{"ALTER TABLE tbl MODIFY COLUMN name varchar(10)", 80023, DDLCopy, DDLLockShared, true, false},
+		{"ALTER TABLE tbl MODIFY COLUMN name varchar(20) NOT NULL", 80023, DDLInplace, DDLLockNone, true, false},
+		{"ALTER TABLE tbl MODIFY COLUMN name varchar(20) COMMENT 'name'", 80023, DDLInstant, DDLLockNone, false, false},
+		{"ALTER TABLE tbl MODIFY COLUMN id bigint NOT NULL", 80023, DDLCopy, DDLLockShared, true, false},
+		{"ALTER TABLE tbl MODIFY COLUMN s enum('a','b','c')", 80023, DDLInstant, DDLLockNone, false, false},
+		{"ALTER TABLE tbl MODIFY COLUMN s enum('b','a')", 80023, DDLCopy, DDLLockShared, true, false},
+		{"ALTER TABLE tbl CHANGE COLUMN c c2 char(10)", 50720, DDLInplace, DDLLockNone, false, false},
+		{"ALTER TABLE tbl ADD INDEX idx_name (name)", 80023, DDLInplace, DDLLockNone, false, false},
+		{"ALTER TABLE tbl DROP PRIMARY KEY", 80023, DDLCopy, DDLLockShared, true, false},
+		{"ALTER TABLE tbl DROP PRIMARY KEY, ADD PRIMARY KEY (id, name)", 80023, DDLInplace, DDLLockNone, true, false},
+		{"ALTER TABLE tbl CONVERT TO CHARACTER SET utf8", 80023, DDLCopy, DDLLockShared, true, false},
+		{"ALTER TABLE tbl ENGINE=InnoDB", 80023, DDLInplace, DDLLockNone, true, false},
+		{"ALTER TABLE tbl RENAME INDEX idx_a TO idx_b", 80023, DDLInstant, DDLLockNone, false, false},
+		{"ALTER TABLE tbl ADD INDEX idx_name (name), ALGORITHM=INSTANT", 80023, DDLInplace, DDLLockNone, false, true},
+		{"ALTER TABLE tbl MODIFY COLUMN id bigint NOT NULL, ALGORITHM=INPLACE, LOCK=NONE", 80023, DDLCopy, DDLLockShared, true, true},
+		{"ALTER TABLE tbl ADD INDEX idx_name (name)", 50520, DDLCopy, DDLLockShared, true, false},
+	}
+	for _, c := range cases {
+		stmts, err := ast.TiParse(c.sql, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		impact := AnalyzeAlterTable(stmts[0].(*tidb.AlterTableStmt), c.version, table)
+		if impact.Algorithm != c.algorithm || impact.Lock != c.lock || impact.Rebuild != c.rebuild || (len(impact.Conflicts) > 0) != c.conflict {
+			t.Errorf("SQL: %s, version: %d, got: %s %s %v %v, reasons: %v", c.sql, c.version,
+				impact.Algorithm, impact.Lock, impact.Rebuild, impact.Conflicts, impact.Reasons)
+		}
+	}
+
+	// 无法获取原表结构时按 COPY 估算
+	stmts, err = ast.TiParse("ALTER TABLE tbl MODIFY COLUMN name varchar(60)", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if impact := AnalyzeAlterTable(stmts[0].(*tidb.AlterTableStmt), 80023, nil); impact.Algorithm != DDLCopy {
+		t.Errorf("want COPY without table definition, got: %s", impact.Algorithm)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/laojianzi/soar/common"
+	"github.com/laojianzi/soar/env"
+
+	"vitess.io/vitess/go/vt/sqlparser"
+)
+
+// Param 预处理语句中的 ? 占位符
+type Param struct {
+	Index  int            // 占位符在 SQL 中的序号，从 0 开始
+	Column *common.Column // 占位符对应的列，无法确定时为 nil
+	Limit  bool           // LIMIT 中的占位符
+}
+
+var enumValueRe = regexp.MustCompile(`(?i)^(?:enum|set)\s*\(\s*('(?:[^'\\]|\\.|'')*')`)
+
+// FindParams 查找 SQL 中的 ? 占位符及其对应的列，vitess 将 ? 依次解析为 :v1, :v2 等 ValArg
+// 支持 WHERE, ON 中的比较、IN、BETWEEN 条件，UPDATE 中的 SET 及 INSERT 中的 VALUES
+func FindParams(stmt sqlparser.Statement) []*Param {
+	params := make(map[int]*Param)
+	// 只处理直接与列比较的占位符，函数参数中的占位符无法确定类型
+	add := func(expr sqlparser.Expr, col *sqlparser.ColName, limit bool) {
+		var values []sqlparser.Expr
+		switch n := expr.(type) {
+		case *sqlparser.SQLVal:
+			values = append(values, n)
+		case sqlparser.ValTuple:
+			values = n
+		}
+		for _, v := range values {
+			val, ok := v.(*sqlparser.SQLVal)
+			if !ok || paramIndex(val) < 0 {
+				continue
+			}
+			p := &Param{Index: paramIndex(val), Limit: limit}
+			if col != nil {
+				p.Column = &common.Column{Name: col.Name.String(), Table: col.Qualifier.Name.String()}
+			}
+			params[p.Index] = p
+		}
+	}
+
+	err := sqlparser.Walk(func(node sqlparser.SQLNode) (kontinue bool, err error) {
+		switch n := node.(type) {
+		case *sqlparser.ComparisonExpr:
+			if col, ok := n.Left.(*sqlparser.ColName); ok {
+				add(n.Right, col, false)
+			}
+			if col, ok := n.Right.(*sqlparser.ColName); ok {
+				add(n.Left, col, false)
+			}
+		case *sqlparser.RangeCond:
+			if col, ok := n.Left.(*sqlparser.ColName); ok {
+				add(n.From, col, false)
+				add(n.To, col, false)
+			}
+		case *sqlparser.UpdateExpr:
+			add(n.Expr, n.Name, false)
+		case *sqlparser.Insert:
+			if rows, ok := n.Rows.(sqlparser.Values); ok {
+				for _, row := range rows {
+					for i, expr := range row {
+						if i < len(n.Columns) {
+							add(expr, &sqlparser.ColName{Name: n.Columns[i], Qualifier: sqlparser.TableName{Name: n.Table.Name}}, false)
+						}
+					}
+				}
+			}
+		case *sqlparser.Limit:
+			add(n.Offset, nil, true)
+			add(n.Rowcount, nil, true)
+		}
+		return true, nil
+	}, stmt)
+	common.LogIfError(err, "")
+
+	// 无法确定对应列的占位符
+	err = sqlparser.Walk(func(node sqlparser.SQLNode) (kontinue bool, err error) {
+		if val, ok := node.(*sqlparser.SQLVal); ok {
+			if idx := paramIndex(val); idx >= 0 {
+				if _, ok := params[idx]; !ok {
+					params[idx] = &Param{Index: idx}
+				}
+			}
+		}
+		return true, nil
+	}, stmt)
+	common.LogIfError(err, "")
+
+	var res []*Param
+	for i := 0; i < len(params); i++ {
+		if p, ok := params[i]; ok {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// paramIndex 返回 ValArg 的序号，不是 ? 占位符时返回 -1
+func paramIndex(val *sqlparser.SQLVal) int {
+	if val.Type != sqlparser.ValArg || !strings.HasPrefix(string(val.Val), ":v") {
+		return -1
+	}
+	idx, err := strconv.Atoi(string(val.Val[2:]))
+	if err != nil {
+		return -1
+	}
+	return idx - 1
+}
+
+// ParamValues 根据占位符对应列的数据类型生成具有代表性的值，替换占位符后即可进行 EXPLAIN 及索引建议
+// 列的数据类型从测试环境中获取，无法获取时使用字符串 '1'，与数值及字符串类型的列比较都不会导致索引失效
+func ParamValues(stmt sqlparser.Statement, params []*Param, vEnv *env.VirtualEnv) []string {
+	var cols []*common.Column
+	for _, p := range params {
+		if p.Column != nil {
+			cols = append(cols, p.Column)
+		}
+	}
+	if !common.Config.TestDSN.Disable {
+		CompleteColumnsInfo(stmt, cols, vEnv)
+	}
+
+	values := make([]string, len(params))
+	for i, p := range params {
+		switch {
+		case p.Limit:
+			values[i] = "1"
+		case p.Column != nil && p.Column.DataType != "":
+			values[i] = typeValue(p.Column.DataType)
+		default:
+			values[i] = "'1'"
+		}
+	}
+	return values
+}
+
+// typeValue 返回指定数据类型的代表值
+func typeValue(dataType string) string {
+	switch strings.ToLower(common.GetDataTypeBase(dataType)) {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "bit":
+		return "1"
+	case "float", "double", "real", "decimal", "numeric":
+		return "1.0"
+	case "year":
+		return "2006"
+	case "date":
+		return "'2006-01-02'"
+	case "time":
+		return "'15:04:05'"
+	case "datetime", "timestamp":
+		return "'2006-01-02 15:04:05'"
+	case "enum", "set":
+		// 使用第一个可选值
+		if m := enumValueRe.FindStringSubmatch(dataType); m != nil {
+			return m[1]
+		}
+	}
+	return "'1'"
+}
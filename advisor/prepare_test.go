@@ -0,0 +1,82 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/laojianzi/soar/common"
+
+	"vitess.io/vitess/go/vt/sqlparser"
+)
+
+func TestFindParams(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	cases := map[string]string{
+		"select * from film where film_id = ? and ? < rental_rate":                           "0:film_id 1:rental_rate",
+		"select * from film f where f.title in (?, ?) and last_update between ? and ?":       "0:f.title 1:f.title 2:last_update 3:last_update",
+		"select * from film where film_id = ? limit ?, ?":                                    "0:film_id 1:LIMIT 2:LIMIT",
+		"update film set title = ?, rating = ? where film_id = ?":                            "0:title 1:rating 2:film_id",
+		"insert into film (film_id, title) values (?, ?), (?, ?)":                            "0:film.film_id 1:film.title 2:film.film_id 3:film.title",
+		"select * from film where upper(title) = concat(?, 'x') and film_id = abs(?)":        "0:? 1:?",
+		"select * from film where film_id = (select max(film_id) from film where title = ?)": "0:title",
+	}
+	for sql, want := range cases {
+		stmt, err := sqlparser.Parse(sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, p := range FindParams(stmt) {
+			switch {
+			case p.Limit:
+				got = append(got, fmt.Sprintf("%d:LIMIT", p.Index))
+			case p.Column == nil:
+				got = append(got, fmt.Sprintf("%d:?", p.Index))
+			case p.Column.Table != "":
+				got = append(got, fmt.Sprintf("%d:%s.%s", p.Index, p.Column.Table, p.Column.Name))
+			default:
+				got = append(got, fmt.Sprintf("%d:%s", p.Index, p.Column.Name))
+			}
+		}
+		if strings.Join(got, " ") != want {
+			t.Errorf("SQL: %s, want: %s, got: %s", sql, want, strings.Join(got, " "))
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestTypeValue(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	cases := map[string]string{
+		"smallint(5) unsigned":   "1",
+		"decimal(4,2)":           "1.0",
+		"DATETIME":               "'2006-01-02 15:04:05'",
+		"date":                   "'2006-01-02'",
+		"year(4)":                "2006",
+		"enum('G','PG','NC-17')": "'G'",
+		"varchar(255)":           "'1'",
+	}
+	for dataType, want := range cases {
+		if got := typeValue(dataType); got != want {
+			t.Errorf("dataType: %s, want: %s, got: %s", dataType, want, got)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
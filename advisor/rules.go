@@ -87,12 +87,14 @@ type Rule struct {
 * ARG   Argument
 * CLA   Classic
 * COL   Column
+* CTE   Common Table Expression(WITH)
 * DIS   Distinct
-* ERR   Error, 特指MySQL执行返回的报错信息, ERR.000为vitess语法错误，ERR.001为执行错误，ERR.002为EXPLAIN错误
+* ERR   Error, 特指MySQL执行返回的报错信息, ERR.000为vitess语法错误，ERR.001为执行错误，ERR.002为EXPLAIN错误，ERR.004为线上环境负载过高跳过的查询
 * EXP   Explain, 由explain模块给
 * FUN   Function
 * IDX   Index, 由index模块给
 * JOI   Join
+* JSN   JSON
 * KEY   Key
 * KWR   Keyword
 * LCK	Lock
@@ -104,6 +106,8 @@ type Rule struct {
 * SUB   Subquery
 * TBL   TableName
 * TRA   Trace, 由trace模块给
+* TRX   Transaction, 由TrxAnalyzer给
+* WIN   Window Function
 
 */
 
@@ -181,6 +185,14 @@ func InitHeuristicRules() {
 			Case:     "ALTER TABLE tbl DROP PRIMARY KEY;",
 			Func:     (*Query4Audit).RuleAlterDropKey,
 		},
+		"ALT.005": {
+			Item:     "ALT.005",
+			Severity: "L2",
+			Summary:  "ALTER TABLE 可能会重建表或阻塞写入，请评估对线上的影响",
+			Content:  `根据线上 MySQL 版本及当前表结构，预估 ALTER TABLE 会以 INSTANT, INPLACE 还是 COPY 的方式执行，以及执行期间是否阻塞读写。建议在 ALTER 语句中显式指定 ALGORITHM 和 LOCK 子句，不满足时 MySQL 会直接报错而不是悄悄锁表。需要重建的表超过 max-ddl-rebuild-size 时建议使用 gh-ost, pt-online-schema-change 等在线变更工具。`,
+			Case:     "ALTER TABLE tbl MODIFY COLUMN col BIGINT;",
+			Func:     (*Query4Audit).RuleOK, // 该建议在indexAdvisor中给
+		},
 		"ARG.001": {
 			Item:     "ARG.001",
 			Severity: "L4",
@@ -598,6 +610,22 @@ func InitHeuristicRules() {
 			Case:     "CREATE TABLE t1 (t TIME(3), dt DATETIME(6));",
 			Func:     (*Query4Audit).RuleTimePrecision,
 		},
+		"CTE.001": {
+			Item:     "CTE.001",
+			Severity: "L3",
+			Summary:  "递归 CTE 缺少终止条件",
+			Content:  `递归 CTE 的递归部分没有 WHERE 条件，也没有 LIMIT 限制，只能在递归次数超过 cte_max_recursion_depth（默认 1000）时报错终止。请在递归部分添加终止条件，如：WHERE n < 100，或在 CTE 中使用 LIMIT（MySQL 8.0.19 及以上版本）。`,
+			Case:     "WITH RECURSIVE seq(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM seq) SELECT * FROM seq;",
+			Func:     (*Query4Audit).RuleRecursiveCTE,
+		},
+		"CTE.002": {
+			Item:     "CTE.002",
+			Severity: "L1",
+			Summary:  "CTE 被多次引用，MySQL 会将其物化为内部临时表",
+			Content:  `只被引用一次的 CTE 可以像派生表一样合并到外层查询中，被多次引用的 CTE 通常会被物化为内部临时表，外层查询的过滤条件无法用到原表上的索引，临时表超过 tmp_table_size 时还会转为磁盘临时表。请确认 CTE 的结果集足够小，或尽量在 CTE 的定义中完成过滤。`,
+			Case:     "WITH t AS (SELECT * FROM tbl) SELECT * FROM t a JOIN t b ON a.pid = b.id;",
+			Func:     (*Query4Audit).RuleCTEMultiReference,
+		},
 		"DIS.001": {
 			Item:     "DIS.001",
 			Severity: "L1",
@@ -628,7 +656,7 @@ func InitHeuristicRules() {
 			Item:     "FUN.001",
 			Severity: "L2",
 			Summary:  "避免在 WHERE 条件中使用函数或其他运算符",
-			Content:  `虽然在 SQL 中使用函数可以简化很多复杂的查询，但使用了函数的查询无法利用表中已经建立的索引，该查询将会是全表扫描，性能较差。通常建议将列名写在比较运算符左侧，将查询过滤条件放在比较运算符右侧。也不建议在查询比较条件两侧书写多余的括号，这会对阅读产生比较大的困扰。`,
+			Content:  `虽然在 SQL 中使用函数可以简化很多复杂的查询，但使用了函数的查询无法利用表中已经建立的索引，该查询将会是全表扫描，性能较差。通常建议将列名写在比较运算符左侧，将查询过滤条件放在比较运算符右侧。也不建议在查询比较条件两侧书写多余的括号，这会对阅读产生比较大的困扰。MySQL 8.0.13 及以上版本可以为对单列使用函数的过滤条件添加函数索引，如：ALTER TABLE tbl ADD INDEX idx_lower_email ((LOWER(email)))。`,
 			Case:     "SELECT id FROM t WHERE SUBSTRING(name,1,3)='abc'",
 			Func:     (*Query4Audit).RuleCompareWithFunction,
 		},
@@ -769,6 +797,38 @@ func InitHeuristicRules() {
 			Func:     (*Query4Audit).RuleMultiDBJoin,
 		},
 		// TODO: 跨库事务的检查，目前SOAR未对事务做处理
+		"JSN.001": {
+			Item:     "JSN.001",
+			Severity: "L3",
+			Summary:  "对 JSON 列中的路径进行过滤时没有可用的索引",
+			Content:  `JSON 列不能直接添加索引，使用 JSON_EXTRACT, ->, ->> 对 JSON 中的某个路径进行过滤时会全表扫描。MySQL 5.7 可以为该路径添加虚拟列（GENERATED ALWAYS AS ... VIRTUAL）并在虚拟列上添加索引，查询条件与虚拟列的定义相同时优化器会自动使用该索引；MySQL 8.0.13 及以上版本也可以直接添加函数索引，字符串比较时需要指定 COLLATE utf8mb4_bin。`,
+			Case:     "SELECT * FROM tbl WHERE data->>'$.name' = 'abc';",
+			Func:     (*Query4Audit).RuleOK, // 该建议在indexAdvisor中给
+		},
+		"JSN.002": {
+			Item:     "JSN.002",
+			Severity: "L3",
+			Summary:  "JSON_CONTAINS, JSON_OVERLAPS 查找 JSON 数组时没有可用的多值索引",
+			Content:  `JSON_CONTAINS, JSON_OVERLAPS 查找 JSON 数组中的元素时，只能使用多值索引（Multi-Valued Index），普通索引和虚拟列索引都无法使用，MySQL 8.0.17 及以上版本支持多值索引，如：ALTER TABLE tbl ADD INDEX idx_tags ((CAST(data->'$.tags' AS UNSIGNED ARRAY)))。`,
+			Case:     "SELECT * FROM tbl WHERE JSON_CONTAINS(data->'$.tags', '[1, 2]');",
+			Func:     (*Query4Audit).RuleOK, // 该建议在indexAdvisor中给
+		},
+		"JSN.003": {
+			Item:     "JSN.003",
+			Severity: "L2",
+			Summary:  "建议使用 JSON 类型存储 JSON 数据",
+			Content:  `使用 TEXT, VARCHAR 等字符串类型存储 JSON 数据时，写入时不会校验格式，每次读取都需要重新解析整个文档，也无法使用部分更新及多值索引。MySQL 5.7.8 及以上版本建议使用 JSON 类型，JSON 类型以二进制格式存储，可以直接按路径读取。`,
+			Case:     "CREATE TABLE tbl (id INT, data TEXT CHECK (JSON_VALID(data)));",
+			Func:     (*Query4Audit).RuleJSONInText,
+		},
+		"JSN.004": {
+			Item:     "JSN.004",
+			Severity: "L2",
+			Summary:  "JSON 列的更新无法原地部分更新，会重写整个文档",
+			Content:  `MySQL 8.0 只有在 SET col = JSON_SET(col, ...)、JSON_REPLACE(col, ...)、JSON_REMOVE(col, ...)，且第一个参数为被更新的列时才会原地部分更新 JSON 文档，binlog_row_value_options=PARTIAL_JSON 时 binlog 中也只记录修改的部分。使用 JSON_INSERT, JSON_ARRAY_APPEND, JSON_MERGE_PATCH 等函数，或从其他列计算新值时会重写整个文档。另外 JSON_SET 新增路径或新值比原值更长时，同样无法原地更新。`,
+			Case:     "UPDATE tbl SET data = JSON_ARRAY_APPEND(data, '$.tags', 3) WHERE id = 1;",
+			Func:     (*Query4Audit).RuleJSONPartialUpdate,
+		},
 		"KEY.001": {
 			Item:     "KEY.001",
 			Severity: "L2",
@@ -982,7 +1042,7 @@ func InitHeuristicRules() {
 			Item:     "RES.006",
 			Severity: "L4",
 			Summary:  "永远不真的比较条件",
-			Content:  "查询条件永远非真，如果该条件出现在 where 中可能导致查询无匹配到的结果。",
+			Content:  "查询条件永远非真，如果该条件出现在 where 中可能导致查询无匹配到的结果。col NOT IN (1, NULL) 这类列表中包含 NULL 的 NOT IN 条件也永远不为真。",
 			Case:     "SELECT * FROM tbl WHERE 1 != 1;",
 			Func:     (*Query4Audit).RuleImpossibleWhere,
 		},
@@ -1026,6 +1086,14 @@ func InitHeuristicRules() {
 			Case:     "UPDATE category SET name='ActioN', last_update=last_update WHERE category_id=1",
 			Func:     (*Query4Audit).RuleOK, // 该建议在indexAdvisor中给 RuleUpdateOnUpdate
 		},
+		"RES.012": {
+			Item:     "RES.012",
+			Severity: "L4",
+			Summary:  "NOT IN 子查询的列允许为 NULL，可能静默地返回空结果",
+			Content:  "col NOT IN (SELECT x ...) 中只要子查询返回了一个 NULL 值，NOT IN 的结果就永远不为真，查询不会报错但返回空结果。建议改写为 NOT EXISTS (SELECT 1 ... WHERE x = col)，或在子查询中添加 x IS NOT NULL 条件。col 为 NULL 时 NOT IN 只在子查询结果为空时返回该行而 NOT EXISTS 总会返回，col 允许为 NULL 时改写后需要添加 (col IS NOT NULL OR NOT EXISTS (SELECT 1 ...)) 条件。",
+			Case:     "SELECT name FROM language WHERE language_id NOT IN (SELECT original_language_id FROM film)",
+			Func:     (*Query4Audit).RuleOK, // 该建议在indexAdvisor中给 RuleNotInNullable
+		},
 		"SEC.001": {
 			Item:     "SEC.001",
 			Severity: "L0",
@@ -1214,6 +1282,54 @@ func InitHeuristicRules() {
 			Case:     "CREATE TABLE tbl (a INT) DEFAULT COLLATE = latin1_bin;",
 			Func:     (*Query4Audit).RuleTableCharsetCheck,
 		},
+		"TRX.001": {
+			Item:     "TRX.001",
+			Severity: "L4",
+			Summary:  "事务中的 DDL 会隐式提交当前事务",
+			Content:  `DDL, LOCK TABLES 等语句执行前会隐式提交当前未提交的事务，之前的修改无法再通过 ROLLBACK 回滚。同时 DDL 需要等待表上的事务结束才能获取元数据锁，长事务中混合 DDL 容易造成元数据锁等待堆积。请将 DDL 与业务事务分开执行。`,
+			Case:     "BEGIN; UPDATE tbl SET col = 1 WHERE id = 1; ALTER TABLE tbl ADD COLUMN c INT; COMMIT;",
+			Func:     (*Query4Audit).RuleOK, // 该建议在TrxAnalyzer中给
+		},
+		"TRX.002": {
+			Item:     "TRX.002",
+			Severity: "L3",
+			Summary:  "事务间加锁顺序不一致，存在死锁风险",
+			Content:  `多个事务以不同的顺序对相同的表加锁，并发执行时容易形成循环等待导致死锁。建议所有事务按照相同的顺序访问表。`,
+			Case:     "BEGIN; UPDATE a SET c = 1 WHERE id = 1; UPDATE b SET c = 1 WHERE id = 1; COMMIT; BEGIN; UPDATE b SET c = 2 WHERE id = 1; UPDATE a SET c = 2 WHERE id = 1; COMMIT;",
+			Func:     (*Query4Audit).RuleOK, // 该建议在TrxAnalyzer中给
+		},
+		"TRX.003": {
+			Item:     "TRX.003",
+			Severity: "L3",
+			Summary:  "事务中的加锁读可能锁定大范围的记录",
+			Content:  `REPEATABLE-READ 隔离级别下 SELECT ... FOR UPDATE, LOCK IN SHARE MODE 会对扫描到的所有记录及间隙加锁（next-key lock），没有使用索引或只使用范围条件时会锁住大量记录和间隙，阻塞其他事务的写入。建议使用主键或唯一索引上的等值条件进行加锁读。`,
+			Case:     "BEGIN; SELECT * FROM tbl WHERE create_time > '2021-01-01' FOR UPDATE; COMMIT;",
+			Func:     (*Query4Audit).RuleOK, // 该建议在TrxAnalyzer中给
+		},
+		"TRX.004": {
+			Item:     "TRX.004",
+			Severity: "L2",
+			Summary:  "事务中存在大批量更新",
+			Content:  `事务中没有等值条件及 LIMIT 的 UPDATE, DELETE 可能影响大量记录，这些记录上的锁会一直持有到事务结束，同时产生大量 undo log，回滚代价很高。建议按主键分批更新并及时提交。`,
+			Case:     "BEGIN; UPDATE tbl SET status = 1 WHERE create_time < '2021-01-01'; COMMIT;",
+			Func:     (*Query4Audit).RuleOK, // 该建议在TrxAnalyzer中给
+		},
+		"WIN.001": {
+			Item:     "WIN.001",
+			Severity: "L2",
+			Summary:  "大表上使用不带 PARTITION BY 的窗口函数",
+			Content:  `不带 PARTITION BY 的窗口函数会将整个结果集作为一个窗口，需要对所有数据排序或缓存，表的数据行数超过 max-total-rows 时执行代价很高。建议先通过 WHERE 条件缩小结果集，或按业务字段添加 PARTITION BY。`,
+			Case:     "SELECT id, ROW_NUMBER() OVER (ORDER BY create_time) FROM tbl;",
+			Func:     (*Query4Audit).RuleOK, // 该建议在indexAdvisor中给
+		},
+		"WIN.002": {
+			Item:     "WIN.002",
+			Severity: "L1",
+			Summary:  "窗口函数中的 ORDER BY 与外层 ORDER BY 相同",
+			Content:  `窗口定义中的 ORDER BY 只决定窗口内的计算顺序，不保证结果集的顺序，与外层 ORDER BY 重复时可能导致对同一结果集排序两次。另外 SUM, COUNT 等聚合窗口函数指定 ORDER BY 后默认窗口范围会变为 RANGE BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW，计算结果变为累计值。请确认窗口中的 ORDER BY 是否必要。`,
+			Case:     "SELECT id, SUM(amount) OVER (ORDER BY id) FROM tbl ORDER BY id;",
+			Func:     (*Query4Audit).RuleWindowOrderBy,
+		},
 	}
 }
 
@@ -1432,7 +1548,12 @@ func FormatSuggest(sql string, currentDB string, format string, suggests ...map[
 			buf = append(buf, fmt.Sprintln("* **Content:** ", common.MarkdownEscape(suggest[item].Content)))
 
 			if format == "duplicate-key-checker" {
-				buf = append(buf, fmt.Sprintf("* **原建表语句:** \n```sql\n%s\n```\n", suggest[item].Case), "\n\n")
+				// 开启 allow-drop-index 时 Case 为删除索引的 DDL
+				label := "原建表语句"
+				if !strings.HasPrefix(strings.ToUpper(suggest[item].Case), "CREATE") {
+					label = "建议执行"
+				}
+				buf = append(buf, fmt.Sprintf("* **%s:** \n```sql\n%s\n```\n", label, suggest[item].Case), "\n\n")
 			} else {
 				buf = append(buf, fmt.Sprint("* **Case:** ", common.MarkdownEscape(suggest[item].Case), "\n\n"))
 			}
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/laojianzi/soar/common"
+	"github.com/laojianzi/soar/database"
+)
+
+// schemaAuditItems 检查表结构时使用的启发式规则，只有这些规则与 CREATE TABLE 语句相关
+var schemaAuditItems = []string{"CLA.011", "COL.", "JSN.", "KEY.", "STA.", "TBL."}
+
+// TableAudit 单表的表结构审查结果
+type TableAudit struct {
+	Table   string
+	Score   int
+	Suggest map[string]Rule
+}
+
+// SchemaAudit 单库的表结构审查结果，Score 为库中所有表得分的平均值
+type SchemaAudit struct {
+	Database string
+	Score    int
+	Tables   []TableAudit
+	Errors   []string
+}
+
+// isSchemaAuditRule 规则是否用于表结构审查
+func isSchemaAuditRule(item string) bool {
+	for _, prefix := range schemaAuditItems {
+		if strings.HasPrefix(item, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// suggestScore 按照 FormatSuggest 中的打分方式计算得分，每条建议扣除 5 倍的 Severity 分
+func suggestScore(suggest map[string]Rule) int {
+	score := 100
+	for item, rule := range suggest {
+		if item == "OK" {
+			continue
+		}
+		minus, err := strconv.Atoi(strings.TrimLeft(rule.Severity, "L"))
+		if err != nil {
+			common.Log.Debug("suggestScore, strconv.Atoi, Error: ", err)
+			return 0
+		}
+		score -= minus * 5
+	}
+	if score < 0 {
+		score = 0
+	}
+	return score
+}
+
+// auditTable 对 SHOW CREATE TABLE 的结果执行表结构相关的启发式规则
+func auditTable(table, ddl string) TableAudit {
+	audit := TableAudit{Table: table, Suggest: make(map[string]Rule)}
+	q, err := NewQuery4Audit(ddl)
+	if err != nil {
+		audit.Suggest["ERR.000"] = RuleMySQLError("ERR.000", err)
+		return audit
+	}
+
+	for item, rule := range HeuristicRules {
+		if !isSchemaAuditRule(item) || IsIgnoreRule(item) {
+			continue
+		}
+		if r := rule.Func(q); r.Item == item {
+			audit.Suggest[item] = r
+		}
+	}
+	// COL.007 在 IndexAdvisor 中依赖测试环境，这里直接检查线上的建表语句
+	if !IsIgnoreRule("COL.007") {
+		if r := q.RuleMaxTextColsCount(); r.Item == "COL.007" {
+			audit.Suggest[r.Item] = r
+		}
+	}
+	audit.Suggest = MergeConflictHeuristicRules(audit.Suggest)
+	delete(audit.Suggest, "OK")
+	audit.Score = suggestScore(audit.Suggest)
+	return audit
+}
+
+// SchemaAuditChecker 对 OnlineDSN 中指定库的所有表执行表结构审查，不指定库时检查 OnlineDSN 中的库
+func SchemaAuditChecker(conn *database.Connector, databases ...string) []SchemaAudit {
+	common.Log.Debug("Enter:  SchemaAuditChecker, Caller: %s", common.Caller())
+	// 复制一份online connector,防止环境切换影响其他功能的使用
+	tmpOnline := *conn
+	if len(databases) == 0 {
+		databases = append(databases, tmpOnline.Database)
+	}
+
+	var audits []SchemaAudit
+	for _, db := range databases {
+		schema := SchemaAudit{Database: db}
+		tmpOnline.Database = db
+		tables, err := tmpOnline.ShowTables()
+		if err != nil {
+			schema.Errors = append(schema.Errors, err.Error())
+		}
+
+		for _, tb := range tables {
+			ddl, err := tmpOnline.ShowCreateTable(tb)
+			if err != nil {
+				schema.Errors = append(schema.Errors, err.Error())
+				continue
+			}
+			schema.Tables = append(schema.Tables, auditTable(tb, ddl))
+		}
+		schema.Score = schemaScore(schema.Tables)
+		audits = append(audits, schema)
+	}
+	return audits
+}
+
+// schemaScore 库的得分为所有表得分的平均值，没有表时为满分
+func schemaScore(tables []TableAudit) int {
+	if len(tables) == 0 {
+		return 100
+	}
+	var total int
+	for _, tb := range tables {
+		total += tb.Score
+	}
+	return total / len(tables)
+}
+
+// FormatSchemaAudit 按库、表分组输出表结构审查结果，没有问题的表只计入得分不输出
+func FormatSchemaAudit(audits []SchemaAudit) string {
+	var buf []string
+	for _, schema := range audits {
+		var issued int
+		for _, tb := range schema.Tables {
+			if len(tb.Suggest) > 0 {
+				issued++
+			}
+		}
+
+		buf = append(buf, fmt.Sprintf("# Schema: %s\n", schema.Database))
+		buf = append(buf, common.Score(schema.Score)+"\n")
+		buf = append(buf, fmt.Sprintf("共检查%d张表，其中%d张表存在需要优化的表结构\n", len(schema.Tables), issued))
+		if len(schema.Errors) > 0 {
+			buf = append(buf, "## MySQL execute failed\n")
+			buf = append(buf, strings.Join(schema.Errors, "\n")+"\n")
+		}
+
+		for _, tb := range schema.Tables {
+			if len(tb.Suggest) == 0 {
+				continue
+			}
+			buf = append(buf, fmt.Sprintf("## Table: %s\n", common.MarkdownEscape(tb.Table)))
+			buf = append(buf, common.Score(tb.Score)+"\n")
+
+			var items []string
+			for item := range tb.Suggest {
+				items = append(items, item)
+			}
+			sort.Strings(items)
+			for _, item := range items {
+				buf = append(buf, fmt.Sprintln("###", tb.Suggest[item].Summary))
+				buf = append(buf, fmt.Sprintln("* **Item:** ", item))
+				buf = append(buf, fmt.Sprintln("* **Severity:** ", tb.Suggest[item].Severity))
+				buf = append(buf, fmt.Sprintln("* **Content:** ", common.MarkdownEscape(tb.Suggest[item].Content)))
+			}
+		}
+	}
+	return strings.Join(buf, "\n")
+}
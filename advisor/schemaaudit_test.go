@@ -0,0 +1,95 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/laojianzi/soar/common"
+)
+
+func TestAuditTable(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	good := "CREATE TABLE `actor` (\n" +
+		"  `actor_id` int unsigned NOT NULL AUTO_INCREMENT COMMENT 'id',\n" +
+		"  `first_name` varchar(45) NOT NULL DEFAULT '' COMMENT 'first name',\n" +
+		"  PRIMARY KEY (`actor_id`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin COMMENT='actor'"
+	bad := "CREATE TABLE `film_text` (\n" +
+		"  `film_id` varchar(32) NOT NULL,\n" +
+		"  `title` varchar(255) NOT NULL,\n" +
+		"  `description` text,\n" +
+		"  KEY `idx_title` (`title`)\n" +
+		") ENGINE=MyISAM DEFAULT CHARSET=latin1"
+
+	audit := auditTable("actor", good)
+	if len(audit.Suggest) != 0 || audit.Score != 100 {
+		t.Errorf("actor got: %d, %v", audit.Score, audit.Suggest)
+	}
+
+	audit = auditTable("film_text", bad)
+	for _, item := range []string{"CLA.011", "COL.005", "KEY.007", "TBL.002", "TBL.005"} {
+		if _, ok := audit.Suggest[item]; !ok {
+			t.Errorf("film_text want: %s, got: %v", item, audit.Suggest)
+		}
+	}
+	for item := range audit.Suggest {
+		if !isSchemaAuditRule(item) {
+			t.Errorf("film_text got unexpected rule: %s", item)
+		}
+	}
+	if audit.Score >= 100 || audit.Score != suggestScore(audit.Suggest) {
+		t.Errorf("film_text got score: %d", audit.Score)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestFormatSchemaAudit(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	tables := []TableAudit{
+		{Table: "actor", Score: 100, Suggest: map[string]Rule{}},
+		{Table: "film_text", Score: 70, Suggest: map[string]Rule{
+			"TBL.002": HeuristicRules["TBL.002"],
+			"KEY.002": HeuristicRules["KEY.002"],
+		}},
+	}
+	audits := []SchemaAudit{
+		{Database: "sakila", Score: schemaScore(tables), Tables: tables},
+		{Database: "empty", Score: schemaScore(nil), Errors: []string{"Error 1049: Unknown database 'empty'"}},
+	}
+	if audits[0].Score != 85 || audits[1].Score != 100 {
+		t.Errorf("schemaScore got: %d, %d", audits[0].Score, audits[1].Score)
+	}
+
+	err := common.GoldenDiff(func() {
+		fmt.Println(FormatSchemaAudit(audits))
+	}, t.Name(), update)
+	if err != nil {
+		t.Error(err)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestSchemaAuditChecker(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	audits := SchemaAuditChecker(rEnv, "sakila")
+	if len(audits) != 1 || len(audits[0].Errors) != 0 || len(audits[0].Tables) == 0 {
+		t.Errorf("got: %v", audits)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
@@ -0,0 +1,561 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/laojianzi/soar/ast"
+	"github.com/laojianzi/soar/common"
+	"github.com/laojianzi/soar/database"
+	"github.com/laojianzi/soar/env"
+
+	tidb "github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/format"
+)
+
+// intDisplayWidthRe MySQL 8.0.19 开始 SHOW CREATE TABLE 不再输出整型的显示宽度，对比时忽略
+var intDisplayWidthRe = regexp.MustCompile(`(?i)\b(tinyint|smallint|mediumint|int|integer|bigint)\(\d+\)`)
+
+// SchemaDiffDropComment 未开启 -schema-diff-allow-drop 时删除表及删除列的语句以该注释前缀输出，不会被执行
+const SchemaDiffDropComment = "-- "
+
+// schemaTable 表结构对比时使用的列、索引及表选项，外键及 CHECK 约束不参与对比
+// 列与 SHOW COLUMNS 的结果对应，索引与 SHOW INDEX 的结果对应，建表语句中的原始定义用于生成 ALTER 语句
+type schemaTable struct {
+	name       string
+	columns    []*common.Column
+	indexes    *database.TableIndexInfo
+	columnDefs map[string]string // 小写列名 -> 列定义
+	indexDefs  map[string]string // 小写索引名 -> 索引定义
+	options    map[string]string // ENGINE, CHARSET, COLLATE, COMMENT
+}
+
+// splitTableDefinitions 按最外层的逗号切分建表语句括号中的列及索引定义，同时返回括号后的表选项
+func splitTableDefinitions(ddl string) ([]string, string) {
+	var defs []string
+	var quote byte
+	depth, last := 0, -1
+	for i := 0; i < len(ddl); i++ {
+		b := ddl[i]
+		if quote != 0 {
+			switch {
+			case b == '\\' && quote != '`':
+				i++
+			case b == quote && i+1 < len(ddl) && ddl[i+1] == quote:
+				i++
+			case b == quote:
+				quote = 0
+			}
+			continue
+		}
+
+		switch b {
+		case '`', '\'', '"':
+			quote = b
+		case '(':
+			depth++
+			if last < 0 {
+				last = i + 1
+			}
+		case ')':
+			depth--
+			if depth == 0 && last >= 0 {
+				defs = append(defs, strings.TrimSpace(ddl[last:i]))
+				return defs, strings.TrimSpace(ddl[i+1:])
+			}
+		case ',':
+			if depth == 1 {
+				defs = append(defs, strings.TrimSpace(ddl[last:i]))
+				last = i + 1
+			}
+		}
+	}
+	return nil, ""
+}
+
+// isConstraintDefinition 定义是否为索引或约束，而不是列
+func isConstraintDefinition(def string) bool {
+	fields := strings.Fields(def)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "PRIMARY", "UNIQUE", "KEY", "INDEX", "FULLTEXT", "SPATIAL", "CONSTRAINT", "FOREIGN", "CHECK":
+		return true
+	}
+	return false
+}
+
+// restoreSchemaExpr 还原列默认值、生成列及函数索引中的表达式，用于对比
+func restoreSchemaExpr(node tidb.Node) string {
+	var sb strings.Builder
+	if err := node.Restore(format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)); err != nil {
+		common.Log.Warn("restoreSchemaExpr Restore Error: %s", err.Error())
+		return ""
+	}
+	return sb.String()
+}
+
+// schemaColumn 将建表语句中的列定义转换为与 SHOW COLUMNS 结果对应的 common.Column
+func schemaColumn(table string, col *tidb.ColumnDef, primary bool) *common.Column {
+	// MySQL 8.0.19 开始 SHOW COLUMNS 不再输出整型的显示宽度，对比时忽略
+	dataType := intDisplayWidthRe.ReplaceAllString(strings.ToLower(col.Tp.InfoSchemaStr()), "$1")
+	column := &common.Column{
+		Name:      col.Name.Name.O,
+		Table:     table,
+		DataType:  strings.Replace(dataType, "(-1)", "", -1),
+		Character: col.Tp.Charset,
+		Collation: col.Tp.Collate,
+		Null:      "YES",
+	}
+	if primary {
+		column.Null = "NO"
+	}
+
+	var extra []string
+	for _, opt := range col.Options {
+		switch opt.Tp {
+		case tidb.ColumnOptionNotNull, tidb.ColumnOptionPrimaryKey:
+			column.Null = "NO"
+		case tidb.ColumnOptionDefaultValue:
+			column.Default = restoreSchemaExpr(opt.Expr)
+		case tidb.ColumnOptionAutoIncrement:
+			extra = append(extra, "auto_increment")
+		case tidb.ColumnOptionOnUpdate:
+			extra = append(extra, "on update "+strings.ToLower(restoreSchemaExpr(opt.Expr)))
+		case tidb.ColumnOptionGenerated:
+			generated := "virtual generated "
+			if opt.Stored {
+				generated = "stored generated "
+			}
+			extra = append(extra, generated+strings.ToLower(restoreSchemaExpr(opt.Expr)))
+		case tidb.ColumnOptionComment:
+			column.Comment = restoreSchemaExpr(opt.Expr)
+		case tidb.ColumnOptionCollate:
+			column.Collation = opt.StrValue
+		}
+	}
+	column.Extra = strings.Join(extra, " ")
+	return column
+}
+
+// schemaIndexRows 将建表语句中的索引定义转换为与 SHOW INDEX 结果对应的 TableIndexRow
+func schemaIndexRows(table, name string, c *tidb.Constraint) []database.TableIndexRow {
+	nonUnique, indexType := 1, "BTREE"
+	switch c.Tp {
+	case tidb.ConstraintPrimaryKey, tidb.ConstraintUniq, tidb.ConstraintUniqKey, tidb.ConstraintUniqIndex:
+		nonUnique = 0
+	case tidb.ConstraintFulltext:
+		indexType = "FULLTEXT"
+	}
+	var visible string
+	if c.Option != nil {
+		if tp := c.Option.Tp.String(); tp != "" {
+			indexType = strings.ToUpper(tp)
+		}
+		if c.Option.Visibility == tidb.IndexVisibilityInvisible {
+			visible = "NO"
+		}
+	}
+
+	var rows []database.TableIndexRow
+	for i, key := range c.Keys {
+		row := database.TableIndexRow{
+			Table:      table,
+			NonUnique:  nonUnique,
+			KeyName:    name,
+			SeqInIndex: i + 1,
+			IndexType:  indexType,
+			Visible:    visible,
+		}
+		if key.Column != nil {
+			row.ColumnName = key.Column.Name.O
+			if key.Length > 0 {
+				row.SubPart = key.Length
+			}
+		} else if key.Expr != nil {
+			row.Expression = []byte(restoreSchemaExpr(key.Expr))
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// parseSchemaTable 解析建表语句，生成列及索引的模型，同时保留原始定义用于生成 ALTER 语句
+func parseSchemaTable(ddl string) (*schemaTable, error) {
+	stmts, err := ast.TiParse(ddl, "", "")
+	if err != nil {
+		return nil, err
+	}
+	var node *tidb.CreateTableStmt
+	for _, stmt := range stmts {
+		if n, ok := stmt.(*tidb.CreateTableStmt); ok {
+			node = n
+		}
+	}
+	if node == nil || node.ReferTable != nil || node.Select != nil {
+		return nil, fmt.Errorf("not a CREATE TABLE statement with column definitions")
+	}
+
+	defs, _ := splitTableDefinitions(ddl)
+	if len(defs) != len(node.Cols)+len(node.Constraints) {
+		return nil, fmt.Errorf("table `%s` definitions count mismatch, got %d, want %d",
+			node.Table.Name.O, len(defs), len(node.Cols)+len(node.Constraints))
+	}
+
+	// 主键中的列不能为 NULL
+	primary := make(map[string]bool)
+	for _, c := range node.Constraints {
+		if c.Tp != tidb.ConstraintPrimaryKey {
+			continue
+		}
+		for _, key := range c.Keys {
+			if key.Column != nil {
+				primary[key.Column.Name.L] = true
+			}
+		}
+	}
+
+	tb := &schemaTable{
+		name:       node.Table.Name.O,
+		indexes:    database.NewTableIndexInfo(node.Table.Name.O),
+		columnDefs: make(map[string]string),
+		indexDefs:  make(map[string]string),
+		options:    make(map[string]string),
+	}
+	var colIdx, keyIdx int
+	for _, def := range defs {
+		if !isConstraintDefinition(def) {
+			col := node.Cols[colIdx]
+			colIdx++
+			tb.columns = append(tb.columns, schemaColumn(tb.name, col, primary[col.Name.Name.L]))
+			tb.columnDefs[col.Name.Name.L] = def
+			continue
+		}
+
+		c := node.Constraints[keyIdx]
+		keyIdx++
+		name := c.Name
+		switch c.Tp {
+		case tidb.ConstraintForeignKey, tidb.ConstraintCheck:
+			continue
+		case tidb.ConstraintPrimaryKey:
+			name = "PRIMARY"
+		}
+		// 未指定索引名时 MySQL 使用第一列的列名
+		if name == "" && len(c.Keys) > 0 && c.Keys[0].Column != nil {
+			name = c.Keys[0].Column.Name.O
+		}
+		tb.indexes.Rows = append(tb.indexes.Rows, schemaIndexRows(tb.name, name, c)...)
+		tb.indexDefs[strings.ToLower(name)] = def
+	}
+
+	for _, opt := range node.Options {
+		switch opt.Tp {
+		case tidb.TableOptionEngine:
+			tb.options["ENGINE"] = opt.StrValue
+		case tidb.TableOptionCharset:
+			tb.options["CHARSET"] = opt.StrValue
+		case tidb.TableOptionCollate:
+			tb.options["COLLATE"] = opt.StrValue
+		case tidb.TableOptionComment:
+			tb.options["COMMENT"] = opt.StrValue
+		}
+	}
+	return tb, nil
+}
+
+// findSchemaColumn 按名称查找列，名称不区分大小写
+func findSchemaColumn(columns []*common.Column, name string) *common.Column {
+	for _, col := range columns {
+		if strings.EqualFold(col.Name, name) {
+			return col
+		}
+	}
+	return nil
+}
+
+// isSameColumn 除列名外两列的定义是否相同
+func isSameColumn(a, b *common.Column) bool {
+	return strings.EqualFold(a.DataType, b.DataType) &&
+		strings.EqualFold(a.Character, b.Character) &&
+		strings.EqualFold(a.Collation, b.Collation) &&
+		a.Null == b.Null &&
+		a.Default == b.Default &&
+		strings.EqualFold(a.Extra, b.Extra) &&
+		a.Comment == b.Comment
+}
+
+// isSameIndex 两个索引的列、唯一性、类型及可见性是否相同，renamed 为改名的列，旧列名(小写) -> 新列名
+func isSameIndex(from, to *database.TableIndexInfo, name string, renamed map[string]string) bool {
+	fromRows, toRows := from.FindIndex(database.IndexKeyName, name), to.FindIndex(database.IndexKeyName, name)
+	if len(fromRows) == 0 || len(toRows) == 0 || fromRows[0].NonUnique != toRows[0].NonUnique ||
+		fromRows[0].IndexType != toRows[0].IndexType || fromRows[0].Invisible() != toRows[0].Invisible() {
+		return false
+	}
+
+	fromParts, toParts := from.KeyParts(name), to.KeyParts(name)
+	if len(fromParts) != len(toParts) {
+		return false
+	}
+	for i, part := range fromParts {
+		if newName, ok := renamed[strings.ToLower(part.Column)]; ok {
+			part.Column = newName
+		}
+		if !strings.EqualFold(part.Column, toParts[i].Column) || part.SubPart != toParts[i].SubPart ||
+			part.Desc != toParts[i].Desc || !strings.EqualFold(part.Expression, toParts[i].Expression) {
+			return false
+		}
+	}
+	return true
+}
+
+// renamedColumns 识别改名的列，from 中删除的列与 to 中新增的列定义相同且一一对应时认为是改名，旧列名(小写) -> 新列名
+func renamedColumns(from, to *schemaTable) map[string]string {
+	var removed, added []*common.Column
+	for _, col := range from.columns {
+		if findSchemaColumn(to.columns, col.Name) == nil {
+			removed = append(removed, col)
+		}
+	}
+	for _, col := range to.columns {
+		if findSchemaColumn(from.columns, col.Name) == nil {
+			added = append(added, col)
+		}
+	}
+
+	// matches 统计每一列定义相同的候选列数量，只有唯一候选时才认为是改名
+	matches := func(col *common.Column, candidates []*common.Column) (*common.Column, int) {
+		var found *common.Column
+		var count int
+		for _, c := range candidates {
+			if isSameColumn(col, c) {
+				found = c
+				count++
+			}
+		}
+		return found, count
+	}
+
+	renamed := make(map[string]string)
+	for _, col := range removed {
+		newCol, count := matches(col, added)
+		if count != 1 {
+			continue
+		}
+		if _, back := matches(newCol, removed); back == 1 {
+			renamed[strings.ToLower(col.Name)] = newCol.Name
+		}
+	}
+	return renamed
+}
+
+// dropIndexSpec 删除索引的 ALTER 子句
+func dropIndexSpec(name string) string {
+	if name == "PRIMARY" {
+		return "DROP PRIMARY KEY"
+	}
+	return fmt.Sprintf("DROP INDEX `%s`", name)
+}
+
+// diffSchemaTable 对比两个版本的表结构，返回从 from 变更到 to 需要的 ALTER 子句及删除列的子句
+// 先删除索引，再修改、添加列，最后添加索引及修改表选项，删除列会丢失数据，单独返回由调用方决定是否执行
+func diffSchemaTable(from, to *schemaTable) ([]string, []string) {
+	var specs, addIndexes, dropColumns []string
+	renamed := renamedColumns(from, to)
+
+	// 删除或重建的索引
+	for _, name := range from.indexes.KeyNames() {
+		toRows := to.indexes.FindIndex(database.IndexKeyName, name)
+		if len(toRows) == 0 {
+			specs = append(specs, dropIndexSpec(name))
+			continue
+		}
+		if !isSameIndex(from.indexes, to.indexes, name, renamed) {
+			specs = append(specs, dropIndexSpec(name))
+			addIndexes = append(addIndexes, "ADD "+to.indexDefs[strings.ToLower(toRows[0].KeyName)])
+		}
+	}
+	for _, name := range to.indexes.KeyNames() {
+		if len(from.indexes.FindIndex(database.IndexKeyName, name)) == 0 {
+			addIndexes = append(addIndexes, "ADD "+to.indexDefs[strings.ToLower(name)])
+		}
+	}
+
+	// 删除的列，改名的列不删除
+	for _, col := range from.columns {
+		if _, ok := renamed[strings.ToLower(col.Name)]; !ok && findSchemaColumn(to.columns, col.Name) == nil {
+			dropColumns = append(dropColumns, fmt.Sprintf("DROP COLUMN `%s`", col.Name))
+		}
+	}
+
+	// 改名、修改及添加的列，添加的列按 to 中的顺序指定位置
+	newNames := make(map[string]string)
+	for oldName, newName := range renamed {
+		newNames[strings.ToLower(newName)] = oldName
+	}
+	for i, col := range to.columns {
+		def := to.columnDefs[strings.ToLower(col.Name)]
+		if oldName, ok := newNames[strings.ToLower(col.Name)]; ok {
+			specs = append(specs, fmt.Sprintf("CHANGE COLUMN `%s` %s", findSchemaColumn(from.columns, oldName).Name, def))
+			continue
+		}
+		fromCol := findSchemaColumn(from.columns, col.Name)
+		switch {
+		case fromCol == nil && i == 0:
+			specs = append(specs, fmt.Sprintf("ADD COLUMN %s FIRST", def))
+		case fromCol == nil:
+			specs = append(specs, fmt.Sprintf("ADD COLUMN %s AFTER `%s`", def, to.columns[i-1].Name))
+		case !isSameColumn(fromCol, col):
+			specs = append(specs, "MODIFY COLUMN "+def)
+		}
+	}
+	specs = append(specs, addIndexes...)
+
+	// 表选项，to 中未指定存储引擎及字符集时使用默认值，不做变更
+	if engine := to.options["ENGINE"]; engine != "" && !strings.EqualFold(engine, from.options["ENGINE"]) {
+		specs = append(specs, "ENGINE="+engine)
+	}
+	charset, collate := to.options["CHARSET"], to.options["COLLATE"]
+	if (charset != "" && !strings.EqualFold(charset, from.options["CHARSET"])) ||
+		(collate != "" && !strings.EqualFold(collate, from.options["COLLATE"])) {
+		if charset == "" {
+			charset = from.options["CHARSET"]
+		}
+		spec := "CONVERT TO CHARSET " + charset
+		if collate != "" {
+			spec += " COLLATE " + collate
+		}
+		specs = append(specs, spec)
+	}
+	if to.options["COMMENT"] != from.options["COMMENT"] {
+		specs = append(specs, fmt.Sprintf("COMMENT='%s'", strings.Replace(to.options["COMMENT"], "'", "''", -1)))
+	}
+	return specs, dropColumns
+}
+
+// mergeAlterSpecs 将同一张表的 ALTER 子句合并为一条 ALTER 语句，TiDB 无法解析的子句单独输出
+func mergeAlterSpecs(table string, specs []string) []string {
+	var alters, unparsed []string
+	for _, spec := range specs {
+		alter := fmt.Sprintf("ALTER TABLE `%s` %s", table, spec)
+		if _, err := ast.TiParse(alter, "", ""); err != nil {
+			common.Log.Warning("mergeAlterSpecs, TiParse Error: %s, SQL: %s", err.Error(), alter)
+			unparsed = append(unparsed, alter+common.Config.Delimiter)
+			continue
+		}
+		alters = append(alters, alter)
+	}
+
+	var stmts []string
+	for _, merged := range ast.MergeAlterTables(alters...) {
+		stmts = append(stmts, strings.TrimSpace(merged))
+	}
+	return append(stmts, unparsed...)
+}
+
+// SchemaDiff 对比两个库的表结构，返回将 from 变更为 to 需要依次执行的 SQL
+// 先创建新增的表，再按表合并 ALTER 语句，最后删除多余的表，视图不参与对比
+// 删除表及删除列会丢失数据，未开启 -schema-diff-allow-drop 时以 SchemaDiffDropComment 注释的形式放在最后
+func SchemaDiff(from, to *database.SchemaSnapshot) ([]string, error) {
+	fromTables := make(map[string]*database.TableSnapshot)
+	for _, tb := range from.Tables {
+		if !tb.View {
+			fromTables[strings.ToLower(tb.Name)] = tb
+		}
+	}
+
+	var creates, alters, drops []string
+	toTables := make(map[string]bool)
+	for _, tb := range to.Tables {
+		if tb.View {
+			continue
+		}
+		toTables[strings.ToLower(tb.Name)] = true
+		fromTable, ok := fromTables[strings.ToLower(tb.Name)]
+		if !ok {
+			creates = append(creates, strings.TrimSuffix(tb.DDL, common.Config.Delimiter)+common.Config.Delimiter)
+			continue
+		}
+
+		toSchema, err := parseSchemaTable(tb.DDL)
+		if err != nil {
+			return nil, fmt.Errorf("SchemaDiff `%s`.`%s`: %v", to.Database, tb.Name, err)
+		}
+		fromSchema, err := parseSchemaTable(fromTable.DDL)
+		if err != nil {
+			return nil, fmt.Errorf("SchemaDiff `%s`.`%s`: %v", from.Database, fromTable.Name, err)
+		}
+		specs, dropColumns := diffSchemaTable(fromSchema, toSchema)
+		if common.Config.SchemaDiffAllowDrop {
+			specs = append(dropColumns, specs...)
+		} else if len(dropColumns) > 0 {
+			drops = append(drops, fmt.Sprintf("%sALTER TABLE `%s` %s%s",
+				SchemaDiffDropComment, fromTable.Name, strings.Join(dropColumns, ", "), common.Config.Delimiter))
+		}
+		if len(specs) > 0 {
+			alters = append(alters, mergeAlterSpecs(fromTable.Name, specs)...)
+		}
+	}
+
+	for _, tb := range from.Tables {
+		if !tb.View && !toTables[strings.ToLower(tb.Name)] {
+			drop := fmt.Sprintf("DROP TABLE `%s`%s", tb.Name, common.Config.Delimiter)
+			if !common.Config.SchemaDiffAllowDrop {
+				drop = SchemaDiffDropComment + drop
+			}
+			drops = append(drops, drop)
+		}
+	}
+
+	return append(append(creates, alters...), drops...), nil
+}
+
+// SchemaDiffSuggest 对表结构变更语句执行 ALTER 相关的规则，from 为变更前的表结构，用于预估 Online DDL 的影响
+func SchemaDiffSuggest(from *database.SchemaSnapshot, sql string) map[string]Rule {
+	suggest := make(map[string]Rule)
+	q, err := NewQuery4Audit(sql)
+	if err != nil {
+		suggest["ERR.000"] = RuleMySQLError("ERR.000", err)
+		return suggest
+	}
+
+	for item, rule := range HeuristicRules {
+		if !(strings.HasPrefix(item, "ALT.") || item == "SEC.003") || IsIgnoreRule(item) {
+			continue
+		}
+		if r := rule.Func(q); r.Item == item {
+			suggest[item] = r
+		}
+	}
+
+	// ALT.005 依赖线上环境版本，表结构来自建表语句文件时无法判断
+	if IsIgnoreRule("ALT.005") || common.Config.OnlineDSN.Version == 0 {
+		return suggest
+	}
+	idxAdv := &IndexAdvisor{
+		vEnv: &env.VirtualEnv{Snapshot: from},
+		rEnv: database.Connector{Database: from.Database},
+	}
+	if r := idxAdv.RuleOnlineDDL(*q); r.Item == "ALT.005" {
+		suggest[r.Item] = r
+	}
+	return suggest
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/laojianzi/soar/ast"
+	"github.com/laojianzi/soar/common"
+	"github.com/laojianzi/soar/database"
+)
+
+var schemaDiffFrom = &database.SchemaSnapshot{
+	Database: "sakila",
+	Version:  80023,
+	Tables: []*database.TableSnapshot{
+		{
+			Name: "film",
+			DDL: "CREATE TABLE `film` (\n" +
+				"  `film_id` smallint(5) unsigned NOT NULL AUTO_INCREMENT,\n" +
+				"  `title` varchar(128) NOT NULL,\n" +
+				"  `description` text,\n" +
+				"  `rating` enum('G','PG','R') DEFAULT 'G',\n" +
+				"  PRIMARY KEY (`film_id`),\n" +
+				"  KEY `idx_title` (`title`),\n" +
+				"  KEY `idx_rating` (`rating`)\n" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+			DataLength:  196608,
+			IndexLength: 81920,
+		},
+		{
+			Name: "actor",
+			DDL: "CREATE TABLE `actor` (\n" +
+				"  `actor_id` smallint unsigned NOT NULL AUTO_INCREMENT,\n" +
+				"  `first_name` varchar(45) NOT NULL COMMENT 'first, name',\n" +
+				"  PRIMARY KEY (`actor_id`)\n" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+		},
+		{
+			Name: "old_log",
+			DDL:  "CREATE TABLE `old_log` (\n  `id` int NOT NULL\n) ENGINE=MyISAM",
+		},
+		{
+			Name: "actor_info",
+			View: true,
+			DDL:  "CREATE VIEW `actor_info` AS select 1",
+		},
+	},
+}
+
+var schemaDiffTo = &database.SchemaSnapshot{
+	Tables: []*database.TableSnapshot{
+		{
+			Name: "actor",
+			DDL: "CREATE TABLE actor (\n" +
+				"  actor_id SMALLINT(5) UNSIGNED NOT NULL AUTO_INCREMENT,\n" +
+				"  first_name VARCHAR(45) NOT NULL COMMENT 'first, name',\n" +
+				"  PRIMARY KEY (actor_id)\n" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+		},
+		{
+			Name: "film",
+			DDL: "CREATE TABLE `film` (\n" +
+				"  `id` int unsigned NOT NULL AUTO_INCREMENT,\n" +
+				"  `film_id` smallint unsigned NOT NULL,\n" +
+				"  `title` varchar(255) NOT NULL,\n" +
+				"  `rating` enum('G','PG','R') DEFAULT 'G',\n" +
+				"  `release_year` year DEFAULT NULL,\n" +
+				"  PRIMARY KEY (`id`),\n" +
+				"  KEY `idx_title` (`title`, `release_year`),\n" +
+				"  KEY (`rating`),\n" +
+				"  CONSTRAINT `fk_film` FOREIGN KEY (`film_id`) REFERENCES `film_text` (`film_id`)\n" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin COMMENT='film''s'",
+		},
+		{
+			Name: "film_text",
+			DDL:  "CREATE TABLE `film_text` (\n  `film_id` smallint NOT NULL,\n  PRIMARY KEY (`film_id`)\n)",
+		},
+	},
+}
+
+func TestSplitTableDefinitions(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	ddl := "CREATE TABLE `t(1)` (`a` decimal(10,2) DEFAULT '1,)', `b` int COMMENT 'it''s, ok', KEY `idx_ab` (`a`,`b`)) ENGINE=InnoDB"
+	defs, options := splitTableDefinitions(ddl)
+	want := []string{"`a` decimal(10,2) DEFAULT '1,)'", "`b` int COMMENT 'it''s, ok'", "KEY `idx_ab` (`a`,`b`)"}
+	if fmt.Sprint(defs) != fmt.Sprint(want) {
+		t.Errorf("want: %v, got: %v", want, defs)
+	}
+	if options != "ENGINE=InnoDB" {
+		t.Errorf("options want: ENGINE=InnoDB, got: %s", options)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestSchemaDiff(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	sqls, err := SchemaDiff(schemaDiffFrom, schemaDiffTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sql := range sqls {
+		if _, err := ast.TiParse(sql, "", ""); err != nil {
+			t.Error(sql, err)
+		}
+	}
+
+	// 表结构一致时不需要变更
+	same, err := SchemaDiff(schemaDiffFrom, schemaDiffFrom)
+	if err != nil || len(same) != 0 {
+		t.Errorf("same schema got: %v, %v", same, err)
+	}
+
+	// 开启 -schema-diff-allow-drop 后才生成可执行的删除语句
+	orgAllowDrop := common.Config.SchemaDiffAllowDrop
+	common.Config.SchemaDiffAllowDrop = true
+	allowDrop, err := SchemaDiff(schemaDiffFrom, schemaDiffTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sql := range allowDrop {
+		if _, err := ast.TiParse(sql, "", ""); err != nil {
+			t.Error(sql, err)
+		}
+	}
+	common.Config.SchemaDiffAllowDrop = orgAllowDrop
+
+	err = common.GoldenDiff(func() {
+		for _, sql := range sqls {
+			fmt.Println(sql)
+		}
+		for _, sql := range allowDrop {
+			fmt.Println(sql)
+		}
+	}, t.Name(), update)
+	if err != nil {
+		t.Error(err)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestSchemaDiffRename(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	from := &database.SchemaSnapshot{Tables: []*database.TableSnapshot{{
+		Name: "actor",
+		DDL: "CREATE TABLE `actor` (\n" +
+			"  `actor_id` int NOT NULL,\n" +
+			"  `first_name` varchar(45) NOT NULL,\n" +
+			"  `last_name` varchar(45) NOT NULL,\n" +
+			"  `nick` varchar(32) DEFAULT NULL,\n" +
+			"  PRIMARY KEY (`actor_id`),\n" +
+			"  KEY `idx_nick` (`nick`)\n" +
+			")",
+	}}}
+	to := &database.SchemaSnapshot{Tables: []*database.TableSnapshot{{
+		Name: "actor",
+		DDL: "CREATE TABLE `actor` (\n" +
+			"  `actor_id` int(11) NOT NULL,\n" +
+			"  `given_name` varchar(45) NOT NULL,\n" +
+			"  `family_name` varchar(45) NOT NULL,\n" +
+			"  `nickname` varchar(32) DEFAULT NULL,\n" +
+			"  PRIMARY KEY (`actor_id`),\n" +
+			"  KEY `idx_nick` (`nickname`)\n" +
+			")",
+	}}}
+
+	// first_name, last_name 定义相同无法确定对应关系，nick 改名为 nickname，索引随列改名不需要重建
+	sqls, err := SchemaDiff(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ALTER TABLE `actor` ADD COLUMN `given_name` varchar(45) NOT NULL AFTER `actor_id`, ADD COLUMN `family_name` varchar(45) NOT NULL AFTER `given_name`, CHANGE COLUMN `nick` `nickname` varchar(32) DEFAULT NULL ;",
+		"-- ALTER TABLE `actor` DROP COLUMN `first_name`, DROP COLUMN `last_name`;",
+	}
+	if fmt.Sprint(sqls) != fmt.Sprint(want) {
+		t.Errorf("want: %v\ngot: %v", want, sqls)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestSchemaDiffSuggest(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	orgVersion := common.Config.OnlineDSN.Version
+	common.Config.OnlineDSN.Version = schemaDiffFrom.Version
+
+	cases := map[string][]string{
+		"ALTER TABLE `film` DROP INDEX `idx_rating`, DROP COLUMN `description` ;": {"ALT.003", "ALT.004", "ALT.005"},
+		"ALTER TABLE `film` CONVERT TO CHARSET utf8mb4 ;":                         {"ALT.005"},
+		"DROP TABLE `old_log`;": {"SEC.003"},
+	}
+	for sql, items := range cases {
+		suggest := SchemaDiffSuggest(schemaDiffFrom, sql)
+		if len(suggest) != len(items) {
+			t.Errorf("SQL: %s, want: %v, got: %v", sql, items, suggest)
+			continue
+		}
+		for _, item := range items {
+			if _, ok := suggest[item]; !ok {
+				t.Errorf("SQL: %s, want: %s, got: %v", sql, item, suggest)
+			}
+		}
+	}
+
+	common.Config.OnlineDSN.Version = orgVersion
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
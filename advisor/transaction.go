@@ -0,0 +1,284 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/laojianzi/soar/ast"
+	"github.com/laojianzi/soar/common"
+	"github.com/laojianzi/soar/database"
+
+	tidb "github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/opcode"
+	driver "github.com/pingcap/tidb/types/parser_driver"
+)
+
+// TrxAnalyzer 多条 SQL 组成的脚本中的事务分析，需要按 SQL 在脚本中的顺序逐条调用 Check
+// 事务的开始和结束依赖上下文，所以与 ALT.002 一样不能在单条 SQL 的启发式规则中检查
+type TrxAnalyzer struct {
+	autocommit bool       // 会话的 autocommit 设置，关闭时每条 DML 都处于事务中
+	inTrx      bool       // 是否处于 BEGIN, START TRANSACTION 开启的事务中
+	statements int        // 当前事务中已执行的 DML 数量
+	locks      []string   // 当前事务按加锁顺序记录的表
+	history    [][]string // 已结束的事务的加锁顺序
+
+	lockingRead bool // 上一条 SQL 是否为事务中的加锁读，用于结合 EXPLAIN 结果检查
+	batchWrite  bool // 上一条 SQL 是否为事务中的 UPDATE, DELETE，用于结合 EXPLAIN 结果检查
+}
+
+// NewTrxAnalyzer 创建事务分析器，会话默认开启 autocommit
+func NewTrxAnalyzer() *TrxAnalyzer {
+	return &TrxAnalyzer{autocommit: true}
+}
+
+// active 当前 SQL 是否处于事务中
+func (t *TrxAnalyzer) active() bool {
+	return t.inTrx || !t.autocommit
+}
+
+// end 结束当前事务，记录事务的加锁顺序用于检查之后的事务
+func (t *TrxAnalyzer) end() {
+	if len(t.locks) > 1 {
+		t.history = append(t.history, t.locks)
+	}
+	t.inTrx = false
+	t.statements = 0
+	t.locks = nil
+}
+
+// lock 记录当前事务中新加锁的表，与之前事务的加锁顺序相反时返回冲突的表
+func (t *TrxAnalyzer) lock(tables []string) (string, string) {
+	var first, second string
+	for _, tb := range tables {
+		if inTables(tb, t.locks) {
+			continue
+		}
+		for _, locked := range t.locks {
+			if first == "" && lockedBefore(t.history, tb, locked) {
+				first, second = locked, tb
+			}
+		}
+		t.locks = append(t.locks, tb)
+	}
+	return first, second
+}
+
+// lockedBefore 之前的事务中是否存在先锁 a 后锁 b 的情况
+func lockedBefore(history [][]string, a, b string) bool {
+	for _, locks := range history {
+		for i, tb := range locks {
+			// 同一事务中 a 之后没有锁 b 时继续检查之前的其他事务
+			if tb == a && inTables(b, locks[i+1:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check 分析单条 SQL 对事务状态的影响，返回需要在该 SQL 上给出的事务相关建议
+func (t *TrxAnalyzer) Check(sql string) map[string]Rule {
+	suggest := make(map[string]Rule)
+	t.lockingRead, t.batchWrite = false, false
+	stmts, err := ast.TiParse(sql, "", "")
+	if err != nil || len(stmts) == 0 {
+		return suggest
+	}
+
+	switch node := stmts[0].(type) {
+	case *tidb.BeginStmt:
+		// 在事务中执行 BEGIN 会先隐式提交当前事务
+		t.end()
+		t.inTrx = true
+	case *tidb.CommitStmt, *tidb.RollbackStmt:
+		t.end()
+	case *tidb.SetStmt:
+		for _, v := range node.Variables {
+			if !strings.EqualFold(v.Name, "autocommit") {
+				continue
+			}
+			on := isAutocommitOn(v.Value)
+			// 关闭状态下重新开启 autocommit 会提交当前事务
+			if on && !t.autocommit {
+				t.end()
+			}
+			t.autocommit = on
+		}
+	case tidb.DDLNode:
+		// DDL, LOCK TABLES 等语句会隐式提交当前事务
+		if t.active() && t.statements > 0 {
+			rule := HeuristicRules["TRX.001"]
+			rule.Content += fmt.Sprintf("该语句执行前事务中已有%d条语句未提交。", t.statements)
+			suggest[rule.Item] = rule
+		}
+		t.end()
+	case *tidb.SelectStmt:
+		// 普通的 SELECT 为一致性读，不加锁
+		if node.LockInfo == nil || node.LockInfo.LockType == tidb.SelectLockNone || !t.active() {
+			break
+		}
+		t.lockingRead = true
+		if node.Where == nil {
+			rule := HeuristicRules["TRX.003"]
+			rule.Content += "该语句未指定 WHERE 条件，会锁住全表。"
+			suggest[rule.Item] = rule
+		} else if !hasEqualFilter(node.Where) {
+			suggest["TRX.003"] = HeuristicRules["TRX.003"]
+		}
+		t.checkLockOrder(node, suggest)
+	case *tidb.UpdateStmt, *tidb.DeleteStmt, *tidb.InsertStmt:
+		if !t.active() {
+			break
+		}
+		var where tidb.ExprNode
+		var limit *tidb.Limit
+		switch n := node.(type) {
+		case *tidb.UpdateStmt:
+			where, limit = n.Where, n.Limit
+			t.batchWrite = true
+		case *tidb.DeleteStmt:
+			where, limit = n.Where, n.Limit
+			t.batchWrite = true
+		}
+		if t.batchWrite && limit == nil && (where == nil || !hasEqualFilter(where)) {
+			suggest["TRX.004"] = HeuristicRules["TRX.004"]
+		}
+		t.checkLockOrder(stmts[0], suggest)
+	}
+	return suggest
+}
+
+// checkLockOrder 记录语句中加锁的表，与之前事务的加锁顺序相反时给出 TRX.002
+func (t *TrxAnalyzer) checkLockOrder(node tidb.Node, suggest map[string]Rule) {
+	t.statements++
+	v := &trxTableFinder{}
+	node.Accept(v)
+	if first, second := t.lock(v.tables); first != "" {
+		rule := HeuristicRules["TRX.002"]
+		rule.Content += fmt.Sprintf("当前事务先锁定 `%s` 后锁定 `%s`，与之前事务的加锁顺序相反。", first, second)
+		suggest[rule.Item] = rule
+	}
+}
+
+// CheckExplain 结合上一条 SQL 的 EXPLAIN 结果检查事务中的加锁读及批量更新
+func (t *TrxAnalyzer) CheckExplain(exp *database.ExplainInfo) map[string]Rule {
+	suggest := make(map[string]Rule)
+	if exp == nil || (!t.lockingRead && !t.batchWrite) {
+		return suggest
+	}
+
+	rows := exp.ExplainRows
+	if exp.ExplainFormat == database.JSONFormatExplain {
+		// JSON形式遍历分析不方便，转成Row格式统一处理
+		rows = database.ConvertExplainJSON2Row(exp.ExplainJSON)
+	}
+	for _, row := range rows {
+		if t.lockingRead && (row.AccessType == "ALL" || row.AccessType == "index") {
+			rule := HeuristicRules["TRX.003"]
+			rule.Content += fmt.Sprintf("EXPLAIN 显示表 `%s` 的访问类型为 %s，会对扫描到的所有记录加锁。", row.TableName, row.AccessType)
+			suggest[rule.Item] = rule
+		}
+		if t.batchWrite && common.Config.ExplainMaxRows > 0 && row.Rows >= common.Config.ExplainMaxRows {
+			rule := HeuristicRules["TRX.004"]
+			rule.Content += fmt.Sprintf("EXPLAIN 预估表 `%s` 扫描%d行。", row.TableName, row.Rows)
+			suggest[rule.Item] = rule
+		}
+	}
+	return suggest
+}
+
+// isAutocommitOn SET autocommit 的值是否为开启
+func isAutocommitOn(expr tidb.ExprNode) bool {
+	var value string
+	switch node := expr.(type) {
+	case *driver.ValueExpr:
+		value = fmt.Sprint(node.GetValue())
+	case *tidb.ColumnNameExpr:
+		value = node.Name.Name.O
+	default:
+		return true
+	}
+	switch strings.ToLower(value) {
+	case "0", "off", "false":
+		return false
+	}
+	return true
+}
+
+// hasEqualFilter WHERE 条件中是否包含 AND 连接的列等值条件，只有等值条件能够将锁限制在少量记录上
+func hasEqualFilter(expr tidb.ExprNode) bool {
+	switch node := expr.(type) {
+	case *tidb.ParenthesesExpr:
+		return hasEqualFilter(node.Expr)
+	case *tidb.BinaryOperationExpr:
+		switch node.Op {
+		case opcode.LogicAnd:
+			return hasEqualFilter(node.L) || hasEqualFilter(node.R)
+		case opcode.EQ, opcode.NullEQ:
+			_, lCol := node.L.(*tidb.ColumnNameExpr)
+			_, rCol := node.R.(*tidb.ColumnNameExpr)
+			return (lCol && isConstExpr(node.R)) || (rCol && isConstExpr(node.L))
+		}
+	case *tidb.PatternInExpr:
+		if _, ok := node.Expr.(*tidb.ColumnNameExpr); !ok || node.Not || node.Sel != nil {
+			return false
+		}
+		for _, item := range node.List {
+			if !isConstExpr(item) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// trxTableFinder 按出现顺序获取语句中的表
+type trxTableFinder struct {
+	tables []string
+}
+
+// Enter implements ast.Visitor interface
+func (v *trxTableFinder) Enter(in tidb.Node) (tidb.Node, bool) {
+	if node, ok := in.(*tidb.TableName); ok {
+		tb := node.Name.L
+		if node.Schema.L != "" {
+			tb = node.Schema.L + "." + tb
+		}
+		if !inTables(tb, v.tables) {
+			v.tables = append(v.tables, tb)
+		}
+	}
+	return in, false
+}
+
+// Leave implements ast.Visitor interface
+func (v *trxTableFinder) Leave(in tidb.Node) (tidb.Node, bool) {
+	return in, true
+}
+
+// inTables 表是否在列表中
+func inTables(tb string, tables []string) bool {
+	for _, t := range tables {
+		if t == tb {
+			return true
+		}
+	}
+	return false
+}
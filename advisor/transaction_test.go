@@ -0,0 +1,148 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/laojianzi/soar/ast"
+	"github.com/laojianzi/soar/common"
+	"github.com/laojianzi/soar/database"
+)
+
+// trxCheckScript 按 SQL 在脚本中的顺序执行事务分析，返回每条 SQL 上的建议
+func trxCheckScript(script string) [][]string {
+	trx := NewTrxAnalyzer()
+	var result [][]string
+	buf := script
+	for buf != "" {
+		_, sql, left := ast.SplitStatement([]byte(buf), []byte(";"))
+		if len(left) == len(buf) {
+			break
+		}
+		buf = string(left)
+		sql = database.RemoveSQLComments(sql)
+		if sql == "" {
+			continue
+		}
+
+		var items []string
+		for item := range trx.Check(sql) {
+			items = append(items, item)
+		}
+		sort.Strings(items)
+		result = append(result, items)
+	}
+	return result
+}
+
+func TestTrxAnalyzerCheck(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	cases := []struct {
+		script string
+		want   [][]string
+	}{
+		{
+			// 事务中的 DDL 隐式提交
+			script: "BEGIN; UPDATE tbl SET c = 1 WHERE id = 1; ALTER TABLE tbl ADD COLUMN d INT; COMMIT;",
+			want:   [][]string{nil, nil, {"TRX.001"}, nil},
+		},
+		{
+			// 事务外的 DDL 及 autocommit 模式下的单条 DML 不检查
+			script: "ALTER TABLE tbl ADD COLUMN d INT; UPDATE tbl SET c = 1; TRUNCATE TABLE tbl;",
+			want:   [][]string{nil, nil, nil},
+		},
+		{
+			// 关闭 autocommit 后 DML 处于事务中
+			script: "SET autocommit = 0; DELETE FROM tbl WHERE c > 1; LOCK TABLES tbl WRITE;",
+			want:   [][]string{nil, {"TRX.004"}, {"TRX.001"}},
+		},
+		{
+			// 开启 autocommit 会提交当前事务
+			script: "SET autocommit = OFF; UPDATE tbl SET c = 1 WHERE id = 1; SET autocommit = 1; DROP TABLE tbl;",
+			want:   [][]string{nil, nil, nil, nil},
+		},
+		{
+			// 事务间加锁顺序相反
+			script: `START TRANSACTION; UPDATE a SET c = 1 WHERE id = 1; UPDATE b SET c = 1 WHERE id = 1; COMMIT;
+BEGIN; SELECT * FROM b WHERE id = 1 FOR UPDATE; INSERT INTO a (id) VALUES (1); COMMIT;`,
+			want: [][]string{nil, nil, nil, nil, nil, nil, {"TRX.002"}, nil},
+		},
+		{
+			// 第一个事务中锁了 a 但没有锁 b，需要继续检查之后的事务
+			script: `BEGIN; UPDATE a SET c = 1 WHERE id = 1; UPDATE c SET c = 1 WHERE id = 1; COMMIT;
+BEGIN; UPDATE a SET c = 1 WHERE id = 1; UPDATE b SET c = 1 WHERE id = 1; COMMIT;
+BEGIN; UPDATE b SET c = 1 WHERE id = 1; UPDATE a SET c = 1 WHERE id = 1; COMMIT;`,
+			want: [][]string{nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, {"TRX.002"}, nil},
+		},
+		{
+			// 加锁顺序相同
+			script: `BEGIN; UPDATE a SET c = 1 WHERE id = 1; UPDATE b SET c = 1 WHERE id = 1; COMMIT;
+BEGIN; UPDATE a SET c = 2 WHERE id = 2; UPDATE b SET c = 2 WHERE id = 2; COMMIT;`,
+			want: [][]string{nil, nil, nil, nil, nil, nil, nil, nil},
+		},
+		{
+			// 加锁读及批量更新
+			script: `BEGIN;
+SELECT * FROM tbl FOR UPDATE;
+SELECT * FROM tbl WHERE c > 1 LOCK IN SHARE MODE;
+SELECT * FROM tbl WHERE id IN (1, 2) AND c > 1 FOR UPDATE;
+SELECT * FROM tbl WHERE c > 1;
+UPDATE tbl SET c = 1 WHERE c > 1 OR id = 1;
+UPDATE tbl SET c = 1 WHERE c > 1 LIMIT 100;
+DELETE FROM tbl WHERE id = ?;
+COMMIT;`,
+			want: [][]string{nil, {"TRX.003"}, {"TRX.003"}, nil, nil, {"TRX.004"}, nil, nil, nil},
+		},
+	}
+	for _, c := range cases {
+		got := trxCheckScript(c.script)
+		if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("SQL: %s\nwant: %v\ngot: %v", c.script, c.want, got)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestTrxAnalyzerCheckExplain(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	exp := &database.ExplainInfo{
+		ExplainRows: []database.ExplainRow{
+			{TableName: "tbl", AccessType: "ALL", Rows: common.Config.ExplainMaxRows},
+		},
+	}
+
+	trx := NewTrxAnalyzer()
+	// 事务外的 SQL 不检查
+	trx.Check("UPDATE tbl SET c = 1 WHERE id = 1")
+	if suggest := trx.CheckExplain(exp); len(suggest) != 0 {
+		t.Errorf("want no suggest, got: %v", suggest)
+	}
+
+	trx.Check("BEGIN")
+	trx.Check("SELECT * FROM tbl WHERE id = 1 FOR UPDATE")
+	if _, ok := trx.CheckExplain(exp)["TRX.003"]; !ok {
+		t.Error("want TRX.003")
+	}
+	trx.Check("UPDATE tbl SET c = 1 WHERE id = 1")
+	if _, ok := trx.CheckExplain(exp)["TRX.004"]; !ok {
+		t.Error("want TRX.004")
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
@@ -22,6 +22,8 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/kr/pretty"
@@ -38,6 +40,7 @@ type Rule struct {
 	Original    string                  `json:"Original"` // 错误示范。为空或"暂不支持"不会出现在list-rewrite-rules中
 	Suggest     string                  `json:"Suggest"`  // 正确示范。
 	Func        func(*Rewrite) *Rewrite `json:"-"`        // 如果不定义 Func 需要多条 SQL 联动改写
+	TiFunc      func(*Rewrite) *Rewrite `json:"-"`        // vitess 无法解析时在 TiDB 语法树上改写，未定义时跳过
 }
 
 // RewriteRules SQL重写规则，注意这个规则是有序的，先后顺序不能乱
@@ -65,6 +68,7 @@ func init() {
 			Original:    "SELECT * FROM film",
 			Suggest:     "select film.film_id, film.title from film",
 			Func:        (*Rewrite).RewriteStar2Columns,
+			TiFunc:      (*Rewrite).RewriteTiStar2Columns,
 		},
 		{
 			Name:        "insertcolumns",
@@ -103,25 +107,40 @@ func init() {
 		},
 		{
 			Name:        "innull",
-			Description: "如果 IN 条件中可能有 NULL 值而又想匹配 NULL 值时，建议添加OR col IS NULL",
-			Original:    "暂不支持",
-			Suggest:     "暂不支持",
+			Description: "WHERE, ON 条件中 IN 列表里的 NULL 不会匹配任何行，将其删除；NOT IN 列表中包含 NULL 时条件永远不为真，转写为 false。想匹配 NULL 值时需要添加 OR col IS NULL，建议见 ARG.004",
+			Original:    "SELECT * FROM film WHERE original_language_id IN (1, NULL) AND film_id NOT IN (2, NULL)",
+			Suggest:     "select * from film where original_language_id in (1) and false",
 			Func:        (*Rewrite).RewriteInNull,
 		},
+		{
+			Name:        "notin2notexists",
+			Description: "NOT IN 子查询返回 NULL 时结果为空，子查询的列允许为 NULL 时转写为 NOT EXISTS，依赖测试环境中的表结构",
+			Original:    "SELECT name FROM language WHERE language_id NOT IN (SELECT original_language_id FROM film)",
+			Suggest:     "select name from `language` where not exists (select 1 from film where film.original_language_id = `language`.language_id)",
+			Func:        (*Rewrite).RewriteNotIn2NotExists,
+		},
 		// 把所有跟 or 相关的重写完之后才进行 or 转 union 的重写
 		{
 			Name:        "or2union",
-			Description: "将不同列的 OR 查询转为 UNION 查询，建议结合 unionall 重写策略一起使用",
-			Original:    "暂不支持",
-			Suggest:     "暂不支持",
+			Description: "将不同索引列的 OR 查询转为 UNION ALL 查询，依赖测试环境中的索引信息",
+			Original:    "SELECT * FROM film WHERE film_id = 1 OR title = 'ACE GOLDFINGER'",
+			Suggest:     "select * from film where film_id = 1 union all select * from film where title = 'ACE GOLDFINGER' and (film_id = 1) is not true",
 			Func:        (*Rewrite).RewriteOr2Union,
 		},
+		{
+			Name:        "keyset",
+			Description: "将 LIMIT OFFSET 深分页转写为基于书签的分页，ORDER BY 的列不唯一时使用延迟关联，依赖测试环境中的主键及唯一索引信息",
+			Original:    "SELECT * FROM film ORDER BY title LIMIT 10000, 10",
+			Suggest:     "select film.* from film join (select film_id from film order by title asc limit 10000, 10) as keyset using (film_id) order by title asc",
+			Func:        (*Rewrite).RewriteKeyset,
+		},
 		{
 			Name:        "dmlorderby",
 			Description: "删除 DML 更新操作中无意义的 ORDER BY",
 			Original:    "DELETE FROM tbl WHERE col1=1 ORDER BY col",
 			Suggest:     "delete from tbl where col1 = 1",
 			Func:        (*Rewrite).RewriteRemoveDMLOrderBy,
+			TiFunc:      (*Rewrite).RewriteTiRemoveDMLOrderBy,
 		},
 		/*
 			{
@@ -159,6 +178,7 @@ func init() {
 			Original:    "SELECT sum(col1) FROM tbl GROUP BY 1;",
 			Suggest:     "select sum(col1) from tbl group by 1",
 			Func:        (*Rewrite).RewriteStandard,
+			TiFunc:      (*Rewrite).RewriteTiStandard,
 		},
 		{
 			Name:        "mergealter",
@@ -179,6 +199,7 @@ func init() {
 			Original:    "SELECT count(col) FROM tbl GROUP BY 1;",
 			Suggest:     "SELECT count(*) FROM tbl GROUP BY 1;",
 			Func:        (*Rewrite).RewriteCountStar,
+			TiFunc:      (*Rewrite).RewriteTiCountStar,
 		},
 		{
 			Name:        "innodb",
@@ -222,6 +243,7 @@ func init() {
 			Original:    "use sakila",
 			Suggest:     "use sakila;",
 			Func:        (*Rewrite).RewriteDelimiter,
+			TiFunc:      (*Rewrite).RewriteDelimiter,
 		},
 		// TODO in to exists
 		// TODO exists to in
@@ -258,15 +280,35 @@ type Rewrite struct {
 	SQL     string
 	NewSQL  string
 	Stmt    sqlparser.Statement
+	TiStmt  ast.StmtNode // vitess 无法解析时使用 TiDB 的语法树，此时 Stmt 为 nil
 	Columns common.TableColumns
+	// UniqueKeys 表名（小写）对应的主键及唯一索引，每个索引按顺序记录其包含的列
+	UniqueKeys map[string][][]string
+	Steps      []RewriteStep // 按执行顺序记录改变了 SQL 的重写规则
+}
+
+// RewriteStep 一条重写规则生效后的中间结果
+type RewriteStep struct {
+	Rule        string `json:"Rule"`
+	Description string `json:"Description"`
+	SQL         string `json:"SQL"` // 该规则执行后的 SQL
 }
 
 // NewRewrite 返回一个*Rewrite对象，如果SQL无法被正常解析，将错误输出到日志中，返回一个nil
+// vitess 不支持 WITH, 窗口函数等语法，这类语句使用 TiDB 解析，只执行定义了 TiFunc 的规则
 func NewRewrite(sql string) *Rewrite {
 	stmt, err := sqlparser.Parse(sql)
 	if err != nil {
-		common.Log.Error(err.Error(), sql)
-		return nil
+		tiStmts, tiErr := TiParse(sql, "", "")
+		if tiErr != nil || len(tiStmts) != 1 {
+			common.Log.Error(err.Error(), sql)
+			return nil
+		}
+		common.Log.Debug("NewRewrite vitess parse error: %s, rewrite with TiDB parser", err.Error())
+		return &Rewrite{
+			SQL:    sql,
+			TiStmt: tiStmts[0],
+		}
 	}
 
 	return &Rewrite{
@@ -285,16 +327,41 @@ func (rw *Rewrite) Rewrite() *Rewrite {
 		}
 	}()
 
+	rw.Steps = nil
+	last := normalizeRewriteSQL(rw.SQL)
+	// 多数规则转写回 SQL 时会丢掉原 SQL 结尾的 DELIMITER，不算规则的改写
+	delimited := strings.HasSuffix(strings.TrimSpace(rw.SQL), common.Config.Delimiter)
 	for _, rule := range RewriteRules {
-		if RewriteRuleMatch(rule.Name) && rule.Func != nil {
+		if !RewriteRuleMatch(rule.Name) {
+			continue
+		}
+		switch {
+		case rw.Stmt != nil && rule.Func != nil:
 			rule.Func(rw)
-			common.Log.Debug("Rewrite Rule:%s Output NewSQL: %s", rule.Name, rw.NewSQL)
+		case rw.Stmt == nil && rw.TiStmt != nil && rule.TiFunc != nil:
+			rule.TiFunc(rw)
+		default:
+			continue
+		}
+		common.Log.Debug("Rewrite Rule:%s Output NewSQL: %s", rule.Name, rw.NewSQL)
+
+		// 只转写回 SQL 导致的格式变化不算规则生效
+		if rw.NewSQL == "" {
+			continue
+		}
+		current := normalizeRewriteSQL(rw.NewSQL)
+		added := !delimited && strings.HasSuffix(strings.TrimSpace(rw.NewSQL), common.Config.Delimiter)
+		if current != last || added {
+			rw.Steps = append(rw.Steps, RewriteStep{Rule: rule.Name, Description: rule.Description, SQL: rw.NewSQL})
+			last, delimited = current, delimited || added
 		}
 	}
 	if rw.NewSQL == "" {
 		rw.NewSQL = rw.SQL
 	}
-	rw.Stmt, _ = sqlparser.Parse(rw.NewSQL)
+	if rw.TiStmt == nil {
+		rw.Stmt, _ = sqlparser.Parse(rw.NewSQL)
+	}
 
 	// TODO: 重新前后返回结果一致性对比
 
@@ -302,6 +369,86 @@ func (rw *Rewrite) Rewrite() *Rewrite {
 	return rw
 }
 
+// normalizeRewriteSQL 去掉结尾的 DELIMITER 并将 SQL 转写为统一的格式，用于判断重写规则是否改变了 SQL
+func normalizeRewriteSQL(sql string) string {
+	sql = strings.TrimSuffix(strings.TrimSpace(sql), common.Config.Delimiter)
+	if stmt, err := sqlparser.Parse(sql); err == nil {
+		return sqlparser.String(stmt)
+	}
+	if stmts, err := TiParse(sql, "", ""); err == nil && len(stmts) == 1 {
+		if restored := tiRestore(stmts[0]); restored != "" {
+			return restored
+		}
+	}
+	return sql
+}
+
+// RewriteReport SQL 重写报告，包括生效的规则、每条规则执行后的 SQL 及重写前后的差异
+type RewriteReport struct {
+	ID     string        `json:"ID"`
+	SQL    string        `json:"SQL"`
+	NewSQL string        `json:"NewSQL"`
+	Steps  []RewriteStep `json:"Steps"`
+	Diff   string        `json:"Diff"`             // 重写前后 SQL 格式化后的 unified diff
+	Verify string        `json:"Verify,omitempty"` // 开启 -rewrite-verify 时的结果对比
+}
+
+// Report 生成重写报告，需要在 Rewrite 之后调用。原 SQL 先转写为统一的格式再对比，差异中只包含规则的改写
+func (rw *Rewrite) Report(id string) RewriteReport {
+	newSQL := rw.NewSQL
+	if newSQL == "" {
+		newSQL = rw.SQL
+	}
+	steps := rw.Steps
+	if steps == nil {
+		steps = make([]RewriteStep, 0)
+	}
+	origin := normalizeRewriteSQL(rw.SQL)
+	if strings.HasSuffix(strings.TrimSpace(rw.SQL), common.Config.Delimiter) {
+		origin += common.Config.Delimiter
+	}
+	return RewriteReport{
+		ID:     id,
+		SQL:    rw.SQL,
+		NewSQL: newSQL,
+		Steps:  steps,
+		Diff:   common.UnifiedDiff(prettyDiffText(origin), prettyDiffText(newSQL), "original", "rewritten"),
+	}
+}
+
+// prettyDiffText 格式化 SQL 并去掉行尾空白，便于逐行对比
+func prettyDiffText(sql string) string {
+	lines := strings.Split(strings.TrimSpace(Pretty(sql, "builtin")), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], " \t")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Markdown 以 markdown 格式输出重写报告，按执行顺序列出生效的规则，便于逐条确认是否接受改写
+func (r RewriteReport) Markdown() string {
+	buf := []string{fmt.Sprintf("# Query: %s\n", r.ID)}
+	if len(r.Steps) == 0 {
+		buf = append(buf, "未命中任何重写规则\n")
+	} else {
+		buf = append(buf, "## 生效的重写规则\n")
+		for i, step := range r.Steps {
+			buf = append(buf, fmt.Sprintf("### %d. %s\n", i+1, common.MarkdownEscape(step.Rule)))
+			buf = append(buf, step.Description+"\n")
+			buf = append(buf, "```sql\n"+step.SQL+"\n```\n")
+		}
+	}
+	if r.Diff != "" {
+		buf = append(buf, "## 重写前后对比\n")
+		buf = append(buf, "```diff\n"+r.Diff+"```\n")
+	}
+	if r.Verify != "" {
+		buf = append(buf, "## 结果验证\n")
+		buf = append(buf, "```sql\n"+r.Verify+"\n```\n")
+	}
+	return strings.Join(buf, "\n")
+}
+
 // RewriteDelimiter delimiter: 补分号，可以指定不同的DELIMITER
 func (rw *Rewrite) RewriteDelimiter() *Rewrite {
 	if rw.NewSQL != "" {
@@ -869,12 +1016,457 @@ func (rw *Rewrite) RewriteAddOrderByNull() *Rewrite {
 	return rw
 }
 
-// RewriteOr2Union or2union: 将 OR 查询转写为 UNION ALL TODO: 暂无对应 HeuristicRules
-// TODO: https://sqlperformance.com/2014/09/sql-plan/rewriting-queries-improve-performance
+// RewriteOr2Union or2union: 将单表查询中不同索引列的 OR 条件转写为 UNION ALL，每个分支可以分别使用索引
+// 后面的分支通过 (条件) IS NOT TRUE 排除前面分支已经返回的数据，分支之间互斥，结果与 OR 一致
+// SELECT DISTINCT 需要去重，使用 UNION 且分支不需要互斥条件
+// 依赖测试环境中的索引信息，每个 OR 分支都有可以使用索引的条件，并且不能由同一个索引满足时才转写
+// https://sqlperformance.com/2014/09/sql-plan/rewriting-queries-improve-performance
 func (rw *Rewrite) RewriteOr2Union() *Rewrite {
+	if common.Config.TestDSN.Disable || len(rw.Columns) == 0 {
+		common.Log.Debug("(rw *Rewrite) RewriteOr2Union(): Rewrite failed. TestDSN.Disable: %v, len(rw.Columns):%d",
+			common.Config.TestDSN.Disable, len(rw.Columns))
+		return rw
+	}
+
+	// 只处理单表查询，GROUP BY、聚合函数、加锁读等拆分后语义会发生变化
+	sel, ok := rw.Stmt.(*sqlparser.Select)
+	if !ok || sel.Where == nil || len(sel.From) != 1 || len(sel.GroupBy) > 0 || sel.Having != nil ||
+		sel.Lock != "" || strings.Contains(strings.ToLower(sel.Hints), "sql_calc_found_rows") || hasAggregate(sel.SelectExprs) {
+		return rw
+	}
+	from, ok := sel.From[0].(*sqlparser.AliasedTableExpr)
+	if !ok {
+		return rw
+	}
+	table, ok := from.Expr.(sqlparser.TableName)
+	if !ok {
+		return rw
+	}
+	indexed := rw.indexedColumns(table.Name.String())
+
+	// UNION 的 ORDER BY 只能使用结果中的列，LIMIT 下推到每个分支
+	orderBy, ok := unionOrderBy(sel)
+	if !ok {
+		return rw
+	}
+	var branchLimit *sqlparser.Limit
+	if sel.Limit != nil {
+		offset, rowCount := int64(0), int64(-1)
+		if v, ok := sel.Limit.Rowcount.(*sqlparser.SQLVal); ok && v.Type == sqlparser.IntVal {
+			rowCount, _ = strconv.ParseInt(string(v.Val), 10, 64)
+		}
+		if sel.Limit.Offset != nil {
+			offset = -1
+			if v, ok := sel.Limit.Offset.(*sqlparser.SQLVal); ok && v.Type == sqlparser.IntVal {
+				offset, _ = strconv.ParseInt(string(v.Val), 10, 64)
+			}
+		}
+		if offset < 0 || rowCount < 0 {
+			return rw
+		}
+		branchLimit = &sqlparser.Limit{Rowcount: sqlparser.NewIntVal([]byte(strconv.FormatInt(offset+rowCount, 10)))}
+	}
+
+	terms := splitAndExpr(sel.Where.Expr)
+	for i, term := range terms {
+		disjuncts := splitOrExpr(term)
+		if len(disjuncts) < 2 || !or2unionBeneficial(disjuncts, indexed) {
+			continue
+		}
+
+		others := append(append([]sqlparser.Expr{}, terms[:i]...), terms[i+1:]...)
+		unionType := sqlparser.UnionAllStr
+		if sel.Distinct != "" {
+			unionType = sqlparser.UnionStr
+		}
+		var union sqlparser.SelectStatement
+		for j, disjunct := range disjuncts {
+			conds := append(append([]sqlparser.Expr{}, others...), parenIfOr(disjunct))
+			if unionType == sqlparser.UnionAllStr {
+				for _, prev := range disjuncts[:j] {
+					conds = append(conds, &sqlparser.IsExpr{
+						Operator: sqlparser.IsNotTrueStr,
+						Expr:     &sqlparser.ParenExpr{Expr: prev},
+					})
+				}
+			}
+
+			branch := *sel
+			branch.Distinct = ""
+			branch.Where = sqlparser.NewWhere(sqlparser.WhereStr, joinAndExpr(conds))
+			branch.OrderBy, branch.Limit = nil, nil
+			var stmt sqlparser.SelectStatement = &branch
+			if branchLimit != nil {
+				branch.OrderBy, branch.Limit = sel.OrderBy, branchLimit
+				stmt = &sqlparser.ParenSelect{Select: &branch}
+			}
+			if union == nil {
+				union = stmt
+				continue
+			}
+			union = &sqlparser.Union{Type: unionType, Left: union, Right: stmt}
+		}
+		union.(*sqlparser.Union).OrderBy = orderBy
+		union.SetLimit(sel.Limit)
+
+		rw.NewSQL = sqlparser.String(union)
+		// 重新解析，避免分支间共享的节点被后续的重写规则重复修改
+		if stmt, err := sqlparser.Parse(rw.NewSQL); err == nil {
+			rw.Stmt = stmt
+		}
+		return rw
+	}
+	return rw
+}
+
+// RewriteKeyset keyset: 将 LIMIT m, n 深分页转写为基于书签的分页，对应CLA.003
+// ORDER BY 的列唯一且不为 NULL 时使用 seek 方法，生成 WHERE (a, b) > (?, ?) ORDER BY a, b LIMIT n 的查询模板，? 为上一页最后一行的值
+// 否则使用延迟关联，先在子查询中只对主键分页，再关联回原表获取其他列
+func (rw *Rewrite) RewriteKeyset() *Rewrite {
+	if common.Config.TestDSN.Disable || len(rw.Columns) == 0 {
+		common.Log.Debug("(rw *Rewrite) RewriteKeyset(): Rewrite failed. TestDSN.Disable: %v, len(rw.Columns):%d",
+			common.Config.TestDSN.Disable, len(rw.Columns))
+		return rw
+	}
+
+	sel, ok := rw.Stmt.(*sqlparser.Select)
+	if !ok || sel.Limit == nil || sel.Limit.Offset == nil || len(sel.OrderBy) == 0 || sel.Distinct != "" ||
+		len(sel.GroupBy) > 0 || sel.Having != nil || sel.Lock != "" || hasAggregate(sel.SelectExprs) {
+		return rw
+	}
+	offset, ok := sel.Limit.Offset.(*sqlparser.SQLVal)
+	if !ok || offset.Type != sqlparser.IntVal || string(offset.Val) == "0" {
+		return rw
+	}
+	table, qualifier := singleTable(sel)
+	if table == "" {
+		return rw
+	}
+	columns := make(map[string]*common.Column)
+	var primary []string
+	for _, tables := range rw.Columns {
+		for tb, cols := range tables {
+			if !strings.EqualFold(tb, table) {
+				continue
+			}
+			for _, col := range cols {
+				columns[strings.ToLower(col.Name)] = col
+				if col.Key == "PRI" {
+					primary = append(primary, col.Name)
+				}
+			}
+		}
+	}
+	if len(primary) == 0 {
+		return rw
+	}
+
+	// ORDER BY 只能使用表中的列
+	var orderCols []*sqlparser.ColName
+	for _, order := range sel.OrderBy {
+		col, ok := order.Expr.(*sqlparser.ColName)
+		if !ok || columns[col.Name.Lowered()] == nil ||
+			(!col.Qualifier.IsEmpty() && !strings.EqualFold(col.Qualifier.Name.String(), qualifier)) {
+			return rw
+		}
+		orderCols = append(orderCols, col)
+	}
+
+	if keysetSeekable(sel.OrderBy, orderCols, columns, append([][]string{primary}, rw.UniqueKeys[strings.ToLower(table)]...)) {
+		var cols, args sqlparser.ValTuple
+		for _, col := range orderCols {
+			cols = append(cols, col)
+			args = append(args, &sqlparser.SQLVal{Type: sqlparser.ValArg, Val: []byte("?")})
+		}
+		seek := &sqlparser.ComparisonExpr{Operator: sqlparser.GreaterThanStr, Left: cols, Right: args}
+		if len(cols) == 1 {
+			seek.Left, seek.Right = cols[0], args[0]
+		}
+		if sel.OrderBy[0].Direction == sqlparser.DescScr {
+			seek.Operator = sqlparser.LessThanStr
+		}
+		if sel.Where == nil {
+			sel.Where = sqlparser.NewWhere(sqlparser.WhereStr, seek)
+		} else {
+			sel.Where.Expr = &sqlparser.AndExpr{Left: parenIfOr(sel.Where.Expr), Right: seek}
+		}
+		sel.Limit = &sqlparser.Limit{Rowcount: sel.Limit.Rowcount}
+		rw.NewSQL = sqlparser.String(sel)
+		return rw
+	}
+
+	// 延迟关联，子查询只需要扫描主键及 ORDER BY, WHERE 中的列
+	var keys sqlparser.SelectExprs
+	var using sqlparser.Columns
+	for _, pk := range primary {
+		keys = append(keys, &sqlparser.AliasedExpr{Expr: &sqlparser.ColName{Name: sqlparser.NewColIdent(pk)}})
+		using = append(using, sqlparser.NewColIdent(pk))
+	}
+	deferred := *sel
+	deferred.Comments, deferred.Cache, deferred.Hints = nil, "", ""
+	deferred.SelectExprs = keys
+	for i, expr := range sel.SelectExprs {
+		// USING 会将主键列放在结果的最前面，* 需要指定表名以保持列的顺序
+		if star, ok := expr.(*sqlparser.StarExpr); ok && star.TableName.IsEmpty() {
+			sel.SelectExprs[i] = &sqlparser.StarExpr{TableName: sqlparser.TableName{Name: sqlparser.NewTableIdent(qualifier)}}
+		}
+	}
+	sel.From = sqlparser.TableExprs{&sqlparser.JoinTableExpr{
+		LeftExpr: sel.From[0],
+		Join:     sqlparser.JoinStr,
+		RightExpr: &sqlparser.AliasedTableExpr{
+			Expr: &sqlparser.Subquery{Select: &deferred},
+			As:   sqlparser.NewTableIdent("keyset"),
+		},
+		Condition: sqlparser.JoinCondition{Using: using},
+	}}
+	sel.Where, sel.Limit = nil, nil
+	rw.NewSQL = sqlparser.String(sel)
 	return rw
 }
 
+// keysetSeekable ORDER BY 的列方向相同、不为 NULL 并且能够唯一确定一行时才可以使用 seek 方法分页
+// ORDER BY 包含主键或某个唯一索引的全部列时才能唯一确定一行。SHOW COLUMNS 中 Key 为 UNI 只表示该列是某个唯一索引的第一列，
+// 不能说明该列本身唯一，唯一索引需要使用 SHOW INDEX 的结果
+func keysetSeekable(orderBy sqlparser.OrderBy, orderCols []*sqlparser.ColName, columns map[string]*common.Column, keys [][]string) bool {
+	order := make(map[string]bool)
+	for i, col := range orderCols {
+		c := columns[col.Name.Lowered()]
+		if orderBy[i].Direction != orderBy[0].Direction || c.Null == "YES" {
+			return false
+		}
+		order[col.Name.Lowered()] = true
+	}
+	for _, key := range keys {
+		covered := len(key) > 0
+		for _, col := range key {
+			if !order[strings.ToLower(col)] {
+				covered = false
+				break
+			}
+		}
+		if covered {
+			return true
+		}
+	}
+	return false
+}
+
+// indexedColumns 返回表中可以作为索引第一列使用的列，列名为小写
+func (rw *Rewrite) indexedColumns(table string) map[string]bool {
+	indexed := make(map[string]bool)
+	for _, tables := range rw.Columns {
+		for tb, cols := range tables {
+			if !strings.EqualFold(tb, table) {
+				continue
+			}
+			for _, col := range cols {
+				// SHOW COLUMNS 中的 Key 为 PRI, UNI, MUL 时列是某个索引的第一列
+				if col.Key != "" {
+					indexed[strings.ToLower(col.Name)] = true
+				}
+			}
+		}
+	}
+	return indexed
+}
+
+// or2unionBeneficial 每个 OR 分支都有可以使用索引的条件，并且不能由同一个索引满足时转写为 UNION 才有意义
+func or2unionBeneficial(disjuncts []sqlparser.Expr, indexed map[string]bool) bool {
+	var shared map[string]bool // 所有分支都可以使用的索引列
+	for i, disjunct := range disjuncts {
+		if !or2unionSafe(disjunct) {
+			return false
+		}
+		cols := make(map[string]bool)
+		for _, cond := range splitAndExpr(disjunct) {
+			if col := sargableColumn(cond); col != "" && indexed[col] {
+				cols[col] = true
+			}
+		}
+		if len(cols) == 0 {
+			return false
+		}
+		if i == 0 {
+			shared = cols
+			continue
+		}
+		for col := range shared {
+			if !cols[col] {
+				delete(shared, col)
+			}
+		}
+	}
+	return len(shared) == 0
+}
+
+// or2unionSafe 包含子查询或不确定函数的条件多次计算时结果可能不同，不进行转写
+func or2unionSafe(expr sqlparser.Expr) bool {
+	safe := true
+	err := sqlparser.Walk(func(node sqlparser.SQLNode) (kontinue bool, err error) {
+		switch n := node.(type) {
+		case *sqlparser.Subquery:
+			safe = false
+		case *sqlparser.FuncExpr:
+			switch n.Name.Lowered() {
+			case "rand", "uuid", "uuid_short", "sysdate", "sleep", "last_insert_id", "found_rows", "row_count":
+				safe = false
+			}
+		}
+		return safe, nil
+	}, expr)
+	common.LogIfError(err, "")
+	return safe
+}
+
+// sargableColumn 返回可以使用索引的条件中的列名，列名为小写，条件无法使用索引时返回空
+func sargableColumn(expr sqlparser.Expr) string {
+	isValue := func(e sqlparser.Expr) bool {
+		switch v := e.(type) {
+		case *sqlparser.SQLVal, *sqlparser.NullVal, sqlparser.BoolVal:
+			return true
+		case sqlparser.ValTuple:
+			for _, item := range v {
+				if _, ok := item.(*sqlparser.SQLVal); !ok {
+					return false
+				}
+			}
+			return true
+		}
+		return false
+	}
+
+	switch n := expr.(type) {
+	case *sqlparser.ParenExpr:
+		return sargableColumn(n.Expr)
+	case *sqlparser.ComparisonExpr:
+		left, right := n.Left, n.Right
+		op := n.Operator
+		if _, ok := left.(*sqlparser.ColName); !ok {
+			left, right = right, left
+		}
+		col, ok := left.(*sqlparser.ColName)
+		if !ok || !isValue(right) {
+			return ""
+		}
+		switch op {
+		case sqlparser.EqualStr, sqlparser.LessThanStr, sqlparser.GreaterThanStr, sqlparser.LessEqualStr,
+			sqlparser.GreaterEqualStr, sqlparser.NullSafeEqualStr, sqlparser.InStr:
+			return col.Name.Lowered()
+		case sqlparser.LikeStr:
+			// 前项通配符无法使用索引
+			if v, ok := right.(*sqlparser.SQLVal); ok && v.Type == sqlparser.StrVal &&
+				!strings.HasPrefix(string(v.Val), "%") && !strings.HasPrefix(string(v.Val), "_") {
+				return col.Name.Lowered()
+			}
+		}
+	case *sqlparser.RangeCond:
+		if col, ok := n.Left.(*sqlparser.ColName); ok && n.Operator == sqlparser.BetweenStr && isValue(n.From) && isValue(n.To) {
+			return col.Name.Lowered()
+		}
+	case *sqlparser.IsExpr:
+		if col, ok := n.Expr.(*sqlparser.ColName); ok && n.Operator == sqlparser.IsNullStr {
+			return col.Name.Lowered()
+		}
+	}
+	return ""
+}
+
+// unionOrderBy 返回 UNION 外层的 ORDER BY，ORDER BY 的列不在查询结果中时无法转写
+func unionOrderBy(sel *sqlparser.Select) (sqlparser.OrderBy, bool) {
+	var orderBy sqlparser.OrderBy
+	for _, order := range sel.OrderBy {
+		col, ok := order.Expr.(*sqlparser.ColName)
+		if !ok {
+			return nil, false
+		}
+		found := false
+		for _, expr := range sel.SelectExprs {
+			switch e := expr.(type) {
+			case *sqlparser.StarExpr:
+				found = true
+			case *sqlparser.AliasedExpr:
+				if c, ok := e.Expr.(*sqlparser.ColName); ok && c.Name.Equal(col.Name) && e.As.IsEmpty() {
+					found = true
+				}
+				if e.As.Equal(col.Name) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return nil, false
+		}
+		// UNION 结果中的列没有表名前缀
+		orderBy = append(orderBy, &sqlparser.Order{
+			Expr:      &sqlparser.ColName{Name: col.Name},
+			Direction: order.Direction,
+		})
+	}
+	return orderBy, true
+}
+
+// hasAggregate 查询的列中是否有聚合函数
+func hasAggregate(exprs sqlparser.SelectExprs) bool {
+	var found bool
+	err := sqlparser.Walk(func(node sqlparser.SQLNode) (kontinue bool, err error) {
+		switch n := node.(type) {
+		case *sqlparser.FuncExpr:
+			if n.IsAggregate() {
+				found = true
+			}
+		case *sqlparser.GroupConcatExpr:
+			found = true
+		}
+		return !found, nil
+	}, exprs)
+	common.LogIfError(err, "")
+	return found
+}
+
+// splitAndExpr 将 AND 连接的条件拆分为多个条件
+func splitAndExpr(expr sqlparser.Expr) []sqlparser.Expr {
+	switch n := expr.(type) {
+	case *sqlparser.AndExpr:
+		return append(splitAndExpr(n.Left), splitAndExpr(n.Right)...)
+	case *sqlparser.ParenExpr:
+		if _, ok := n.Expr.(*sqlparser.AndExpr); ok {
+			return splitAndExpr(n.Expr)
+		}
+	}
+	return []sqlparser.Expr{expr}
+}
+
+// splitOrExpr 将 OR 连接的条件拆分为多个条件
+func splitOrExpr(expr sqlparser.Expr) []sqlparser.Expr {
+	switch n := expr.(type) {
+	case *sqlparser.OrExpr:
+		return append(splitOrExpr(n.Left), splitOrExpr(n.Right)...)
+	case *sqlparser.ParenExpr:
+		if _, ok := n.Expr.(*sqlparser.OrExpr); ok {
+			return splitOrExpr(n.Expr)
+		}
+	}
+	return []sqlparser.Expr{expr}
+}
+
+// joinAndExpr 使用 AND 连接多个条件
+func joinAndExpr(exprs []sqlparser.Expr) sqlparser.Expr {
+	expr := exprs[0]
+	for _, e := range exprs[1:] {
+		expr = &sqlparser.AndExpr{Left: expr, Right: e}
+	}
+	return expr
+}
+
+// parenIfOr OR 条件与其他条件使用 AND 连接时需要加括号
+func parenIfOr(expr sqlparser.Expr) sqlparser.Expr {
+	if _, ok := expr.(*sqlparser.OrExpr); ok {
+		return &sqlparser.ParenExpr{Expr: expr}
+	}
+	return expr
+}
+
 // RewriteUnionAll unionall: 不介意重复数据的情况下使用 union all 替换 union
 func (rw *Rewrite) RewriteUnionAll() *Rewrite {
 	err := sqlparser.Walk(func(node sqlparser.SQLNode) (kontinue bool, err error) {
@@ -1141,11 +1733,352 @@ func removeDup(vt ...sqlparser.Expr) sqlparser.ValTuple {
 	return uni
 }
 
-// RewriteInNull innull: TODO: 对应ARG.004
+// RewriteInNull innull: 对应ARG.004, RES.006
+// 作为过滤条件时 NULL 与 FALSE 的效果相同，col IN (1, NULL) 与 col IN (1) 返回的行一致，col NOT IN (1, NULL) 永远不返回任何行
+// NOT 会把 FALSE 变为 TRUE 而 NULL 仍为 NULL，只改写 AND, OR 连接的条件，NOT 下的条件保持不变
+// 想匹配 NULL 值的写法 (col IN (1) OR col IS NULL) 会改变查询结果，由 InNullSuggest 在 ARG.004 中给出建议
 func (rw *Rewrite) RewriteInNull() *Rewrite {
+	changed := false
+	rewrite := func(expr sqlparser.Expr) sqlparser.Expr {
+		if inNull, ok := rewriteInNullExpr(expr); ok {
+			changed = true
+			return inNull
+		}
+		return expr
+	}
+	err := sqlparser.Walk(func(node sqlparser.SQLNode) (kontinue bool, err error) {
+		switch n := node.(type) {
+		case *sqlparser.Where:
+			if n != nil {
+				n.Expr = replaceFilterExpr(n.Expr, rewrite)
+			}
+		case *sqlparser.JoinTableExpr:
+			if n.Condition.On != nil {
+				n.Condition.On = replaceFilterExpr(n.Condition.On, rewrite)
+			}
+		}
+		return true, nil
+	}, rw.Stmt)
+	common.LogIfError(err, "")
+	if changed {
+		rw.NewSQL = sqlparser.String(rw.Stmt)
+	}
+	return rw
+}
+
+// rewriteInNullExpr 删除 IN 列表中的 NULL，NOT IN 列表中包含 NULL 时返回 false，不包含 NULL 时第二个返回值为 false
+func rewriteInNullExpr(expr sqlparser.Expr) (sqlparser.Expr, bool) {
+	cmp, ok := expr.(*sqlparser.ComparisonExpr)
+	if !ok || (cmp.Operator != sqlparser.InStr && cmp.Operator != sqlparser.NotInStr) {
+		return nil, false
+	}
+	tuple, ok := cmp.Right.(sqlparser.ValTuple)
+	if !ok {
+		return nil, false
+	}
+	var values sqlparser.ValTuple
+	for _, v := range tuple {
+		if _, ok := v.(*sqlparser.NullVal); !ok {
+			values = append(values, v)
+		}
+	}
+	if len(values) == len(tuple) {
+		return nil, false
+	}
+	if cmp.Operator == sqlparser.NotInStr || len(values) == 0 {
+		return sqlparser.BoolVal(false), true
+	}
+	cmp.Right = values
+	return cmp, true
+}
+
+// replaceFilterExpr 对 AND, OR 连接的每个条件调用 f，使用 f 的返回值替换原条件，NOT 下的条件不做处理
+func replaceFilterExpr(expr sqlparser.Expr, f func(sqlparser.Expr) sqlparser.Expr) sqlparser.Expr {
+	switch n := expr.(type) {
+	case *sqlparser.AndExpr:
+		n.Left, n.Right = replaceFilterExpr(n.Left, f), replaceFilterExpr(n.Right, f)
+	case *sqlparser.OrExpr:
+		n.Left, n.Right = replaceFilterExpr(n.Left, f), replaceFilterExpr(n.Right, f)
+	case *sqlparser.ParenExpr:
+		n.Expr = replaceFilterExpr(n.Expr, f)
+	case *sqlparser.NotExpr:
+	default:
+		return f(expr)
+	}
+	return expr
+}
+
+// InNullSuggest 为包含 NULL 值的 IN, NOT IN 列表给出符合预期的写法，不包含 NULL 值时返回 false
+// col IN (1, NULL) 中的 NULL 不会匹配任何行，想匹配 NULL 值时写作 (col IN (1) OR col IS NULL)
+// col NOT IN (1, NULL) 永远不会返回任何行，想排除列表中的值时写作 col NOT IN (1)，NOT IN (NULL) 写作 col IS NOT NULL
+func InNullSuggest(cmp *sqlparser.ComparisonExpr) (sqlparser.Expr, bool) {
+	if cmp.Operator != sqlparser.InStr && cmp.Operator != sqlparser.NotInStr {
+		return nil, false
+	}
+	tuple, ok := cmp.Right.(sqlparser.ValTuple)
+	if !ok {
+		return nil, false
+	}
+	var values sqlparser.ValTuple
+	for _, v := range tuple {
+		if _, ok := v.(*sqlparser.NullVal); !ok {
+			values = append(values, v)
+		}
+	}
+	if len(values) == len(tuple) {
+		return nil, false
+	}
+
+	isNull := &sqlparser.IsExpr{Operator: sqlparser.IsNullStr, Expr: cmp.Left}
+	if cmp.Operator == sqlparser.NotInStr {
+		isNull.Operator = sqlparser.IsNotNullStr
+	}
+	if len(values) == 0 {
+		return isNull, true
+	}
+	in := &sqlparser.ComparisonExpr{Operator: cmp.Operator, Left: cmp.Left, Right: values}
+	if cmp.Operator == sqlparser.NotInStr {
+		return in, true
+	}
+	return &sqlparser.ParenExpr{Expr: &sqlparser.OrExpr{Left: in, Right: isNull}}, true
+}
+
+// RewriteNotIn2NotExists notin2notexists: 子查询返回 NULL 时 NOT IN 永远非真，查询会静默地返回空结果
+// 子查询的列在表结构中允许为 NULL 时将 col NOT IN (SELECT x ...) 转写为 NOT EXISTS (SELECT 1 ... AND x = col)
+func (rw *Rewrite) RewriteNotIn2NotExists() *Rewrite {
+	if common.Config.TestDSN.Disable || len(rw.Columns) == 0 {
+		common.Log.Debug("(rw *Rewrite) RewriteNotIn2NotExists(): Rewrite failed. TestDSN.Disable: %v, len(rw.Columns):%d",
+			common.Config.TestDSN.Disable, len(rw.Columns))
+		return rw
+	}
+
+	changed := false
+	err := sqlparser.Walk(func(node sqlparser.SQLNode) (kontinue bool, err error) {
+		sel, ok := node.(*sqlparser.Select)
+		if !ok || sel.Where == nil {
+			return true, nil
+		}
+		sel.Where.Expr = replaceBoolExpr(sel.Where.Expr, func(expr sqlparser.Expr) sqlparser.Expr {
+			cmp, ok := expr.(*sqlparser.ComparisonExpr)
+			if !ok || !NotInNullable(cmp, rw.Columns) {
+				return expr
+			}
+			if exists, ok := NotIn2NotExists(sel, cmp, rw.Columns); ok {
+				changed = true
+				return exists
+			}
+			return expr
+		})
+		return true, nil
+	}, rw.Stmt)
+	common.LogIfError(err, "")
+	if changed {
+		rw.NewSQL = sqlparser.String(rw.Stmt)
+	}
 	return rw
 }
 
+// NotInNullable 判断 col NOT IN (SELECT x FROM tb ...) 中子查询返回的列 x 在表结构中是否允许为 NULL
+func NotInNullable(cmp *sqlparser.ComparisonExpr, columns common.TableColumns) bool {
+	sub, col := notInSubquery(cmp)
+	if col == nil {
+		return false
+	}
+	nullable, found := columnNullable(sub, col, columns)
+	return found && nullable
+}
+
+// columnNullable 查询 sel 中引用的列在表结构中是否允许为 NULL，第二个返回值表示是否找到了该列
+func columnNullable(sel *sqlparser.Select, col *sqlparser.ColName, columns common.TableColumns) (bool, bool) {
+	table, _ := singleTable(sel)
+	if !col.Qualifier.IsEmpty() {
+		table = tableByQualifier(sel, col.Qualifier.Name.String())
+	}
+	if table == "" {
+		return false, false
+	}
+	for _, tables := range columns {
+		for tb, cols := range tables {
+			if !strings.EqualFold(tb, table) {
+				continue
+			}
+			for _, c := range cols {
+				if strings.EqualFold(c.Name, col.Name.String()) {
+					return c.Null == "YES", true
+				}
+			}
+		}
+	}
+	return false, false
+}
+
+// NotIn2NotExists 将 outer 查询中的 col NOT IN (SELECT x ...) 转写为 NOT EXISTS 相关子查询，无法转写时返回 false
+// 子查询包含 GROUP BY, HAVING, LIMIT 或内外层的列无法区分时不进行转写
+// col 为 NULL 时 NOT IN 只在子查询结果为空时返回该行，而 NOT EXISTS 总会返回该行
+// col 允许为 NULL 或表结构中找不到 col 时补充 (col IS NOT NULL OR NOT EXISTS (子查询)) 保持这一行为
+func NotIn2NotExists(outer *sqlparser.Select, cmp *sqlparser.ComparisonExpr, columns common.TableColumns) (sqlparser.Expr, bool) {
+	sub, innerCol := notInSubquery(cmp)
+	outerCol, ok := cmp.Left.(*sqlparser.ColName)
+	if innerCol == nil || !ok || len(sub.GroupBy) > 0 || sub.Having != nil || sub.Limit != nil || hasAggregate(sub.SelectExprs) {
+		return nil, false
+	}
+
+	// 相关子查询中的列都需要指定表名，否则内层的同名列会覆盖外层的列
+	inner := *innerCol
+	if inner.Qualifier.IsEmpty() {
+		_, qualifier := singleTable(sub)
+		if qualifier == "" {
+			return nil, false
+		}
+		inner.Qualifier = sqlparser.TableName{Name: sqlparser.NewTableIdent(qualifier)}
+	}
+	outerRef := *outerCol
+	if outerRef.Qualifier.IsEmpty() {
+		_, qualifier := singleTable(outer)
+		if qualifier == "" {
+			return nil, false
+		}
+		outerRef.Qualifier = sqlparser.TableName{Name: sqlparser.NewTableIdent(qualifier)}
+	}
+	if tableByQualifier(sub, outerRef.Qualifier.Name.String()) != "" {
+		return nil, false
+	}
+
+	var cond sqlparser.Expr = &sqlparser.ComparisonExpr{Operator: sqlparser.EqualStr, Left: &inner, Right: &outerRef}
+	if sub.Where != nil {
+		cond = &sqlparser.AndExpr{Left: parenIfOr(sub.Where.Expr), Right: cond}
+	}
+	notExists := notExistsExpr(sub, cond)
+	if nullable, found := columnNullable(outer, &outerRef, columns); nullable || !found {
+		var empty sqlparser.Expr
+		if sub.Where != nil {
+			empty = sub.Where.Expr
+		}
+		notExists = &sqlparser.ParenExpr{Expr: &sqlparser.AndExpr{
+			Left: notExists,
+			Right: &sqlparser.ParenExpr{Expr: &sqlparser.OrExpr{
+				Left:  &sqlparser.IsExpr{Operator: sqlparser.IsNotNullStr, Expr: &outerRef},
+				Right: notExistsExpr(sub, empty),
+			}},
+		}}
+	}
+	return notExists, true
+}
+
+// notExistsExpr 返回 NOT EXISTS (SELECT 1 FROM sub 的表 WHERE cond)，cond 为 nil 时不带 WHERE 条件
+func notExistsExpr(sub *sqlparser.Select, cond sqlparser.Expr) sqlparser.Expr {
+	exists := *sub
+	exists.Distinct = ""
+	exists.SelectExprs = sqlparser.SelectExprs{&sqlparser.AliasedExpr{Expr: sqlparser.NewIntVal([]byte("1"))}}
+	exists.Where = nil
+	if cond != nil {
+		exists.Where = sqlparser.NewWhere(sqlparser.WhereStr, cond)
+	}
+	exists.OrderBy = nil
+	return &sqlparser.NotExpr{Expr: &sqlparser.ExistsExpr{Subquery: &sqlparser.Subquery{Select: &exists}}}
+}
+
+// notInSubquery 返回 col NOT IN (SELECT x ...) 中的子查询及其返回的列，不是该形式时返回 nil
+func notInSubquery(cmp *sqlparser.ComparisonExpr) (*sqlparser.Select, *sqlparser.ColName) {
+	if cmp.Operator != sqlparser.NotInStr {
+		return nil, nil
+	}
+	subquery, ok := cmp.Right.(*sqlparser.Subquery)
+	if !ok {
+		return nil, nil
+	}
+	sub, ok := subquery.Select.(*sqlparser.Select)
+	if !ok || len(sub.SelectExprs) != 1 {
+		return nil, nil
+	}
+	expr, ok := sub.SelectExprs[0].(*sqlparser.AliasedExpr)
+	if !ok {
+		return nil, nil
+	}
+	col, ok := expr.Expr.(*sqlparser.ColName)
+	if !ok {
+		return nil, nil
+	}
+	return sub, col
+}
+
+// singleTable 返回单表查询的表名及引用该表时使用的名称（别名或表名），多表查询时返回空
+func singleTable(sel *sqlparser.Select) (table string, qualifier string) {
+	if len(sel.From) != 1 {
+		return "", ""
+	}
+	from, ok := sel.From[0].(*sqlparser.AliasedTableExpr)
+	if !ok {
+		return "", ""
+	}
+	name, ok := from.Expr.(sqlparser.TableName)
+	if !ok {
+		return "", ""
+	}
+	if !from.As.IsEmpty() {
+		return name.Name.String(), from.As.String()
+	}
+	return name.Name.String(), name.Name.String()
+}
+
+// tableByQualifier 根据列的表名前缀（别名或表名）查找查询 FROM 中的表名，找不到时返回空
+func tableByQualifier(sel *sqlparser.Select, qualifier string) string {
+	table := ""
+	err := sqlparser.Walk(func(node sqlparser.SQLNode) (kontinue bool, err error) {
+		switch n := node.(type) {
+		case *sqlparser.AliasedTableExpr:
+			name, ok := n.Expr.(sqlparser.TableName)
+			if !ok {
+				return false, nil
+			}
+			if (n.As.IsEmpty() && strings.EqualFold(name.Name.String(), qualifier)) ||
+				(!n.As.IsEmpty() && strings.EqualFold(n.As.String(), qualifier)) {
+				table = name.Name.String()
+			}
+			return false, nil
+		case sqlparser.TableExprs, *sqlparser.JoinTableExpr, *sqlparser.ParenTableExpr:
+			return true, nil
+		}
+		return false, nil
+	}, sel.From)
+	common.LogIfError(err, "")
+	return table
+}
+
+// stmtWhere 返回 SELECT, UPDATE, DELETE 的 WHERE 条件
+func stmtWhere(node sqlparser.SQLNode) *sqlparser.Where {
+	switch n := node.(type) {
+	case *sqlparser.Select:
+		return n.Where
+	case *sqlparser.Update:
+		return n.Where
+	case *sqlparser.Delete:
+		return n.Where
+	}
+	return nil
+}
+
+// replaceBoolExpr 对 AND, OR, NOT 连接的每个条件调用 f，使用 f 的返回值替换原条件
+func replaceBoolExpr(expr sqlparser.Expr, f func(sqlparser.Expr) sqlparser.Expr) sqlparser.Expr {
+	switch n := expr.(type) {
+	case *sqlparser.AndExpr:
+		n.Left, n.Right = replaceBoolExpr(n.Left, f), replaceBoolExpr(n.Right, f)
+	case *sqlparser.OrExpr:
+		n.Left, n.Right = replaceBoolExpr(n.Left, f), replaceBoolExpr(n.Right, f)
+	case *sqlparser.NotExpr:
+		n.Expr = replaceBoolExpr(n.Expr, f)
+	case *sqlparser.ParenExpr:
+		n.Expr = replaceBoolExpr(n.Expr, f)
+		// 避免出现多余的括号
+		if paren, ok := n.Expr.(*sqlparser.ParenExpr); ok {
+			n.Expr = paren.Expr
+		}
+	default:
+		return f(expr)
+	}
+	return expr
+}
+
 // RewriteRmParenthesis rmparenthesis: 去除无意义的括号
 func (rw *Rewrite) RewriteRmParenthesis() *Rewrite {
 	rw.rmParenthesis()
@@ -1799,6 +2732,42 @@ func MergeAlterTables(sqls ...string) map[string]string {
 	return mergedAlterStr
 }
 
+// MergeAlterReports 生成 mergealter 的重写报告，每张表一条，SQL 为该表的所有原始语句，ID 由调用方填写
+func MergeAlterReports(sqls ...string) []RewriteReport {
+	merged := MergeAlterTables(sqls...)
+	origins := make(map[string][]string)
+	for _, sql := range sqls {
+		for tb := range MergeAlterTables(sql) {
+			origins[tb] = append(origins[tb], strings.TrimSpace(sql))
+		}
+	}
+
+	var tables []string
+	for tb := range merged {
+		tables = append(tables, tb)
+	}
+	sort.Strings(tables)
+
+	description := ""
+	for _, r := range RewriteRules {
+		if r.Name == "mergealter" {
+			description = r.Description
+		}
+	}
+	reports := make([]RewriteReport, 0, len(tables))
+	for _, tb := range tables {
+		origin := strings.Join(origins[tb], "\n")
+		newSQL := strings.TrimSpace(merged[tb])
+		reports = append(reports, RewriteReport{
+			SQL:    origin,
+			NewSQL: newSQL,
+			Steps:  []RewriteStep{{Rule: "mergealter", Description: description, SQL: newSQL}},
+			Diff:   common.UnifiedDiff(origin, newSQL, "original", "rewritten"),
+		})
+	}
+	return reports
+}
+
 // RewriteRuleMatch 检查重写规则是否生效
 func RewriteRuleMatch(name string) bool {
 	for _, r := range common.Config.RewriteRules {
@@ -17,11 +17,14 @@
 package ast
 
 import (
+	"encoding/json"
 	"fmt"
 	"sort"
 	"testing"
 
 	"github.com/laojianzi/soar/common"
+
+	"vitess.io/vitess/go/vt/sqlparser"
 )
 
 func TestRewrite(t *testing.T) {
@@ -706,6 +709,37 @@ func TestMergeAlterTables(t *testing.T) {
 	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
 }
 
+func TestMergeAlterReports(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	reports := MergeAlterReports(
+		"ALTER TABLE t2 DROP COLUMN c;",
+		"alter table `sakila`.`t1` add index `idx_col`(`col`)",
+		"ALTER TABLE t2 ADD COLUMN d int;",
+	)
+	want := []map[string]string{
+		{
+			"SQL":    "alter table `sakila`.`t1` add index `idx_col`(`col`)",
+			"NewSQL": "ALTER TABLE `sakila`.`t1` add index `idx_col`(`col`) ;",
+		},
+		{
+			"SQL":    "ALTER TABLE t2 DROP COLUMN c;\nALTER TABLE t2 ADD COLUMN d int;",
+			"NewSQL": "ALTER TABLE `t2` DROP COLUMN c, ADD COLUMN d int ;",
+		},
+	}
+	if len(reports) != len(want) {
+		t.Fatalf("want %d reports, got %d", len(want), len(reports))
+	}
+	for i, report := range reports {
+		if report.SQL != want[i]["SQL"] || report.NewSQL != want[i]["NewSQL"] {
+			t.Errorf("want: %s => %s\ngot: %s => %s", want[i]["SQL"], want[i]["NewSQL"], report.SQL, report.NewSQL)
+		}
+		if len(report.Steps) != 1 || report.Steps[0].Rule != "mergealter" || report.Diff == "" {
+			t.Errorf("mergealter report error: %v", report)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
 func TestRewriteUnionAll(t *testing.T) {
 	common.Log.Debug("Entering function: %s", common.GetFunctionName())
 	testSQL := []map[string]string{
@@ -782,6 +816,337 @@ func TestRewriteOr2In(t *testing.T) {
 	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
 }
 
+func TestRewriteOr2Union(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	orgTestDSNStatus := common.Config.TestDSN.Disable
+	common.Config.TestDSN.Disable = false
+	testSQL := []map[string]string{
+		{
+			"input":  `SELECT * FROM film WHERE film_id = 1 OR title = 'ACE GOLDFINGER'`,
+			"output": "select * from film where film_id = 1 union all select * from film where title = 'ACE GOLDFINGER' and (film_id = 1) is not true",
+		},
+		{
+			"input":  `SELECT film_id FROM film WHERE rating = 'G' AND (film_id < 10 OR title LIKE 'ACE%' OR language_id IN (1, 2))`,
+			"output": "select film_id from film where rating = 'G' and film_id < 10 union all select film_id from film where rating = 'G' and title like 'ACE%' and (film_id < 10) is not true union all select film_id from film where rating = 'G' and language_id in (1, 2) and (film_id < 10) is not true and (title like 'ACE%') is not true",
+		},
+		// DISTINCT 需要去重，使用 UNION
+		{
+			"input":  `SELECT DISTINCT title FROM film WHERE film_id = 1 OR title = 'ACE GOLDFINGER'`,
+			"output": "select title from film where film_id = 1 union select title from film where title = 'ACE GOLDFINGER'",
+		},
+		// ORDER BY 和 LIMIT 下推到每个分支
+		{
+			"input":  `SELECT film.film_id, title FROM film WHERE film_id > 100 OR title = 'ACE GOLDFINGER' ORDER BY film.film_id DESC LIMIT 10, 5`,
+			"output": "(select film.film_id, title from film where film_id > 100 order by film.film_id desc limit 15) union all (select film.film_id, title from film where title = 'ACE GOLDFINGER' and (film_id > 100) is not true order by film.film_id desc limit 15) order by film_id desc limit 10, 5",
+		},
+		// rating 列上没有索引
+		{
+			"input":  `SELECT * FROM film WHERE film_id = 1 OR rating = 'G'`,
+			"output": "",
+		},
+		// 同一个索引可以满足所有分支
+		{
+			"input":  `SELECT * FROM film WHERE film_id = 1 OR (film_id = 2 AND title = 'ACE GOLDFINGER')`,
+			"output": "",
+		},
+		// 前项通配符无法使用索引
+		{
+			"input":  `SELECT * FROM film WHERE film_id = 1 OR title LIKE '%ACE'`,
+			"output": "",
+		},
+		// ORDER BY 的列不在查询结果中
+		{
+			"input":  `SELECT title FROM film WHERE film_id = 1 OR title = 'ACE GOLDFINGER' ORDER BY language_id`,
+			"output": "",
+		},
+		{
+			"input":  `SELECT COUNT(*) FROM film WHERE film_id = 1 OR title = 'ACE GOLDFINGER'`,
+			"output": "",
+		},
+	}
+	for _, sql := range testSQL {
+		rw := NewRewrite(sql["input"])
+		rw.Columns = map[string]map[string][]*common.Column{
+			"sakila": {
+				"film": {
+					{Name: "film_id", Table: "film", Key: "PRI"},
+					{Name: "title", Table: "film", Key: "MUL"},
+					{Name: "language_id", Table: "film", Key: "MUL"},
+					{Name: "rating", Table: "film"},
+				},
+			},
+		}
+		rw.RewriteOr2Union()
+		if rw.NewSQL != sql["output"] {
+			t.Errorf("want: %s\ngot: %s", sql["output"], rw.NewSQL)
+		}
+	}
+
+	// 没有测试环境时无法获取索引信息
+	common.Config.TestDSN.Disable = true
+	rw := NewRewrite(`SELECT * FROM film WHERE film_id = 1 OR title = 'ACE GOLDFINGER'`).RewriteOr2Union()
+	if rw.NewSQL != "" {
+		t.Errorf("got: %s", rw.NewSQL)
+	}
+	common.Config.TestDSN.Disable = orgTestDSNStatus
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestRewriteKeyset(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	orgTestDSNStatus := common.Config.TestDSN.Disable
+	common.Config.TestDSN.Disable = false
+	testSQL := []map[string]string{
+		{
+			"input":  `SELECT * FROM film ORDER BY film_id LIMIT 10000, 10`,
+			"output": "select * from film where film_id > ? order by film_id asc limit 10",
+		},
+		{
+			"input":  `SELECT film_id, title FROM film WHERE rating = 'G' OR rating = 'PG' ORDER BY rental_rate DESC, film_id DESC LIMIT 20 OFFSET 10000`,
+			"output": "select film_id, title from film where (rating = 'G' or rating = 'PG') and (rental_rate, film_id) < (?, ?) order by rental_rate desc, film_id desc limit 20",
+		},
+		{
+			"input":  `SELECT title FROM film ORDER BY title LIMIT 10000, 10`,
+			"output": "select title from film where title > ? order by title asc limit 10",
+		},
+		// rental_rate 列不唯一，使用延迟关联
+		{
+			"input":  `SELECT * FROM film WHERE rating = 'G' ORDER BY rental_rate LIMIT 10000, 10`,
+			"output": "select film.* from film join (select film_id from film where rating = 'G' order by rental_rate asc limit 10000, 10) as keyset using (film_id) order by rental_rate asc",
+		},
+		// 排序方向不同
+		{
+			"input":  `SELECT f.title FROM film f ORDER BY f.rental_rate DESC, f.film_id ASC LIMIT 100, 10`,
+			"output": "select f.title from film as f join (select film_id from film as f order by f.rental_rate desc, f.film_id asc limit 100, 10) as keyset using (film_id) order by f.rental_rate desc, f.film_id asc",
+		},
+		// 排序的列允许为 NULL
+		{
+			"input":  `SELECT title FROM film ORDER BY original_language_id, film_id LIMIT 100, 10`,
+			"output": "select title from film join (select film_id from film order by original_language_id asc, film_id asc limit 100, 10) as keyset using (film_id) order by original_language_id asc, film_id asc",
+		},
+		{
+			"input":  `SELECT title FROM film ORDER BY film_id LIMIT 10`,
+			"output": "",
+		},
+		{
+			"input":  `SELECT rating, COUNT(*) FROM film GROUP BY rating ORDER BY rating LIMIT 1, 10`,
+			"output": "",
+		},
+		// ORDER BY 使用了列的别名
+		{
+			"input":  `SELECT title AS t FROM film ORDER BY t LIMIT 100, 10`,
+			"output": "",
+		},
+		// description 是联合唯一索引 (description, release_year) 的第一列，单独使用不唯一
+		{
+			"input":  `SELECT title FROM film ORDER BY description LIMIT 100, 10`,
+			"output": "select title from film join (select film_id from film order by description asc limit 100, 10) as keyset using (film_id) order by description asc",
+		},
+		{
+			"input":  `SELECT title FROM film ORDER BY description, release_year LIMIT 100, 10`,
+			"output": "select title from film where (description, release_year) > (?, ?) order by description asc, release_year asc limit 10",
+		},
+	}
+	for _, sql := range testSQL {
+		rw := NewRewrite(sql["input"])
+		rw.Columns = common.TableColumns{
+			"sakila": {
+				"film": {
+					{Name: "film_id", Table: "film", Key: "PRI", Null: "NO"},
+					{Name: "title", Table: "film", Key: "UNI", Null: "NO"},
+					{Name: "rating", Table: "film", Null: "YES"},
+					{Name: "rental_rate", Table: "film", Null: "NO"},
+					{Name: "original_language_id", Table: "film", Key: "MUL", Null: "YES"},
+					{Name: "description", Table: "film", Key: "UNI", Null: "NO"},
+					{Name: "release_year", Table: "film", Null: "NO"},
+				},
+			},
+		}
+		rw.UniqueKeys = map[string][][]string{
+			"film": {{"film_id"}, {"title"}, {"description", "release_year"}},
+		}
+		rw.RewriteKeyset()
+		if rw.NewSQL != sql["output"] {
+			t.Errorf("want: %s\ngot: %s", sql["output"], rw.NewSQL)
+		}
+		if _, err := sqlparser.Parse(rw.NewSQL); rw.NewSQL != "" && err != nil {
+			t.Errorf("SQL: %s, Error: %s", rw.NewSQL, err.Error())
+		}
+	}
+	common.Config.TestDSN.Disable = orgTestDSNStatus
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestRewriteInNull(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	testSQL := []map[string]string{
+		{
+			"input":  `SELECT * FROM film WHERE original_language_id IN (1, NULL)`,
+			"output": "select * from film where original_language_id in (1)",
+		},
+		{
+			"input":  `SELECT * FROM film WHERE original_language_id IN (NULL) OR film_id = 1`,
+			"output": "select * from film where false or film_id = 1",
+		},
+		{
+			"input":  `SELECT * FROM film WHERE film_id > 1 AND (original_language_id NOT IN (1, NULL) OR rating = 'G')`,
+			"output": "select * from film where film_id > 1 and (false or rating = 'G')",
+		},
+		{
+			"input":  `SELECT * FROM film f JOIN language l ON f.language_id = l.language_id AND l.language_id IN (1, NULL)`,
+			"output": "select * from film as f join `language` as l on f.language_id = l.language_id and l.language_id in (1)",
+		},
+		{
+			"input":  `DELETE FROM film WHERE original_language_id NOT IN (NULL)`,
+			"output": "delete from film where false",
+		},
+		// NOT 会改变 NULL 与 FALSE 的区别，不进行改写
+		{
+			"input":  `SELECT * FROM film WHERE NOT (original_language_id IN (1, NULL))`,
+			"output": "",
+		},
+		// 不是过滤条件
+		{
+			"input":  `SELECT original_language_id IN (1, NULL) FROM film`,
+			"output": "",
+		},
+		{
+			"input":  `SELECT * FROM film WHERE original_language_id IN (1, 2)`,
+			"output": "",
+		},
+	}
+	for _, sql := range testSQL {
+		rw := NewRewrite(sql["input"]).RewriteInNull()
+		if rw.NewSQL != sql["output"] {
+			t.Errorf("want: %s\ngot: %s", sql["output"], rw.NewSQL)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestInNullSuggest(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	testSQL := []map[string]string{
+		{
+			"input":  `SELECT * FROM film WHERE original_language_id IN (1, NULL)`,
+			"output": "(original_language_id in (1) or original_language_id is null)",
+		},
+		{
+			"input":  `SELECT * FROM film WHERE original_language_id IN (NULL)`,
+			"output": "original_language_id is null",
+		},
+		{
+			"input":  `SELECT * FROM film WHERE original_language_id NOT IN (1, 2, NULL)`,
+			"output": "original_language_id not in (1, 2)",
+		},
+		{
+			"input":  `DELETE FROM film WHERE original_language_id NOT IN (NULL)`,
+			"output": "original_language_id is not null",
+		},
+		{
+			"input":  `SELECT * FROM film WHERE original_language_id IN (1, 2)`,
+			"output": "",
+		},
+	}
+	for _, sql := range testSQL {
+		stmt, err := sqlparser.Parse(sql["input"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		err = sqlparser.Walk(func(node sqlparser.SQLNode) (kontinue bool, err error) {
+			if cmp, ok := node.(*sqlparser.ComparisonExpr); ok {
+				if suggest, ok := InNullSuggest(cmp); ok {
+					got = sqlparser.String(suggest)
+				}
+			}
+			return true, nil
+		}, stmt)
+		if err != nil {
+			t.Error(err)
+		}
+		if got != sql["output"] {
+			t.Errorf("want: %s\ngot: %s", sql["output"], got)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestRewriteNotIn2NotExists(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	orgTestDSNStatus := common.Config.TestDSN.Disable
+	common.Config.TestDSN.Disable = false
+	testSQL := []map[string]string{
+		{
+			"input":  `SELECT name FROM language WHERE language_id NOT IN (SELECT original_language_id FROM film)`,
+			"output": "select name from `language` where not exists (select 1 from film where film.original_language_id = `language`.language_id)",
+		},
+		{
+			"input":  `SELECT l.name FROM language l WHERE l.language_id NOT IN (SELECT DISTINCT f.original_language_id FROM film f WHERE f.rating = 'G' OR f.rating = 'PG' ORDER BY f.film_id) AND l.name != 'English'`,
+			"output": "select l.name from `language` as l where not exists (select 1 from film as f where (f.rating = 'G' or f.rating = 'PG') and f.original_language_id = l.language_id) and l.name != 'English'",
+		},
+		// 子查询中也有 NOT IN
+		{
+			"input":  `SELECT name FROM language WHERE language_id NOT IN (SELECT original_language_id FROM film WHERE film_id NOT IN (SELECT film_id FROM inventory))`,
+			"output": "select name from `language` where not exists (select 1 from film where not exists (select 1 from inventory where inventory.film_id = film.film_id) and film.original_language_id = `language`.language_id)",
+		},
+		// 外层的列允许为 NULL，NOT IN 只在子查询为空时返回外层列为 NULL 的行，NOT EXISTS 总会返回
+		{
+			"input":  `SELECT film_id FROM inventory WHERE film_id NOT IN (SELECT original_language_id FROM film)`,
+			"output": "select film_id from inventory where (not exists (select 1 from film where film.original_language_id = inventory.film_id) and (inventory.film_id is not null or not exists (select 1 from film)))",
+		},
+		{
+			"input":  `SELECT film_id FROM inventory WHERE film_id NOT IN (SELECT original_language_id FROM film WHERE rating = 'G')`,
+			"output": "select film_id from inventory where (not exists (select 1 from film where rating = 'G' and film.original_language_id = inventory.film_id) and (inventory.film_id is not null or not exists (select 1 from film where rating = 'G')))",
+		},
+		// 子查询的列不允许为 NULL
+		{
+			"input":  `SELECT name FROM language WHERE language_id NOT IN (SELECT language_id FROM film)`,
+			"output": "",
+		},
+		// 内外层是同一张表，无法区分
+		{
+			"input":  `SELECT title FROM film WHERE language_id NOT IN (SELECT original_language_id FROM film)`,
+			"output": "",
+		},
+		{
+			"input":  `SELECT name FROM language WHERE language_id NOT IN (SELECT original_language_id FROM film GROUP BY original_language_id)`,
+			"output": "",
+		},
+		{
+			"input":  `SELECT name FROM language WHERE language_id NOT IN (SELECT original_language_id FROM film LIMIT 10)`,
+			"output": "",
+		},
+	}
+	columns := common.TableColumns{
+		"sakila": {
+			"film": {
+				{Name: "film_id", Table: "film", Null: "NO"},
+				{Name: "language_id", Table: "film", Null: "NO"},
+				{Name: "original_language_id", Table: "film", Null: "YES"},
+				{Name: "rating", Table: "film", Null: "YES"},
+			},
+			"language": {
+				{Name: "language_id", Table: "language", Null: "NO"},
+				{Name: "name", Table: "language", Null: "NO"},
+			},
+			"inventory": {
+				{Name: "film_id", Table: "inventory", Null: "YES"},
+			},
+		},
+	}
+	for _, sql := range testSQL {
+		rw := NewRewrite(sql["input"])
+		rw.Columns = columns
+		rw.RewriteNotIn2NotExists()
+		if rw.NewSQL != sql["output"] {
+			t.Errorf("want: %s\ngot: %s", sql["output"], rw.NewSQL)
+		}
+	}
+	common.Config.TestDSN.Disable = orgTestDSNStatus
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
 func TestRmParenthesis(t *testing.T) {
 	common.Log.Debug("Entering function: %s", common.GetFunctionName())
 	testSQL := []map[string]string{
@@ -811,6 +1176,64 @@ func TestRmParenthesis(t *testing.T) {
 	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
 }
 
+func TestRewriteSteps(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	orgRewriteRules := common.Config.RewriteRules
+	common.Config.RewriteRules = []string{"or2in", "dmlorderby", "standard", "countstar", "delimiter"}
+	testSQL := []struct {
+		input string
+		rules []string
+	}{
+		{"SELECT count(title) FROM film WHERE film_id = 1 OR film_id = 2", []string{"or2in", "countstar", "delimiter"}},
+		// standard 只改变了 SQL 的格式，不算规则生效
+		{"SELECT * FROM film;", nil},
+		{"DELETE FROM film WHERE film_id = 1 ORDER BY title", []string{"dmlorderby", "delimiter"}},
+		// vitess 无法解析的语句在 TiDB 语法树上改写
+		{"WITH f AS (SELECT film_id FROM film) SELECT COUNT(film_id) FROM f", []string{"countstar", "delimiter"}},
+	}
+	for _, sql := range testSQL {
+		rw := NewRewrite(sql.input).Rewrite()
+		var rules []string
+		for _, step := range rw.Steps {
+			rules = append(rules, step.Rule)
+		}
+		if fmt.Sprint(rules) != fmt.Sprint(sql.rules) {
+			t.Errorf("SQL: %s, want: %v, got: %v", sql.input, sql.rules, rules)
+		}
+		if len(rw.Steps) > 0 && rw.Steps[len(rw.Steps)-1].SQL != rw.NewSQL {
+			t.Errorf("SQL: %s, last step: %s, NewSQL: %s", sql.input, rw.Steps[len(rw.Steps)-1].SQL, rw.NewSQL)
+		}
+	}
+	common.Config.RewriteRules = orgRewriteRules
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestRewriteReport(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	orgRewriteRules := common.Config.RewriteRules
+	common.Config.RewriteRules = []string{"or2in", "countstar", "delimiter"}
+	err := common.GoldenDiff(func() {
+		for _, sql := range []string{
+			"SELECT count(title) FROM film WHERE film_id = 1 OR film_id = 2",
+			"SELECT * FROM film;",
+		} {
+			report := NewRewrite(sql).Rewrite().Report("ID")
+			report.Verify = "-- rewrite-verify: verified"
+			fmt.Println(report.Markdown())
+			js, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				t.Error(err)
+			}
+			fmt.Println(string(js))
+		}
+	}, t.Name(), update)
+	if err != nil {
+		t.Error(err)
+	}
+	common.Config.RewriteRules = orgRewriteRules
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
 func TestListRewriteRules(t *testing.T) {
 	common.Log.Debug("Entering function: %s", common.GetFunctionName())
 	err := common.GoldenDiff(func() {
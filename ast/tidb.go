@@ -27,6 +27,8 @@ import (
 	"github.com/kr/pretty"
 	"github.com/pingcap/parser"
 	"github.com/pingcap/parser/ast"
+	tiformat "github.com/pingcap/parser/format"
+	"github.com/pingcap/parser/model"
 	"github.com/tidwall/gjson"
 
 	// for pingcap parser
@@ -129,12 +131,17 @@ func SchemaMetaInfo(sql string, defaultDatabase string) []string {
 		// SetOprStmt represents "union/except/intersect statement"
 		case *ast.InsertStmt, *ast.SelectStmt, *ast.SetOprStmt, *ast.UpdateStmt, *ast.DeleteStmt:
 			// DML/DQL: INSERT, SELECT, UPDATE, DELETE
+			// WITH 子句中定义的 CTE 不是实体表
+			ctes := make(map[string]bool)
+			for _, cte := range FindCTEs(n) {
+				ctes[strings.ToLower(cte.Name)] = true
+			}
 			for _, tableRef := range common.JSONFind(jsonString, "TableRefs") {
 				for _, source := range common.JSONFind(tableRef, "Source") {
 					database := gjson.Get(source, "Schema.O")
 					table := gjson.Get(source, "Name.O")
 					if database.String() == "" {
-						if table.String() != "" {
+						if table.String() != "" && !ctes[strings.ToLower(table.String())] {
 							tables = append(tables, fmt.Sprintf("`%s`.`%s`", defaultDatabase, table.String()))
 						}
 					} else {
@@ -190,3 +197,328 @@ func SchemaMetaInfo(sql string, defaultDatabase string) []string {
 	}
 	return common.RemoveDuplicatesItem(tables)
 }
+
+// schemaRenamer 按映射关系替换 TableName 中的库名
+type schemaRenamer struct {
+	mapping map[string]string
+}
+
+// Enter implements ast.Visitor interface
+func (v *schemaRenamer) Enter(in ast.Node) (ast.Node, bool) {
+	if tn, ok := in.(*ast.TableName); ok && tn.Schema.O != "" {
+		if schema, ok := v.mapping[tn.Schema.O]; ok {
+			tn.Schema = model.NewCIStr(schema)
+		}
+	}
+	return in, false
+}
+
+// Leave implements ast.Visitor interface
+func (v *schemaRenamer) Leave(in ast.Node) (ast.Node, bool) {
+	return in, true
+}
+
+// RenameSchema 将 SQL 中 db.tb 形式的库名按 mapping 替换，返回重新生成的 SQL，未指定库名的表保持不变
+func RenameSchema(sql string, mapping map[string]string) (string, error) {
+	stmts, _, err := parser.New().Parse(sql, "", "")
+	if err != nil {
+		return sql, err
+	}
+
+	var newSQLs []string
+	for _, stmt := range stmts {
+		stmt.Accept(&schemaRenamer{mapping: mapping})
+		var sb strings.Builder
+		err = stmt.Restore(tiformat.NewRestoreCtx(tiformat.DefaultRestoreFlags, &sb))
+		if err != nil {
+			return sql, err
+		}
+		newSQLs = append(newSQLs, sb.String())
+	}
+	return strings.Join(newSQLs, ";\n"), nil
+}
+
+// CTE WITH 子句中定义的公用表表达式
+type CTE struct {
+	Name       string
+	Recursive  bool              // 是否在自身的定义中引用了自己
+	Query      *ast.SubqueryExpr // CTE 的定义
+	References int               // 在语句中被引用的次数，不含递归引用
+}
+
+// cteFinder 查找语句中的 CTE 定义及引用
+type cteFinder struct {
+	ctes    []*CTE
+	current *CTE // 当前正在遍历的 CTE 定义
+}
+
+// lookup 按名称查找 CTE，CTE 名称不区分大小写
+func (v *cteFinder) lookup(name string) *CTE {
+	// 后定义的同名 CTE 优先
+	for i := len(v.ctes) - 1; i >= 0; i-- {
+		if strings.EqualFold(v.ctes[i].Name, name) {
+			return v.ctes[i]
+		}
+	}
+	return nil
+}
+
+// Enter implements ast.Visitor interface
+func (v *cteFinder) Enter(in ast.Node) (ast.Node, bool) {
+	switch node := in.(type) {
+	case *ast.WithClause:
+		for _, c := range node.CTEs {
+			cte := &CTE{Name: c.Name.O, Query: c.Query}
+			v.ctes = append(v.ctes, cte)
+			// WITH RECURSIVE 中的 CTE 在定义中可以引用自己
+			parent := v.current
+			if node.IsRecursive {
+				v.current = cte
+			} else {
+				v.current = nil
+			}
+			c.Query.Accept(v)
+			v.current = parent
+		}
+		return in, true
+	case *ast.TableName:
+		if node.Schema.O != "" {
+			return in, false
+		}
+		if cte := v.lookup(node.Name.O); cte != nil {
+			if cte == v.current {
+				cte.Recursive = true
+			} else {
+				cte.References++
+			}
+		}
+	}
+	return in, false
+}
+
+// Leave implements ast.Visitor interface
+func (v *cteFinder) Leave(in ast.Node) (ast.Node, bool) {
+	return in, true
+}
+
+// FindCTEs 获取语句中 WITH 子句定义的所有 CTE 及其被引用的次数
+func FindCTEs(node ast.Node) []*CTE {
+	v := &cteFinder{}
+	node.Accept(v)
+	return v.ctes
+}
+
+// GetTiMeta 从 TiDB 语法树中获取库表信息，构建到 db->table 层级，CTE 及派生表的别名会归于 ""（空）数据库 ""（空）表下
+// vitess 不支持 WITH, 窗口函数等语法，这类语句使用 GetTiMeta 代替 GetMeta。当 meta 不为 nil 时，返回值会将新老 meta 合并去重
+func GetTiMeta(node ast.Node, meta common.Meta) common.Meta {
+	if meta == nil {
+		meta = make(map[string]*common.DB)
+	}
+
+	ctes := make(map[string]bool)
+	for _, cte := range FindCTEs(node) {
+		ctes[strings.ToLower(cte.Name)] = true
+	}
+
+	node.Accept(&tiMetaFinder{ctes: ctes, meta: meta})
+	return meta
+}
+
+// tiMetaFinder 查找 TableSource 中的实体表及别名
+type tiMetaFinder struct {
+	ctes map[string]bool
+	meta common.Meta
+}
+
+// Enter implements ast.Visitor interface
+func (v *tiMetaFinder) Enter(in ast.Node) (ast.Node, bool) {
+	source, ok := in.(*ast.TableSource)
+	if !ok {
+		return in, false
+	}
+
+	table, ok := source.Source.(*ast.TableName)
+	if !ok || (table.Schema.O == "" && v.ctes[table.Name.L]) {
+		// 子查询或 CTE，只记录别名
+		alias := source.AsName.O
+		if ok && alias == "" {
+			alias = table.Name.O
+		}
+		if v.meta[""] == nil {
+			v.meta[""] = common.NewDB("")
+		}
+		if v.meta[""].Table[""] == nil {
+			v.meta[""].Table[""] = common.NewTable("")
+		}
+		if alias != "" {
+			v.meta[""].Table[""].TableAliases = append(v.meta[""].Table[""].TableAliases, alias)
+		}
+		return in, false
+	}
+
+	dbName, tbName := table.Schema.O, table.Name.O
+	if v.meta[dbName] == nil {
+		v.meta[dbName] = common.NewDB(dbName)
+	}
+	if v.meta[dbName].Table[tbName] == nil {
+		v.meta[dbName].Table[tbName] = common.NewTable(tbName)
+	}
+	mergeAlias(dbName, tbName, source.AsName.O, v.meta)
+	return in, false
+}
+
+// Leave implements ast.Visitor interface
+func (v *tiMetaFinder) Leave(in ast.Node) (ast.Node, bool) {
+	return in, true
+}
+
+// SplitCTE 将含有 WITH 子句的查询拆分为每个 CTE 的定义及去掉 WITH 子句后的主查询，不含 WITH 子句时返回空
+func SplitCTE(node ast.StmtNode) []string {
+	var with *ast.WithClause
+	var main ast.Node
+	switch stmt := node.(type) {
+	case *ast.SelectStmt:
+		if stmt.With != nil {
+			s := *stmt
+			s.With, with, main = nil, stmt.With, &s
+		}
+	case *ast.SetOprStmt:
+		if stmt.With != nil {
+			s := *stmt
+			s.With, with, main = nil, stmt.With, &s
+		}
+	}
+	if with == nil {
+		return nil
+	}
+
+	var queries []string
+	for _, cte := range with.CTEs {
+		nodes := []ast.Node{cte.Query.Query}
+		// 递归 CTE 的各部分分别拆分
+		if union, ok := cte.Query.Query.(*ast.SetOprStmt); ok && union.SelectList != nil {
+			nodes = nodes[:0]
+			for _, sel := range union.SelectList.Selects {
+				nodes = append(nodes, sel)
+			}
+		}
+		for _, n := range nodes {
+			if sql := restoreNode(n); sql != "" {
+				queries = append(queries, sql)
+			}
+		}
+	}
+	if sql := restoreNode(main); sql != "" {
+		queries = append(queries, sql)
+	}
+	return queries
+}
+
+// restoreNode 将语法树还原为 SQL，出错时返回空
+func restoreNode(node ast.Node) string {
+	var sb strings.Builder
+	if err := node.Restore(tiformat.NewRestoreCtx(tiformat.DefaultRestoreFlags, &sb)); err != nil {
+		common.Log.Warn("restoreNode Restore Error: %s", err.Error())
+		return ""
+	}
+	return sb.String()
+}
+
+// WindowFunc 窗口函数及其生效的窗口定义，命名窗口已展开
+type WindowFunc struct {
+	Func        *ast.WindowFuncExpr
+	PartitionBy []*ast.ByItem
+	OrderBy     []*ast.ByItem
+}
+
+// windowFuncFinder 查找 SELECT 中的窗口函数，不进入子查询
+type windowFuncFinder struct {
+	funcs []*ast.WindowFuncExpr
+}
+
+// Enter implements ast.Visitor interface
+func (v *windowFuncFinder) Enter(in ast.Node) (ast.Node, bool) {
+	switch node := in.(type) {
+	case *ast.SubqueryExpr:
+		return in, true
+	case *ast.WindowFuncExpr:
+		v.funcs = append(v.funcs, node)
+	}
+	return in, false
+}
+
+// Leave implements ast.Visitor interface
+func (v *windowFuncFinder) Leave(in ast.Node) (ast.Node, bool) {
+	return in, true
+}
+
+// FindWindowFuncs 获取 SELECT 字段及 ORDER BY 中使用的窗口函数，不包含子查询中的窗口函数
+func FindWindowFuncs(sel *ast.SelectStmt) []*WindowFunc {
+	v := &windowFuncFinder{}
+	if sel.Fields != nil {
+		sel.Fields.Accept(v)
+	}
+	if sel.OrderBy != nil {
+		sel.OrderBy.Accept(v)
+	}
+
+	var funcs []*WindowFunc
+	for _, f := range v.funcs {
+		wf := &WindowFunc{Func: f}
+		spec := f.Spec
+		// OVER w 或 OVER (w ORDER BY ...) 引用 WINDOW 子句中的命名窗口，最多展开 len(sel.WindowSpecs) 层防止循环引用
+		for i := 0; i <= len(sel.WindowSpecs); i++ {
+			if spec.PartitionBy != nil && wf.PartitionBy == nil {
+				wf.PartitionBy = spec.PartitionBy.Items
+			}
+			if spec.OrderBy != nil && wf.OrderBy == nil {
+				wf.OrderBy = spec.OrderBy.Items
+			}
+
+			ref := spec.Ref.L
+			if spec.OnlyAlias {
+				ref = spec.Name.L
+			}
+			if ref == "" {
+				break
+			}
+			found := false
+			for _, named := range sel.WindowSpecs {
+				if named.Name.L == ref {
+					spec, found = named, true
+					break
+				}
+			}
+			if !found {
+				break
+			}
+		}
+		funcs = append(funcs, wf)
+	}
+	return funcs
+}
+
+// selectFinder 查找语句中所有的 SELECT
+type selectFinder struct {
+	selects []*ast.SelectStmt
+}
+
+// Enter implements ast.Visitor interface
+func (v *selectFinder) Enter(in ast.Node) (ast.Node, bool) {
+	if sel, ok := in.(*ast.SelectStmt); ok {
+		v.selects = append(v.selects, sel)
+	}
+	return in, false
+}
+
+// Leave implements ast.Visitor interface
+func (v *selectFinder) Leave(in ast.Node) (ast.Node, bool) {
+	return in, true
+}
+
+// FindSelects 获取语句中所有的 SELECT，包括 UNION, 子查询及 CTE 中的 SELECT
+func FindSelects(node ast.Node) []*ast.SelectStmt {
+	v := &selectFinder{}
+	node.Accept(v)
+	return v.selects
+}
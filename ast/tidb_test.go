@@ -18,9 +18,13 @@ package ast
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/laojianzi/soar/common"
+
+	"github.com/kr/pretty"
+	"github.com/pingcap/parser/ast"
 )
 
 func TestPrintPrettyStmtNode(t *testing.T) {
@@ -71,6 +75,8 @@ func TestSchemaMetaInfo(t *testing.T) {
 		"create database db",
 		"create index idx_col on tbl (col)",
 		"DROP INDEX idx_col on tbl",
+		"with t as (select * from ta) select * from t join tb on t.id = tb.id",
+		"with recursive t(n) as (select 1 union all select n + 1 from t where n < 10) select * from t",
 	}
 	// fmt.Println(sqls[len(sqls)-1])
 	// fmt.Println(SchemaMetaInfo(sqls[len(sqls)-1], "sakila"))
@@ -114,3 +120,175 @@ func TestRemoveIncompatibleWords(t *testing.T) {
 	}
 	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
 }
+
+func TestRenameSchema(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	mapping := map[string]string{"sakila": "optimizer_sakila", "world": "optimizer_world"}
+	sqls := [][]string{
+		{
+			"CREATE TABLE sakila.t1 (id INT)",
+			"CREATE TABLE `optimizer_sakila`.`t1` (`id` INT)",
+		},
+		{
+			"create table t2 like world.city",
+			"CREATE TABLE `t2` LIKE `optimizer_world`.`city`",
+		},
+		{
+			"alter table sakila.film add index idx_title(title)",
+			"ALTER TABLE `optimizer_sakila`.`film` ADD INDEX `idx_title`(`title`)",
+		},
+		{
+			"rename table sakila.film to world.film, other.t to t",
+			"RENAME TABLE `optimizer_sakila`.`film` TO `optimizer_world`.`film`, `other`.`t` TO `t`",
+		},
+	}
+	for _, sql := range sqls {
+		newSQL, err := RenameSchema(sql[0], mapping)
+		if err != nil {
+			t.Error(err)
+		}
+		if newSQL != sql[1] {
+			t.Errorf("want: %s, got: %s", sql[1], newSQL)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestFindCTEs(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	sqls := []struct {
+		sql        string
+		names      []string
+		recursive  []bool
+		references []int
+	}{
+		{"select * from t", nil, nil, nil},
+		{"with t as (select 1) select * from t", []string{"t"}, []bool{false}, []int{1}},
+		{"with t as (select 1) select * from t a join t b on a.id = b.id", []string{"t"}, []bool{false}, []int{2}},
+		{"with t as (select 1) select * from db.t", []string{"t"}, []bool{false}, []int{0}},
+		{"with recursive t(n) as (select 1 union all select n + 1 from t where n < 10) select * from t", []string{"t"}, []bool{true}, []int{1}},
+		{"with a as (select 1), b as (select * from a) select * from a, b", []string{"a", "b"}, []bool{false, false}, []int{2, 1}},
+	}
+	for _, sql := range sqls {
+		stmts, err := TiParse(sql.sql, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctes := FindCTEs(stmts[0])
+		if len(ctes) != len(sql.names) {
+			t.Errorf("SQL: %s, want %d CTEs, got %d", sql.sql, len(sql.names), len(ctes))
+			continue
+		}
+		for i, cte := range ctes {
+			if cte.Name != sql.names[i] || cte.Recursive != sql.recursive[i] || cte.References != sql.references[i] {
+				t.Errorf("SQL: %s, got: %s %v %d", sql.sql, cte.Name, cte.Recursive, cte.References)
+			}
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestGetTiMeta(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	sqls := []string{
+		"with t as (select * from ta) select * from t join sakila.tb b on t.id = b.id",
+		"select a, row_number() over (partition by b order by c) from ta",
+		"select * from (select * from ta) x",
+	}
+	err := common.GoldenDiff(func() {
+		for _, sql := range sqls {
+			stmts, err := TiParse(sql, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fmt.Println(sql)
+			pretty.Println(GetTiMeta(stmts[0], nil))
+		}
+	}, t.Name(), update)
+	if nil != err {
+		t.Fatal(err)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestSplitCTE(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	sqls := [][]string{
+		{"select * from t"},
+		{
+			"with t as (select * from ta where a = 1) select * from t where b = 2",
+			"SELECT * FROM `ta` WHERE `a`=1",
+			"SELECT * FROM `t` WHERE `b`=2",
+		},
+		{
+			"with recursive t(n) as (select 1 union all select n + 1 from t where n < 10) select * from t",
+			"SELECT 1",
+			"SELECT `n`+1 FROM `t` WHERE `n`<10",
+			"SELECT * FROM `t`",
+		},
+	}
+	for _, sql := range sqls {
+		stmts, err := TiParse(sql[0], "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		queries := SplitCTE(stmts[0])
+		if strings.Join(queries, "\n") != strings.Join(sql[1:], "\n") {
+			t.Errorf("SQL: %s, got: %v", sql[0], queries)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestFindWindowFuncs(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	sqls := []struct {
+		sql       string
+		partition []int
+		order     []int
+	}{
+		{"select * from t", nil, nil},
+		{"select row_number() over (partition by a order by b, c) from t", []int{1}, []int{2}},
+		{"select sum(a) over () from t order by rank() over (order by b)", []int{0, 0}, []int{0, 1}},
+		{"select sum(a) over w from t window w as (partition by b)", []int{1}, []int{0}},
+		{"select sum(a) over (w order by c) from t window w as (partition by b, d)", []int{2}, []int{1}},
+		{"select (select max(a) over () from t1) from t", nil, nil},
+	}
+	for _, sql := range sqls {
+		stmts, err := TiParse(sql.sql, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		funcs := FindWindowFuncs(stmts[0].(*ast.SelectStmt))
+		if len(funcs) != len(sql.partition) {
+			t.Errorf("SQL: %s, want %d window functions, got %d", sql.sql, len(sql.partition), len(funcs))
+			continue
+		}
+		for i, f := range funcs {
+			if len(f.PartitionBy) != sql.partition[i] || len(f.OrderBy) != sql.order[i] {
+				t.Errorf("SQL: %s, got partition by: %d, order by: %d", sql.sql, len(f.PartitionBy), len(f.OrderBy))
+			}
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestFindSelects(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	sqls := map[string]int{
+		"select 1": 1,
+		"select * from t where a in (select a from t1)":       2,
+		"with c as (select 1) select * from c union select 2": 3,
+		"update t set a = 1": 0,
+	}
+	for sql, count := range sqls {
+		stmts, err := TiParse(sql, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if selects := FindSelects(stmts[0]); len(selects) != count {
+			t.Errorf("SQL: %s, want %d SELECT, got %d", sql, count, len(selects))
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
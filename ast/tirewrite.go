@@ -0,0 +1,250 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ast
+
+import (
+	"strings"
+
+	"github.com/laojianzi/soar/common"
+
+	"github.com/pingcap/parser/ast"
+	tiformat "github.com/pingcap/parser/format"
+	"github.com/pingcap/parser/model"
+	driver "github.com/pingcap/tidb/types/parser_driver"
+)
+
+// tiRestoreFlags 关键字小写，与 vitess 输出的 SQL 风格保持一致
+const tiRestoreFlags = tiformat.RestoreStringSingleQuotes | tiformat.RestoreKeyWordLowercase | tiformat.RestoreNameBackQuotes |
+	tiformat.RestoreStringWithoutCharset
+
+// tiStarExpr COUNT(*) 中的 *，TiDB 将其解析为常量 1，还原时需要输出 *
+type tiStarExpr struct {
+	*driver.ValueExpr
+}
+
+// Restore implements ast.Node interface
+func (n *tiStarExpr) Restore(ctx *tiformat.RestoreCtx) error {
+	ctx.WritePlain("*")
+	return nil
+}
+
+// Accept implements ast.Node interface，driver.ValueExpr 的 Accept 会将节点替换回 *driver.ValueExpr
+func (n *tiStarExpr) Accept(v ast.Visitor) (ast.Node, bool) {
+	newNode, _ := v.Enter(n)
+	return v.Leave(newNode)
+}
+
+// newTiStarExpr 返回 COUNT(*) 中的 *
+func newTiStarExpr() *tiStarExpr {
+	return &tiStarExpr{ast.NewValueExpr(1, "", "").(*driver.ValueExpr)}
+}
+
+// tiCountStar 将 COUNT(1) 的参数替换为 *，columns 为 true 时同时替换 COUNT(col)
+type tiCountStar struct {
+	columns bool
+}
+
+// Enter implements ast.Visitor interface
+func (v *tiCountStar) Enter(in ast.Node) (ast.Node, bool) {
+	return in, false
+}
+
+// Leave implements ast.Visitor interface
+func (v *tiCountStar) Leave(in ast.Node) (ast.Node, bool) {
+	f, ok := in.(*ast.AggregateFuncExpr)
+	if !ok || !strings.EqualFold(f.F, ast.AggFuncCount) || f.Distinct || len(f.Args) != 1 {
+		return in, true
+	}
+	switch arg := f.Args[0].(type) {
+	case *driver.ValueExpr:
+		// COUNT(*) 与 COUNT(1) 解析后无法区分，统一还原为 COUNT(*)
+		if val, ok := arg.GetValue().(int64); ok && val == 1 {
+			f.Args[0] = newTiStarExpr()
+		}
+	case *ast.ColumnNameExpr:
+		if v.columns {
+			f.Args[0] = newTiStarExpr()
+		}
+	}
+	return in, true
+}
+
+// tiRestore 将 TiDB 语法树还原为 SQL，出错时返回空
+func tiRestore(node ast.Node) string {
+	node.Accept(&tiCountStar{})
+	var sb strings.Builder
+	if err := node.Restore(tiformat.NewRestoreCtx(tiRestoreFlags, &sb)); err != nil {
+		common.Log.Warn("tiRestore Restore Error: %s", err.Error())
+		return ""
+	}
+	return sb.String()
+}
+
+// restoreTiStmt 使用 TiDB 的 Restore 功能将改写后的语法树转写回 SQL
+func (rw *Rewrite) restoreTiStmt() *Rewrite {
+	if sql := tiRestore(rw.TiStmt); sql != "" {
+		rw.NewSQL = sql
+	}
+	return rw
+}
+
+// RewriteTiStandard standard: vitess 无法解析时使用 TiDB 提供的 Restore 功能将抽象语法树转写回 SQL
+func (rw *Rewrite) RewriteTiStandard() *Rewrite {
+	return rw.restoreTiStmt()
+}
+
+// RewriteTiCountStar countstar: 在 TiDB 语法树上将 COUNT(col) 改写为 COUNT(*)
+func (rw *Rewrite) RewriteTiCountStar() *Rewrite {
+	rw.TiStmt.Accept(&tiCountStar{columns: true})
+	return rw.restoreTiStmt()
+}
+
+// RewriteTiRemoveDMLOrderBy dmlorderby: 在 TiDB 语法树上删除 DML 及其子查询中无 LIMIT 的 ORDER BY
+func (rw *Rewrite) RewriteTiRemoveDMLOrderBy() *Rewrite {
+	switch st := rw.TiStmt.(type) {
+	case *ast.UpdateStmt:
+		if st.Limit == nil {
+			st.Order = nil
+		}
+	case *ast.DeleteStmt:
+		if st.Limit == nil {
+			st.Order = nil
+		}
+	default:
+		return rw
+	}
+	for _, sel := range FindSelects(rw.TiStmt) {
+		if sel.Limit == nil {
+			sel.OrderBy = nil
+		}
+	}
+	return rw.restoreTiStmt()
+}
+
+// tiTableSource FROM 子句中的表，CTE 及派生表的 columns 为 nil
+type tiTableSource struct {
+	qualifier string // 别名，没有别名时为表名
+	schema    string
+	columns   []*common.Column
+}
+
+// RewriteTiStar2Columns star2columns: 在 TiDB 语法树上为 SELECT * 补全表的列信息
+// CTE 及派生表的列无法从测试环境获取，引用了这类表的 * 不进行替换
+func (rw *Rewrite) RewriteTiStar2Columns() *Rewrite {
+	// 如果未配置mysql环境或从环境中获取失败，*不进行替换
+	if common.Config.TestDSN.Disable || len(rw.Columns) == 0 {
+		common.Log.Debug("(rw *Rewrite) RewriteTiStar2Columns(): Rewrite failed. TestDSN.Disable: %v, len(rw.Columns):%d",
+			common.Config.TestDSN.Disable, len(rw.Columns))
+		return rw
+	}
+
+	ctes := make(map[string]bool)
+	for _, cte := range FindCTEs(rw.TiStmt) {
+		ctes[strings.ToLower(cte.Name)] = true
+	}
+
+	for _, sel := range FindSelects(rw.TiStmt) {
+		if sel.Fields == nil || sel.From == nil || sel.From.TableRefs == nil {
+			continue
+		}
+		sources, using := rw.tiTableSources(sel.From.TableRefs, ctes)
+
+		var fields []*ast.SelectField
+		for _, field := range sel.Fields.Fields {
+			if field.WildCard == nil {
+				fields = append(fields, field)
+				continue
+			}
+
+			// 找出 * 对应的表，JOIN USING 及 NATURAL JOIN 中的 * 会合并同名列，不进行替换
+			var matched []*tiTableSource
+			for _, source := range sources {
+				if field.WildCard.Table.O == "" ||
+					(strings.EqualFold(field.WildCard.Table.O, source.qualifier) &&
+						(field.WildCard.Schema.O == "" || strings.EqualFold(field.WildCard.Schema.O, source.schema))) {
+					matched = append(matched, source)
+				}
+			}
+			expandable := len(matched) > 0 && !(field.WildCard.Table.O == "" && using)
+			for _, source := range matched {
+				if source.columns == nil {
+					expandable = false
+				}
+			}
+			if !expandable {
+				fields = append(fields, field)
+				continue
+			}
+
+			// 单张表 select * 不补全表名，避免SQL过长，多张表需要补全表名
+			for _, source := range matched {
+				var table string
+				if len(sources) > 1 {
+					table = source.qualifier
+				}
+				for _, col := range source.columns {
+					fields = append(fields, &ast.SelectField{
+						Expr: &ast.ColumnNameExpr{Name: &ast.ColumnName{
+							Table: model.NewCIStr(table),
+							Name:  model.NewCIStr(col.Name),
+						}},
+					})
+				}
+			}
+		}
+		sel.Fields.Fields = fields
+	}
+	return rw.restoreTiStmt()
+}
+
+// tiTableSources 获取 FROM 子句中的所有表，第二个返回值表示是否使用了 JOIN USING 或 NATURAL JOIN
+func (rw *Rewrite) tiTableSources(node ast.ResultSetNode, ctes map[string]bool) ([]*tiTableSource, bool) {
+	switch n := node.(type) {
+	case *ast.Join:
+		sources, using := rw.tiTableSources(n.Left, ctes)
+		if n.Right != nil {
+			right, rightUsing := rw.tiTableSources(n.Right, ctes)
+			sources = append(sources, right...)
+			using = using || rightUsing || len(n.Using) > 0 || n.NaturalJoin
+		}
+		return sources, using
+	case *ast.TableSource:
+		source := &tiTableSource{qualifier: n.AsName.O}
+		table, ok := n.Source.(*ast.TableName)
+		if !ok {
+			return []*tiTableSource{source}, false
+		}
+		if source.qualifier == "" {
+			source.qualifier = table.Name.O
+		}
+		source.schema = table.Schema.O
+		if table.Schema.O == "" && ctes[table.Name.L] {
+			return []*tiTableSource{source}, false
+		}
+		for db, tables := range rw.Columns {
+			if table.Schema.O != "" && !strings.EqualFold(db, table.Schema.O) {
+				continue
+			}
+			if cols, ok := tables[table.Name.O]; ok && len(cols) > 0 {
+				source.columns = cols
+				break
+			}
+		}
+		return []*tiTableSource{source}, false
+	}
+	return nil, false
+}
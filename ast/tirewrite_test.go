@@ -0,0 +1,180 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ast
+
+import (
+	"testing"
+
+	"github.com/laojianzi/soar/common"
+)
+
+// tiRewriteColumns TiDB 语法树重写测试使用的表结构
+var tiRewriteColumns = common.TableColumns{
+	"sakila": {
+		"film": {
+			{Name: "film_id", Table: "film"},
+			{Name: "title", Table: "film"},
+		},
+		"actor": {
+			{Name: "actor_id", Table: "actor"},
+		},
+	},
+}
+
+func TestNewRewriteTiDB(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	// vitess 不支持 WITH 语法，使用 TiDB 解析
+	rw := NewRewrite("WITH f AS (SELECT * FROM film) SELECT * FROM f")
+	if rw == nil || rw.Stmt != nil || rw.TiStmt == nil {
+		t.Errorf("want TiDB statement, got: %v", rw)
+	}
+
+	rw = NewRewrite("SELECT * FROM film")
+	if rw == nil || rw.Stmt == nil || rw.TiStmt != nil {
+		t.Errorf("want vitess statement, got: %v", rw)
+	}
+
+	for _, sql := range []string{"SELECT * FROM", "WITH f AS (SELECT 1) SELECT * FROM f; SELECT 1"} {
+		if rw = NewRewrite(sql); rw != nil {
+			t.Errorf("SQL: %s, want nil, got: %v", sql, rw)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestRewriteTiStar2Columns(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	orgTestDSNStatus := common.Config.TestDSN.Disable
+	common.Config.TestDSN.Disable = false
+	testSQL := []map[string]string{
+		{
+			"input":  "WITH f AS (SELECT * FROM film) SELECT * FROM f",
+			"output": "with `f` as (select `film_id`,`title` from `film`) select * from `f`",
+		},
+		{
+			"input":  "SELECT *, ROW_NUMBER() OVER (ORDER BY film_id) AS rn FROM film",
+			"output": "select `film_id`,`title`,row_number() over (order by `film_id`) as `rn` from `film`",
+		},
+		{
+			"input":  "SELECT f.*, a.* FROM film f JOIN actor a ON f.film_id = a.actor_id WINDOW w AS (ORDER BY f.film_id)",
+			"output": "select `f`.`film_id`,`f`.`title`,`a`.`actor_id` from `film` as `f` join `actor` as `a` on `f`.`film_id`=`a`.`actor_id` window `w` as (order by `f`.`film_id`)",
+		},
+		// CTE 的列无法获取，只替换实体表的 *
+		{
+			"input":  "WITH f AS (SELECT film_id FROM film) SELECT f.*, film.* FROM f, film WINDOW w AS ()",
+			"output": "with `f` as (select `film_id` from `film`) select `f`.*,`film`.`film_id`,`film`.`title` from (`f`) join `film` window `w` as ()",
+		},
+		// JOIN USING 会合并同名列，不进行替换
+		{
+			"input":  "WITH f AS (SELECT 1) SELECT * FROM film JOIN actor USING (film_id)",
+			"output": "with `f` as (select 1) select * from `film` join `actor` using (`film_id`)",
+		},
+	}
+
+	for _, sql := range testSQL {
+		rw := NewRewrite(sql["input"])
+		rw.Columns = tiRewriteColumns
+		rw.RewriteTiStar2Columns()
+		if rw.NewSQL != sql["output"] {
+			t.Errorf("want: %s\ngot: %s", sql["output"], rw.NewSQL)
+		}
+	}
+	common.Config.TestDSN.Disable = orgTestDSNStatus
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestRewriteTiCountStar(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	testSQL := []map[string]string{
+		{
+			"input":  "WITH f AS (SELECT film_id FROM film) SELECT COUNT(film_id), COUNT(1), COUNT(*) FROM f",
+			"output": "with `f` as (select `film_id` from `film`) select count(*),count(*),count(*) from `f`",
+		},
+		{
+			"input":  "SELECT COUNT(DISTINCT title), COUNT(film_id) OVER (PARTITION BY title) FROM film",
+			"output": "select count(distinct `title`),count(`film_id`) over (partition by `title`) from `film`",
+		},
+	}
+
+	for _, sql := range testSQL {
+		rw := NewRewrite(sql["input"])
+		rw.RewriteTiCountStar()
+		if rw.NewSQL != sql["output"] {
+			t.Errorf("want: %s\ngot: %s", sql["output"], rw.NewSQL)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestRewriteTiRemoveDMLOrderBy(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	testSQL := []map[string]string{
+		{
+			"input":  "WITH ids AS (SELECT film_id FROM inventory ORDER BY film_id) DELETE FROM film WHERE film_id IN (SELECT film_id FROM ids) ORDER BY film_id",
+			"output": "with `ids` as (select `film_id` from `inventory`) delete from `film` where `film_id` in (select `film_id` from `ids`)",
+		},
+		{
+			"input":  "WITH ids AS (SELECT film_id FROM inventory) UPDATE film SET title = 'a' WHERE film_id IN (SELECT film_id FROM ids) ORDER BY film_id LIMIT 10",
+			"output": "with `ids` as (select `film_id` from `inventory`) update `film` set `title`='a' where `film_id` in (select `film_id` from `ids`) order by `film_id` limit 10",
+		},
+		// 非 DML 语句不改写
+		{
+			"input":  "WITH f AS (SELECT film_id FROM film) SELECT film_id FROM f ORDER BY film_id",
+			"output": "",
+		},
+	}
+
+	for _, sql := range testSQL {
+		rw := NewRewrite(sql["input"])
+		rw.RewriteTiRemoveDMLOrderBy()
+		if rw.NewSQL != sql["output"] {
+			t.Errorf("want: %s\ngot: %s", sql["output"], rw.NewSQL)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestRewriteTiDB(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	orgTestDSNStatus := common.Config.TestDSN.Disable
+	common.Config.TestDSN.Disable = false
+	orgRewriteRules := common.Config.RewriteRules
+	common.Config.RewriteRules = []string{"star2columns", "or2in", "dmlorderby", "standard", "countstar", "delimiter"}
+
+	testSQL := []map[string]string{
+		{
+			"input":  "WITH f AS (SELECT * FROM film WHERE film_id = 1 OR film_id = 2) SELECT COUNT(film_id) FROM f",
+			"output": "with `f` as (select `film_id`,`title` from `film` where `film_id`=1 or `film_id`=2) select count(*) from `f`;",
+		},
+		{
+			"input":  "SELECT *, RANK() OVER w FROM film WINDOW w AS (ORDER BY title)",
+			"output": "select `film_id`,`title`,rank() over `w` from `film` window `w` as (order by `title`);",
+		},
+	}
+
+	for _, sql := range testSQL {
+		rw := NewRewrite(sql["input"])
+		rw.Columns = tiRewriteColumns
+		rw.Rewrite()
+		if rw.NewSQL != sql["output"] {
+			t.Errorf("want: %s\ngot: %s", sql["output"], rw.NewSQL)
+		}
+	}
+	common.Config.RewriteRules = orgRewriteRules
+	common.Config.TestDSN.Disable = orgTestDSNStatus
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
@@ -1004,3 +1004,31 @@ func QueryType(sql string) string {
 	}
 	return "UNKNOWN"
 }
+
+// BindParams 将参数按顺序替换到预处理语句的 ? 中，跳过字符串及标识符中的 ?，参数不足时保留剩余的 ?
+func BindParams(sql string, values []string) string {
+	var buf strings.Builder
+	var quote byte
+	n := 0
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote != '`' && i+1 < len(sql) {
+				buf.WriteByte(c)
+				i++
+				c = sql[i]
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '?' && n < len(values):
+			buf.WriteString(values[n])
+			n++
+			continue
+		}
+		buf.WriteByte(c)
+	}
+	return buf.String()
+}
@@ -274,3 +274,22 @@ func TestQueryType(t *testing.T) {
 	}
 	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
 }
+
+func TestBindParams(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	cases := []struct {
+		sql    string
+		values []string
+		want   string
+	}{
+		{"select ? from t where a = ?", []string{"1", "'x'"}, "select 1 from t where a = 'x'"},
+		{"select '?', `?`, \"\\\"?\" from t where a = ?", []string{"1"}, "select '?', `?`, \"\\\"?\" from t where a = 1"},
+		{"select ? from t where a = ? and b = ?", []string{"1", "'x'"}, "select 1 from t where a = 'x' and b = ?"},
+	}
+	for _, c := range cases {
+		if got := BindParams(c.sql, c.values); got != c.want {
+			t.Errorf("want: %s, got: %s", c.want, got)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
@@ -51,19 +51,34 @@ var (
 // Configuration 配置文件定义结构体
 type Configuration struct {
 	// +++++++++++++++测试环境+++++++++++++++++
-	OnlineDSN               *Dsn   `yaml:"online-dsn"`                // 线上环境数据库配置
-	TestDSN                 *Dsn   `yaml:"test-dsn"`                  // 测试环境数据库配置
-	AllowOnlineAsTest       bool   `yaml:"allow-online-as-test"`      // 允许 Online 环境也可以当作 Test 环境
-	DropTestTemporary       bool   `yaml:"drop-test-temporary"`       // 是否清理Test环境产生的临时库表
-	CleanupTestDatabase     bool   `yaml:"cleanup-test-database"`     // 清理残余的测试数据库（程序异常退出或未开启drop-test-temporary）  issue #48
-	OnlySyntaxCheck         bool   `yaml:"only-syntax-check"`         // 只做语法检查不输出优化建议
-	SamplingStatisticTarget int    `yaml:"sampling-statistic-target"` // 数据采样因子，对应 PostgreSQL 的 default_statistics_target
-	Sampling                bool   `yaml:"sampling"`                  // 数据采样开关
-	SamplingCondition       string `yaml:"sampling-condition"`        // 指定采样条件，如：WHERE xxx LIMIT xxx;
-	Profiling               bool   `yaml:"profiling"`                 // 在开启数据采样的情况下，在测试环境执行进行profile
-	Trace                   bool   `yaml:"trace"`                     // 在开启数据采样的情况下，在测试环境执行进行Trace
-	Explain                 bool   `yaml:"explain"`                   // Explain开关
-	Delimiter               string `yaml:"delimiter"`                 // SQL分隔符
+	OnlineDSN               *Dsn     `yaml:"online-dsn"`                 // 线上环境数据库配置
+	TestDSN                 *Dsn     `yaml:"test-dsn"`                   // 测试环境数据库配置
+	AllowOnlineAsTest       bool     `yaml:"allow-online-as-test"`       // 允许 Online 环境也可以当作 Test 环境
+	OnlineAllowStatements   []string `yaml:"online-allow-statements"`    // 允许在 Online 环境执行的语句类型，如：select, show, explain
+	OnlineDenyFunctions     []string `yaml:"online-deny-functions"`      // 禁止在 Online 环境执行的函数，如：sleep, get_lock
+	OnlineMaxExecutionTime  int      `yaml:"online-max-execution-time"`  // Online 环境 SELECT 最长执行时间，单位毫秒，0 为不限制
+	OnlineLockWaitTimeout   int      `yaml:"online-lock-wait-timeout"`   // Online 环境会话的 lock_wait_timeout, innodb_lock_wait_timeout，单位秒，0 为不设置
+	OnlineResourceGroup     string   `yaml:"online-resource-group"`      // Online 环境 SELECT 使用的低优先级资源组，MySQL 8.0 及以上版本支持，需预先在线上创建，为空时不切换资源组
+	OnlineMaxThreadsRunning int      `yaml:"online-max-threads-running"` // Online 环境 Threads_running 超过该值时跳过 EXPLAIN, 数据采样等查询，0 为不检查
+	OnlineMaxReplicationLag int      `yaml:"online-max-replication-lag"` // Online 环境主从延迟超过该值（秒）时跳过 EXPLAIN, 数据采样等查询，0 为不检查
+	DropTestTemporary       bool     `yaml:"drop-test-temporary"`        // 是否清理Test环境产生的临时库表
+	CleanupTestDatabase     bool     `yaml:"cleanup-test-database"`      // 清理残余的测试数据库（程序异常退出或未开启drop-test-temporary）  issue #48
+	OnlySyntaxCheck         bool     `yaml:"only-syntax-check"`          // 只做语法检查不输出优化建议
+	SamplingStatisticTarget int      `yaml:"sampling-statistic-target"`  // 数据采样因子，对应 PostgreSQL 的 default_statistics_target
+	Sampling                bool     `yaml:"sampling"`                   // 数据采样开关
+	SamplingCondition       string   `yaml:"sampling-condition"`         // 指定采样条件，如：WHERE xxx LIMIT xxx;
+	SamplingMaskRules       []string `yaml:"sampling-mask-rules"`        // 数据采样脱敏规则，格式为 匹配方式:正则:脱敏方法，匹配方式支持 name, type, comment，脱敏方法支持 hash, email, phone, date
+	SamplingMaskSecret      string   `yaml:"sampling-mask-secret"`       // 数据脱敏使用的 HMAC 密钥，不指定时每次运行随机生成，多次采样的脱敏结果不一致
+	SamplingStatistics      bool     `yaml:"sampling-statistics"`        // 统计信息采样开关，只同步线上的表、索引统计信息及直方图，不泵取数据
+	Profiling               bool     `yaml:"profiling"`                  // 在开启数据采样的情况下，在测试环境执行进行profile
+	Trace                   bool     `yaml:"trace"`                      // 在开启数据采样的情况下，在测试环境执行进行Trace
+	Explain                 bool     `yaml:"explain"`                    // Explain开关
+	Delimiter               string   `yaml:"delimiter"`                  // SQL分隔符
+	InputFormat             string   `yaml:"input-format"`               // 待评审 SQL 的输入格式，sql 为按照分隔符切分的 SQL，mybatis 为 MyBatis mapper XML 文件或目录，go 为 Go 源码文件或目录，general-log 为 MySQL general log，binlog 为 mysqlbinlog -v 的输出，pcap 为 tcpdump 等抓取的 MySQL 流量
+	SchemaSnapshot          string   `yaml:"schema-snapshot"`            // 库表结构快照文件，指定后使用快照代替线上环境，report-type 为 schema-dump 时为快照导出文件
+	SchemaDiffFrom          string   `yaml:"schema-diff-from"`           // report-type 为 schema-diff 时变更前的表结构，可以是 DSN、建表语句文件或目录、快照文件，不指定时使用 OnlineDSN
+	SchemaDiffTo            string   `yaml:"schema-diff-to"`             // report-type 为 schema-diff 时变更后的表结构，格式同 SchemaDiffFrom
+	SchemaDiffAllowDrop     bool     `yaml:"schema-diff-allow-drop"`     // report-type 为 schema-diff 时是否生成删除表及删除列的语句，默认以注释的形式输出
 
 	// +++++++++++++++日志相关+++++++++++++++++
 	// 日志级别，这里使用了 beego 的 log 包
@@ -87,6 +102,8 @@ type Configuration struct {
 	// ++++++++++++++优化建议相关++++++++++++++
 	IgnoreRules          []string `yaml:"ignore-rules"`              // 忽略的优化建议规则
 	RewriteRules         []string `yaml:"rewrite-rules"`             // 生效的重写规则
+	RewriteVerify        bool     `yaml:"rewrite-verify"`            // 在测试环境中执行重写前后的 SQL，验证查询结果是否一致
+	RewriteReportType    string   `yaml:"rewrite-report-type"`       // report-type 为 rewrite 时的输出格式，支持 sql, markdown, json, html
 	BlackList            string   `yaml:"blacklist"`                 // blacklist 中的 SQL 不会被评审，可以是指纹，也可以是正则
 	MaxJoinTableCount    int      `yaml:"max-join-table-count"`      // 单条 SQL 中 JOIN 表的最大数量
 	MaxGroupByColsCount  int      `yaml:"max-group-by-cols-count"`   // 单条 SQL 中 GroupBy 包含列的最大数量
@@ -112,6 +129,8 @@ type Configuration struct {
 	MaxVarcharLength     int      `yaml:"max-varchar-length"`        // varchar最大长度
 	ColumnNotAllowType   []string `yaml:"column-not-allow-type"`     // 字段不允许使用的数据类型
 	MinCardinality       float64  `yaml:"min-cardinality"`           // 添加索引散粒度阈值，范围 0~100
+	MinIndexCardinality  float64  `yaml:"min-index-cardinality"`     // 已有索引散粒度低于该值时给出提示，范围 0~100
+	MaxDDLRebuildSize    int64    `yaml:"max-ddl-rebuild-size"`      // ALTER 需要重建的表超过该大小(MB)时建议使用 gh-ost/pt-osc
 
 	// ++++++++++++++EXPLAIN检查项+++++++++++++
 	ExplainSQLReportType   string   `yaml:"explain-sql-report-type"`  // EXPLAIN markdown 格式输出 SQL 样式，支持 sample, fingerprint, pretty 等
@@ -143,17 +162,31 @@ var Config = &Configuration{
 	OnlineDSN:               newDSN(nil),
 	TestDSN:                 newDSN(nil),
 	AllowOnlineAsTest:       false,
+	OnlineMaxExecutionTime:  10000,
+	OnlineLockWaitTimeout:   1,
+	OnlineResourceGroup:     "",
+	OnlineMaxThreadsRunning: 64,
+	OnlineMaxReplicationLag: 30,
 	DropTestTemporary:       true,
 	CleanupTestDatabase:     false,
 	DryRun:                  true,
 	OnlySyntaxCheck:         false,
 	SamplingStatisticTarget: 100,
 	Sampling:                false,
+	SamplingMaskRules:       []string{},
+	SamplingStatistics:      false,
 	Profiling:               false,
 	Trace:                   false,
 	Explain:                 true,
 	Delimiter:               ";",
+	InputFormat:             "sql",
+	SchemaSnapshot:          "",
+	SchemaDiffFrom:          "",
+	SchemaDiffTo:            "",
+	SchemaDiffAllowDrop:     false,
 	MinCardinality:          0,
+	MinIndexCardinality:     1,
+	MaxDDLRebuildSize:       1024,
 
 	MaxJoinTableCount:    5,
 	MaxGroupByColsCount:  5,
@@ -216,6 +249,24 @@ var Config = &Configuration{
 		"insertcolumns",
 		"distinctstar",
 	},
+	RewriteReportType: "sql",
+	OnlineAllowStatements: []string{
+		"select",
+		"show",
+		"explain",
+	},
+	OnlineDenyFunctions: []string{
+		"get_lock",
+		"release_lock",
+		"release_all_locks",
+		"sleep",
+		"benchmark",
+		"load_file",
+		"master_pos_wait",
+		"source_pos_wait",
+		"wait_for_executed_gtid_set",
+		"wait_until_sql_thread_after_gtids",
+	},
 
 	ListHeuristicRules: false,
 	ListRewriteRules:   false,
@@ -585,6 +636,13 @@ func readCmdFlags() error {
 	onlineDSN := flag.String("online-dsn", FormatDSN(Config.OnlineDSN), "OnlineDSN, 线上环境数据库配置, username:password@tcp(ip:port)/schema")
 	testDSN := flag.String("test-dsn", FormatDSN(Config.TestDSN), "TestDSN, 测试环境数据库配置, username:password@tcp(ip:port)/schema")
 	allowOnlineAsTest := flag.Bool("allow-online-as-test", Config.AllowOnlineAsTest, "AllowOnlineAsTest, 允许线上环境也可以当作测试环境")
+	onlineAllowStatements := flag.String("online-allow-statements", strings.ToLower(strings.Join(Config.OnlineAllowStatements, ",")), "OnlineAllowStatements, 允许在线上环境执行的语句类型")
+	onlineMaxExecutionTime := flag.Int("online-max-execution-time", Config.OnlineMaxExecutionTime, "OnlineMaxExecutionTime, 线上环境 SELECT 最长执行时间，单位毫秒，0 为不限制")
+	onlineLockWaitTimeout := flag.Int("online-lock-wait-timeout", Config.OnlineLockWaitTimeout, "OnlineLockWaitTimeout, 线上环境会话的锁等待超时时间，单位秒，0 为不设置")
+	onlineResourceGroup := flag.String("online-resource-group", Config.OnlineResourceGroup, "OnlineResourceGroup, 线上环境 SELECT 使用的低优先级资源组")
+	onlineMaxThreadsRunning := flag.Int("online-max-threads-running", Config.OnlineMaxThreadsRunning, "OnlineMaxThreadsRunning, 线上环境 Threads_running 超过该值时跳过 EXPLAIN, 数据采样等查询，0 为不检查")
+	onlineMaxReplicationLag := flag.Int("online-max-replication-lag", Config.OnlineMaxReplicationLag, "OnlineMaxReplicationLag, 线上环境主从延迟超过该值（秒）时跳过 EXPLAIN, 数据采样等查询，0 为不检查")
+	onlineDenyFunctions := flag.String("online-deny-functions", strings.ToLower(strings.Join(Config.OnlineDenyFunctions, ",")), "OnlineDenyFunctions, 禁止在线上环境执行的函数")
 	dropTestTemporary := flag.Bool("drop-test-temporary", Config.DropTestTemporary, "DropTestTemporary, 是否清理测试环境产生的临时库表")
 	cleanupTestDatabase := flag.Bool("cleanup-test-database", Config.CleanupTestDatabase, "单次运行清理历史1小时前残余的测试库。")
 	onlySyntaxCheck := flag.Bool("only-syntax-check", Config.OnlySyntaxCheck, "OnlySyntaxCheck, 只做语法检查不输出优化建议")
@@ -594,8 +652,18 @@ func readCmdFlags() error {
 	sampling := flag.Bool("sampling", Config.Sampling, "Sampling, 数据采样开关")
 	samplingStatisticTarget := flag.Int("sampling-statistic-target", Config.SamplingStatisticTarget, "SamplingStatisticTarget, 数据采样因子，对应 PostgreSQL 的 default_statistics_target")
 	samplingCondition := flag.String("sampling-condition", Config.SamplingCondition, "SamplingCondition, 数据采样条件，如： WHERE xxx LIMIT xxx")
+	samplingStatistics := flag.Bool("sampling-statistics", Config.SamplingStatistics, "SamplingStatistics, 统计信息采样开关，只同步线上的表、索引统计信息及直方图，不泵取数据")
+	samplingMaskRules := flag.String("sampling-mask-rules", strings.Join(Config.SamplingMaskRules, ","), "SamplingMaskRules, 数据采样脱敏规则，如：name:^email$:email,comment:手机:phone")
+	samplingMaskSecret := flag.String("sampling-mask-secret", Config.SamplingMaskSecret, "SamplingMaskSecret, 数据脱敏使用的 HMAC 密钥，不指定时每次运行随机生成，多次采样的脱敏结果不一致")
 	delimiter := flag.String("delimiter", Config.Delimiter, "Delimiter, SQL分隔符")
+	inputFormat := flag.String("input-format", Config.InputFormat, "InputFormat, 待评审 SQL 的输入格式，支持: sql, mybatis, go, general-log, binlog, pcap，非 sql 格式时 -query 可以指定文件或目录")
+	schemaSnapshot := flag.String("schema-snapshot", Config.SchemaSnapshot, "SchemaSnapshot, 库表结构快照文件，指定后使用快照代替线上环境，report-type 为 schema-dump 时为快照导出文件")
+	schemaDiffFrom := flag.String("schema-diff-from", Config.SchemaDiffFrom, "SchemaDiffFrom, report-type 为 schema-diff 时变更前的表结构，可以是 DSN、建表语句文件或目录、快照文件，不指定时使用 OnlineDSN")
+	schemaDiffTo := flag.String("schema-diff-to", Config.SchemaDiffTo, "SchemaDiffTo, report-type 为 schema-diff 时变更后的表结构，格式同 schema-diff-from")
+	schemaDiffAllowDrop := flag.Bool("schema-diff-allow-drop", Config.SchemaDiffAllowDrop, "SchemaDiffAllowDrop, report-type 为 schema-diff 时是否生成删除表及删除列的语句，默认以注释的形式输出")
+	maxDDLRebuildSize := flag.Int64("max-ddl-rebuild-size", Config.MaxDDLRebuildSize, "MaxDDLRebuildSize, ALTER 需要重建的表超过该大小(MB)时建议使用 gh-ost/pt-osc")
 	minCardinality := flag.Float64("min-cardinality", Config.MinCardinality, "MinCardinality，索引列散粒度最低阈值，散粒度低于该值的列不添加索引，建议范围0.0 ~ 100.0")
+	minIndexCardinality := flag.Float64("min-index-cardinality", Config.MinIndexCardinality, "MinIndexCardinality, duplicate-key-checker 检查已有索引时，散粒度低于该值的索引给出提示，建议范围0.0 ~ 100.0")
 	// +++++++++++++++日志相关+++++++++++++++++
 	logLevel := flag.Int("log-level", Config.LogLevel, "LogLevel, 日志级别, [0:Emergency, 1:Alert, 2:Critical, 3:Error, 4:Warning, 5:Notice, 6:Informational, 7:Debug]")
 	logOutput := flag.String("log-output", Config.LogOutput, "LogOutput, 日志输出位置")
@@ -609,6 +677,8 @@ func readCmdFlags() error {
 	// ++++++++++++++优化建议相关++++++++++++++
 	ignoreRules := flag.String("ignore-rules", strings.Join(Config.IgnoreRules, ","), "IgnoreRules, 忽略的优化建议规则")
 	rewriteRules := flag.String("rewrite-rules", strings.Join(Config.RewriteRules, ","), "RewriteRules, 生效的重写规则")
+	rewriteVerify := flag.Bool("rewrite-verify", Config.RewriteVerify, "RewriteVerify, 在测试环境中执行重写前后的只读查询，验证查询结果是否一致")
+	rewriteReportType := flag.String("rewrite-report-type", Config.RewriteReportType, "RewriteReportType, report-type 为 rewrite 时的输出格式 [sql, markdown, json, html]，非 sql 格式时输出生效的规则、每条规则执行后的 SQL 及重写前后的差异")
 	blackList := flag.String("blacklist", Config.BlackList, "指定 blacklist 配置文件的位置，文件中的 SQL 不会被评审。一行一条SQL，可以是指纹，也可以是正则")
 	maxJoinTableCount := flag.Int("max-join-table-count", Config.MaxJoinTableCount, "MaxJoinTableCount, 单条 SQL 中 JOIN 表的最大数量")
 	maxGroupByColsCount := flag.Int("max-group-by-cols-count", Config.MaxGroupByColsCount, "MaxGroupByColsCount, 单条 SQL 中 GroupBy 包含列的最大数量")
@@ -669,6 +739,17 @@ func readCmdFlags() error {
 	Config.OnlineDSN = ParseDSN(*onlineDSN, Config.OnlineDSN)
 	Config.TestDSN = ParseDSN(*testDSN, Config.TestDSN)
 	Config.AllowOnlineAsTest = *allowOnlineAsTest
+	if *onlineAllowStatements != "" {
+		Config.OnlineAllowStatements = strings.Split(strings.ToLower(*onlineAllowStatements), ",")
+	}
+	if *onlineDenyFunctions != "" {
+		Config.OnlineDenyFunctions = strings.Split(strings.ToLower(*onlineDenyFunctions), ",")
+	}
+	Config.OnlineMaxExecutionTime = *onlineMaxExecutionTime
+	Config.OnlineLockWaitTimeout = *onlineLockWaitTimeout
+	Config.OnlineResourceGroup = *onlineResourceGroup
+	Config.OnlineMaxThreadsRunning = *onlineMaxThreadsRunning
+	Config.OnlineMaxReplicationLag = *onlineMaxReplicationLag
 	Config.DropTestTemporary = *dropTestTemporary
 	Config.CleanupTestDatabase = *cleanupTestDatabase
 	Config.OnlySyntaxCheck = *onlySyntaxCheck
@@ -678,6 +759,11 @@ func readCmdFlags() error {
 	Config.Sampling = *sampling
 	Config.SamplingStatisticTarget = *samplingStatisticTarget
 	Config.SamplingCondition = *samplingCondition
+	Config.SamplingStatistics = *samplingStatistics
+	if *samplingMaskRules != "" {
+		Config.SamplingMaskRules = strings.Split(*samplingMaskRules, ",")
+	}
+	Config.SamplingMaskSecret = *samplingMaskSecret
 
 	Config.LogLevel = *logLevel
 
@@ -698,8 +784,12 @@ func readCmdFlags() error {
 	Config.MarkdownHTMLFlags = *markdownHTMLFlags
 	Config.IgnoreRules = strings.Split(*ignoreRules, ",")
 	Config.RewriteRules = strings.Split(*rewriteRules, ",")
+	Config.RewriteVerify = *rewriteVerify
+	Config.RewriteReportType = strings.ToLower(*rewriteReportType)
 	*blackList = strings.TrimSpace(*blackList)
 	Config.MinCardinality = *minCardinality
+	Config.MinIndexCardinality = *minIndexCardinality
+	Config.MaxDDLRebuildSize = *maxDDLRebuildSize
 
 	if filepath.IsAbs(*blackList) || *blackList == "" {
 		Config.BlackList = *blackList
@@ -742,6 +832,11 @@ func readCmdFlags() error {
 	Config.SpaghettiQueryLength = *spaghettiQueryLength
 	Config.Query = *query
 	Config.Delimiter = *delimiter
+	Config.InputFormat = strings.ToLower(*inputFormat)
+	Config.SchemaSnapshot = *schemaSnapshot
+	Config.SchemaDiffFrom = *schemaDiffFrom
+	Config.SchemaDiffTo = *schemaDiffTo
+	Config.SchemaDiffAllowDrop = *schemaDiffAllowDrop
 
 	Config.ExplainSQLReportType = strings.ToLower(*explainSQLReportType)
 	Config.ExplainType = strings.ToLower(*explainType)
@@ -912,9 +1007,24 @@ EOF`,
 	},
 	{
 		Name:        "duplicate-key-checker",
-		Description: "对 OnlineDsn 中指定的 database 进行索引重复检查",
+		Description: "对 OnlineDsn 中指定的 database 进行索引检查，包括重复索引、主键最左前缀冗余的索引、未使用的索引及散粒度过低的索引，外键依赖的索引会被保留",
 		Example:     `soar -report-type duplicate-key-checker -online-dsn user:password@127.0.0.1:3306/db`,
 	},
+	{
+		Name:        "schema-audit",
+		Description: "对 OnlineDsn 中指定 database 的所有表进行表结构审查，按表汇总 COL, KEY, TBL 等建表相关的建议并给出库的整体评分",
+		Example:     `soar -report-type schema-audit -online-dsn user:password@127.0.0.1:3306/db`,
+	},
+	{
+		Name:        "schema-diff",
+		Description: "对比两个库的表结构，按表生成从 -schema-diff-from 变更为 -schema-diff-to 的 SQL，并给出 ALTER 语句的执行建议，表结构可以来自 DSN、建表语句文件或目录、快照文件",
+		Example:     `soar -report-type schema-diff -schema-diff-from user:password@127.0.0.1:3306/db -schema-diff-to ./schema/`,
+	},
+	{
+		Name:        "schema-dump",
+		Description: "导出 OnlineDsn 中指定 database 的库表结构及统计信息快照，配合 -schema-snapshot 可脱离线上环境进行评审",
+		Example:     `soar -report-type schema-dump -online-dsn user:password@127.0.0.1:3306/db -schema-snapshot db.yaml`,
+	},
 	{
 		Name:        "html",
 		Description: "以HTML格式输出报表",
@@ -25,6 +25,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 
 	"github.com/tidwall/gjson"
 )
@@ -163,3 +164,97 @@ func RemoveDuplicatesItem(duplicate []string) []string {
 	sort.Strings(unique)
 	return unique
 }
+
+// diffContext unified diff 中每处差异前后保留的相同行数
+const diffContext = 3
+
+// UnifiedDiff 逐行对比两段文本，返回 unified diff 格式的差异，内容相同时返回空
+func UnifiedDiff(from, to, fromName, toName string) string {
+	a, b := strings.Split(from, "\n"), strings.Split(to, "\n")
+
+	// lcs[i][j] 为 a[i:] 与 b[j:] 的最长公共子序列长度
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// 编辑脚本，ai, bi 为该行之前两段文本各自已经输出的行数
+	type edit struct {
+		op     byte
+		line   string
+		ai, bi int
+	}
+	var edits []edit
+	var changes []int
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i], i, j})
+			i++
+			j++
+		case j >= len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			changes = append(changes, len(edits))
+			edits = append(edits, edit{'-', a[i], i, j})
+			i++
+		default:
+			changes = append(changes, len(edits))
+			edits = append(edits, edit{'+', b[j], i, j})
+			j++
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", fromName, toName)
+	for c := 0; c < len(changes); {
+		start := changes[c] - diffContext
+		if start < 0 {
+			start = 0
+		}
+		// 相邻差异之间的相同行不超过 2*diffContext 时合并为一个 hunk
+		end := changes[c] + 1
+		for c < len(changes) && changes[c]-end <= 2*diffContext {
+			end = changes[c] + 1
+			c++
+		}
+		end += diffContext
+		if end > len(edits) {
+			end = len(edits)
+		}
+
+		var aLen, bLen int
+		var lines []string
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				aLen++
+			}
+			if e.op != '-' {
+				bLen++
+			}
+			lines = append(lines, string(e.op)+e.line)
+		}
+		aStart, bStart := edits[start].ai, edits[start].bi
+		if aLen > 0 {
+			aStart++
+		}
+		if bLen > 0 {
+			bStart++
+		}
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		buf.WriteString(strings.Join(lines, "\n") + "\n")
+	}
+	return buf.String()
+}
@@ -409,3 +409,32 @@ func TestRemoveDuplicatesItem(t *testing.T) {
 	}
 	Log.Debug("Exiting function: %s", GetFunctionName())
 }
+
+func TestUnifiedDiff(t *testing.T) {
+	Log.Debug("Entering function: %s", GetFunctionName())
+	from := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk"
+	cases := []struct {
+		to, want string
+	}{
+		{from, ""},
+		{
+			"a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk",
+			"--- from\n+++ to\n@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n",
+		},
+		// 相距较远的差异拆分为两个 hunk
+		{
+			"b\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl",
+			"--- from\n+++ to\n@@ -1,4 +1,3 @@\n-a\n b\n c\n d\n@@ -9,3 +8,4 @@\n i\n j\n k\n+l\n",
+		},
+		{
+			"x",
+			"--- from\n+++ to\n@@ -1,11 +1,1 @@\n-a\n-b\n-c\n-d\n-e\n-f\n-g\n-h\n-i\n-j\n-k\n+x\n",
+		},
+	}
+	for _, c := range cases {
+		if got := UnifiedDiff(from, c.to, "from", "to"); got != c.want {
+			t.Errorf("want: %q\ngot: %q", c.want, got)
+		}
+	}
+	Log.Debug("Exiting function: %s", GetFunctionName())
+}
@@ -1081,6 +1081,11 @@ func (db *Connector) Explain(sql string, explainType int, formatType int) (exp *
 		}
 	}()
 
+	// 线上环境负载过高时不执行 EXPLAIN
+	if err = db.CheckServerLoad(); err != nil {
+		return nil, err
+	}
+
 	// 执行EXPLAIN请求
 	exp.SQL = db.explainQuery(sql, explainType, formatType)
 	if exp.SQL == "" {
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/laojianzi/soar/ast"
+	"github.com/laojianzi/soar/common"
+
+	tidb "github.com/pingcap/parser/ast"
+)
+
+// pingcap/parser 不支持 EXPLAIN EXTENDED, EXPLAIN PARTITIONS，这两种写法与 EXPLAIN 一样不会执行查询
+var explainModifierRe = regexp.MustCompile(`(?i)^\s*(explain|describe|desc)\s+(extended|partitions)\s+`)
+
+// CheckOnlineQuery 检查 SQL 能否在 Online 环境执行，不允许时返回原因
+// 只允许 online-allow-statements 中的语句类型，并禁止 INTO OUTFILE, FOR UPDATE, EXPLAIN ANALYZE 及 online-deny-functions 中的函数
+func CheckOnlineQuery(query string) error {
+	stmts, err := ast.TiParse(explainModifierRe.ReplaceAllString(query, "$1 "), "", "")
+	if err != nil {
+		return fmt.Errorf("parse error: %s", err.Error())
+	}
+	if len(stmts) == 0 {
+		return fmt.Errorf("empty query")
+	}
+
+	for _, stmt := range stmts {
+		class := statementClass(stmt)
+		allowed := false
+		for _, s := range common.Config.OnlineAllowStatements {
+			if strings.EqualFold(strings.TrimSpace(s), class) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%s statement not in online-allow-statements", strings.ToUpper(class))
+		}
+
+		if explain, ok := stmt.(*tidb.ExplainStmt); ok {
+			if explain.Analyze {
+				return fmt.Errorf("EXPLAIN ANALYZE will execute the query")
+			}
+			// EXPLAIN 不会执行查询，不需要检查其中的子句和函数
+			continue
+		}
+
+		v := &onlineQueryVisitor{}
+		stmt.Accept(v)
+		if v.err != nil {
+			return v.err
+		}
+	}
+	return nil
+}
+
+// statementClass 语句类型，与 online-allow-statements 中的配置对应
+func statementClass(stmt tidb.StmtNode) string {
+	switch node := stmt.(type) {
+	case *tidb.SelectStmt, *tidb.SetOprStmt:
+		return "select"
+	case *tidb.ShowStmt:
+		return "show"
+	case *tidb.ExplainStmt, *tidb.ExplainForStmt:
+		return "explain"
+	case *tidb.SetStmt:
+		return "set"
+	case *tidb.UseStmt:
+		return "use"
+	case *tidb.InsertStmt:
+		if node.IsReplace {
+			return "replace"
+		}
+		return "insert"
+	case *tidb.UpdateStmt:
+		return "update"
+	case *tidb.DeleteStmt:
+		return "delete"
+	case *tidb.AnalyzeTableStmt:
+		return "analyze"
+	case tidb.DDLNode:
+		return "ddl"
+	}
+	// 其他语句以类型名称作为语句类型，如：*ast.LoadDataStmt 为 loaddata
+	class := fmt.Sprintf("%T", stmt)
+	class = class[strings.LastIndex(class, ".")+1:]
+	return strings.ToLower(strings.TrimSuffix(class, "Stmt"))
+}
+
+// onlineQueryVisitor 查找语句中有副作用或会加锁的子句及函数
+type onlineQueryVisitor struct {
+	err error
+}
+
+// Enter implements ast.Visitor interface
+func (v *onlineQueryVisitor) Enter(in tidb.Node) (tidb.Node, bool) {
+	switch node := in.(type) {
+	case *tidb.SelectStmt:
+		if node.SelectIntoOpt != nil && node.SelectIntoOpt.Tp != tidb.SelectIntoVars {
+			v.err = fmt.Errorf("SELECT ... INTO OUTFILE/DUMPFILE will write file on server")
+		}
+		if node.LockInfo != nil && node.LockInfo.LockType != tidb.SelectLockNone {
+			v.err = fmt.Errorf("SELECT ... %s will lock rows", strings.ToUpper(node.LockInfo.LockType.String()))
+		}
+	case *tidb.FuncCallExpr:
+		for _, f := range common.Config.OnlineDenyFunctions {
+			if strings.EqualFold(strings.TrimSpace(f), node.FnName.L) {
+				v.err = fmt.Errorf("function %s() in online-deny-functions", strings.ToUpper(node.FnName.L))
+			}
+		}
+	}
+	return in, v.err != nil
+}
+
+// Leave implements ast.Visitor interface
+func (v *onlineQueryVisitor) Leave(in tidb.Node) (tidb.Node, bool) {
+	return in, v.err == nil
+}
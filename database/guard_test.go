@@ -0,0 +1,43 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/laojianzi/soar/common"
+)
+
+func TestCheckOnlineQuery(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	allow, deny := common.Config.OnlineAllowStatements, common.Config.OnlineDenyFunctions
+	common.Config.OnlineAllowStatements = append(allow, "set")
+	common.Config.OnlineDenyFunctions = []string{"now"}
+
+	for _, sql := range []string{"set @@profiling=1", "select sleep(1)"} {
+		if err := CheckOnlineQuery(sql); err != nil {
+			t.Errorf("SQL: %s should be allowed, got: %s", sql, err.Error())
+		}
+	}
+	if err := CheckOnlineQuery("select now()"); err == nil || !strings.Contains(err.Error(), "NOW()") {
+		t.Errorf("select now() should be denied, got: %v", err)
+	}
+
+	common.Config.OnlineAllowStatements, common.Config.OnlineDenyFunctions = allow, deny
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
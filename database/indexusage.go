@@ -0,0 +1,147 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/laojianzi/soar/common"
+)
+
+// https://dev.mysql.com/doc/refman/8.0/en/sys-schema-unused-indexes.html
+// https://dev.mysql.com/doc/refman/8.0/en/performance-schema-table-io-waits-summary-by-index-usage.html
+
+// ForeignKey 外键及其用到的列
+type ForeignKey struct {
+	Name              string
+	Schema            string   // 子表所在库
+	Table             string   // 子表
+	Columns           []string // 子表中的列
+	ReferencedSchema  string   // 父表所在库
+	ReferencedTable   string   // 父表
+	ReferencedColumns []string // 父表中被引用的列
+}
+
+// ShowUnusedIndexes 获取 MySQL 启动以来没有被使用过的索引，优先使用 sys.schema_unused_indexes，
+// sys 库不存在时直接查询 performance_schema，performance_schema 未开启时返回错误
+func (db *Connector) ShowUnusedIndexes(tableName string) ([]string, error) {
+	queries := []string{
+		fmt.Sprintf("SELECT index_name FROM sys.schema_unused_indexes WHERE object_schema = '%s' AND object_name = '%s'",
+			Escape(db.Database, false), Escape(tableName, false)),
+		fmt.Sprintf("SELECT INDEX_NAME FROM performance_schema.table_io_waits_summary_by_index_usage WHERE OBJECT_SCHEMA = '%s' AND OBJECT_NAME = '%s' AND INDEX_NAME IS NOT NULL AND INDEX_NAME != 'PRIMARY' AND COUNT_STAR = 0",
+			Escape(db.Database, false), Escape(tableName, false)),
+	}
+
+	var res QueryResult
+	var err error
+	for _, query := range queries {
+		res, err = db.Query(query)
+		if err == nil {
+			break
+		}
+		common.Log.Debug("ShowUnusedIndexes, Query: %s, Error: %s", query, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var indexes []string
+	for res.Rows.Next() {
+		var name string
+		if err = res.Rows.Scan(&name); err != nil {
+			break
+		}
+		indexes = append(indexes, name)
+	}
+	res.Rows.Close()
+	return indexes, err
+}
+
+// PerformanceSchemaEnabled performance_schema 是否开启，未开启时无法判断索引是否被使用
+func (db *Connector) PerformanceSchemaEnabled() bool {
+	res, err := db.Query("SELECT @@performance_schema")
+	if err != nil {
+		return false
+	}
+	defer res.Rows.Close()
+
+	var enabled int
+	if res.Rows.Next() {
+		common.LogIfError(res.Rows.Scan(&enabled), "")
+	}
+	return enabled == 1
+}
+
+// Uptime 获取 MySQL 启动以来的秒数，索引使用情况的统计在重启后清零
+func (db *Connector) Uptime() (int, error) {
+	res, err := db.Query("SHOW GLOBAL STATUS LIKE 'Uptime'")
+	if err != nil {
+		return 0, err
+	}
+	defer res.Rows.Close()
+
+	var name string
+	var value int
+	if res.Rows.Next() {
+		err = res.Rows.Scan(&name, &value)
+	}
+	return value, err
+}
+
+// ShowForeignKeys 获取与表相关的所有外键，包括表作为子表及作为父表被引用的外键
+func (db *Connector) ShowForeignKeys(tableName string) ([]ForeignKey, error) {
+	dbName, tbName := Escape(db.Database, false), Escape(tableName, false)
+	query := fmt.Sprintf("SELECT CONSTRAINT_NAME, TABLE_SCHEMA, TABLE_NAME, COLUMN_NAME, REFERENCED_TABLE_SCHEMA, REFERENCED_TABLE_NAME, REFERENCED_COLUMN_NAME FROM INFORMATION_SCHEMA.KEY_COLUMN_USAGE WHERE REFERENCED_TABLE_NAME IS NOT NULL AND ((TABLE_SCHEMA = '%s' AND TABLE_NAME = '%s') OR (REFERENCED_TABLE_SCHEMA = '%s' AND REFERENCED_TABLE_NAME = '%s')) ORDER BY TABLE_SCHEMA, TABLE_NAME, CONSTRAINT_NAME, ORDINAL_POSITION",
+		dbName, tbName, dbName, tbName)
+	res, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var fks []ForeignKey
+	for res.Rows.Next() {
+		var fk ForeignKey
+		var col, refCol string
+		err = res.Rows.Scan(&fk.Name, &fk.Schema, &fk.Table, &col, &fk.ReferencedSchema, &fk.ReferencedTable, &refCol)
+		if err != nil {
+			break
+		}
+		// 同一个外键的多列按 ORDINAL_POSITION 合并
+		if n := len(fks); n > 0 && fks[n-1].Name == fk.Name && fks[n-1].Schema == fk.Schema && fks[n-1].Table == fk.Table {
+			fks[n-1].Columns = append(fks[n-1].Columns, col)
+			fks[n-1].ReferencedColumns = append(fks[n-1].ReferencedColumns, refCol)
+			continue
+		}
+		fk.Columns = []string{col}
+		fk.ReferencedColumns = []string{refCol}
+		fks = append(fks, fk)
+	}
+	res.Rows.Close()
+	return fks, err
+}
+
+// IndexColumns 获取外键在表中需要索引的列，表既不是子表也不是父表时返回空
+func (fk ForeignKey) IndexColumns(dbName, tableName string) []string {
+	if strings.EqualFold(fk.Schema, dbName) && strings.EqualFold(fk.Table, tableName) {
+		return fk.Columns
+	}
+	if strings.EqualFold(fk.ReferencedSchema, dbName) && strings.EqualFold(fk.ReferencedTable, tableName) {
+		return fk.ReferencedColumns
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/laojianzi/soar/common"
+)
+
+func TestShowForeignKeys(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	orgDatabase := connTest.Database
+	connTest.Database = "sakila"
+	fks, err := connTest.ShowForeignKeys("film")
+	if err != nil {
+		t.Error("ShowForeignKeys Error: ", err)
+	}
+
+	// film 作为父表被 film_actor, film_category, inventory 引用，作为子表引用 language
+	for _, fk := range fks {
+		if cols := fk.IndexColumns("sakila", "film"); len(cols) == 0 {
+			t.Errorf("foreign key %s has no columns in film", fk.Name)
+		}
+	}
+	connTest.Database = orgDatabase
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestForeignKeyIndexColumns(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	fk := ForeignKey{
+		Name:              "fk_film_actor_film",
+		Schema:            "sakila",
+		Table:             "film_actor",
+		Columns:           []string{"film_id"},
+		ReferencedSchema:  "sakila",
+		ReferencedTable:   "film",
+		ReferencedColumns: []string{"id"},
+	}
+	cases := map[string]string{
+		"film_actor": "[film_id]",
+		"film":       "[id]",
+		"actor":      "[]",
+	}
+	for tb, want := range cases {
+		if got := fmt.Sprint(fk.IndexColumns("sakila", tb)); got != want {
+			t.Errorf("%s want: %s, got: %s", tb, want, got)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
@@ -0,0 +1,556 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/laojianzi/soar/common"
+)
+
+// 数据采样脱敏方法
+const (
+	MaskHash  = "hash"  // 带密钥的确定性哈希，相同的输入得到相同的输出，保持散粒度不变
+	MaskEmail = "email" // 保留邮箱域名，对用户名部分做确定性哈希
+	MaskPhone = "phone" // 保留号码长度、前三位及非数字字符，其余数字做一一映射
+	MaskDate  = "date"  // 日期按月分桶
+)
+
+// MaskRule 数据采样脱敏规则
+type MaskRule struct {
+	Target  string         // 匹配方式: name, type, comment
+	Pattern *regexp.Regexp // 匹配的正则表达式
+	Method  string         // 脱敏方法: hash, email, phone, date
+}
+
+// ParseMaskRules 解析 sampling-mask-rules 配置，格式为 匹配方式:正则:脱敏方法
+func ParseMaskRules(rules []string) ([]MaskRule, error) {
+	var maskRules []MaskRule
+	for _, r := range rules {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		first := strings.Index(r, ":")
+		last := strings.LastIndex(r, ":")
+		if first < 0 || first == last {
+			return nil, fmt.Errorf("ParseMaskRules wrong format: %s", r)
+		}
+		target := strings.ToLower(r[:first])
+		method := strings.ToLower(r[last+1:])
+		switch target {
+		case "name", "type", "comment":
+		default:
+			return nil, fmt.Errorf("ParseMaskRules not support target: %s", target)
+		}
+		switch method {
+		case MaskHash, MaskEmail, MaskPhone, MaskDate:
+		default:
+			return nil, fmt.Errorf("ParseMaskRules not support method: %s", method)
+		}
+		pattern, err := regexp.Compile("(?i)" + r[first+1:last])
+		if err != nil {
+			return nil, err
+		}
+		maskRules = append(maskRules, MaskRule{
+			Target:  target,
+			Pattern: pattern,
+			Method:  method,
+		})
+	}
+	return maskRules, nil
+}
+
+// Match 判断列是否命中脱敏规则
+func (rule MaskRule) Match(col TableDescValue) bool {
+	switch rule.Target {
+	case "name":
+		return rule.Pattern.MatchString(col.Field)
+	case "type":
+		return rule.Pattern.MatchString(col.Type)
+	case "comment":
+		return rule.Pattern.MatchString(col.Comment)
+	}
+	return false
+}
+
+// columnMask 列的脱敏方法及数据类型
+type columnMask struct {
+	method  string
+	colType string // SHOW COLUMNS 中的 Type，脱敏结果需要在该类型的值域内
+	skip    bool   // 无法在值域内脱敏的类型，采样时该列使用默认值
+}
+
+// samplingMasks 获取表中需要脱敏的列及对应的脱敏方法，多条规则命中时以第一条为准
+func (db *Connector) samplingMasks(table string) (map[string]columnMask, error) {
+	rules, err := ParseMaskRules(common.Config.SamplingMaskRules)
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+
+	desc, err := db.ShowColumns(table)
+	if err != nil {
+		return nil, err
+	}
+
+	masks := make(map[string]columnMask)
+	for _, col := range desc.DescValues {
+		for _, rule := range rules {
+			if rule.Match(col) {
+				common.Log.Debug("samplingMasks, column %s.%s masked by %s", table, col.Field, rule.Method)
+				mask := columnMask{method: rule.Method, colType: col.Type}
+				if maskKind(col.Type) == "" {
+					common.Log.Warn("samplingMasks, column %s.%s type %s can't be masked, sampling with default value", table, col.Field, col.Type)
+					mask.skip = true
+				}
+				masks[col.Field] = mask
+				break
+			}
+		}
+	}
+	return masks, nil
+}
+
+// maskMinDigestLength 字符串脱敏结果的最小长度，过短的摘要无法保持散粒度
+const maskMinDigestLength = 16
+
+// maskFeistelRounds 数字脱敏使用的 Feistel 网络轮数
+const maskFeistelRounds = 8
+
+// maskMaxChunkDigits 数字脱敏时每段的最大位数，10^18 < 2^63
+const maskMaxChunkDigits = 18
+
+var (
+	maskRandomSecret     []byte
+	maskRandomSecretOnce sync.Once
+	maskCharLengthRe     = regexp.MustCompile(`(?i)^(?:var)?(?:char|binary)\((\d+)\)`)
+)
+
+// maskSecret 脱敏使用的 HMAC 密钥，未配置 sampling-mask-secret 时每次运行随机生成
+func maskSecret() []byte {
+	if common.Config.SamplingMaskSecret != "" {
+		return []byte(common.Config.SamplingMaskSecret)
+	}
+	maskRandomSecretOnce.Do(func() {
+		maskRandomSecret = make([]byte, 32)
+		if _, err := rand.Read(maskRandomSecret); err != nil {
+			common.Log.Error("maskSecret, generate random secret Error: %s", err.Error())
+		}
+	})
+	return maskRandomSecret
+}
+
+// maskMAC 计算 HMAC-SHA256，没有密钥时无法通过字典攻击还原原始值
+func maskMAC(data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, maskSecret())
+	for _, d := range data {
+		mac.Write(d)
+		mac.Write([]byte{0})
+	}
+	return mac.Sum(nil)
+}
+
+// maskCharLength 获取 CHAR, VARCHAR, BINARY, VARBINARY 类型列的最大长度，其他类型返回 0
+func maskCharLength(dataType string) int {
+	m := maskCharLengthRe.FindStringSubmatch(dataType)
+	if m == nil {
+		return 0
+	}
+	length, _ := strconv.Atoi(m[1])
+	return length
+}
+
+// MaskValue 按脱敏方法对采样数据进行处理，脱敏结果保持在列类型 colType 的值域内
+// 数值、ENUM、SET、TIME、日期类型按类型处理，字符串类型按脱敏方法处理，格式无法识别时退化为确定性哈希
+func MaskValue(method string, val []byte, colType string) []byte {
+	if val == nil {
+		return nil
+	}
+	switch kind := maskKind(colType); kind {
+	case "integer", "year":
+		if min, max, ok := maskIntRange(colType); ok {
+			return maskInteger(val, min, max, []byte(kind+":"+colType))
+		}
+		return maskBigInteger(val, strings.Contains(strings.ToLower(colType), "unsigned"))
+	case "decimal":
+		return maskNumber(val)
+	case "enum", "set":
+		return maskMember(val, kind == "set", colType)
+	case "json":
+		// JSON 列的值脱敏后作为 JSON 字符串写入
+		js, _ := json.Marshal(string(maskString(method, val, 0)))
+		return js
+	case "time":
+		return maskTime(method, val)
+	case "date":
+		// 日期类型只能按月分桶，无法解析的值（如 0000-00-00）不包含敏感信息
+		if t, ok := maskDate(val); ok {
+			return t
+		}
+		return val
+	}
+	return maskString(method, val, maskCharLength(colType))
+}
+
+// maskString 字符串类型的脱敏，length 为列的最大字符长度，为 0 时不限制，脱敏后的长度不会超过该值
+func maskString(method string, val []byte, length int) []byte {
+	switch method {
+	case MaskEmail:
+		if at := bytes.LastIndexByte(val, '@'); at > 0 {
+			if length > 0 {
+				length -= utf8.RuneCount(val[at:])
+			}
+			return append(maskHash(val[:at], length), val[at:]...)
+		}
+	case MaskPhone:
+		return maskDigits(val, 3)
+	case MaskDate:
+		if t, ok := maskDate(val); ok {
+			return t
+		}
+	}
+	return maskHash(val, length)
+}
+
+// maskKind 按脱敏时值域的处理方式对列类型分类，返回空表示该类型无法脱敏
+func maskKind(colType string) string {
+	base := strings.ToLower(colType)
+	if i := strings.IndexAny(base, "( "); i >= 0 {
+		base = base[:i]
+	}
+	switch base {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint":
+		return "integer"
+	case "year":
+		return "year"
+	case "decimal", "numeric", "float", "double", "real":
+		return "decimal"
+	case "enum", "set", "json", "time":
+		return base
+	case "date", "datetime", "timestamp":
+		return "date"
+	case "char", "varchar", "binary", "varbinary",
+		"tinytext", "text", "mediumtext", "longtext", "tinyblob", "blob", "mediumblob", "longblob":
+		return "string"
+	}
+	return ""
+}
+
+// maskIntRange 整数类型的取值范围，BIGINT 的范围无法在 uint64 内表示一一映射，返回 false
+func maskIntRange(colType string) (int64, int64, bool) {
+	colType = strings.ToLower(colType)
+	bits := map[string]uint{"tinyint": 8, "smallint": 16, "mediumint": 24, "int": 32, "integer": 32}
+	base := colType
+	if i := strings.IndexAny(base, "( "); i >= 0 {
+		base = base[:i]
+	}
+	if base == "year" {
+		return 1901, 2155, true
+	}
+	n, ok := bits[base]
+	if !ok {
+		return 0, 0, false
+	}
+	if strings.Contains(colType, "unsigned") {
+		return 0, 1<<n - 1, true
+	}
+	return -1 << (n - 1), 1<<(n-1) - 1, true
+}
+
+// maskInteger 整数在 [min, max] 内做一一映射，正负号不变，超出范围的值保持不变
+func maskInteger(val []byte, min, max int64, tweak []byte) []byte {
+	x, err := strconv.ParseInt(string(val), 10, 64)
+	if err != nil || x < min || x > max {
+		return val
+	}
+	var y int64
+	if x >= 0 {
+		low := int64(0)
+		if min > 0 {
+			low = min
+		}
+		y = low + int64(maskPermute(uint64(x-low), uint64(max-low+1), tweak))
+	} else {
+		y = -1 - int64(maskPermute(uint64(-1-x), uint64(-min), tweak))
+	}
+	return []byte(strconv.FormatInt(y, 10))
+}
+
+// maskBigInteger BIGINT 保持位数做一一映射，超出取值范围时截断为最大值或最小值
+func maskBigInteger(val []byte, unsigned bool) []byte {
+	masked := maskDigits(val, 0)
+	var err error
+	if unsigned {
+		_, err = strconv.ParseUint(string(masked), 10, 64)
+	} else {
+		_, err = strconv.ParseInt(string(masked), 10, 64)
+	}
+	if err == nil {
+		return masked
+	}
+	switch {
+	case unsigned:
+		return []byte(strconv.FormatUint(math.MaxUint64, 10))
+	case bytes.HasPrefix(masked, []byte("-")):
+		return []byte(strconv.FormatInt(math.MinInt64, 10))
+	}
+	return []byte(strconv.FormatInt(math.MaxInt64, 10))
+}
+
+// maskNumber DECIMAL, FLOAT 等类型保持位数及小数点位置，科学计数法只处理尾数部分
+func maskNumber(val []byte) []byte {
+	if e := bytes.IndexAny(val, "eE"); e > 0 {
+		return append(maskDigits(val[:e], 0), val[e:]...)
+	}
+	return maskDigits(val, 0)
+}
+
+// maskMember ENUM, SET 的值在成员列表内做一一映射，不是成员的值保持不变
+func maskMember(val []byte, set bool, colType string) []byte {
+	members := maskMembers(colType)
+	index := make(map[string]int)
+	for i, m := range members {
+		index[m] = i
+	}
+	values := []string{string(val)}
+	if set {
+		values = strings.Split(string(val), ",")
+	}
+	for i, v := range values {
+		if pos, ok := index[v]; ok {
+			values[i] = members[maskPermute(uint64(pos), uint64(len(members)), []byte("member:"+colType))]
+		}
+	}
+	return []byte(strings.Join(values, ","))
+}
+
+// maskMembers 解析 enum('a','b') 或 set('a','b') 中的成员列表
+func maskMembers(colType string) []string {
+	start := strings.Index(colType, "(")
+	var members []string
+	var member []byte
+	quoted := false
+	for i := start + 1; start >= 0 && i < len(colType); i++ {
+		c := colType[i]
+		switch {
+		case !quoted && c == '\'':
+			quoted, member = true, nil
+		case quoted && c == '\'' && i+1 < len(colType) && colType[i+1] == '\'':
+			member = append(member, c)
+			i++
+		case quoted && c == '\'':
+			quoted = false
+			members = append(members, string(member))
+		case quoted && c == '\\' && i+1 < len(colType):
+			member = append(member, colType[i+1])
+			i++
+		case quoted:
+			member = append(member, c)
+		}
+	}
+	return members
+}
+
+// maskTimeRe TIME 类型的值，范围为 -838:59:59 到 838:59:59
+var maskTimeRe = regexp.MustCompile(`^(-?)(\d+):(\d{2}):(\d{2})(\.\d+)?$`)
+
+// maskTime TIME 类型按 date 方法脱敏时按小时分桶，其他方法在取值范围内对秒数做一一映射
+func maskTime(method string, val []byte) []byte {
+	m := maskTimeRe.FindSubmatch(val)
+	if m == nil {
+		return val
+	}
+	hour, _ := strconv.ParseUint(string(m[2]), 10, 64)
+	minute, _ := strconv.ParseUint(string(m[3]), 10, 64)
+	second, _ := strconv.ParseUint(string(m[4]), 10, 64)
+	seconds := hour*3600 + minute*60 + second
+	if method == MaskDate {
+		seconds -= seconds % 3600
+		m[5] = nil
+	} else if seconds <= maskTimeMaxSeconds {
+		seconds = maskPermute(seconds, maskTimeMaxSeconds+1, []byte("time"))
+	}
+	frac := m[5]
+	if len(frac) > 0 {
+		frac = maskDigits(frac, 0)
+	}
+	return []byte(fmt.Sprintf("%s%02d:%02d:%02d%s", m[1], seconds/3600, seconds/60%60, seconds%60, frac))
+}
+
+// maskTimeMaxSeconds TIME 类型的最大值 838:59:59 对应的秒数
+const maskTimeMaxSeconds = 838*3600 + 59*60 + 59
+
+// maskHash 确定性哈希，数值保持为等长数值并且不同的数值脱敏后仍不同
+// 字符串替换为 HMAC 摘要，长度不小于 maskMinDigestLength，受列长度限制时截断
+func maskHash(val []byte, length int) []byte {
+	if isNumeric(val) {
+		return maskDigits(val, 0)
+	}
+
+	size := utf8.RuneCount(val)
+	if size < maskMinDigestLength {
+		size = maskMinDigestLength
+	}
+	if length > 0 && size > length {
+		size = length
+	}
+	var digest string
+	for i := 0; len(digest) < size; i++ {
+		digest += hex.EncodeToString(maskMAC(val, []byte(strconv.Itoa(i))))
+	}
+	return []byte(digest[:size])
+}
+
+// maskDigits 保留前 keep 个数字以及 '+', '-', '.', ' ' 等非数字字符，其余数字按位数做一一映射
+// 首位数字不为 0 时替换后仍不为 0，首位为 0 时保留，不改变数值的位数，不同的输入脱敏后仍不同
+func maskDigits(val []byte, keep int) []byte {
+	masked := append([]byte{}, val...)
+	var pos []int
+	var digits int
+	for i, c := range val {
+		if c < '0' || c > '9' {
+			continue
+		}
+		digits++
+		if digits > keep {
+			pos = append(pos, i)
+		}
+	}
+
+	lead := false
+	if keep == 0 && len(pos) > 1 {
+		if val[pos[0]] == '0' {
+			pos = pos[1:]
+		} else {
+			lead = true
+		}
+	}
+
+	// 超过 maskMaxChunkDigits 位时分段映射，每段都是一一映射
+	for chunk := 0; chunk*maskMaxChunkDigits < len(pos); chunk++ {
+		start, end := chunk*maskMaxChunkDigits, (chunk+1)*maskMaxChunkDigits
+		if end > len(pos) {
+			end = len(pos)
+		}
+		var x uint64
+		for _, p := range pos[start:end] {
+			x = x*10 + uint64(val[p]-'0')
+		}
+
+		var base uint64
+		n := pow10(end - start)
+		if lead && chunk == 0 {
+			base = n / 10
+			n -= base
+		}
+		tweak := []byte(fmt.Sprintf("digits:%d:%d:%d", keep, len(pos), chunk))
+		y := maskPermute(x-base, n, tweak) + base
+
+		for i := end - 1; i >= start; i-- {
+			masked[pos[i]] = '0' + byte(y%10)
+			y /= 10
+		}
+	}
+	return masked
+}
+
+// maskPermute 以 HMAC 为轮函数的 Feistel 网络，通过 cycle walking 得到 [0, n) 上的一一映射
+func maskPermute(x, n uint64, tweak []byte) uint64 {
+	if n <= 1 {
+		return x
+	}
+	bits := 2
+	for uint64(1)<<uint(bits) < n {
+		bits++
+	}
+	if bits%2 == 1 {
+		bits++
+	}
+	half := uint(bits / 2)
+	mask := uint64(1)<<half - 1
+
+	// Feistel 网络是 [0, 2^bits) 上的置换，结果超出 [0, n) 时继续置换直到落入区间内
+	for {
+		l, r := x>>half, x&mask
+		for round := 0; round < maskFeistelRounds; round++ {
+			var buf [9]byte
+			buf[0] = byte(round)
+			binary.BigEndian.PutUint64(buf[1:], r)
+			f := binary.BigEndian.Uint64(maskMAC(tweak, buf[:])[:8]) & mask
+			l, r = r, l^f
+		}
+		x = l<<half | r
+		if x < n {
+			return x
+		}
+	}
+}
+
+// pow10 返回 10 的 n 次方
+func pow10(n int) uint64 {
+	p := uint64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// maskDate 日期按月分桶，保持原有的日期格式
+func maskDate(val []byte) ([]byte, bool) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		t, err := time.Parse(layout, string(val))
+		if err != nil {
+			continue
+		}
+		bucket := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		return []byte(bucket.Format(layout)), true
+	}
+	return nil, false
+}
+
+// isNumeric 判断是否为整数或小数
+func isNumeric(val []byte) bool {
+	if len(val) == 0 {
+		return false
+	}
+	var dot bool
+	for i, c := range val {
+		switch {
+		case c >= '0' && c <= '9':
+		case c == '-' && i == 0 && len(val) > 1:
+		case c == '.' && !dot:
+			dot = true
+		default:
+			return false
+		}
+	}
+	return true
+}
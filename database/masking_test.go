@@ -0,0 +1,211 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/laojianzi/soar/common"
+)
+
+func TestParseMaskRules(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	rules, err := ParseMaskRules([]string{"", "name:^e?mail$:email", "comment:手机:phone", "type:^(date|datetime):date"})
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if len(rules) != 3 {
+		t.Errorf("want 3 rules, got %d", len(rules))
+	}
+	if !rules[0].Match(TableDescValue{Field: "EMAIL"}) {
+		t.Error("name rule not match")
+	}
+	if !rules[1].Match(TableDescValue{Field: "c1", Comment: "用户手机号"}) {
+		t.Error("comment rule not match")
+	}
+	if rules[2].Match(TableDescValue{Field: "c2", Type: "varchar(10)"}) {
+		t.Error("type rule should not match")
+	}
+
+	for _, r := range []string{"name:email", "column:^a$:hash", "name:^a$:unknown", "name:(:hash"} {
+		if _, err := ParseMaskRules([]string{r}); err == nil {
+			t.Errorf("%s should be invalid", r)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestMaskValue(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	orgSecret := common.Config.SamplingMaskSecret
+	common.Config.SamplingMaskSecret = "soar"
+	cases := []struct {
+		method  string
+		input   string
+		colType string
+		check   func(string) bool
+	}{
+		{MaskHash, "12345", "bigint(20)", func(s string) bool { return len(s) == 5 && isNumeric([]byte(s)) && s[0] != '0' }},
+		{MaskHash, "-0.25", "decimal(5,2)", func(s string) bool { return len(s) == 5 && strings.HasPrefix(s, "-0.") }},
+		{MaskHash, "张三", "varchar(255)", func(s string) bool { return len(s) == maskMinDigestLength }},
+		{MaskHash, "张三", "varchar(4)", func(s string) bool { return len(s) == 4 }},
+		{MaskEmail, "someone@example.com", "varchar(255)", func(s string) bool {
+			return strings.HasSuffix(s, "@example.com") && len(s) == maskMinDigestLength+len("@example.com")
+		}},
+		{MaskEmail, "someone@example.com", "varchar(20)", func(s string) bool {
+			return strings.HasSuffix(s, "@example.com") && len(s) == 20
+		}},
+		{MaskPhone, "+86 138-0013-8000", "varchar(32)", func(s string) bool {
+			return strings.HasPrefix(s, "+86 1") && len(s) == len("+86 138-0013-8000") && s[7] == '-'
+		}},
+		{MaskDate, "2019-05-17 10:11:12", "datetime", func(s string) bool { return s == "2019-05-01 00:00:00" }},
+		{MaskDate, "2019-05-17T10:11:12Z", "timestamp", func(s string) bool { return s == "2019-05-01T00:00:00Z" }},
+	}
+	for _, c := range cases {
+		masked := string(MaskValue(c.method, []byte(c.input), c.colType))
+		if masked == c.input || !c.check(masked) {
+			t.Errorf("MaskValue %s(%s) got: %s", c.method, c.input, masked)
+		}
+		// 确定性，保持散粒度
+		if again := string(MaskValue(c.method, []byte(c.input), c.colType)); again != masked {
+			t.Errorf("MaskValue %s(%s) not deterministic: %s, %s", c.method, c.input, masked, again)
+		}
+	}
+
+	// 不同的值脱敏后仍不同，数值位数不变
+	for _, c := range []struct {
+		method   string
+		from, to int
+		format   string
+		colType  string
+	}{
+		{MaskHash, 0, 10, "%d", "bigint(20)"},
+		{MaskHash, 10, 1000, "%d", "bigint(20)"},
+		{MaskHash, 0, 1000, "0.%03d", "decimal(4,3)"},
+		{MaskPhone, 0, 1000, "138-0013-8%03d", "varchar(20)"},
+	} {
+		seen := make(map[string]string)
+		for i := c.from; i < c.to; i++ {
+			input := fmt.Sprintf(c.format, i)
+			masked := string(MaskValue(c.method, []byte(input), c.colType))
+			if len(masked) != len(input) || (len(input) > 1 && input[0] != '0' && masked[0] == '0') {
+				t.Errorf("MaskValue %s(%s) got: %s", c.method, input, masked)
+			}
+			if prev, ok := seen[masked]; ok {
+				t.Errorf("MaskValue %s(%s) and %s(%s) both got: %s", c.method, prev, c.method, input, masked)
+			}
+			seen[masked] = input
+		}
+	}
+	long := "1234567890123456789012345678901234567890"
+	if masked := string(MaskValue(MaskHash, []byte(long), "decimal(65,0)")); len(masked) != len(long) || masked == long || !isNumeric([]byte(masked)) {
+		t.Errorf("MaskValue %s(%s) got: %s", MaskHash, long, masked)
+	}
+
+	// 脱敏结果依赖密钥，不同的密钥结果不同
+	masked := string(MaskValue(MaskHash, []byte("someone"), "varchar(64)"))
+	common.Config.SamplingMaskSecret = "another"
+	if again := string(MaskValue(MaskHash, []byte("someone"), "varchar(64)")); again == masked {
+		t.Errorf("MaskValue with different secret got same value: %s", masked)
+	}
+	common.Config.SamplingMaskSecret = orgSecret
+
+	if MaskValue(MaskHash, nil, "varchar(64)") != nil {
+		t.Error("NULL value should not be masked")
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestMaskValueDomain(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	orgSecret := common.Config.SamplingMaskSecret
+	common.Config.SamplingMaskSecret = "soar"
+
+	// 整数在类型的取值范围内一一映射
+	for colType, r := range map[string][2]int64{
+		"tinyint(4)":          {-128, 127},
+		"tinyint(3) unsigned": {0, 255},
+		"smallint(6)":         {-32768, 32767},
+		"year(4)":             {1901, 2155},
+	} {
+		seen := make(map[string]int64)
+		for i := r[0]; i <= r[1]; i++ {
+			masked := string(MaskValue(MaskHash, []byte(strconv.FormatInt(i, 10)), colType))
+			v, err := strconv.ParseInt(masked, 10, 64)
+			if err != nil || v < r[0] || v > r[1] || (v < 0) != (i < 0) {
+				t.Errorf("MaskValue %s(%d) out of range: %s", colType, i, masked)
+			}
+			if prev, ok := seen[masked]; ok {
+				t.Errorf("MaskValue %s(%d) and %s(%d) both got: %s", colType, prev, colType, i, masked)
+			}
+			seen[masked] = i
+		}
+	}
+
+	cases := []struct {
+		method  string
+		input   string
+		colType string
+		check   func(string) bool
+	}{
+		{MaskPhone, "127", "tinyint(4)", func(s string) bool { v, err := strconv.Atoi(s); return err == nil && v <= 127 }},
+		{MaskHash, "9223372036854775807", "bigint(20)", func(s string) bool { _, err := strconv.ParseInt(s, 10, 64); return err == nil }},
+		{MaskHash, "18446744073709551615", "bigint(20) unsigned", func(s string) bool { _, err := strconv.ParseUint(s, 10, 64); return err == nil }},
+		{MaskHash, "1.5e+20", "double", func(s string) bool { return strings.HasSuffix(s, "e+20") && len(s) == len("1.5e+20") }},
+		{MaskHash, "red", "enum('red','green','it''s')", func(s string) bool { return s == "red" || s == "green" || s == "it's" }},
+		{MaskHash, "a,c", "set('a','b','c')", func(s string) bool {
+			parts := strings.Split(s, ",")
+			return len(parts) == 2 && parts[0] != parts[1] && strings.Contains("abc", parts[0]) && strings.Contains("abc", parts[1])
+		}},
+		{MaskHash, `{"a":1}`, "json", func(s string) bool { return json.Valid([]byte(s)) && strings.HasPrefix(s, `"`) }},
+		{MaskEmail, `{"a":1}`, "json", func(s string) bool { return json.Valid([]byte(s)) }},
+		{MaskDate, "15:04:05", "time", func(s string) bool { return s == "15:00:00" }},
+		{MaskHash, "15:04:05", "time", func(s string) bool { return maskTimeRe.MatchString(s) }},
+		{MaskHash, "-838:59:59.25", "time(2)", func(s string) bool { return maskTimeRe.MatchString(s) && strings.HasPrefix(s, "-") }},
+		{MaskHash, "2019-05-17", "date", func(s string) bool { return s == "2019-05-01" }},
+		{MaskHash, "0000-00-00", "date", func(s string) bool { return s == "0000-00-00" }},
+	}
+	for _, c := range cases {
+		if masked := string(MaskValue(c.method, []byte(c.input), c.colType)); !c.check(masked) {
+			t.Errorf("MaskValue %s(%s) %s got: %s", c.method, c.input, c.colType, masked)
+		}
+	}
+
+	// 无法在值域内脱敏的类型
+	for colType, want := range map[string]string{"bit(1)": "", "point": "", "varchar(10)": "string", "INT(11) UNSIGNED": "integer"} {
+		if got := maskKind(colType); got != want {
+			t.Errorf("maskKind(%s) want: %s, got: %s", colType, want, got)
+		}
+	}
+	common.Config.SamplingMaskSecret = orgSecret
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestMaskCharLength(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	cases := map[string]int{"varchar(20)": 20, "CHAR(4)": 4, "varbinary(16)": 16, "text": 0, "int(11)": 0}
+	for dataType, want := range cases {
+		if got := maskCharLength(dataType); got != want {
+			t.Errorf("maskCharLength(%s) want: %d, got: %d", dataType, want, got)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
@@ -31,7 +31,6 @@ import (
 
 	// for database/sql
 	_ "github.com/go-sql-driver/mysql"
-	"vitess.io/vitess/go/vt/sqlparser"
 )
 
 // Connector 数据库连接基本对象
@@ -42,6 +41,8 @@ type Connector struct {
 	Database string
 	Charset  string
 	Conn     *sql.DB
+
+	load *serverLoad // Online 环境负载检查结果缓存，复制的 Connector 共享同一份缓存
 }
 
 // QueryResult 数据库查询返回值
@@ -54,7 +55,7 @@ type QueryResult struct {
 
 // NewConnector 创建新连接
 func NewConnector(dsn *common.Dsn) (*Connector, error) {
-	conn, err := sql.Open("mysql", common.FormatDSN(dsn))
+	conn, err := sql.Open("mysql", common.FormatDSN(onlineDSN(dsn)))
 	if err != nil {
 		return nil, err
 	}
@@ -65,6 +66,7 @@ func NewConnector(dsn *common.Dsn) (*Connector, error) {
 		Database: dsn.Schema,
 		Charset:  dsn.Charset,
 		Conn:     conn,
+		load:     &serverLoad{},
 	}
 	return connector, err
 }
@@ -80,9 +82,13 @@ func (db *Connector) Query(sql string, params ...interface{}) (QueryResult, erro
 	// 数据库安全性检查：如果 Connector 的 IP 端口与 TEST 环境不一致，则启用SQL白名单
 	// 不在白名单中的SQL不允许执行
 	// 执行环境与test环境不相同
-	if db.Addr != common.Config.TestDSN.Addr && db.dangerousQuery(sql) {
-		return res, fmt.Errorf("query execution deny: execute SQL with DSN(%s/%s) '%s'",
-			db.Addr, db.Database, fmt.Sprintf(sql, params...))
+	if db.Addr != common.Config.TestDSN.Addr {
+		if db.dangerousQuery(sql) {
+			return res, fmt.Errorf("query execution deny: execute SQL with DSN(%s/%s) '%s'",
+				db.Addr, db.Database, fmt.Sprintf(sql, params...))
+		}
+		// 限制线上环境 SELECT 的执行时间及资源组
+		sql = withOnlineHints(sql)
 	}
 
 	if db.Database == "" {
@@ -176,8 +182,8 @@ func (db *Connector) SingleIntValue(option string) (int, error) {
 	return intVal, err
 }
 
-// ColumnCardinality 粒度计算
-func (db *Connector) ColumnCardinality(tb, col string) float64 {
+// ColumnCardinality 粒度计算，线上环境负载过高跳过计算时返回 0.5 及 *ServerBusyError
+func (db *Connector) ColumnCardinality(tb, col string) (float64, error) {
 	// 获取该表上的已有的索引
 
 	// show table status 获取总行数（近似）
@@ -185,18 +191,18 @@ func (db *Connector) ColumnCardinality(tb, col string) float64 {
 	tbStatus, err := db.ShowTableStatus(tb)
 	if err != nil {
 		common.Log.Warn("(db *Connector) ColumnCardinality() ShowTableStatus Error: %v", err)
-		return 0
+		return 0, nil
 	}
 
 	// 如果是视图或表中无数据，rowTotal 都为 0
 	// 视图不需要加索引，无数据相当于散粒度为 1
 	if len(tbStatus.Rows) == 0 {
 		common.Log.Debug("(db *Connector) ColumnCardinality() No table status: %s", tb)
-		return 1
+		return 1, nil
 	}
 	if tbStatus.Rows[0].Rows == nil {
 		common.Log.Debug("(db *Connector) ColumnCardinality() No table status: %s", tb)
-		return 1
+		return 1, nil
 	}
 	rowTotal, err := strconv.ParseUint(string(tbStatus.Rows[0].Rows), 10, 64)
 	if rowTotal == 0 || err != nil {
@@ -206,12 +212,18 @@ func (db *Connector) ColumnCardinality(tb, col string) float64 {
 		if err != nil {
 			common.Log.Error("ColumnCardinality, ParseUint: " + string(tbStatus.Rows[0].Rows) + " Error: " + err.Error())
 		}
-		return 1
+		return 1, nil
 	}
 
 	// rowTotal > xxx 时保护数据库，不对该值计算散粒度，xxx可以在配置中设置
 	if rowTotal > common.Config.MaxTotalRows {
-		return 0.5
+		return 0.5, nil
+	}
+
+	// 线上环境负载过高时不计算散粒度
+	if err = db.CheckServerLoad(); err != nil {
+		common.Log.Warn("(db *Connector) ColumnCardinality() %v", err)
+		return 0.5, err
 	}
 
 	// 计算该列散粒度
@@ -222,7 +234,7 @@ func (db *Connector) ColumnCardinality(tb, col string) float64 {
 		Escape(tb, false)))
 	if err != nil {
 		common.Log.Warn("(db *Connector) ColumnCardinality() Query Error: %v", err)
-		return 0
+		return 0, nil
 	}
 
 	var colNum float64
@@ -230,17 +242,17 @@ func (db *Connector) ColumnCardinality(tb, col string) float64 {
 		err = res.Rows.Scan(&colNum)
 		if err != nil {
 			common.Log.Warn("(db *Connector) ColumnCardinality() Query Error: %v", err)
-			return 0
+			return 0, nil
 		}
 	}
 	res.Rows.Close()
 
 	// 当table status元数据不准确时 rowTotal 可能远小于count(*)，导致散粒度大于1
 	if colNum > float64(rowTotal) {
-		return 1
+		return 1, nil
 	}
 	// 散粒度区间：[0,1]
-	return colNum / float64(rowTotal)
+	return colNum / float64(rowTotal), nil
 }
 
 // IsView 判断表是否是视图
@@ -329,35 +341,13 @@ func RemoveSQLComments(sql string) string {
 	return strings.TrimSpace(string(res))
 }
 
-// 为了防止在 Online 环境进行误操作，通过 dangerousQuery 来判断能否在 Online 执行
+// 为了防止在 Online 环境进行误操作，通过 dangerousQuery 来判断能否在 Online 执行，不能执行时在日志中记录原因
 func (db *Connector) dangerousQuery(query string) bool {
-	queries, err := sqlparser.SplitStatementToPieces(strings.TrimSpace(strings.ToLower(query)))
+	err := CheckOnlineQuery(query)
 	if err != nil {
+		common.Log.Warning("dangerousQuery, deny to execute SQL with DSN(%s/%s): %s, SQL: %s", db.Addr, db.Database, err.Error(), query)
 		return true
 	}
-
-	for _, query := range queries {
-		dangerous := true
-		whiteList := []string{
-			"select",
-			"show",
-			"explain",
-			"describe",
-			"desc",
-		}
-
-		for _, prefix := range whiteList {
-			if strings.HasPrefix(query, prefix) {
-				dangerous = false
-				break
-			}
-		}
-
-		if dangerous {
-			return true
-		}
-	}
-
 	return false
 }
 
@@ -86,7 +86,10 @@ func TestColumnCardinality(t *testing.T) {
 	common.Log.Debug("Entering function: %s", common.GetFunctionName())
 	orgDatabase := connTest.Database
 	connTest.Database = "sakila"
-	a := connTest.ColumnCardinality("actor", "first_name")
+	a, err := connTest.ColumnCardinality("actor", "first_name")
+	if err != nil {
+		t.Error(err)
+	}
 	if a > 1 || a <= 0 {
 		t.Error("sakila.actor.first_name cardinality should in [0, 1], now it's", a)
 	}
@@ -97,10 +100,21 @@ func TestColumnCardinality(t *testing.T) {
 func TestDangerousSQL(t *testing.T) {
 	common.Log.Debug("Entering function: %s", common.GetFunctionName())
 	testCase := map[string]bool{
-		"select * from tb;delete from tb;": true,
-		"show database;":                   false,
-		"select * from t;":                 false,
-		"explain delete from t;":           false,
+		"select * from tb;delete from tb;":    true,
+		"show databases;":                     false,
+		"select * from t;":                    false,
+		"explain delete from t;":              false,
+		"explain extended select 1;":          false,
+		"desc t;":                             false,
+		"select get_lock('a', 1);":            true,
+		"select * from t where sleep(1);":     true,
+		"explain select sleep(1);":            false,
+		"explain analyze select * from t;":    true,
+		"select * from t for update;":         true,
+		"select * from t into outfile 'a';":   true,
+		"select * from t lock in share mode;": true,
+		"set @@profiling=1;":                  true,
+		"update t set a = 1;":                 true,
 	}
 
 	db := Connector{}
@@ -0,0 +1,208 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/laojianzi/soar/common"
+)
+
+// ServerBusyError Online 环境负载过高，跳过 EXPLAIN, 数据采样等对线上环境有压力的查询
+type ServerBusyError struct {
+	Addr   string
+	Reason string
+}
+
+// Error implements error interface
+func (e *ServerBusyError) Error() string {
+	return fmt.Sprintf("online server %s is busy, %s, heavy query skipped", e.Addr, e.Reason)
+}
+
+// isOnline 是否为 Online 环境的连接，与 Query 中的安全检查保持一致
+func (db *Connector) isOnline() bool {
+	return db.Addr != common.Config.TestDSN.Addr
+}
+
+// onlineDSN 为 Online 环境的连接添加会话级别的锁等待超时设置，每个新建的连接都会执行 SET
+func onlineDSN(dsn *common.Dsn) *common.Dsn {
+	if dsn == nil || dsn.Addr == common.Config.TestDSN.Addr || common.Config.OnlineLockWaitTimeout <= 0 {
+		return dsn
+	}
+
+	// 复制一份，不修改全局配置
+	safeDSN := *dsn
+	safeDSN.Params = make(map[string]string)
+	for k, v := range dsn.Params {
+		safeDSN.Params[k] = v
+	}
+	timeout := strconv.Itoa(common.Config.OnlineLockWaitTimeout)
+	for _, param := range []string{"lock_wait_timeout", "innodb_lock_wait_timeout"} {
+		if _, ok := safeDSN.Params[param]; !ok {
+			safeDSN.Params[param] = timeout
+		}
+	}
+	return &safeDSN
+}
+
+var selectPrefixRe = regexp.MustCompile(`(?i)^\s*select\b`)
+
+// withOnlineHints 为 Online 环境执行的 SELECT 添加 MAX_EXECUTION_TIME, RESOURCE_GROUP 优化器提示
+// 不支持的 MySQL 版本会将其作为注释忽略。未配置 OnlineResourceGroup 时不会切换资源组，线上查询与业务查询优先级相同，只受 MAX_EXECUTION_TIME 限制
+func withOnlineHints(query string) string {
+	var hints []string
+	if common.Config.OnlineMaxExecutionTime > 0 {
+		hints = append(hints, fmt.Sprintf("MAX_EXECUTION_TIME(%d)", common.Config.OnlineMaxExecutionTime))
+	}
+	if common.Config.OnlineResourceGroup != "" {
+		hints = append(hints, fmt.Sprintf("RESOURCE_GROUP(%s)", common.Config.OnlineResourceGroup))
+	}
+	if len(hints) == 0 || !selectPrefixRe.MatchString(query) {
+		return query
+	}
+	return selectPrefixRe.ReplaceAllLiteralString(query, "SELECT /*+ "+strings.Join(hints, " ")+" */")
+}
+
+// serverLoadCacheTime CheckServerLoad 结果的缓存时间，避免每条查询前都额外执行多条状态查询
+const serverLoadCacheTime = time.Second
+
+// serverLoad 缓存最近一次负载检查的结果
+type serverLoad struct {
+	sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// CheckServerLoad 检查 Online 环境的负载，Threads_running 或主从延迟超过阈值时返回 *ServerBusyError
+// 测试环境不做检查，没有权限等原因导致无法获取负载时只记录日志，检查结果在 serverLoadCacheTime 内复用
+func (db *Connector) CheckServerLoad() error {
+	if !db.isOnline() {
+		return nil
+	}
+	if db.load == nil {
+		return db.checkServerLoad()
+	}
+
+	db.load.Lock()
+	defer db.load.Unlock()
+	if db.load.checked.IsZero() || time.Since(db.load.checked) >= serverLoadCacheTime {
+		db.load.err = db.checkServerLoad()
+		db.load.checked = time.Now()
+	}
+	return db.load.err
+}
+
+// checkServerLoad 查询 Threads_running 及主从延迟判断 Online 环境是否负载过高
+func (db *Connector) checkServerLoad() error {
+
+	if common.Config.OnlineMaxThreadsRunning > 0 {
+		threads, err := db.threadsRunning()
+		common.LogIfWarn(err, "CheckServerLoad Threads_running")
+		if err == nil && threads > common.Config.OnlineMaxThreadsRunning {
+			return &ServerBusyError{
+				Addr:   db.Addr,
+				Reason: fmt.Sprintf("Threads_running %d > %d", threads, common.Config.OnlineMaxThreadsRunning),
+			}
+		}
+	}
+
+	if common.Config.OnlineMaxReplicationLag > 0 {
+		lag, ok, err := db.replicationLag()
+		common.LogIfWarn(err, "CheckServerLoad replication lag")
+		if err == nil && ok && lag > common.Config.OnlineMaxReplicationLag {
+			return &ServerBusyError{
+				Addr:   db.Addr,
+				Reason: fmt.Sprintf("replication lag %ds > %ds", lag, common.Config.OnlineMaxReplicationLag),
+			}
+		}
+	}
+	return nil
+}
+
+// threadsRunning 获取当前 Threads_running
+func (db *Connector) threadsRunning() (int, error) {
+	res, err := db.Query("SHOW GLOBAL STATUS LIKE 'Threads_running'")
+	if err != nil {
+		return 0, err
+	}
+	defer res.Rows.Close()
+
+	var name string
+	var value int
+	if res.Rows.Next() {
+		err = res.Rows.Scan(&name, &value)
+	}
+	return value, err
+}
+
+// replicationLag 获取主从延迟，非从库或复制线程未运行时 ok 为 false
+// pingcap/parser 不支持 SHOW SLAVE STATUS，该语句为固定的只读语句，不经过 Query 的安全检查
+func (db *Connector) replicationLag() (lag int, ok bool, err error) {
+	query := "SHOW SLAVE STATUS"
+	version, err := db.Version()
+	if err != nil {
+		return 0, false, err
+	}
+	if version >= 80022 {
+		query = "SHOW REPLICA STATUS"
+	}
+
+	rows, err := db.Conn.Query(query)
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, false, err
+	}
+	values := make([]sql.RawBytes, len(columns))
+	fields := make([]interface{}, len(columns))
+	for i := range values {
+		fields[i] = &values[i]
+	}
+	// 多源复制时取延迟最大的通道
+	for rows.Next() {
+		if err = rows.Scan(fields...); err != nil {
+			return 0, false, err
+		}
+		for i, col := range columns {
+			if col != "Seconds_Behind_Master" && col != "Seconds_Behind_Source" {
+				continue
+			}
+			// 复制线程未运行时为 NULL
+			if values[i] == nil {
+				continue
+			}
+			seconds, err := strconv.Atoi(string(values[i]))
+			if err != nil {
+				return 0, false, err
+			}
+			if !ok || seconds > lag {
+				lag, ok = seconds, true
+			}
+		}
+	}
+	return lag, ok, rows.Err()
+}
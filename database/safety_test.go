@@ -0,0 +1,98 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/laojianzi/soar/common"
+)
+
+func TestWithOnlineHints(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	timeout, group := common.Config.OnlineMaxExecutionTime, common.Config.OnlineResourceGroup
+	common.Config.OnlineMaxExecutionTime, common.Config.OnlineResourceGroup = 1000, "rg_low"
+
+	cases := map[string]string{
+		"select * from t":        "SELECT /*+ MAX_EXECUTION_TIME(1000) RESOURCE_GROUP(rg_low) */ * from t",
+		"  SELECT 1":             "SELECT /*+ MAX_EXECUTION_TIME(1000) RESOURCE_GROUP(rg_low) */ 1",
+		"show tables":            "show tables",
+		"explain select 1":       "explain select 1",
+		"selected_tables_status": "selected_tables_status",
+	}
+	for sql, want := range cases {
+		if got := withOnlineHints(sql); got != want {
+			t.Errorf("SQL: %s, want: %s, got: %s", sql, want, got)
+		}
+	}
+
+	common.Config.OnlineMaxExecutionTime, common.Config.OnlineResourceGroup = 0, ""
+	if got := withOnlineHints("select 1"); got != "select 1" {
+		t.Errorf("no hints want, got: %s", got)
+	}
+	common.Config.OnlineMaxExecutionTime, common.Config.OnlineResourceGroup = timeout, group
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestOnlineDSN(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	dsn := &common.Dsn{Addr: "192.168.0.1:3306", Params: map[string]string{"lock_wait_timeout": "5"}}
+	safeDSN := onlineDSN(dsn)
+	if safeDSN.Params["lock_wait_timeout"] != "5" || safeDSN.Params["innodb_lock_wait_timeout"] == "" {
+		t.Errorf("onlineDSN got params: %v", safeDSN.Params)
+	}
+	if _, ok := dsn.Params["innodb_lock_wait_timeout"]; ok {
+		t.Error("onlineDSN should not modify the origin dsn")
+	}
+	if onlineDSN(common.Config.TestDSN) != common.Config.TestDSN {
+		t.Error("onlineDSN should not change test dsn")
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestCheckServerLoadCache(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	orgThreads, orgLag := common.Config.OnlineMaxThreadsRunning, common.Config.OnlineMaxReplicationLag
+	common.Config.OnlineMaxThreadsRunning, common.Config.OnlineMaxReplicationLag = 0, 0
+	defer func() {
+		common.Config.OnlineMaxThreadsRunning, common.Config.OnlineMaxReplicationLag = orgThreads, orgLag
+	}()
+
+	busy := &ServerBusyError{Addr: "192.168.0.1:3306", Reason: "Threads_running 100 > 30"}
+	db := &Connector{Addr: "192.168.0.1:3306", load: &serverLoad{checked: time.Now(), err: busy}}
+	// 缓存时间内直接返回上次的检查结果
+	if err := db.CheckServerLoad(); err != busy {
+		t.Errorf("CheckServerLoad want cached: %v, got: %v", busy, err)
+	}
+
+	// 缓存过期后重新检查
+	db.load.checked = time.Now().Add(-serverLoadCacheTime)
+	if err := db.CheckServerLoad(); err != nil {
+		t.Errorf("CheckServerLoad want nil, got: %v", err)
+	}
+	if time.Since(db.load.checked) >= serverLoadCacheTime || db.load.err != nil {
+		t.Errorf("CheckServerLoad should refresh cache, got: %+v", db.load)
+	}
+
+	// 测试环境不检查
+	test := &Connector{Addr: common.Config.TestDSN.Addr, load: &serverLoad{checked: time.Now(), err: busy}}
+	if err := test.CheckServerLoad(); err != nil {
+		t.Errorf("CheckServerLoad of test dsn want nil, got: %v", err)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
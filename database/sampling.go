@@ -53,6 +53,11 @@ func (db *Connector) SamplingData(onlineConn *Connector, tables ...string) error
 		return fmt.Errorf("SamplingData the same database, From: %s/%s, To: %s/%s", onlineConn.Addr, onlineConn.Database, db.Addr, db.Database)
 	}
 
+	// 线上环境负载过高时不泵取数据
+	if err = onlineConn.CheckServerLoad(); err != nil {
+		return err
+	}
+
 	// 计算需要泵取的数据量
 	wantRowsCount := 300 * common.Config.SamplingStatisticTarget
 
@@ -93,17 +98,25 @@ func (db *Connector) SamplingData(onlineConn *Connector, tables ...string) error
 		} else {
 			where = common.Config.SamplingCondition
 		}
-		err = db.startSampling(onlineConn.Conn, onlineConn.Database, table, where)
+		// 数据脱敏
+		var masks map[string]columnMask
+		masks, err = onlineConn.samplingMasks(table)
+		if err != nil {
+			return err
+		}
+		err = db.startSampling(onlineConn.Conn, onlineConn.Database, table, where, masks)
 	}
 	return err
 }
 
-// startSampling sampling data from OnlineDSN to TestDSN
-func (db *Connector) startSampling(onlineConn *sql.DB, database, table string, where string) error {
+// startSampling sampling data from OnlineDSN to TestDSN, masks 为需要脱敏的列及脱敏方法
+func (db *Connector) startSampling(onlineConn *sql.DB, database, table string, where string, masks map[string]columnMask) error {
 	samplingQuery := fmt.Sprintf("SELECT * FROM `%s`.`%s` %s",
 		Escape(database, false),
 		Escape(table, false),
 		Escape(where, false))
+	// 限制线上环境 SELECT 的执行时间及资源组
+	samplingQuery = withOnlineHints(samplingQuery)
 	common.Log.Debug("startSampling with Query: %s", samplingQuery)
 	res, err := onlineConn.Query(samplingQuery)
 	if err != nil {
@@ -137,6 +150,13 @@ func (db *Connector) startSampling(onlineConn *sql.DB, database, table string, w
 			common.Log.Debug(err.Error())
 		}
 		for i, val := range row {
+			if mask, ok := masks[columns[i]]; ok {
+				if mask.skip {
+					values = append(values, "DEFAULT")
+					continue
+				}
+				val = MaskValue(mask.method, val, mask.colType)
+			}
 			if val == nil {
 				values = append(values, "NULL")
 			} else {
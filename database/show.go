@@ -17,8 +17,10 @@
 package database
 
 import (
+	"database/sql"
 	"fmt"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -225,18 +227,21 @@ func (db *Connector) ShowIndex(tableName string) (*TableIndexInfo, error) {
 	}
 
 	// columns info
+	// 函数索引的 Column_name，以及 Collation, Cardinality, Sub_part, Packed 可能为 NULL
 	ti := TableIndexRow{}
+	var columnName, collation, packed sql.NullString
+	var cardinality, subPart sql.NullInt64
 	indexFields := make([]interface{}, 0)
 	fields := map[string]interface{}{
 		"Table":         &ti.Table,
 		"Non_unique":    &ti.NonUnique,
 		"Key_name":      &ti.KeyName,
 		"Seq_in_index":  &ti.SeqInIndex,
-		"Column_name":   &ti.ColumnName,
-		"Collation":     &ti.Collation,
-		"Cardinality":   &ti.Cardinality,
-		"Sub_part":      &ti.SubPart,
-		"Packed":        &ti.Packed,
+		"Column_name":   &columnName,
+		"Collation":     &collation,
+		"Cardinality":   &cardinality,
+		"Sub_part":      &subPart,
+		"Packed":        &packed,
 		"Null":          &ti.Null,
 		"Index_type":    &ti.IndexType,
 		"Comment":       &ti.Comment,
@@ -257,16 +262,113 @@ func (db *Connector) ShowIndex(tableName string) (*TableIndexInfo, error) {
 	}
 	// 获取值
 	for res.Rows.Next() {
+		ti.Expression = nil
 		err := res.Rows.Scan(indexFields...)
 		if err != nil {
 			common.Log.Debug(err.Error())
 		}
+		ti.ColumnName = columnName.String
+		ti.Collation = collation.String
+		ti.Cardinality = int(cardinality.Int64)
+		ti.SubPart = int(subPart.Int64)
+		ti.Packed, _ = strconv.Atoi(packed.String)
 		tbIndex.Rows = append(tbIndex.Rows, ti)
 	}
 	res.Rows.Close()
 	return tbIndex, err
 }
 
+// IndexKeyPart 索引中的一列或一个函数表达式
+type IndexKeyPart struct {
+	Column     string `json:"column,omitempty"`     // 列名，函数索引时为空
+	Expression string `json:"expression,omitempty"` // 函数索引的表达式
+	SubPart    int    `json:"sub_part,omitempty"`   // 前缀索引长度，0 表示整列
+	Desc       bool   `json:"desc,omitempty"`       // 降序索引
+}
+
+// String 用于拼接 DDL 中的索引定义，如：`name`(10), (lower(`email`)) DESC
+func (k IndexKeyPart) String() string {
+	var part string
+	if k.Expression != "" {
+		part = "(" + k.Expression + ")"
+	} else {
+		part = "`" + k.Column + "`"
+		if k.SubPart > 0 {
+			part += fmt.Sprintf("(%d)", k.SubPart)
+		}
+	}
+	if k.Desc {
+		part += " DESC"
+	}
+	return part
+}
+
+// Covers 判断 k 是否可以替代 part，列或表达式及排序方向相同，且前缀长度不短于 part
+func (k IndexKeyPart) Covers(part IndexKeyPart) bool {
+	if !strings.EqualFold(k.Column, part.Column) || !strings.EqualFold(k.Expression, part.Expression) || k.Desc != part.Desc {
+		return false
+	}
+	return k.SubPart == 0 || (part.SubPart > 0 && k.SubPart >= part.SubPart)
+}
+
+// KeyPart 获取 show index 中的一行对应的索引列
+func (row TableIndexRow) KeyPart() IndexKeyPart {
+	return IndexKeyPart{
+		Column:     row.ColumnName,
+		Expression: string(row.Expression),
+		SubPart:    row.SubPart,
+		// MySQL 8.0 的降序索引 Collation 为 D
+		Desc: row.Collation == "D",
+	}
+}
+
+// Invisible 是否为不可见索引，MySQL 8.0 以下版本没有 Visible 列
+func (row TableIndexRow) Invisible() bool {
+	return strings.EqualFold(row.Visible, "NO")
+}
+
+// KeyNames 按 show index 的顺序获取所有的索引名称
+func (tbIndex *TableIndexInfo) KeyNames() []string {
+	var names []string
+	if tbIndex == nil {
+		return names
+	}
+	seen := make(map[string]bool)
+	for _, row := range tbIndex.Rows {
+		if !seen[row.KeyName] {
+			seen[row.KeyName] = true
+			names = append(names, row.KeyName)
+		}
+	}
+	return names
+}
+
+// KeyParts 获取索引中的所有列，按 Seq_in_index 排序
+func (tbIndex *TableIndexInfo) KeyParts(keyName string) []IndexKeyPart {
+	rows := tbIndex.FindIndex(IndexKeyName, keyName)
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].SeqInIndex < rows[j].SeqInIndex
+	})
+	var parts []IndexKeyPart
+	for _, row := range rows {
+		parts = append(parts, row.KeyPart())
+	}
+	return parts
+}
+
+// KeyDefinition 获取索引在 DDL 中的定义，如：`idx_name` (`name`(10), (lower(`email`)) DESC) INVISIBLE
+func (tbIndex *TableIndexInfo) KeyDefinition(keyName string) string {
+	var parts []string
+	for _, part := range tbIndex.KeyParts(keyName) {
+		parts = append(parts, part.String())
+	}
+	def := fmt.Sprintf("`%s` (%s)", keyName, strings.Join(parts, ", "))
+	if rows := tbIndex.FindIndex(IndexKeyName, keyName); len(rows) > 0 && rows[0].Invisible() {
+		def += " INVISIBLE"
+	}
+	return def
+}
+
 // IndexSelectKey 用以对 TableIndexInfo 进行查询
 type IndexSelectKey string
 
@@ -129,6 +129,42 @@ func TestShowIndex(t *testing.T) {
 	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
 }
 
+func TestIndexKeyPart(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	tbIndex := &TableIndexInfo{
+		TableName: "tbl",
+		Rows: []TableIndexRow{
+			{Table: "tbl", NonUnique: 1, KeyName: "idx_name_email", SeqInIndex: 2, Collation: "D", Expression: []byte("lower(`email`)"), Visible: "YES"},
+			{Table: "tbl", NonUnique: 1, KeyName: "idx_name_email", SeqInIndex: 1, ColumnName: "name", Collation: "A", SubPart: 10, Visible: "YES"},
+			{Table: "tbl", NonUnique: 1, KeyName: "idx_name", SeqInIndex: 1, ColumnName: "name", Collation: "A", Visible: "NO"},
+		},
+	}
+
+	if names := tbIndex.KeyNames(); fmt.Sprint(names) != "[idx_name_email idx_name]" {
+		t.Error("KeyNames got:", names)
+	}
+
+	defs := map[string]string{
+		"idx_name_email": "`idx_name_email` (`name`(10), (lower(`email`)) DESC)",
+		"idx_name":       "`idx_name` (`name`) INVISIBLE",
+	}
+	for keyName, want := range defs {
+		if got := tbIndex.KeyDefinition(keyName); got != want {
+			t.Errorf("KeyDefinition want: %s, got: %s", want, got)
+		}
+	}
+
+	full := tbIndex.KeyParts("idx_name")[0]
+	prefix := tbIndex.KeyParts("idx_name_email")[0]
+	if !full.Covers(prefix) || prefix.Covers(full) {
+		t.Errorf("%s should covers %s", full, prefix)
+	}
+	if full.Covers(IndexKeyPart{Column: "name", Desc: true}) {
+		t.Errorf("%s should not covers descending key part", full)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
 func TestShowColumns(t *testing.T) {
 	common.Log.Debug("Entering function: %s", common.GetFunctionName())
 	orgDatabase := connTest.Database
@@ -0,0 +1,364 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/laojianzi/soar/ast"
+	"github.com/laojianzi/soar/common"
+
+	tidb "github.com/pingcap/parser/ast"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// InnoDB 默认页大小，用于通过 Data_length, Index_length 估算持久化统计信息中的页数
+const innodbPageSize = 16384
+
+// SchemaSnapshot 数据库库表结构及统计信息快照，用于脱离线上环境进行评审
+type SchemaSnapshot struct {
+	Database       string           `json:"Database" yaml:"database"`              // 库名
+	CreateDatabase string           `json:"CreateDatabase" yaml:"create-database"` // 建库语句
+	Version        int              `json:"Version" yaml:"version"`                // 线上环境版本
+	Tables         []*TableSnapshot `json:"Tables" yaml:"tables"`
+}
+
+// TableSnapshot 表结构及统计信息快照
+type TableSnapshot struct {
+	Name        string           `json:"Name" yaml:"name"`
+	View        bool             `json:"View" yaml:"view"`
+	DDL         string           `json:"DDL" yaml:"ddl"`                  // 建表语句
+	Rows        uint64           `json:"Rows" yaml:"rows"`                // show table status 中的表行数
+	DataLength  uint64           `json:"DataLength" yaml:"data-length"`   // 聚簇索引大小，单位为 bytes
+	IndexLength uint64           `json:"IndexLength" yaml:"index-length"` // 二级索引大小，单位为 bytes
+	Indexes     []IndexSnapshot  `json:"Indexes,omitempty" yaml:"indexes,omitempty"`
+	Columns     []ColumnSnapshot `json:"Columns,omitempty" yaml:"columns,omitempty"`
+}
+
+// IndexSnapshot show index 中每一列的快照
+type IndexSnapshot struct {
+	KeyName     string `json:"KeyName" yaml:"key-name"`
+	SeqInIndex  int    `json:"SeqInIndex" yaml:"seq-in-index"`
+	ColumnName  string `json:"ColumnName" yaml:"column-name"`
+	NonUnique   int    `json:"NonUnique" yaml:"non-unique"`
+	Cardinality int    `json:"Cardinality" yaml:"cardinality"` // 索引前缀的唯一值数量
+}
+
+// ColumnSnapshot 列统计信息快照
+type ColumnSnapshot struct {
+	Name        string  `json:"Name" yaml:"name"`
+	NDV         uint64  `json:"NDV" yaml:"ndv"`                             // 唯一值数量
+	Cardinality float64 `json:"Cardinality" yaml:"cardinality"`             // 散粒度，范围 [0,1]
+	Unknown     bool    `json:"Unknown,omitempty" yaml:"unknown,omitempty"` // 线上环境负载过高，没有采集到散粒度
+}
+
+// snapshotUnknownCardinality 快照中未采集到散粒度的列使用的估算值，与线上环境负载过高时 ColumnCardinality 的返回值一致
+const snapshotUnknownCardinality = 0.5
+
+// DumpSchema 导出 db 中所有库表的结构及统计信息快照
+func (db *Connector) DumpSchema() (*SchemaSnapshot, error) {
+	return db.dumpSchema(true)
+}
+
+// DumpSchemaDDL 导出 db 中所有库表的结构及表大小，不采集索引及列的散粒度，用于表结构对比
+func (db *Connector) DumpSchemaDDL() (*SchemaSnapshot, error) {
+	return db.dumpSchema(false)
+}
+
+// dumpSchema 导出库表结构快照，withStats 为 false 时只记录建表语句及表大小
+func (db *Connector) dumpSchema(withStats bool) (*SchemaSnapshot, error) {
+	snapshot := &SchemaSnapshot{Database: db.Database}
+
+	var err error
+	snapshot.Version, err = db.Version()
+	if err != nil {
+		return nil, err
+	}
+	snapshot.CreateDatabase, err = db.ShowCreateDatabase(db.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	tables, err := db.ShowTables()
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range tables {
+		common.Log.Debug("DumpSchema, dump table `%s`.`%s`", db.Database, table)
+		tb, err := db.dumpTable(table, withStats)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Tables = append(snapshot.Tables, tb)
+	}
+	return snapshot, nil
+}
+
+// dumpTable 导出单张表的结构及统计信息
+func (db *Connector) dumpTable(table string, withStats bool) (*TableSnapshot, error) {
+	tb := &TableSnapshot{Name: table}
+
+	var err error
+	tb.DDL, err = db.ShowCreateTable(table)
+	if err != nil {
+		return nil, err
+	}
+	tb.View = db.IsView(table)
+	if tb.View {
+		return tb, nil
+	}
+
+	status, err := db.ShowTableStatus(table)
+	if err != nil {
+		return nil, err
+	}
+	if len(status.Rows) > 0 {
+		tb.Rows, _ = strconv.ParseUint(string(status.Rows[0].Rows), 10, 64)
+		tb.DataLength, _ = strconv.ParseUint(string(status.Rows[0].DataLength), 10, 64)
+		tb.IndexLength, _ = strconv.ParseUint(string(status.Rows[0].IndexLength), 10, 64)
+	}
+	if !withStats {
+		return tb, nil
+	}
+
+	indexes, err := db.ShowIndex(table)
+	if err != nil {
+		return nil, err
+	}
+	for _, idx := range indexes.Rows {
+		tb.Indexes = append(tb.Indexes, IndexSnapshot{
+			KeyName:     idx.KeyName,
+			SeqInIndex:  idx.SeqInIndex,
+			ColumnName:  idx.ColumnName,
+			NonUnique:   idx.NonUnique,
+			Cardinality: idx.Cardinality,
+		})
+	}
+
+	desc, err := db.ShowColumns(table)
+	if err != nil {
+		return nil, err
+	}
+	// MySQL 8.0 以下版本没有直方图
+	histograms, err := db.ShowColumnStatistics(table)
+	if err != nil {
+		common.Log.Debug("dumpTable, ShowColumnStatistics Error: %s", err.Error())
+	}
+	for _, col := range desc.DescValues {
+		tb.Columns = append(tb.Columns, tb.columnSnapshot(col.Field, histograms, func() (float64, error) {
+			return db.ColumnCardinality(table, col.Field)
+		}))
+	}
+	return tb, nil
+}
+
+// columnSnapshot 采集列的唯一值数量，优先使用以该列为第一列的索引的散粒度，其次使用直方图，都没有时才调用 count 全表扫描计算
+// 线上环境负载过高跳过计算时将该列记录为未知，不中断快照的导出
+func (tb *TableSnapshot) columnSnapshot(column string, histograms []ColumnStatistic, count func() (float64, error)) ColumnSnapshot {
+	col := ColumnSnapshot{Name: column}
+	var ndv float64
+	for _, idx := range tb.Indexes {
+		if idx.SeqInIndex == 1 && strings.EqualFold(idx.ColumnName, column) && float64(idx.Cardinality) > ndv {
+			ndv = float64(idx.Cardinality)
+		}
+	}
+	for _, cs := range histograms {
+		if ndv == 0 && strings.EqualFold(cs.ColumnName, column) {
+			var err error
+			ndv, err = HistogramDistinct(cs.Histogram)
+			common.LogIfWarn(err, "")
+		}
+	}
+
+	if ndv > 0 {
+		col.Cardinality = 1
+		if float64(tb.Rows) > ndv {
+			col.Cardinality = ndv / float64(tb.Rows)
+		}
+		col.NDV = uint64(math.Round(col.Cardinality * float64(tb.Rows)))
+		return col
+	}
+
+	cardinality, err := count()
+	if err != nil {
+		common.Log.Warn("dumpTable, `%s`.`%s` cardinality unknown: %s", tb.Name, column, err.Error())
+		col.Unknown = true
+		return col
+	}
+	col.NDV = uint64(math.Round(cardinality * float64(tb.Rows)))
+	col.Cardinality = cardinality
+	return col
+}
+
+// Marshal 按文件后缀格式化快照，.yaml, .yml 为 YAML 格式，其他为 JSON 格式
+func (s *SchemaSnapshot) Marshal(file string) ([]byte, error) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return yaml.Marshal(s)
+	default:
+		return json.MarshalIndent(s, "", "  ")
+	}
+}
+
+// LoadSchemaSnapshot 从文件中加载快照，.yaml, .yml 为 YAML 格式，其他为 JSON 格式
+func LoadSchemaSnapshot(file string) (*SchemaSnapshot, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SchemaSnapshot{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(buf, s)
+	default:
+		err = json.Unmarshal(buf, s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.Database == "" {
+		return nil, fmt.Errorf("LoadSchemaSnapshot %s: database not specified", file)
+	}
+	return s, nil
+}
+
+// LoadSchemaDDL 从建表语句文件或目录中加载表结构，目录中只读取 .sql 文件
+// 只保留 CREATE TABLE 语句，库名取 USE 语句或建表语句中指定的库，没有统计信息
+func LoadSchemaDDL(path string) (*SchemaSnapshot, error) {
+	files := []string{path}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		files, err = filepath.Glob(filepath.Join(path, "*.sql"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+	}
+
+	s := &SchemaSnapshot{}
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for len(buf) > 0 {
+			_, sql, left := ast.SplitStatement(buf, []byte(common.Config.Delimiter))
+			// 防止切分死循环，当剩余的内容和原 SQL 相同时直接清空 buf
+			if len(left) == len(buf) {
+				sql, left = string(buf), nil
+			}
+			buf = left
+
+			sql = strings.TrimSuffix(RemoveSQLComments(sql), common.Config.Delimiter)
+			if sql == "" {
+				continue
+			}
+			stmts, err := ast.TiParse(sql, "", "")
+			if err != nil {
+				common.Log.Warning("LoadSchemaDDL %s, TiParse Error: %s, SQL: %s", file, err.Error(), sql)
+				continue
+			}
+			for _, stmt := range stmts {
+				switch node := stmt.(type) {
+				case *tidb.UseStmt:
+					s.Database = node.DBName
+				case *tidb.CreateTableStmt:
+					if s.Database == "" {
+						s.Database = node.Table.Schema.O
+					}
+					s.Tables = append(s.Tables, &TableSnapshot{
+						Name: node.Table.Name.O,
+						DDL:  sql,
+					})
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+// Table 获取快照中的表，不存在时返回 nil
+func (s *SchemaSnapshot) Table(dbName, table string) *TableSnapshot {
+	if s == nil || s.Database != dbName {
+		return nil
+	}
+	for _, tb := range s.Tables {
+		if tb.Name == table {
+			return tb
+		}
+	}
+	return nil
+}
+
+// ColumnCardinality 获取快照中列的散粒度，导出时未采集到散粒度的列返回估算值
+func (s *SchemaSnapshot) ColumnCardinality(dbName, table, column string) (float64, bool) {
+	tb := s.Table(dbName, table)
+	if tb == nil {
+		return 0, false
+	}
+	for _, col := range tb.Columns {
+		if strings.EqualFold(col.Name, column) {
+			if col.Unknown {
+				return snapshotUnknownCardinality, true
+			}
+			return col.Cardinality, true
+		}
+	}
+	return 0, false
+}
+
+// Statistics 将快照转换为 InnoDB 持久化统计信息
+func (tb *TableSnapshot) Statistics() (*TableStatistic, []IndexStatistic) {
+	ts := &TableStatistic{
+		NRows:                tb.Rows,
+		ClusteredIndexSize:   tb.DataLength / innodbPageSize,
+		SumOfOtherIndexSizes: tb.IndexLength / innodbPageSize,
+	}
+	// 页数最少为 1
+	if ts.ClusteredIndexSize == 0 {
+		ts.ClusteredIndexSize = 1
+	}
+
+	var indexStats []IndexStatistic
+	for _, idx := range tb.Indexes {
+		var columns []string
+		for _, col := range tb.Indexes {
+			if col.KeyName == idx.KeyName && col.SeqInIndex <= idx.SeqInIndex {
+				columns = append(columns, col.ColumnName)
+			}
+		}
+		indexStats = append(indexStats, IndexStatistic{
+			IndexName:       idx.KeyName,
+			StatName:        fmt.Sprintf("n_diff_pfx%02d", idx.SeqInIndex),
+			StatValue:       uint64(idx.Cardinality),
+			StatDescription: strings.Join(columns, ","),
+		})
+	}
+	return ts, indexStats
+}
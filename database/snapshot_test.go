@@ -0,0 +1,201 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/laojianzi/soar/common"
+)
+
+var testSnapshot = &SchemaSnapshot{
+	Database:       "sakila",
+	CreateDatabase: "CREATE DATABASE `sakila` /*!40100 DEFAULT CHARACTER SET utf8mb4 */",
+	Version:        80023,
+	Tables: []*TableSnapshot{
+		{
+			Name:        "film_actor",
+			DDL:         "CREATE TABLE `film_actor` (`actor_id` smallint unsigned NOT NULL, `film_id` smallint unsigned NOT NULL, PRIMARY KEY (`actor_id`,`film_id`), KEY `idx_fk_film_id` (`film_id`))",
+			Rows:        5462,
+			DataLength:  196608,
+			IndexLength: 81920,
+			Indexes: []IndexSnapshot{
+				{KeyName: "PRIMARY", SeqInIndex: 1, ColumnName: "actor_id", Cardinality: 200},
+				{KeyName: "PRIMARY", SeqInIndex: 2, ColumnName: "film_id", Cardinality: 5462},
+				{KeyName: "idx_fk_film_id", SeqInIndex: 1, ColumnName: "film_id", NonUnique: 1, Cardinality: 997},
+			},
+			Columns: []ColumnSnapshot{
+				{Name: "actor_id", NDV: 200, Cardinality: 0.0366},
+				{Name: "film_id", NDV: 997, Cardinality: 0.1825},
+				{Name: "last_update", Unknown: true},
+			},
+		},
+		{
+			Name: "actor_info",
+			View: true,
+			DDL:  "CREATE VIEW `actor_info` AS select 1",
+		},
+	},
+}
+
+func TestSchemaSnapshot(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	dir, err := ioutil.TempDir("", "soar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"sakila.json", "sakila.yaml"} {
+		file = filepath.Join(dir, file)
+		buf, err := testSnapshot.Marshal(file)
+		if err != nil {
+			t.Error(err)
+		}
+		err = ioutil.WriteFile(file, buf, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshot, err := LoadSchemaSnapshot(file)
+		if err != nil {
+			t.Error(err)
+		}
+		if !reflect.DeepEqual(snapshot, testSnapshot) {
+			t.Errorf("%s load not equal to dump", file)
+		}
+	}
+
+	if cardinality, ok := testSnapshot.ColumnCardinality("sakila", "film_actor", "FILM_ID"); !ok || cardinality != 0.1825 {
+		t.Errorf("ColumnCardinality got: %f, %v", cardinality, ok)
+	}
+	if cardinality, ok := testSnapshot.ColumnCardinality("sakila", "film_actor", "last_update"); !ok || cardinality != snapshotUnknownCardinality {
+		t.Errorf("ColumnCardinality of unknown column got: %f, %v", cardinality, ok)
+	}
+	if _, ok := testSnapshot.ColumnCardinality("world", "film_actor", "film_id"); ok {
+		t.Error("ColumnCardinality should not found in other database")
+	}
+	var nilSnapshot *SchemaSnapshot
+	if nilSnapshot.Table("sakila", "film_actor") != nil {
+		t.Error("nil snapshot should not have table")
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestColumnSnapshot(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	tb := testSnapshot.Table("sakila", "film_actor")
+	histograms := []ColumnStatistic{
+		{ColumnName: "last_update", Histogram: `{"buckets": [["2006-02-15", 0.5], ["2006-02-16", 1.0]], "histogram-type": "singleton"}`},
+	}
+	counted := 0
+	count := func(cardinality float64, err error) func() (float64, error) {
+		return func() (float64, error) {
+			counted++
+			return cardinality, err
+		}
+	}
+
+	cases := []struct {
+		column string
+		count  func() (float64, error)
+		want   ColumnSnapshot
+	}{
+		// 索引第一列使用索引的散粒度，不全表扫描
+		{"film_id", count(0, errors.New("should not count")), ColumnSnapshot{Name: "film_id", NDV: 997, Cardinality: 997.0 / 5462}},
+		{"actor_id", count(0, errors.New("should not count")), ColumnSnapshot{Name: "actor_id", NDV: 200, Cardinality: 200.0 / 5462}},
+		// 没有索引时使用直方图
+		{"last_update", count(0, errors.New("should not count")), ColumnSnapshot{Name: "last_update", NDV: 2, Cardinality: 2.0 / 5462}},
+		{"description", count(0.5, nil), ColumnSnapshot{Name: "description", NDV: 2731, Cardinality: 0.5}},
+		// 线上环境负载过高时记录为未知
+		{"title", count(0.5, &ServerBusyError{Addr: "127.0.0.1:3306", Reason: "Threads_running 100 > 30"}), ColumnSnapshot{Name: "title", Unknown: true}},
+	}
+	for _, c := range cases {
+		if got := tb.columnSnapshot(c.column, histograms, c.count); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("column %s want: %+v, got: %+v", c.column, c.want, got)
+		}
+	}
+	if counted != 2 {
+		t.Errorf("want count 2 columns, got: %d", counted)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestTableSnapshotStatistics(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	ts, indexStats := testSnapshot.Tables[0].Statistics()
+	if ts.NRows != 5462 || ts.ClusteredIndexSize != 12 || ts.SumOfOtherIndexSizes != 5 {
+		t.Errorf("TableStatistic got: %v", ts)
+	}
+	want := []IndexStatistic{
+		{IndexName: "PRIMARY", StatName: "n_diff_pfx01", StatValue: 200, StatDescription: "actor_id"},
+		{IndexName: "PRIMARY", StatName: "n_diff_pfx02", StatValue: 5462, StatDescription: "actor_id,film_id"},
+		{IndexName: "idx_fk_film_id", StatName: "n_diff_pfx01", StatValue: 997, StatDescription: "film_id"},
+	}
+	if !reflect.DeepEqual(indexStats, want) {
+		t.Errorf("IndexStatistic want: %v, got: %v", want, indexStats)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestLoadSchemaDDL(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	dir, err := ioutil.TempDir("", "soar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"01_actor.sql": "-- sakila schema\nUSE sakila;\nDROP TABLE IF EXISTS `actor`;\nCREATE TABLE `actor` (\n  `actor_id` smallint unsigned NOT NULL,\n  PRIMARY KEY (`actor_id`)\n) ENGINE=InnoDB;\n",
+		"02_film.sql":  "/* film */\nCREATE TABLE film (film_id int NOT NULL, title varchar(255) NOT NULL);\nINSERT INTO film VALUES (1, 'a');\n",
+		"readme.md":    "CREATE TABLE readme (id int);",
+	}
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := LoadSchemaDDL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Database != "sakila" || len(s.Tables) != 2 {
+		t.Fatalf("got: %v", s)
+	}
+	want := []string{
+		"CREATE TABLE `actor` (\n  `actor_id` smallint unsigned NOT NULL,\n  PRIMARY KEY (`actor_id`)\n) ENGINE=InnoDB",
+		"CREATE TABLE film (film_id int NOT NULL, title varchar(255) NOT NULL)",
+	}
+	for i, tb := range s.Tables {
+		if tb.DDL != want[i] {
+			t.Errorf("want: %s, got: %s", want[i], tb.DDL)
+		}
+	}
+
+	// 单个文件
+	s, err = LoadSchemaDDL(filepath.Join(dir, "02_film.sql"))
+	if err != nil || len(s.Tables) != 1 || s.Tables[0].Name != "film" {
+		t.Errorf("got: %v, %v", s, err)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
@@ -0,0 +1,295 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/laojianzi/soar/common"
+)
+
+// https://dev.mysql.com/doc/refman/8.0/en/innodb-persistent-stats.html
+// https://dev.mysql.com/doc/refman/8.0/en/optimizer-statistics.html
+
+// TableStatistic mysql.innodb_table_stats 中的表统计信息
+type TableStatistic struct {
+	NRows                uint64 // 表总行数（估算）
+	ClusteredIndexSize   uint64 // 主键索引大小，单位为页
+	SumOfOtherIndexSizes uint64 // 二级索引大小，单位为页
+}
+
+// IndexStatistic mysql.innodb_index_stats 中的索引统计信息
+type IndexStatistic struct {
+	IndexName       string
+	StatName        string // n_diff_pfxNN, n_leaf_pages, size
+	StatValue       uint64
+	SampleSize      []byte // 可能为 NULL
+	StatDescription string
+}
+
+// ColumnStatistic INFORMATION_SCHEMA.COLUMN_STATISTICS 中的直方图信息，MySQL 8.0 及以上版本支持
+type ColumnStatistic struct {
+	ColumnName string
+	Histogram  string
+}
+
+// ShowTableStatistics 获取表的持久化统计信息，表不存在统计信息时返回 nil
+func (db *Connector) ShowTableStatistics(tableName string) (*TableStatistic, error) {
+	res, err := db.Query(fmt.Sprintf("SELECT n_rows, clustered_index_size, sum_of_other_index_sizes FROM mysql.innodb_table_stats WHERE database_name = '%s' AND table_name = '%s'",
+		Escape(db.Database, false), Escape(tableName, false)))
+	if err != nil {
+		return nil, err
+	}
+
+	var ts *TableStatistic
+	if res.Rows.Next() {
+		ts = &TableStatistic{}
+		err = res.Rows.Scan(&ts.NRows, &ts.ClusteredIndexSize, &ts.SumOfOtherIndexSizes)
+	}
+	res.Rows.Close()
+	return ts, err
+}
+
+// ShowIndexStatistics 获取表中各索引的持久化统计信息
+func (db *Connector) ShowIndexStatistics(tableName string) ([]IndexStatistic, error) {
+	res, err := db.Query(fmt.Sprintf("SELECT index_name, stat_name, stat_value, sample_size, stat_description FROM mysql.innodb_index_stats WHERE database_name = '%s' AND table_name = '%s'",
+		Escape(db.Database, false), Escape(tableName, false)))
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []IndexStatistic
+	for res.Rows.Next() {
+		var is IndexStatistic
+		err = res.Rows.Scan(&is.IndexName, &is.StatName, &is.StatValue, &is.SampleSize, &is.StatDescription)
+		if err != nil {
+			break
+		}
+		stats = append(stats, is)
+	}
+	res.Rows.Close()
+	return stats, err
+}
+
+// ShowColumnStatistics 获取表中各列的直方图
+func (db *Connector) ShowColumnStatistics(tableName string) ([]ColumnStatistic, error) {
+	res, err := db.Query(fmt.Sprintf("SELECT COLUMN_NAME, HISTOGRAM FROM information_schema.COLUMN_STATISTICS WHERE SCHEMA_NAME = '%s' AND TABLE_NAME = '%s'",
+		Escape(db.Database, false), Escape(tableName, false)))
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []ColumnStatistic
+	for res.Rows.Next() {
+		var cs ColumnStatistic
+		err = res.Rows.Scan(&cs.ColumnName, &cs.Histogram)
+		if err != nil {
+			break
+		}
+		stats = append(stats, cs)
+	}
+	res.Rows.Close()
+	return stats, err
+}
+
+// SamplingStatistics 将 onlineConn 中表的统计信息及直方图同步到 db 中，不泵取数据
+func (db *Connector) SamplingStatistics(onlineConn *Connector, tables ...string) error {
+	if onlineConn.Database == db.Database {
+		return fmt.Errorf("SamplingStatistics the same database, From: %s/%s, To: %s/%s", onlineConn.Addr, onlineConn.Database, db.Addr, db.Database)
+	}
+
+	for _, table := range tables {
+		if onlineConn.IsView(table) {
+			continue
+		}
+
+		// 表统计信息
+		ts, err := onlineConn.ShowTableStatistics(table)
+		if err != nil {
+			return err
+		}
+		if ts == nil {
+			common.Log.Info("SamplingStatistics, Table %s with no persistent statistics, stop sampling", table)
+			continue
+		}
+
+		// 索引统计信息
+		indexStats, err := onlineConn.ShowIndexStatistics(table)
+		if err != nil {
+			return err
+		}
+		err = db.RestoreStatistics(table, ts, indexStats)
+		if err != nil {
+			return err
+		}
+
+		// 直方图，失败时不影响其他统计信息的使用
+		common.LogIfWarn(db.samplingHistograms(onlineConn, table), "")
+	}
+	return nil
+}
+
+// RestoreStatistics 将表及索引统计信息写入 db 的持久化统计信息中
+func (db *Connector) RestoreStatistics(table string, ts *TableStatistic, indexStats []IndexStatistic) error {
+	err := db.exec(fmt.Sprintf("REPLACE INTO mysql.innodb_table_stats (database_name, table_name, last_update, n_rows, clustered_index_size, sum_of_other_index_sizes) VALUES ('%s', '%s', NOW(), %d, %d, %d)",
+		Escape(db.Database, false), Escape(table, false), ts.NRows, ts.ClusteredIndexSize, ts.SumOfOtherIndexSizes))
+	if err != nil {
+		return err
+	}
+
+	var values []string
+	for _, is := range indexStats {
+		sampleSize := "NULL"
+		if is.SampleSize != nil {
+			sampleSize = string(is.SampleSize)
+		}
+		values = append(values, fmt.Sprintf("('%s', '%s', '%s', NOW(), '%s', %d, %s, '%s')",
+			Escape(db.Database, false), Escape(table, false), Escape(is.IndexName, false),
+			Escape(is.StatName, false), is.StatValue, sampleSize, Escape(is.StatDescription, false)))
+	}
+	if len(values) > 0 {
+		err = db.exec("REPLACE INTO mysql.innodb_index_stats (database_name, table_name, index_name, last_update, stat_name, stat_value, sample_size, stat_description) VALUES " + strings.Join(values, ","))
+		if err != nil {
+			return err
+		}
+	}
+
+	// 手动修改持久化统计信息后需要 FLUSH TABLE 才能重新加载
+	return db.exec(fmt.Sprintf("FLUSH TABLE `%s`.`%s`", Escape(db.Database, false), Escape(table, false)))
+}
+
+// samplingHistograms 同步直方图，ANALYZE TABLE ... USING DATA 需要 MySQL 8.0.31 及以上版本
+func (db *Connector) samplingHistograms(onlineConn *Connector, table string) error {
+	onlineVersion, err := onlineConn.Version()
+	if err != nil || onlineVersion < 80000 {
+		return err
+	}
+	columnStats, err := onlineConn.ShowColumnStatistics(table)
+	if err != nil || len(columnStats) == 0 {
+		return err
+	}
+	version, err := db.Version()
+	if err != nil {
+		return err
+	}
+	if version < 80031 {
+		return fmt.Errorf("samplingHistograms, test env version %d not support UPDATE HISTOGRAM ... USING DATA", version)
+	}
+
+	for _, cs := range columnStats {
+		err = db.exec(fmt.Sprintf("ANALYZE TABLE `%s`.`%s` UPDATE HISTOGRAM ON `%s` USING DATA '%s'",
+			Escape(db.Database, false), Escape(table, false), Escape(cs.ColumnName, false), Escape(cs.Histogram, false)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exec 执行不关心返回结果的 SQL
+func (db *Connector) exec(sql string) error {
+	res, err := db.Query(sql)
+	if res.Rows != nil {
+		res.Rows.Close()
+	}
+	return err
+}
+
+// StatisticsCardinality 通过索引统计信息或直方图计算散粒度，无可用统计信息时 ok 为 false
+func (db *Connector) StatisticsCardinality(tb, col string) (cardinality float64, ok bool) {
+	ts, err := db.ShowTableStatistics(tb)
+	if err != nil || ts == nil || ts.NRows == 0 {
+		return 0, false
+	}
+
+	var distinct float64
+	// 以该列为第一列的索引，n_diff_pfx01 即为该列的唯一值数量
+	indexInfo, err := db.ShowIndex(tb)
+	if err == nil {
+		indexStats, err := db.ShowIndexStatistics(tb)
+		common.LogIfWarn(err, "")
+		for _, idx := range indexInfo.Rows {
+			if idx.SeqInIndex != 1 || !strings.EqualFold(idx.ColumnName, col) {
+				continue
+			}
+			for _, is := range indexStats {
+				if is.IndexName == idx.KeyName && is.StatName == "n_diff_pfx01" {
+					distinct = float64(is.StatValue)
+				}
+			}
+		}
+	}
+
+	// 没有索引统计信息时使用直方图
+	if distinct == 0 {
+		columnStats, err := db.ShowColumnStatistics(tb)
+		if err != nil {
+			return 0, false
+		}
+		for _, cs := range columnStats {
+			if strings.EqualFold(cs.ColumnName, col) {
+				distinct, err = HistogramDistinct(cs.Histogram)
+				common.LogIfWarn(err, "")
+			}
+		}
+	}
+
+	if distinct == 0 {
+		return 0, false
+	}
+	common.Log.Debug("StatisticsCardinality, `%s`.`%s` distinct: %f, rows: %d", tb, col, distinct, ts.NRows)
+
+	// 统计信息为估算值，散粒度区间：[0,1]
+	if distinct > float64(ts.NRows) {
+		return 1, true
+	}
+	return distinct / float64(ts.NRows), true
+}
+
+// HistogramDistinct 根据直方图估算列的唯一值数量
+// singleton 直方图每个桶对应一个值，equi-height 直方图每个桶的第四个元素为桶内唯一值数量
+func HistogramDistinct(histogram string) (float64, error) {
+	var h struct {
+		Buckets       [][]interface{} `json:"buckets"`
+		HistogramType string          `json:"histogram-type"`
+	}
+	err := json.Unmarshal([]byte(histogram), &h)
+	if err != nil {
+		return 0, err
+	}
+
+	switch h.HistogramType {
+	case "singleton":
+		return float64(len(h.Buckets)), nil
+	case "equi-height":
+		var distinct float64
+		for _, bucket := range h.Buckets {
+			if len(bucket) < 4 {
+				return 0, fmt.Errorf("HistogramDistinct, wrong equi-height bucket: %v", bucket)
+			}
+			num, ok := bucket[3].(float64)
+			if !ok {
+				return 0, fmt.Errorf("HistogramDistinct, wrong equi-height bucket: %v", bucket)
+			}
+			distinct += num
+		}
+		return distinct, nil
+	}
+	return 0, fmt.Errorf("HistogramDistinct, not support histogram-type: %s", h.HistogramType)
+}
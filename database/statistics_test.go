@@ -0,0 +1,47 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"testing"
+
+	"github.com/laojianzi/soar/common"
+)
+
+func TestHistogramDistinct(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	histograms := map[string]float64{
+		`{"buckets": [[1, 0.3], [2, 0.6], [3, 1.0]], "data-type": "int", "null-values": 0.0, "collation-id": 8, "sampling-rate": 1.0, "histogram-type": "singleton", "number-of-buckets-specified": 100}`:                                  3,
+		`{"buckets": [["base64:type254:YQ==", "base64:type254:Yw==", 0.5, 3], ["base64:type254:ZA==", "base64:type254:eg==", 1.0, 20]], "data-type": "string", "null-values": 0.0, "sampling-rate": 1.0, "histogram-type": "equi-height"}`: 23,
+	}
+	for histogram, want := range histograms {
+		distinct, err := HistogramDistinct(histogram)
+		if err != nil {
+			t.Error(err.Error())
+		}
+		if distinct != want {
+			t.Errorf("HistogramDistinct want: %f, got: %f", want, distinct)
+		}
+	}
+
+	for _, histogram := range []string{`{"buckets": [], "histogram-type": "unknown"}`, `{"buckets": [[1, 2, 0.5]], "histogram-type": "equi-height"}`, `not json`} {
+		if _, err := HistogramDistinct(histogram); err == nil {
+			t.Errorf("HistogramDistinct should return error: %s", histogram)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
@@ -0,0 +1,385 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/laojianzi/soar/common"
+
+	"vitess.io/vitess/go/vt/sqlparser"
+)
+
+// 重写前后查询结果的对比结论
+const (
+	RewriteVerified     = "verified"     // 结果一致
+	RewriteUnverifiable = "unverifiable" // 无法验证
+	RewriteDivergent    = "divergent"    // 结果不一致
+)
+
+// rewriteVerifyMaxRows 对比结果时读取的最大行数，测试环境中是采样后的数据，超过该行数时不再对比
+const rewriteVerifyMaxRows = 10000
+
+// rewriteVerifyNonDeterministic 每次执行结果可能不同的函数
+var rewriteVerifyNonDeterministic = map[string]bool{
+	"rand": true, "uuid": true, "uuid_short": true, "now": true, "sysdate": true, "curdate": true,
+	"curtime": true, "current_timestamp": true, "current_date": true, "current_time": true,
+	"localtime": true, "localtimestamp": true, "unix_timestamp": true, "utc_timestamp": true,
+	"utc_date": true, "utc_time": true, "connection_id": true, "last_insert_id": true,
+	"found_rows": true, "row_count": true, "sleep": true, "benchmark": true,
+}
+
+// RewriteVerification 重写前后查询结果的对比
+type RewriteVerification struct {
+	Status string // verified, unverifiable, divergent
+	Reason string // 对比结论的说明
+	Sample string // 结果不一致时的样例行
+}
+
+// String 以 SQL 注释的形式输出对比结论，不影响重写后的 SQL 的使用
+func (v RewriteVerification) String() string {
+	str := "-- rewrite-verify: " + v.Status
+	if v.Reason != "" {
+		str += ", " + v.Reason
+	}
+	if v.Sample != "" {
+		str += ": " + v.Sample
+	}
+	return str
+}
+
+// VerifyRewrite 在测试环境中分别执行重写前后的 SQL，对比返回结果的多重集，原 SQL 有 ORDER BY 时同时对比不同排序值的行的顺序
+// 只执行只读查询，测试环境中没有采样数据时无法验证
+func (db *Connector) VerifyRewrite(origin, rewritten string) RewriteVerification {
+	origin = strings.TrimSuffix(strings.TrimSpace(origin), common.Config.Delimiter)
+	rewritten = strings.TrimSuffix(strings.TrimSpace(rewritten), common.Config.Delimiter)
+
+	if common.Config.TestDSN.Disable {
+		return RewriteVerification{Status: RewriteUnverifiable, Reason: "dsn is disable"}
+	}
+	orderBy, err := rewriteVerifiable(origin, rewritten, db.verifyUniqueKeys)
+	if err != nil {
+		return RewriteVerification{Status: RewriteUnverifiable, Reason: err.Error()}
+	}
+
+	originCols, originRows, err := db.verifyRows(origin)
+	if err != nil {
+		return RewriteVerification{Status: RewriteUnverifiable, Reason: "原 SQL 执行失败, " + err.Error()}
+	}
+	rewrittenCols, rewrittenRows, err := db.verifyRows(rewritten)
+	if err != nil {
+		return RewriteVerification{Status: RewriteDivergent, Reason: "重写后的 SQL 执行失败, " + err.Error()}
+	}
+	if len(originCols) != len(rewrittenCols) {
+		return RewriteVerification{
+			Status: RewriteDivergent,
+			Reason: fmt.Sprintf("返回的列数不同, 原 SQL %d 列, 重写后 %d 列", len(originCols), len(rewrittenCols)),
+		}
+	}
+	return compareRows(originRows, rewrittenRows, orderKeys(orderBy, originCols))
+}
+
+// rewriteVerifiable 检查重写前后的 SQL 能否对比结果，返回原 SQL 最外层的 ORDER BY
+// LIMIT 的结果只有在 ORDER BY 能唯一确定一行时才是确定的，uniqueKeys 返回表中不允许为 NULL 的主键及唯一索引
+func rewriteVerifiable(origin, rewritten string, uniqueKeys func(table string) [][]string) (sqlparser.OrderBy, error) {
+	var orderBy sqlparser.OrderBy
+	for i, query := range []string{origin, rewritten} {
+		stmt, err := sqlparser.Parse(query)
+		if err != nil {
+			return nil, err
+		}
+		switch n := stmt.(type) {
+		case *sqlparser.Select:
+			if n.Limit != nil && !verifyUniqueOrder(n, uniqueKeys) {
+				return nil, errors.New("LIMIT 的 ORDER BY 不能唯一确定一行, 结果不确定")
+			}
+			if i == 0 {
+				orderBy = n.OrderBy
+			}
+		case *sqlparser.Union:
+			if n.Limit != nil {
+				return nil, errors.New("UNION 的 LIMIT 结果不确定")
+			}
+			if i == 0 {
+				orderBy = n.OrderBy
+			}
+		case *sqlparser.ParenSelect:
+		default:
+			return nil, errors.New("只验证 SELECT 查询")
+		}
+		// 与线上环境使用相同的只读检查，排除 FOR UPDATE, INTO OUTFILE 等语句
+		if err = CheckOnlineQuery(query); err != nil {
+			return nil, err
+		}
+
+		err = sqlparser.Walk(func(node sqlparser.SQLNode) (kontinue bool, err error) {
+			switch n := node.(type) {
+			case *sqlparser.SQLVal:
+				if n.Type == sqlparser.ValArg {
+					return false, errors.New("SQL 中包含占位符")
+				}
+			case *sqlparser.FuncExpr:
+				if rewriteVerifyNonDeterministic[n.Name.Lowered()] {
+					return false, fmt.Errorf("%s() 每次执行的结果可能不同", n.Name.Lowered())
+				}
+			}
+			return true, nil
+		}, stmt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return orderBy, nil
+}
+
+// verifyUniqueOrder 单表查询的 ORDER BY 包含主键或某个不允许为 NULL 的唯一索引的全部列时才能唯一确定一行
+func verifyUniqueOrder(sel *sqlparser.Select, uniqueKeys func(table string) [][]string) bool {
+	if len(sel.OrderBy) == 0 || len(sel.From) != 1 {
+		return false
+	}
+	from, ok := sel.From[0].(*sqlparser.AliasedTableExpr)
+	if !ok {
+		return false
+	}
+	table, ok := from.Expr.(sqlparser.TableName)
+	if !ok {
+		return false
+	}
+	order := make(map[string]bool)
+	for _, o := range sel.OrderBy {
+		if col, ok := o.Expr.(*sqlparser.ColName); ok {
+			order[col.Name.Lowered()] = true
+		}
+	}
+	for _, key := range uniqueKeys(table.Name.String()) {
+		covered := len(key) > 0
+		for _, col := range key {
+			covered = covered && order[strings.ToLower(col)]
+		}
+		if covered {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyUniqueKeys 获取测试环境中表的主键及所有列都不允许为 NULL 的唯一索引
+func (db *Connector) verifyUniqueKeys(table string) [][]string {
+	idxInfo, err := db.ShowIndex(table)
+	if err != nil {
+		common.Log.Debug("verifyUniqueKeys, ShowIndex Error: %s", err.Error())
+		return nil
+	}
+	var names []string
+	keys := make(map[string][]string)
+	nullable := make(map[string]bool)
+	for _, row := range idxInfo.Rows {
+		if row.NonUnique != 0 {
+			continue
+		}
+		if _, ok := keys[row.KeyName]; !ok {
+			names = append(names, row.KeyName)
+		}
+		keys[row.KeyName] = append(keys[row.KeyName], row.ColumnName)
+		// 函数索引没有列名，与允许为 NULL 的列一样无法保证唯一
+		if row.Null == "YES" || row.ColumnName == "" {
+			nullable[row.KeyName] = true
+		}
+	}
+	var unique [][]string
+	for _, name := range names {
+		if !nullable[name] {
+			unique = append(unique, keys[name])
+		}
+	}
+	return unique
+}
+
+// orderKeys 获取 ORDER BY 的每一项在结果中的列序号，有无法对应到结果列的表达式时返回 nil，按无序的结果对比
+func orderKeys(orderBy sqlparser.OrderBy, cols []string) []int {
+	var keys []int
+	for _, o := range orderBy {
+		pos := -1
+		switch n := o.Expr.(type) {
+		case *sqlparser.SQLVal:
+			// ORDER BY 1
+			if i, err := strconv.Atoi(string(n.Val)); err == nil && n.Type == sqlparser.IntVal && i >= 1 && i <= len(cols) {
+				pos = i - 1
+			}
+		case *sqlparser.ColName:
+			pos = uniqueColumn(cols, n.Name.String())
+		default:
+			pos = uniqueColumn(cols, sqlparser.String(n))
+		}
+		if pos < 0 {
+			return nil
+		}
+		keys = append(keys, pos)
+	}
+	return keys
+}
+
+// uniqueColumn 查找结果中与 name 同名的列，找不到或有多个同名列时返回 -1
+func uniqueColumn(cols []string, name string) int {
+	pos := -1
+	for i, col := range cols {
+		if strings.EqualFold(col, name) {
+			if pos >= 0 {
+				return -1
+			}
+			pos = i
+		}
+	}
+	return pos
+}
+
+// verifyRows 执行查询，返回结果的列名及所有行
+func (db *Connector) verifyRows(query string) ([]string, [][]sql.NullString, error) {
+	res, err := db.Query(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.Warning != nil {
+		res.Warning.Close()
+	}
+	if res.Error != nil {
+		return nil, nil, res.Error
+	}
+	defer res.Rows.Close()
+
+	cols, err := res.Rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	var rows [][]sql.NullString
+	for res.Rows.Next() {
+		if len(rows) >= rewriteVerifyMaxRows {
+			return nil, nil, fmt.Errorf("结果超过 %d 行", rewriteVerifyMaxRows)
+		}
+		row := make([]sql.NullString, len(cols))
+		fields := make([]interface{}, len(cols))
+		for i := range row {
+			fields[i] = &row[i]
+		}
+		if err = res.Rows.Scan(fields...); err != nil {
+			return nil, nil, err
+		}
+		rows = append(rows, row)
+	}
+	return cols, rows, res.Rows.Err()
+}
+
+// compareRows 对比重写前后的查询结果，keys 为 ORDER BY 的列在结果中的序号，为空时按多重集对比
+// ORDER BY 的值相同的行返回的顺序不确定，有序的结果按 ORDER BY 的值分组，组内的行按多重集对比
+func compareRows(origin, rewritten [][]sql.NullString, keys []int) RewriteVerification {
+	if len(origin) == 0 && len(rewritten) == 0 {
+		return RewriteVerification{Status: RewriteUnverifiable, Reason: "测试环境中重写前后的 SQL 都没有返回数据, 请开启 sampling 后验证"}
+	}
+
+	if len(keys) == 0 {
+		if reason, sample := diffRows(origin, rewritten); reason != "" {
+			return RewriteVerification{Status: RewriteDivergent, Reason: reason, Sample: sample}
+		}
+		return RewriteVerification{Status: RewriteVerified, Reason: fmt.Sprintf("%d 行结果一致", len(origin))}
+	}
+
+	for start, end := 0, 0; start < len(origin); start = end {
+		end = start + 1
+		for end < len(origin) && orderKey(origin[end], keys) == orderKey(origin[start], keys) {
+			end++
+		}
+		if end > len(rewritten) {
+			return RewriteVerification{
+				Status: RewriteDivergent,
+				Reason: fmt.Sprintf("重写后缺少第 %d 行", len(rewritten)+1),
+				Sample: formatRow(origin[len(rewritten)]),
+			}
+		}
+		if end-start == 1 {
+			if formatRow(origin[start]) != formatRow(rewritten[start]) {
+				return RewriteVerification{
+					Status: RewriteDivergent,
+					Reason: fmt.Sprintf("第 %d 行不一致", start+1),
+					Sample: formatRow(origin[start]) + " -> " + formatRow(rewritten[start]),
+				}
+			}
+			continue
+		}
+		if reason, sample := diffRows(origin[start:end], rewritten[start:end]); reason != "" {
+			return RewriteVerification{
+				Status: RewriteDivergent,
+				Reason: fmt.Sprintf("第 %d 至 %d 行排序的值相同, %s", start+1, end, reason),
+				Sample: sample,
+			}
+		}
+	}
+	if len(rewritten) > len(origin) {
+		return RewriteVerification{
+			Status: RewriteDivergent,
+			Reason: fmt.Sprintf("重写后多出第 %d 行", len(origin)+1),
+			Sample: formatRow(rewritten[len(origin)]),
+		}
+	}
+	return RewriteVerification{Status: RewriteVerified, Reason: fmt.Sprintf("%d 行结果一致", len(origin))}
+}
+
+// diffRows 按多重集对比两组行，相同的行出现的次数也需要一致，一致时返回空
+func diffRows(origin, rewritten [][]sql.NullString) (reason string, sample string) {
+	count := make(map[string]int)
+	for _, row := range origin {
+		count[formatRow(row)]++
+	}
+	for _, row := range rewritten {
+		key := formatRow(row)
+		if count[key] == 0 {
+			return "重写后多出的行", key
+		}
+		count[key]--
+	}
+	for _, row := range origin {
+		if key := formatRow(row); count[key] > 0 {
+			return "重写后缺少的行", key
+		}
+	}
+	return "", ""
+}
+
+// orderKey 一行中 ORDER BY 的列的值
+func orderKey(row []sql.NullString, keys []int) string {
+	values := make([]sql.NullString, len(keys))
+	for i, k := range keys {
+		values[i] = row[k]
+	}
+	return formatRow(values)
+}
+
+// formatRow 格式化一行数据用于对比及输出
+func formatRow(row []sql.NullString) string {
+	values := make([]string, len(row))
+	for i, v := range row {
+		if v.Valid {
+			values[i] = "'" + stringEscape(v.String) + "'"
+		} else {
+			values[i] = "NULL"
+		}
+	}
+	return "(" + strings.Join(values, ", ") + ")"
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"github.com/laojianzi/soar/common"
+
+	"vitess.io/vitess/go/vt/sqlparser"
+)
+
+func TestRewriteVerifiable(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	uniqueKeys := func(table string) [][]string {
+		if table == "film" {
+			return [][]string{{"film_id"}, {"title", "release_year"}}
+		}
+		return nil
+	}
+	cases := []struct {
+		origin, rewritten string
+		ordered, ok       bool
+	}{
+		{"select * from film where film_id = 1 or film_id = 2", "select * from film where film_id in (1, 2)", false, true},
+		{"select title from film order by film_id limit 10", "select title from film order by film_id asc limit 10", true, true},
+		{"select title from film order by title, release_year limit 10", "select title from film order by title asc, release_year asc limit 10", true, true},
+		{"select * from film where film_id = 1 or title = 'a'", "select * from film where film_id = 1 union all select * from film where title = 'a' and (film_id = 1) is not true", false, true},
+		{"select * from film order by rating", "select * from film order by rating asc", true, true},
+		// LIMIT 的 ORDER BY 不唯一
+		{"select title from film order by title limit 10", "select title from film order by title asc limit 10", false, false},
+		{"select title from actor order by actor_id limit 10", "select title from actor order by actor_id asc limit 10", false, false},
+		{"select title from film limit 10", "select title from film limit 10", false, false},
+		{"select * from film order by film_id limit 10000, 10", "select * from film where film_id > ? order by film_id asc limit 10", false, false},
+		{"delete from film where film_id = 1", "select * from film where film_id = 1", false, false},
+		{"select * from film for update", "select * from film for update", false, false},
+		{"select rand() from film", "select rand() from film", false, false},
+	}
+	for _, c := range cases {
+		orderBy, err := rewriteVerifiable(c.origin, c.rewritten, uniqueKeys)
+		if (err == nil) != c.ok || (err == nil && (len(orderBy) > 0) != c.ordered) {
+			t.Errorf("SQL: %s, want ordered: %v, ok: %v, got order by: %v, err: %v", c.origin, c.ordered, c.ok, orderBy, err)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestOrderKeys(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	cols := []string{"film_id", "title", "COUNT(*)", "title"}
+	cases := map[string][]int{
+		"select film_id from film order by film_id":           {0},
+		"select film_id from film order by f.FILM_ID desc, 3": {0, 2},
+		"select film_id from film order by count(*)":          {2},
+		// 同名的列无法区分，rating 不在结果中
+		"select film_id from film order by title":  nil,
+		"select film_id from film order by rating": nil,
+	}
+	for query, want := range cases {
+		stmt, err := sqlparser.Parse(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := orderKeys(stmt.(*sqlparser.Select).OrderBy, cols); !reflect.DeepEqual(got, want) {
+			t.Errorf("SQL: %s, want: %v, got: %v", query, want, got)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestCompareRows(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	row := func(values ...interface{}) []sql.NullString {
+		var r []sql.NullString
+		for _, v := range values {
+			if v == nil {
+				r = append(r, sql.NullString{})
+			} else {
+				r = append(r, sql.NullString{String: v.(string), Valid: true})
+			}
+		}
+		return r
+	}
+	a, b, c, null := row("1", "a"), row("2", "it's"), row("3", "c"), row("4", nil)
+	// 第一列为排序的值，x1, x2 排序的值相同
+	x1, x2, y := row("1", "x1"), row("1", "x2"), row("2", "y")
+
+	cases := []struct {
+		origin, rewritten [][]sql.NullString
+		keys              []int
+		want              RewriteVerification
+	}{
+		{
+			[][]sql.NullString{a, b, null}, [][]sql.NullString{null, a, b}, nil,
+			RewriteVerification{Status: RewriteVerified, Reason: "3 行结果一致"},
+		},
+		{
+			[][]sql.NullString{a, b}, [][]sql.NullString{b, a}, []int{0},
+			RewriteVerification{Status: RewriteDivergent, Reason: "第 1 行不一致", Sample: "('1', 'a') -> ('2', 'it\\'s')"},
+		},
+		{
+			[][]sql.NullString{a, a, b}, [][]sql.NullString{a, b, b}, nil,
+			RewriteVerification{Status: RewriteDivergent, Reason: "重写后多出的行", Sample: "('2', 'it\\'s')"},
+		},
+		{
+			[][]sql.NullString{a, b, null}, [][]sql.NullString{a, b}, nil,
+			RewriteVerification{Status: RewriteDivergent, Reason: "重写后缺少的行", Sample: "('4', NULL)"},
+		},
+		{
+			[][]sql.NullString{a}, [][]sql.NullString{a, c}, []int{0},
+			RewriteVerification{Status: RewriteDivergent, Reason: "重写后多出第 2 行", Sample: "('3', 'c')"},
+		},
+		{
+			nil, nil, nil,
+			RewriteVerification{Status: RewriteUnverifiable, Reason: "测试环境中重写前后的 SQL 都没有返回数据, 请开启 sampling 后验证"},
+		},
+		// 排序的值相同的行顺序不确定
+		{
+			[][]sql.NullString{x1, x2, y}, [][]sql.NullString{x2, x1, y}, []int{0},
+			RewriteVerification{Status: RewriteVerified, Reason: "3 行结果一致"},
+		},
+		{
+			[][]sql.NullString{x1, x2, y}, [][]sql.NullString{x2, y, x1}, []int{0},
+			RewriteVerification{Status: RewriteDivergent, Reason: "第 1 至 2 行排序的值相同, 重写后多出的行", Sample: "('2', 'y')"},
+		},
+		{
+			[][]sql.NullString{x1, x2, y}, [][]sql.NullString{x1, x1, y}, []int{0},
+			RewriteVerification{Status: RewriteDivergent, Reason: "第 1 至 2 行排序的值相同, 重写后多出的行", Sample: "('1', 'x1')"},
+		},
+		{
+			[][]sql.NullString{x1, x2, y}, [][]sql.NullString{x1, x2}, []int{0},
+			RewriteVerification{Status: RewriteDivergent, Reason: "重写后缺少第 3 行", Sample: "('2', 'y')"},
+		},
+	}
+	for i, c := range cases {
+		if got := compareRows(c.origin, c.rewritten, c.keys); got != c.want {
+			t.Errorf("case %d, want: %s, got: %s", i, c.want, got)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
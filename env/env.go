@@ -26,6 +26,7 @@ import (
 	"github.com/laojianzi/soar/database"
 
 	"github.com/dchest/uniuri"
+	tidb "github.com/pingcap/parser/ast"
 	"vitess.io/vitess/go/vt/sqlparser"
 )
 
@@ -39,6 +40,10 @@ type VirtualEnv struct {
 	Hash2DB map[string]string // optimizer_xxx -> db
 	// 保存 Table 创建关系，防止重复创建表
 	TableMap map[string]map[string]string
+	// 库表结构快照，指定后使用快照代替线上环境获取库表结构及统计信息
+	Snapshot *database.SchemaSnapshot
+	// 线上环境负载过高时跳过的数据采样，由调用方输出建议后清空
+	ServerBusy error
 	// 错误
 	Error error
 }
@@ -71,6 +76,11 @@ func BuildEnv() (*VirtualEnv, *database.Connector) {
 		common.Config.TestDSN.Disable = true
 	}
 
+	// 使用库表结构快照代替线上环境
+	if common.Config.SchemaSnapshot != "" && common.Config.ReportType != "schema-dump" {
+		return vEnv, vEnv.loadSnapshot(vEnvVersion)
+	}
+
 	// 连接线上环境
 	// 如果未配置线上环境线测试环境配置为线上环境
 	if common.Config.OnlineDSN.User == "" {
@@ -108,6 +118,30 @@ func BuildEnv() (*VirtualEnv, *database.Connector) {
 	return vEnv, connOnline
 }
 
+// loadSnapshot 加载库表结构快照，返回的线上环境连接句柄仅用于记录当前库名
+func (vEnv *VirtualEnv) loadSnapshot(vEnvVersion int) *database.Connector {
+	connOnline, err := database.NewConnector(common.Config.OnlineDSN)
+	common.LogIfError(err, "")
+
+	snapshot, err := database.LoadSchemaSnapshot(common.Config.SchemaSnapshot)
+	if err != nil {
+		common.Log.Error("BuildEnv SchemaSnapshot: %s not available, Error: %s", common.Config.SchemaSnapshot, err.Error())
+		common.Config.TestDSN.Disable = true
+		common.Config.OnlineDSN.Disable = true
+		return connOnline
+	}
+	vEnv.Snapshot = snapshot
+	connOnline.Database = snapshot.Database
+	common.Config.OnlineDSN.Version = snapshot.Version
+
+	// 判断测试环境与快照版本是否一致，要求测试环境版本不低于快照中记录的线上环境版本
+	if vEnvVersion < snapshot.Version {
+		common.Log.Warning("TestDSN MySQL version older than SchemaSnapshot(%d), TestDSN(%d) will not be used", snapshot.Version, vEnvVersion)
+		common.Config.TestDSN.Disable = true
+	}
+	return connOnline
+}
+
 // RealDB 从测试环境中获取通过 hash 后的 DB
 func (vEnv *VirtualEnv) RealDB(hash string) string {
 	if _, ok := vEnv.Hash2DB[hash]; ok {
@@ -257,8 +291,20 @@ func (vEnv *VirtualEnv) BuildVirtualEnv(rEnv *database.Connector, SQLs ...string
 		common.Log.Debug("BuildVirtualEnv Database&TableName Mapping, SQL: %s", sql)
 		stmt, err = sqlparser.Parse(sql)
 		if err != nil {
-			common.Log.Error("BuildVirtualEnv Error : %v", err)
-			return false
+			// vitess 不支持 WITH, 窗口函数等语法，这类 DML 语句使用 tidb parser 提取库表
+			tiStmts, tiErr := ast.TiParse(sql, "", "")
+			if tiErr != nil || len(tiStmts) != 1 {
+				common.Log.Error("BuildVirtualEnv Error : %v", err)
+				return false
+			}
+			if _, ok := tiStmts[0].(tidb.DMLNode); !ok {
+				common.Log.Error("BuildVirtualEnv Error : %v", err)
+				return false
+			}
+			if !vEnv.buildTablesEnv(rEnv, ast.GetTiMeta(tiStmts[0], nil)) {
+				return false
+			}
+			continue
 		}
 
 		// 语句类型判断
@@ -278,43 +324,13 @@ func (vEnv *VirtualEnv) BuildVirtualEnv(rEnv *database.Connector, SQLs ...string
 		case *sqlparser.DDL:
 			// 如果是DDL，则先获取DDL对应的表结构，然后直接在测试环境接执行SQL
 			// 为不影响其他SQL操作，复制一个Connector对象，将数据库切换到对应的DB上直接执行
-			vEnv.Database = vEnv.DBRef[rEnv.Database]
-
-			// 为了支持并发，需要将DB进行映射，但 db.table 这种形式无法保证 DB 的映射是正确的
-			// TODO：暂不支持 create db.tableName (id int) 形式的建表语句
-			if stmt.Table.Qualifier.String() != "" {
-				common.Log.Error("BuildVirtualEnv DDL Not support db.tb format")
+			// 为了支持并发，需要将DB进行映射，db.table 形式的库表同样按 DBRef 映射到测试环境中
+			sql, err = vEnv.buildDDLEnv(rEnv, stmt, sql)
+			if err != nil {
+				common.Log.Error("BuildVirtualEnv DDL Error : %v", err)
 				return false
 			}
-
-			for _, tb := range stmt.FromTables {
-				if tb.Qualifier.String() != "" {
-					common.Log.Error("BuildVirtualEnv DDL Not support db.tb format")
-					return false
-				}
-			}
-
-			for _, tb := range stmt.ToTables {
-				if tb.Qualifier.String() != "" {
-					common.Log.Error("BuildVirtualEnv DDL Not support db.tb format")
-					return false
-				}
-			}
-
-			// 拉取表结构
-			table := stmt.Table.Name.String()
-			if table != "" {
-				err = vEnv.createTable(rEnv, table)
-				// 这里如果报错可能有两种可能：
-				// 1. SQL 是 Create 语句，线上环境并没有相关的库表结构
-				// 2. 在测试环境中执行 SQL 报错
-				// 如果是因为 Create 语句报错，后续会在测试环境中直接执行 create 语句，不会对程序有负面影响
-				// 如果是因为执行 SQL 报错，那么其他地方执行 SQL 的时候也一定会报错
-				// 所以这里不需要 `return false`，可以继续执行
-				if err != nil {
-					common.Log.Warning("BuildVirtualEnv Error : %v", err)
-				}
-			}
+			vEnv.Database = vEnv.DBRef[rEnv.Database]
 
 			_, err = vEnv.Query(sql)
 			if err != nil {
@@ -329,55 +345,61 @@ func (vEnv *VirtualEnv) BuildVirtualEnv(rEnv *database.Connector, SQLs ...string
 			return true
 		}
 
-		meta := ast.GetMeta(stmt, nil)
+		if !vEnv.buildTablesEnv(rEnv, ast.GetMeta(stmt, nil)) {
+			return false
+		}
+	}
+	return true
+}
+
+// buildTablesEnv 在测试环境中创建 meta 中用到的库表
+func (vEnv *VirtualEnv) buildTablesEnv(rEnv *database.Connector, meta common.Meta) bool {
+	// 由于 DB 环境可能是变的，所以需要每一次都单独的提取库表结构，整体随着 rEnv 的变动而发生变化
+	for db, table := range meta {
+		if db == "" {
+			db = rEnv.Database
+		}
+		rEnv.Database = db
 
-		// 由于 DB 环境可能是变的，所以需要每一次都单独的提取库表结构，整体随着 rEnv 的变动而发生变化
-		for db, table := range meta {
-			if db == "" {
-				db = rEnv.Database
+		// 创建数据库环境
+		for _, tb := range table.Table {
+			if tb.TableName == "" {
+				continue
 			}
-			rEnv.Database = db
 
-			// 创建数据库环境
-			for _, tb := range table.Table {
-				if tb.TableName == "" {
-					continue
-				}
+			// 视图检查
+			common.Log.Debug("BuildVirtualEnv Checking view -- %s.%s", rEnv.Database, tb.TableName)
+			isView, err := vEnv.isView(rEnv, tb.TableName)
+			if err != nil {
+				common.Log.Error("BuildVirtualEnv ShowTableStatus Error : %v", err)
+				return false
+			}
 
-				// 视图检查
-				common.Log.Debug("BuildVirtualEnv Checking view -- %s.%s", rEnv.Database, tb.TableName)
-				tbStatus, err := rEnv.ShowTableStatus(tb.TableName)
+			// 如果是视图，解析语句
+			if isView {
+				var viewDDL string
+				viewDDL, err = vEnv.showCreateTable(rEnv, tb.TableName)
 				if err != nil {
-					common.Log.Error("BuildVirtualEnv ShowTableStatus Error : %v", err)
+					common.Log.Error("BuildVirtualEnv create view failed: %v", err)
 					return false
 				}
 
-				// 如果是视图，解析语句
-				if len(tbStatus.Rows) > 0 && string(tbStatus.Rows[0].Comment) == "VIEW" {
-					var viewDDL string
-					viewDDL, err = rEnv.ShowCreateTable(tb.TableName)
-					if err != nil {
-						common.Log.Error("BuildVirtualEnv create view failed: %v", err)
-						return false
-					}
-
-					startIdx := strings.Index(viewDDL, "AS")
-					if startIdx < 0 || viewDDL == "" {
-						common.Log.Error("BuildVirtualEnv '%s' got '%s', Index: %d", tb.TableName, viewDDL, startIdx)
-						return false
-					}
-					viewDDL = viewDDL[startIdx+2:]
-					if !vEnv.BuildVirtualEnv(rEnv, viewDDL) {
-						return false
-					}
+				startIdx := strings.Index(viewDDL, "AS")
+				if startIdx < 0 || viewDDL == "" {
+					common.Log.Error("BuildVirtualEnv '%s' got '%s', Index: %d", tb.TableName, viewDDL, startIdx)
+					return false
 				}
-
-				err = vEnv.createTable(rEnv, tb.TableName)
-				if err != nil {
-					common.Log.Error("BuildVirtualEnv %s.%s Error : %v", rEnv.Database, tb.TableName, err)
+				viewDDL = viewDDL[startIdx+2:]
+				if !vEnv.BuildVirtualEnv(rEnv, viewDDL) {
 					return false
 				}
 			}
+
+			err = vEnv.createTable(rEnv, tb.TableName)
+			if err != nil {
+				common.Log.Error("BuildVirtualEnv %s.%s Error : %v", rEnv.Database, tb.TableName, err)
+				return false
+			}
 		}
 	}
 	return true
@@ -395,7 +417,7 @@ func (vEnv *VirtualEnv) createDatabase(rEnv *database.Connector) error {
 		time.Now().Format("060102150405"), // 12 Bytes 180102030405
 		strings.ToLower(uniuri.New()))     // 16 Bytes random string
 	common.Log.Debug("createDatabase, mapping `%s` :`%s`-->`%s`", rEnv.Database, rEnv.Database, dbHash)
-	ddl, err := rEnv.ShowCreateDatabase(rEnv.Database)
+	ddl, err := vEnv.showCreateDatabase(rEnv)
 	if err != nil {
 		common.Log.Warning("createDatabase, rEnv.ShowCreateDatabase Error : %v", err)
 		ddl = fmt.Sprintf("create database `%s` character set %s", rEnv.Database, rEnv.Charset)
@@ -419,6 +441,74 @@ func (vEnv *VirtualEnv) createDatabase(rEnv *database.Connector) error {
 	return nil
 }
 
+// buildDDLEnv 拉取 DDL 涉及的库表结构，如果 DDL 中含有 db.tb 形式的库表，将库名替换为测试环境中的映射库名后返回
+func (vEnv *VirtualEnv) buildDDLEnv(rEnv *database.Connector, stmt *sqlparser.DDL, sql string) (string, error) {
+	// 需要从线上拉取表结构的表
+	sources := sqlparser.TableNames{stmt.Table}
+	// 只需要创建映射库的表，如 RENAME 的目标表，DROP 的表
+	targets := append(sqlparser.TableNames{}, stmt.ToTables...)
+	if stmt.Action == sqlparser.RenameStr {
+		sources = append(sources, stmt.FromTables...)
+	} else {
+		targets = append(targets, stmt.FromTables...)
+	}
+	if stmt.OptLike != nil {
+		sources = append(sources, stmt.OptLike.LikeTable)
+	}
+
+	var schemas []string
+	for _, tb := range sources {
+		if tb.Name.String() == "" {
+			continue
+		}
+		tbEnv := *rEnv
+		if !tb.Qualifier.IsEmpty() {
+			tbEnv.Database = tb.Qualifier.String()
+			schemas = append(schemas, tbEnv.Database)
+		}
+		err := vEnv.createTable(&tbEnv, tb.Name.String())
+		// 这里如果报错可能有两种可能：
+		// 1. SQL 是 Create 语句，线上环境并没有相关的库表结构
+		// 2. 在测试环境中执行 SQL 报错
+		// 如果是因为 Create 语句报错，后续会在测试环境中直接执行 create 语句，不会对程序有负面影响
+		// 如果是因为执行 SQL 报错，那么其他地方执行 SQL 的时候也一定会报错
+		// 所以这里不需要 `return false`，可以继续执行
+		if err != nil {
+			common.Log.Warning("BuildVirtualEnv Error : %v", err)
+		}
+	}
+
+	for _, tb := range targets {
+		tbEnv := *rEnv
+		if !tb.Qualifier.IsEmpty() {
+			tbEnv.Database = tb.Qualifier.String()
+			schemas = append(schemas, tbEnv.Database)
+		}
+		err := vEnv.createDatabase(&tbEnv)
+		if err != nil {
+			return sql, err
+		}
+		// RENAME 的目标表由 RENAME 语句生成，无需再从线上拉取
+		if stmt.Action == sqlparser.RenameStr {
+			if vEnv.TableMap[tbEnv.Database] == nil {
+				vEnv.TableMap[tbEnv.Database] = make(map[string]string)
+			}
+			vEnv.TableMap[tbEnv.Database][tb.Name.String()] = tb.Name.String()
+		}
+	}
+
+	if len(schemas) == 0 {
+		return sql, nil
+	}
+	// 映射库创建失败时不能执行原 SQL，避免误操作测试环境中的同名库
+	for _, schema := range schemas {
+		if vEnv.DBRef[schema] == "" {
+			return sql, fmt.Errorf("database `%s` mapping not found", schema)
+		}
+	}
+	return ast.RenameSchema(sql, vEnv.DBRef)
+}
+
 /*
 @input:
 
@@ -477,7 +567,7 @@ func (vEnv *VirtualEnv) createTable(rEnv *database.Connector, tbName string) err
 
 	// 生成建表语句
 	common.Log.Debug("createTable DSN(%s/%s): generate ddl", rEnv.Addr, rEnv.Database)
-	ddl, err := rEnv.ShowCreateTable(tbName)
+	ddl, err := vEnv.showCreateTable(rEnv, tbName)
 	if err != nil {
 		// 有可能是用户新建表，因此线上环境查不到
 		common.Log.Error("createTable, %s DDL Error : %v", tbName, err)
@@ -495,15 +585,67 @@ func (vEnv *VirtualEnv) createTable(rEnv *database.Connector, tbName string) err
 	err = res.Rows.Close()
 	common.LogIfWarn(err, "")
 
-	// 泵取数据
-	if common.Config.Sampling {
+	// 同步统计信息或泵取数据，使用快照时同步快照中的统计信息
+	if tb := vEnv.Snapshot.Table(rEnv.Database, tbName); tb != nil {
+		if !tb.View {
+			common.Log.Debug("createTable, Restore statistics from snapshot %s.%s to %s.%s ...", rEnv.Database, tbName, vEnv.DBRef[rEnv.Database], tbName)
+			ts, indexStats := tb.Statistics()
+			err = vEnv.RestoreStatistics(tbName, ts, indexStats)
+		}
+	} else if common.Config.SamplingStatistics {
+		common.Log.Debug("createTable, Start Sampling statistics from %s.%s to %s.%s ...", rEnv.Database, tbName, vEnv.DBRef[rEnv.Database], tbName)
+		err = vEnv.SamplingStatistics(rEnv, tbName)
+	} else if common.Config.Sampling {
 		common.Log.Debug("createTable, Start Sampling data from %s.%s to %s.%s ...", rEnv.Database, tbName, vEnv.DBRef[rEnv.Database], tbName)
 		err = vEnv.SamplingData(rEnv, tbName)
+		// 线上环境负载过高时只跳过数据采样，不影响测试环境的建立
+		if _, ok := err.(*database.ServerBusyError); ok {
+			common.Log.Warning("createTable, %v", err)
+			vEnv.ServerBusy = err
+			err = nil
+		}
 	}
 	return err
 }
 
-// GenTableColumns 为 Rewrite 提供的结构体初始化
+// showCreateDatabase 获取建库语句，指定快照时从快照中获取
+func (vEnv *VirtualEnv) showCreateDatabase(rEnv *database.Connector) (string, error) {
+	if vEnv.Snapshot != nil {
+		if vEnv.Snapshot.Database != rEnv.Database || vEnv.Snapshot.CreateDatabase == "" {
+			return "", fmt.Errorf("database `%s` not found in schema snapshot", rEnv.Database)
+		}
+		return vEnv.Snapshot.CreateDatabase, nil
+	}
+	return rEnv.ShowCreateDatabase(rEnv.Database)
+}
+
+// showCreateTable 获取建表语句，指定快照时从快照中获取
+func (vEnv *VirtualEnv) showCreateTable(rEnv *database.Connector, tbName string) (string, error) {
+	if vEnv.Snapshot != nil {
+		tb := vEnv.Snapshot.Table(rEnv.Database, tbName)
+		if tb == nil {
+			return "", fmt.Errorf("table `%s`.`%s` not found in schema snapshot", rEnv.Database, tbName)
+		}
+		return tb.DDL, nil
+	}
+	return rEnv.ShowCreateTable(tbName)
+}
+
+// isView 判断是否为视图，指定快照时从快照中获取
+func (vEnv *VirtualEnv) isView(rEnv *database.Connector, tbName string) (bool, error) {
+	// 使用快照时不再访问线上环境
+	if vEnv.Snapshot != nil {
+		tb := vEnv.Snapshot.Table(rEnv.Database, tbName)
+		return tb != nil && tb.View, nil
+	}
+	tbStatus, err := rEnv.ShowTableStatus(tbName)
+	if err != nil {
+		return false, err
+	}
+	return len(tbStatus.Rows) > 0 && string(tbStatus.Rows[0].Comment) == "VIEW", nil
+}
+
+// GenTableColumns 为 Rewrite 提供的结构体初始化，包含 SQL 中用到的表的所有列
 func (vEnv *VirtualEnv) GenTableColumns(meta common.Meta) common.TableColumns {
 	tableColumns := make(common.TableColumns)
 	for dbName, db := range meta {
@@ -512,6 +654,10 @@ func (vEnv *VirtualEnv) GenTableColumns(meta common.Meta) common.TableColumns {
 			if tb == nil {
 				break
 			}
+			// CTE 及派生表的别名记录在空表名下，不是测试环境中的表
+			if tb.TableName == "" {
+				continue
+			}
 			td, err := vEnv.Connector.ShowColumns(tb.TableName)
 			if err != nil {
 				common.Log.Warn("GenTableColumns, ShowColumns Error: " + err.Error())
@@ -531,54 +677,70 @@ func (vEnv *VirtualEnv) GenTableColumns(meta common.Meta) common.TableColumns {
 				tableColumns[dbName][tb.TableName] = make([]*common.Column, 0)
 			}
 
-			if len(tb.Column) == 0 {
-				// tb.column 为空说明 SQL 里这个表是用的*来查询
-				if err != nil {
-					common.Log.Error("ast.Rewrite ShowColumns, Error: %v", err)
-					break
-				}
+			// 返回表中所有的列，SELECT * 展开及主键等信息需要的列不一定出现在 SQL 中
+			for _, colInfo := range td.DescValues {
+				tableColumns[dbName][tb.TableName] = append(tableColumns[dbName][tb.TableName], &common.Column{
+					Name:       colInfo.Field,
+					DB:         dbName,
+					Table:      tb.TableName,
+					DataType:   colInfo.Type,
+					Character:  string(colInfo.Collation),
+					Key:        colInfo.Key,
+					Default:    string(colInfo.Default),
+					Extra:      colInfo.Extra,
+					Comment:    colInfo.Comment,
+					Privileges: colInfo.Privileges,
+					Null:       colInfo.Null,
+				})
+			}
+		}
+	}
+	return tableColumns
+}
 
-				for _, colInfo := range td.DescValues {
-					tableColumns[dbName][tb.TableName] = append(tableColumns[dbName][tb.TableName], &common.Column{
-						Name:       colInfo.Field,
-						DB:         dbName,
-						Table:      tb.TableName,
-						DataType:   colInfo.Type,
-						Character:  string(colInfo.Collation),
-						Key:        colInfo.Key,
-						Default:    string(colInfo.Default),
-						Extra:      colInfo.Extra,
-						Comment:    colInfo.Comment,
-						Privileges: colInfo.Privileges,
-						Null:       colInfo.Null,
-					})
+// GenTableUniqueKeys 为 Rewrite 提供 SQL 中用到的表的主键及唯一索引，key 为小写的表名
+func (vEnv *VirtualEnv) GenTableUniqueKeys(meta common.Meta) map[string][][]string {
+	uniqueKeys := make(map[string][][]string)
+	for _, db := range meta {
+		for _, tb := range db.Table {
+			if tb == nil {
+				break
+			}
+			if tb.TableName == "" {
+				continue
+			}
+			idxInfo, err := vEnv.Connector.ShowIndex(tb.TableName)
+			if err != nil {
+				common.Log.Warn("GenTableUniqueKeys, ShowIndex Error: " + err.Error())
+				break
+			}
+
+			// SHOW INDEX 中同一个索引的列按 Seq_in_index 顺序连续出现
+			var keyNames []string
+			keys := make(map[string][]string)
+			for _, row := range idxInfo.Rows {
+				if row.NonUnique != 0 {
+					continue
+				}
+				if _, ok := keys[row.KeyName]; !ok {
+					keyNames = append(keyNames, row.KeyName)
 				}
-			} else {
-				// tb.column如果不为空则需要把使用到的列填写进去
-				var columns []*common.Column
-				for _, col := range tb.Column {
-					for _, colInfo := range td.DescValues {
-						if col.Name == colInfo.Field {
-							// 根据获取的信息将列的信息补全
-							col.DB = dbName
-							col.Table = tb.TableName
-							col.DataType = colInfo.Type
-							col.Character = string(colInfo.Collation)
-							col.Key = colInfo.Key
-							col.Default = string(colInfo.Default)
-							col.Extra = colInfo.Extra
-							col.Comment = colInfo.Comment
-							col.Privileges = colInfo.Privileges
-							col.Null = colInfo.Null
-
-							columns = append(columns, col)
-							break
-						}
+				keys[row.KeyName] = append(keys[row.KeyName], row.ColumnName)
+			}
+			tbName := strings.ToLower(tb.TableName)
+			for _, name := range keyNames {
+				// 函数索引没有列名，这类索引不能用来判断列的组合是否唯一
+				expression := false
+				for _, col := range keys[name] {
+					if col == "" {
+						expression = true
 					}
 				}
-				tableColumns[dbName][tb.TableName] = columns
+				if !expression {
+					uniqueKeys[tbName] = append(uniqueKeys[tbName], keys[name])
+				}
 			}
 		}
 	}
-	return tableColumns
+	return uniqueKeys
 }
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"testing"
 
@@ -137,6 +138,85 @@ func TestNewVirtualEnv(t *testing.T) {
 	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
 }
 
+func TestBuildVirtualEnvQualifiedDDL(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	// db.tb 形式的 DDL 需要在映射库中执行，不能修改测试环境中的同名库
+	db := "soar_qualified_ddl"
+	cases := []struct {
+		sql     string
+		exists  []string
+		missing []string
+	}{
+		{
+			sql:    "CREATE TABLE soar_qualified_ddl.t1 (id INT, c1 VARCHAR(20), PRIMARY KEY (id))",
+			exists: []string{"t1"},
+		},
+		{
+			sql:    "ALTER TABLE soar_qualified_ddl.t1 ADD INDEX idx_c1 (c1)",
+			exists: []string{"t1"},
+		},
+		{
+			sql:     "RENAME TABLE soar_qualified_ddl.t1 TO soar_qualified_ddl.t2",
+			exists:  []string{"t2"},
+			missing: []string{"t1"},
+		},
+		{
+			sql:    "CREATE TABLE soar_qualified_ddl.t3 LIKE soar_qualified_ddl.t2",
+			exists: []string{"t2", "t3"},
+		},
+		{
+			sql:     "DROP TABLE soar_qualified_ddl.t3",
+			exists:  []string{"t2"},
+			missing: []string{"t3"},
+		},
+	}
+
+	tableExists := func(table string) bool {
+		res, err := vEnv.Query(fmt.Sprintf("SHOW TABLES FROM `%s` LIKE '%s'", vEnv.DBHash(db), table))
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		defer res.Rows.Close()
+		return res.Rows.Next()
+	}
+
+	orgREnvDatabase := rEnv.Database
+	rEnv.Database = "sakila"
+	for _, c := range cases {
+		if !vEnv.BuildVirtualEnv(rEnv, c.sql) || vEnv.Error != nil {
+			t.Errorf("BuildVirtualEnv %s, Error: %v", c.sql, vEnv.Error)
+			continue
+		}
+		if vEnv.DBHash(db) == db {
+			t.Errorf("database: %s not mapped, SQL: %s", db, c.sql)
+			continue
+		}
+		for _, table := range c.exists {
+			if !tableExists(table) {
+				t.Errorf("table %s.%s not exists after: %s", db, table, c.sql)
+			}
+		}
+		for _, table := range c.missing {
+			if tableExists(table) {
+				t.Errorf("table %s.%s should not exists after: %s", db, table, c.sql)
+			}
+		}
+	}
+	if rEnv.Database != "sakila" {
+		t.Errorf("rEnv.Database changed to: %s", rEnv.Database)
+	}
+	// 测试环境中不应创建未映射的同名库
+	if res, err := vEnv.Query(fmt.Sprintf("SHOW DATABASES LIKE '%s'", db)); err == nil {
+		if res.Rows.Next() {
+			t.Errorf("database: %s should not be created in test env", db)
+		}
+		res.Rows.Close()
+	}
+	rEnv.Database = orgREnvDatabase
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
 func TestCleanupTestDatabase(t *testing.T) {
 	common.Log.Debug("Entering function: %s", common.GetFunctionName())
 	if common.Config.TestDSN.Disable {
@@ -245,6 +325,33 @@ func TestGenTableColumns(t *testing.T) {
 	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
 }
 
+func TestGenTableUniqueKeys(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	if common.Config.TestDSN.Disable {
+		common.Log.Warn("common.Config.TestDSN.Disable=true, by pass TestGenTableUniqueKeys")
+		return
+	}
+
+	// 只能对sakila数据库进行测试
+	if rEnv.Database == "sakila" {
+		sql := "SELECT * FROM rental ORDER BY rental_date LIMIT 100, 10"
+		vEnv.BuildVirtualEnv(rEnv, sql)
+		keys := vEnv.GenTableUniqueKeys(common.Meta{
+			"": &common.DB{
+				Table: map[string]*common.Table{
+					"rental": common.NewTable("rental"),
+				},
+			},
+		})
+		// rental 表的唯一索引为 PRIMARY (rental_id) 及 rental_date (rental_date, inventory_id, customer_id)
+		want := [][]string{{"rental_id"}, {"rental_date", "inventory_id", "customer_id"}}
+		if !reflect.DeepEqual(keys["rental"], want) {
+			t.Errorf("want: %v, got: %v", want, keys["rental"])
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
 func TestCreateTable(t *testing.T) {
 	common.Log.Debug("Entering function: %s", common.GetFunctionName())
 	orgSamplingCondition := common.Config.SamplingCondition
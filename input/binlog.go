@@ -0,0 +1,250 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package input
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const binlogDelimiter = "/*!*/;"
+
+var (
+	binlogPosRe        = regexp.MustCompile(`^# at (\d+)$`)
+	binlogQueryRe      = regexp.MustCompile(`^#\d{6}\s+\d{1,2}:\d{2}:\d{2} server id .*\tQuery\tthread_id=(\d+)`)
+	binlogRowsRe       = regexp.MustCompile(`^#\d{6}\s+\d{1,2}:\d{2}:\d{2} server id .*\t(Write|Update|Delete)_rows(?:_v1)?: table id`)
+	binlogRowRe        = regexp.MustCompile("^### (INSERT INTO|UPDATE|DELETE FROM) `([^`]+)`\\.`([^`]+)`$")
+	binlogColumnRe     = regexp.MustCompile(`^###\s+@(\d+)=(.*?)(?:\s+/\*.*\*/)?$`)
+	binlogTableMapRe   = regexp.MustCompile("\tTable_map: `([^`]+)`\\.`([^`]+)` mapped to number")
+	binlogMetaNameRe   = regexp.MustCompile("`([^`]+)`")
+	binlogUseRe        = regexp.MustCompile("(?i)^use\\s+`?([^`]+)`?$")
+	binlogSkipPrefixes = []string{"SET TIMESTAMP=", "SET @@SESSION.", "SET @@session.", "SET INSERT_ID=", "SET LAST_INSERT_ID=", "/*!"}
+)
+
+// binlogRow mysqlbinlog -v 输出的行事件中的一行数据
+type binlogRow struct {
+	kind     string // INSERT INTO, UPDATE, DELETE FROM
+	database string
+	table    string
+	where    []binlogColumn // 修改前的数据
+	set      []binlogColumn // 修改后的数据
+	rows     int            // 同一事件中同一张表的行数
+}
+
+// binlogColumn 行事件中 @N=value 形式的列
+type binlogColumn struct {
+	index int
+	value string
+}
+
+// binlogParser mysqlbinlog 输出的解析状态
+type binlogParser struct {
+	file     string
+	stmts    []Statement
+	pos      string              // 当前事件的位置
+	line     int                 // 当前事件的行号
+	thread   string              // 最近一个 Query 事件的 thread_id，行事件属于该事件开启的事务
+	database string              // Query 事件中 USE 的库
+	columns  map[string][]string // --print-table-metadata 输出的列名，key 为 db.table
+	table    string              // 最近一个 Table_map 事件的表
+	query    []string            // 当前 Query 事件中未结束的 SQL
+	inQuery  bool
+	inMeta   bool     // 是否在读取 # Columns(...) 列名
+	meta     []string // 读取中的列名
+	row      *binlogRow
+	image    *[]binlogColumn // 当前读取的 WHERE 或 SET 部分
+}
+
+// ParseBinlog 解析 mysqlbinlog -v 的文本输出，Query 事件中的 SQL 直接提取，行事件根据伪 SQL 还原为 DML
+// 同一个行事件中同一张表的多行数据只还原第一行，使用 mysqlbinlog --print-table-metadata 输出列名时会使用真实的列名
+func ParseBinlog(file string, data []byte) ([]Statement, error) {
+	p := &binlogParser{file: file, columns: make(map[string][]string)}
+	for i, line := range strings.Split(string(data), "\n") {
+		p.parseLine(i+1, strings.TrimRight(line, "\r"))
+	}
+	p.flushRow()
+	return p.stmts, nil
+}
+
+// parseLine 解析单行
+func (p *binlogParser) parseLine(lineNo int, line string) {
+	if m := binlogPosRe.FindStringSubmatch(line); m != nil {
+		p.flushRow()
+		p.inQuery, p.query = false, nil
+		p.pos, p.line = m[1], lineNo
+		return
+	}
+
+	// --print-table-metadata 输出的列名可能有多行
+	if p.inMeta || strings.HasPrefix(line, "# Columns(") {
+		p.meta = append(p.meta, line)
+		p.inMeta = !strings.HasSuffix(line, ")")
+		if !p.inMeta {
+			var names []string
+			for _, m := range binlogMetaNameRe.FindAllStringSubmatch(strings.Join(p.meta, " "), -1) {
+				names = append(names, m[1])
+			}
+			p.columns[p.table] = names
+			p.meta = nil
+		}
+		return
+	}
+
+	switch {
+	case binlogQueryRe.MatchString(line):
+		p.thread = binlogQueryRe.FindStringSubmatch(line)[1]
+		p.inQuery = true
+	case binlogRowsRe.MatchString(line):
+		p.flushRow()
+	case binlogTableMapRe.MatchString(line):
+		m := binlogTableMapRe.FindStringSubmatch(line)
+		p.table = m[1] + "." + m[2]
+	case strings.HasPrefix(line, "###"):
+		p.parseRowLine(line)
+	case strings.HasPrefix(line, "#"):
+	case strings.HasPrefix(line, "COMMIT"+binlogDelimiter):
+		// Xid 事件
+		p.addStatement("COMMIT")
+	case p.inQuery:
+		p.query = append(p.query, line)
+		if strings.HasSuffix(line, binlogDelimiter) {
+			sql := strings.TrimSpace(strings.TrimSuffix(strings.Join(p.query, "\n"), binlogDelimiter))
+			p.query = nil
+			p.addQuery(sql)
+		}
+	}
+}
+
+// addQuery 处理 Query 事件中的单条 SQL
+func (p *binlogParser) addQuery(sql string) {
+	for _, prefix := range binlogSkipPrefixes {
+		if strings.HasPrefix(sql, prefix) {
+			return
+		}
+	}
+	if m := binlogUseRe.FindStringSubmatch(sql); m != nil {
+		p.database = m[1]
+		return
+	}
+	p.addStatement(sql)
+}
+
+// addStatement 添加一条 SQL
+func (p *binlogParser) addStatement(sql string) {
+	if sql == "" {
+		return
+	}
+	p.stmts = append(p.stmts, Statement{
+		File:     p.file,
+		Line:     p.line,
+		ID:       "pos " + p.pos,
+		Database: p.database,
+		Session:  p.thread,
+		SQL:      sql,
+	})
+}
+
+// parseRowLine 解析行事件中以 ### 开始的伪 SQL
+func (p *binlogParser) parseRowLine(line string) {
+	if m := binlogRowRe.FindStringSubmatch(line); m != nil {
+		// 同一事件中同一张表的后续行只计数
+		if p.row != nil && p.row.kind == m[1] && p.row.database == m[2] && p.row.table == m[3] {
+			p.row.rows++
+			p.image = nil
+			return
+		}
+		p.flushRow()
+		p.row = &binlogRow{kind: m[1], database: m[2], table: m[3], rows: 1}
+		// INSERT 只有 SET 部分
+		p.image = &p.row.set
+		return
+	}
+	if p.row == nil || p.row.rows > 1 {
+		return
+	}
+
+	switch strings.TrimSpace(strings.TrimPrefix(line, "###")) {
+	case "WHERE":
+		p.image = &p.row.where
+	case "SET":
+		p.image = &p.row.set
+	default:
+		m := binlogColumnRe.FindStringSubmatch(line)
+		if m == nil || p.image == nil {
+			return
+		}
+		idx, _ := strconv.Atoi(m[1])
+		*p.image = append(*p.image, binlogColumn{index: idx, value: m[2]})
+	}
+}
+
+// flushRow 将行事件中的数据还原为 DML
+func (p *binlogParser) flushRow() {
+	row := p.row
+	p.row, p.image = nil, nil
+	if row == nil {
+		return
+	}
+
+	names := p.columns[row.database+"."+row.table]
+	name := func(c binlogColumn) string {
+		if c.index > 0 && c.index <= len(names) {
+			return "`" + names[c.index-1] + "`"
+		}
+		// 未输出列名时使用 col_N 代替 @N，避免列名不合规的误报
+		return fmt.Sprintf("`col_%d`", c.index)
+	}
+	var cols, values, sets, conds []string
+	for _, c := range row.set {
+		cols = append(cols, name(c))
+		values = append(values, c.value)
+		sets = append(sets, name(c)+" = "+c.value)
+	}
+	for _, c := range row.where {
+		if c.value == "NULL" {
+			conds = append(conds, name(c)+" IS NULL")
+		} else {
+			conds = append(conds, name(c)+" = "+c.value)
+		}
+	}
+
+	table := fmt.Sprintf("`%s`.`%s`", row.database, row.table)
+	var sql string
+	switch row.kind {
+	case "INSERT INTO":
+		sql = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(cols, ", "), strings.Join(values, ", "))
+	case "UPDATE":
+		sql = fmt.Sprintf("UPDATE %s SET %s WHERE %s", table, strings.Join(sets, ", "), strings.Join(conds, " AND "))
+	case "DELETE FROM":
+		sql = fmt.Sprintf("DELETE FROM %s WHERE %s", table, strings.Join(conds, " AND "))
+	}
+
+	stmt := Statement{
+		File:     p.file,
+		Line:     p.line,
+		ID:       "pos " + p.pos,
+		Database: row.database,
+		Session:  p.thread,
+		SQL:      sql,
+	}
+	if row.rows > 1 {
+		stmt.Variant = fmt.Sprintf("%d rows", row.rows)
+	}
+	p.stmts = append(p.stmts, stmt)
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package input
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// 5.7 及以上版本: 2021-06-01T10:00:00.123456Z	   10 Query	select 1
+	// 5.6 及以下版本: 210601 10:00:00	   10 Query	select 1，同一秒内的后续记录没有时间
+	generalLogEventRe = regexp.MustCompile(`^(?:\d{4}-\d{2}-\d{2}T\S+|\d{6}\s+\d{1,2}:\d{2}:\d{2})?\s+(\d+)\s(Query|Execute|Connect|Init DB|Quit|Change user|Prepare|Close stmt|Reset stmt|Field List|Statistics|Ping|Sleep|Processlist|Kill|Refresh|Shutdown|Debug|Binlog Dump|Binlog Dump GTID|Register Slave|Set option|Fetch|Daemon|Connect Out|Long Data|Reset connection|Create DB|Drop DB|Time|Error)(?:\t(.*))?$`)
+	// MySQL 每次启动时在 general log 中输出的文件头
+	generalLogHeaderRe  = regexp.MustCompile(`^(\S.*, Version: .*started with:|Tcp port: .*|Time\s+Id\s+Command\s+Argument)$`)
+	generalLogConnectRe = regexp.MustCompile(`\son\s+(\S*)\s+using\s`)
+	generalLogUseRe     = regexp.MustCompile("(?i)^\\s*use\\s+`?([^`;\\s]+)`?\\s*;?\\s*$")
+)
+
+// generalLogThread general log 中单个连接的状态
+type generalLogThread struct {
+	database   string
+	generation int      // 连接 ID 被复用的次数，用于区分不同的会话
+	prepared   []string // 连接中预处理的语句
+}
+
+// generalLogMaxPrepared 每个连接记录的预处理语句的最大数量
+const generalLogMaxPrepared = 64
+
+// ParseGeneralLog 解析 MySQL general log，提取 Query, Execute 中执行的 SQL
+// 按连接 ID 分别记录每个连接当前使用的库及会话，多个连接交错执行的 SQL 不会相互影响
+// Execute 中记录的是替换参数后的 SQL，与同一连接中 Prepare 的语句匹配时还原为预处理语句及绑定的参数
+func ParseGeneralLog(file string, data []byte) ([]Statement, error) {
+	threads := make(map[string]*generalLogThread)
+	var stmts []Statement
+	var current *Statement    // 当前正在读取的 SQL，多行 SQL 的后续行没有时间及连接 ID
+	var currentCommand string // 当前 SQL 的类型
+
+	flush := func() {
+		if current == nil {
+			return
+		}
+		sql := strings.TrimSpace(current.SQL)
+		current.SQL = strings.TrimSpace(strings.TrimSuffix(sql, ";"))
+		thread := threads[current.ID]
+		if currentCommand == "Prepare" {
+			if len(thread.prepared) >= generalLogMaxPrepared {
+				thread.prepared = thread.prepared[1:]
+			}
+			thread.prepared = append(thread.prepared, current.SQL)
+			current = nil
+			return
+		}
+		if currentCommand == "Execute" {
+			for i := len(thread.prepared) - 1; i >= 0; i-- {
+				if params, ok := extractParams(thread.prepared[i], current.SQL); ok {
+					current.SQL, current.Params = thread.prepared[i], params
+					break
+				}
+			}
+		}
+		if m := generalLogUseRe.FindStringSubmatch(current.SQL); m != nil {
+			// USE 语句只切换连接使用的库，不作为待评审的 SQL
+			thread.database = m[1]
+		} else if current.SQL != "" {
+			current.Database = thread.database
+			current.Session = fmt.Sprintf("%s#%d", current.ID, thread.generation)
+			current.ID = "thread " + current.ID
+			stmts = append(stmts, *current)
+		}
+		current = nil
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if generalLogHeaderRe.MatchString(line) {
+			flush()
+			continue
+		}
+		m := generalLogEventRe.FindStringSubmatch(line)
+		if m == nil {
+			// 多行 SQL 的后续行
+			if current != nil {
+				current.SQL += "\n" + line
+			}
+			continue
+		}
+		flush()
+
+		id, command, argument := m[1], m[2], m[3]
+		thread, ok := threads[id]
+		if !ok {
+			thread = &generalLogThread{}
+			threads[id] = thread
+		}
+		switch command {
+		case "Connect":
+			// 连接 ID 被复用时为新的会话
+			thread.generation++
+			thread.database = ""
+			if c := generalLogConnectRe.FindStringSubmatch(argument); c != nil {
+				thread.database = c[1]
+			}
+		case "Init DB":
+			thread.database = strings.TrimSpace(argument)
+		case "Query", "Execute", "Prepare":
+			current = &Statement{File: file, Line: i + 1, ID: id, SQL: argument}
+			currentCommand = command
+		}
+	}
+	flush()
+	return stmts, nil
+}
+
+// extractParams 对比预处理语句与执行时的 SQL，提取 ? 对应的参数，SQL 与预处理语句不匹配时返回 false
+func extractParams(prepared, sql string) ([]string, bool) {
+	var params []string
+	var quote byte
+	j := 0
+	for i := 0; i < len(prepared); i++ {
+		c := prepared[i]
+		if quote == 0 && c == '?' {
+			n := literalLength(sql[j:])
+			if n == 0 {
+				return nil, false
+			}
+			params = append(params, sql[j:j+n])
+			j += n
+			continue
+		}
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '\'' || c == '"' || c == '`'):
+			quote = c
+		}
+		if j >= len(sql) || sql[j] != c {
+			return nil, false
+		}
+		j++
+	}
+	return params, j == len(sql)
+}
+
+// literalLength 返回 SQL 开头的字面量的长度
+func literalLength(sql string) int {
+	if sql == "" {
+		return 0
+	}
+	if q := sql[0]; q == '\'' || q == '"' {
+		for i := 1; i < len(sql); i++ {
+			switch sql[i] {
+			case '\\':
+				i++
+			case q:
+				// 连续两个引号为转义
+				if i+1 < len(sql) && sql[i+1] == q {
+					i++
+					continue
+				}
+				return i + 1
+			}
+		}
+		return 0
+	}
+	for i := 0; i < len(sql); i++ {
+		if strings.ContainsRune(" \t\n\r,)(;", rune(sql[i])) {
+			return i
+		}
+	}
+	return len(sql)
+}
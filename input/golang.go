@@ -0,0 +1,604 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package input
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// goSQLMethods database/sql, sqlx, gorm 中接收 SQL 的方法及 SQL 所在参数的位置
+var goSQLMethods = map[string]int{
+	// database/sql
+	"Query": 0, "QueryRow": 0, "Exec": 0, "Prepare": 0,
+	"QueryContext": 1, "QueryRowContext": 1, "ExecContext": 1, "PrepareContext": 1,
+	// sqlx
+	"Queryx": 0, "QueryRowx": 0, "MustExec": 0, "Preparex": 0, "NamedExec": 0, "NamedQuery": 0, "PrepareNamed": 0,
+	"QueryxContext": 1, "QueryRowxContext": 1, "MustExecContext": 1, "PreparexContext": 1,
+	"NamedExecContext": 1, "NamedQueryContext": 1, "PrepareNamedContext": 1,
+	"Get": 1, "Select": 1, "GetContext": 2, "SelectContext": 2,
+	// gorm
+	"Raw": 0,
+}
+
+// goSqlxFuncs sqlx 包级别函数中 SQL 所在参数的位置
+var goSqlxFuncs = map[string]int{
+	"Get": 2, "Select": 2, "GetContext": 3, "SelectContext": 3,
+	"NamedExec": 1, "NamedQuery": 1, "NamedExecContext": 2, "NamedQueryContext": 2,
+	"MustExec": 1, "MustExecContext": 2, "In": 0,
+}
+
+// goSquirrelOperators squirrel 中 Eq, Gt 等条件对应的操作符
+var goSquirrelOperators = map[string]string{
+	"Eq": "=", "NotEq": "<>", "Gt": ">", "GtOrEq": ">=", "Lt": "<", "LtOrEq": "<=", "Like": "LIKE", "NotLike": "NOT LIKE",
+}
+
+var (
+	goSQLPrefixRe    = regexp.MustCompile(`(?i)^\s*\(?\s*(select|insert|replace|update|delete|with|create|alter|drop|truncate|rename)\s`)
+	goSprintfVerbRe  = regexp.MustCompile(`%[-+# 0-9.]*[a-zA-Z%]`)
+	goDollarParamRe  = regexp.MustCompile(`^\$\d+`)
+	goNamedParamRe   = regexp.MustCompile(`^:[a-zA-Z_][a-zA-Z0-9_.]*`)
+	goDefaultImports = map[string]string{
+		"github.com/jmoiron/sqlx":         "sqlx",
+		"github.com/Masterminds/squirrel": "squirrel",
+	}
+)
+
+// goPackages 已解析过的包中所有文件的包级别常量及变量定义，目录+包名 -> 定义，同一次读取中同一目录下的文件只解析一次
+type goPackages map[string]map[string][]goValue
+
+// goExtractor 从单个 Go 文件中提取 SQL
+type goExtractor struct {
+	globals  map[string][]goValue // 包级别的常量及变量定义
+	locals   map[string][]goValue // 当前函数中的常量及变量定义，同名多次定义时无法确定取值
+	pos      token.Pos            // 当前检查的调用位置，之后的 += 拼接不影响取值
+	sqlx     string               // sqlx 包的别名
+	squirrel string               // squirrel 包的别名
+	imports  map[string]bool      // 所有导入包的别名
+	visiting map[string]bool      // 防止常量循环引用
+}
+
+// goValue 常量及变量的定义，appended 为 true 表示使用 += 拼接
+type goValue struct {
+	expr     ast.Expr
+	appended bool
+}
+
+// collectValues 收集节点中的常量及变量定义
+func collectValues(node ast.Node, values map[string][]goValue) {
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch node := n.(type) {
+		case *ast.FuncLit:
+			// 匿名函数中的变量与外层函数不在同一个作用域
+			return false
+		case *ast.ValueSpec:
+			for i, name := range node.Names {
+				if i < len(node.Values) {
+					values[name.Name] = append(values[name.Name], goValue{expr: node.Values[i]})
+				}
+			}
+		case *ast.AssignStmt:
+			if len(node.Lhs) != len(node.Rhs) {
+				break
+			}
+			for i, lhs := range node.Lhs {
+				if ident, ok := lhs.(*ast.Ident); ok {
+					values[ident.Name] = append(values[ident.Name], goValue{expr: node.Rhs[i], appended: node.Tok == token.ADD_ASSIGN})
+				}
+			}
+		}
+		return true
+	})
+}
+
+// packageGlobals 收集与 file 同一目录下属于 pkg 包的所有文件中的包级别常量及变量定义，结果缓存在 packages 中
+// file 不是磁盘上的文件时，如从标准输入读取，返回 nil
+func packageGlobals(file, pkg string, packages goPackages) map[string][]goValue {
+	if fi, err := os.Stat(file); err != nil || fi.IsDir() {
+		return nil
+	}
+	dir := filepath.Dir(file)
+	key := dir + "\x00" + pkg
+	if globals, ok := packages[key]; ok {
+		return globals
+	}
+
+	globals := make(map[string][]goValue)
+	packages[key] = globals
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return globals
+	}
+	fset := token.NewFileSet()
+	for _, info := range infos {
+		if info.IsDir() || filepath.Ext(info.Name()) != ".go" {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, info.Name()), nil, 0)
+		// 外部测试包等不属于同一个包的文件不收集
+		if err != nil || f.Name.Name != pkg {
+			continue
+		}
+		for _, decl := range f.Decls {
+			if gen, ok := decl.(*ast.GenDecl); ok {
+				collectValues(gen, globals)
+			}
+		}
+	}
+	return globals
+}
+
+// ParseGo 解析 Go 源码，提取传入 database/sql, sqlx, gorm 查询方法的 SQL 及 squirrel 构造的 SQL
+// SQL 中的常量、字符串拼接及 fmt.Sprintf 会被还原，同一个包中其他文件定义的常量也会被还原，$1, :name 等占位符转换为 ?
+func ParseGo(file string, data []byte) ([]Statement, error) {
+	return parseGo(file, data, make(goPackages))
+}
+
+// parseGo 解析单个 Go 文件，packages 为同一次读取中已解析过的包级别定义
+func parseGo(file string, data []byte, packages goPackages) ([]Statement, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, data, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &goExtractor{
+		globals:  make(map[string][]goValue),
+		imports:  make(map[string]bool),
+		visiting: make(map[string]bool),
+	}
+	for _, imp := range f.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		name := path[strings.LastIndex(path, "/")+1:]
+		if alias, ok := goDefaultImports[path]; ok {
+			name = alias
+		}
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		switch path {
+		case "github.com/jmoiron/sqlx":
+			g.sqlx = name
+		case "github.com/Masterminds/squirrel":
+			g.squirrel = name
+		}
+		g.imports[name] = true
+	}
+
+	for _, decl := range f.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok {
+			collectValues(gen, g.globals)
+		}
+	}
+	// 同一个包中其他文件定义的常量及变量，当前文件的定义以传入的内容为准
+	for name, values := range packageGlobals(file, f.Name.Name, packages) {
+		if _, ok := g.globals[name]; !ok {
+			g.globals[name] = values
+		}
+	}
+
+	var stmts []Statement
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil {
+			continue
+		}
+		id := fn.Name.Name
+		if fn.Recv != nil && len(fn.Recv.List) > 0 {
+			id = goTypeName(fn.Recv.List[0].Type) + "." + id
+		}
+		g.locals = make(map[string][]goValue)
+		collectValues(fn.Body, g.locals)
+
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			g.pos = call.Pos()
+			sql, builder := g.callSQL(call)
+			if sql == "" || !goSQLPrefixRe.MatchString(sql) {
+				return true
+			}
+			stmts = append(stmts, Statement{
+				File: file,
+				Line: fset.Position(call.Pos()).Line,
+				ID:   id,
+				SQL:  goPlaceholders(strings.Join(strings.Fields(sql), " ")),
+			})
+			// squirrel 链式调用已经整体还原，不再检查链中的调用
+			return !builder
+		})
+	}
+	return stmts, nil
+}
+
+// goTypeName 方法接收者的类型名
+func goTypeName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return goTypeName(t.X)
+	case *ast.Ident:
+		return t.Name
+	case *ast.IndexExpr:
+		return goTypeName(t.X)
+	}
+	return ""
+}
+
+// callSQL 返回调用中传入的 SQL，builder 为 true 表示 SQL 由 squirrel 链式调用还原
+func (g *goExtractor) callSQL(call *ast.CallExpr) (sql string, builder bool) {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return "", false
+	}
+
+	if g.squirrel != "" && g.squirrelRoot(call) {
+		return g.squirrelSQL(call), true
+	}
+
+	idx, ok := goSQLMethods[sel.Sel.Name]
+	if pkg, isIdent := sel.X.(*ast.Ident); isIdent && g.imports[pkg.Name] {
+		// 包级别的函数只检查 sqlx
+		if pkg.Name != g.sqlx {
+			return "", false
+		}
+		idx, ok = goSqlxFuncs[sel.Sel.Name]
+	}
+	if !ok || idx >= len(call.Args) {
+		return "", false
+	}
+	sql, _ = g.eval(call.Args[idx])
+	return sql, false
+}
+
+// eval 还原字符串表达式，支持字符串常量、拼接、fmt.Sprintf 及 sqlx 的 Rebind, In
+func (g *goExtractor) eval(expr ast.Expr) (string, bool) {
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		if e.Kind == token.STRING {
+			s, err := strconv.Unquote(e.Value)
+			return s, err == nil
+		}
+		return e.Value, e.Kind == token.INT || e.Kind == token.FLOAT
+	case *ast.ParenExpr:
+		return g.eval(e.X)
+	case *ast.BinaryExpr:
+		if e.Op != token.ADD {
+			return "", false
+		}
+		l, ok := g.eval(e.X)
+		if !ok {
+			return "", false
+		}
+		r, ok := g.eval(e.Y)
+		return l + r, ok
+	case *ast.Ident:
+		values, ok := g.locals[e.Name]
+		if !ok {
+			values = g.globals[e.Name]
+		}
+		if len(values) == 0 || values[0].appended || g.visiting[e.Name] {
+			return "", false
+		}
+		g.visiting[e.Name] = true
+		defer delete(g.visiting, e.Name)
+
+		// 条件分支中使用 += 拼接的 SQL 还原为包含所有分支的 SQL
+		res, ok := g.eval(values[0].expr)
+		for _, v := range values[1:] {
+			if !ok || v.expr.Pos() > g.pos {
+				break
+			}
+			if !v.appended {
+				return "", false
+			}
+			var s string
+			s, ok = g.eval(v.expr)
+			res += s
+		}
+		return res, ok
+	case *ast.CallExpr:
+		sel, ok := e.Fun.(*ast.SelectorExpr)
+		if !ok || len(e.Args) == 0 {
+			return "", false
+		}
+		switch sel.Sel.Name {
+		case "Sprintf":
+			return g.sprintf(e.Args)
+		case "Rebind":
+			return g.eval(e.Args[len(e.Args)-1])
+		case "In":
+			if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == g.sqlx {
+				return g.eval(e.Args[0])
+			}
+		}
+	}
+	return "", false
+}
+
+// sprintf 还原 fmt.Sprintf，无法确定取值的 %d 参数使用 1，其他参数使用变量名，如表名
+func (g *goExtractor) sprintf(args []ast.Expr) (string, bool) {
+	format, ok := g.eval(args[0])
+	if !ok {
+		return "", false
+	}
+	i := 1
+	res := goSprintfVerbRe.ReplaceAllStringFunc(format, func(verb string) string {
+		if verb == "%%" {
+			return "%"
+		}
+		if i >= len(args) {
+			return verb
+		}
+		arg := args[i]
+		i++
+		if s, ok := g.eval(arg); ok {
+			return s
+		}
+		if strings.HasSuffix(verb, "d") {
+			return "1"
+		}
+		switch a := arg.(type) {
+		case *ast.Ident:
+			return a.Name
+		case *ast.SelectorExpr:
+			return a.Sel.Name
+		}
+		return "x"
+	})
+	return res, true
+}
+
+// squirrelRoot 判断调用是否为以 squirrel 包开始的链式调用
+func (g *goExtractor) squirrelRoot(call *ast.CallExpr) bool {
+	for {
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return false
+		}
+		switch x := sel.X.(type) {
+		case *ast.CallExpr:
+			call = x
+		case *ast.Ident:
+			return x.Name == g.squirrel
+		case *ast.SelectorExpr:
+			// squirrel.StatementBuilder.Select(...)
+			pkg, ok := x.X.(*ast.Ident)
+			return ok && pkg.Name == g.squirrel
+		default:
+			return false
+		}
+	}
+}
+
+// squirrelSQL 还原 squirrel 链式调用构造的 SQL
+func (g *goExtractor) squirrelSQL(call *ast.CallExpr) string {
+	// 按调用顺序展开链式调用
+	var chain []*ast.CallExpr
+	for {
+		chain = append([]*ast.CallExpr{call}, chain...)
+		sel := call.Fun.(*ast.SelectorExpr)
+		x, ok := sel.X.(*ast.CallExpr)
+		if !ok {
+			break
+		}
+		call = x
+	}
+
+	var kind, table string
+	var columns, joins, where, groupBy, having, orderBy, sets []string
+	var limit, offset string
+	var rows int
+	strs := func(args []ast.Expr) []string {
+		var res []string
+		for _, arg := range args {
+			if s, ok := g.eval(arg); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	first := func(args []ast.Expr) string {
+		if len(args) == 0 {
+			return ""
+		}
+		s, _ := g.eval(args[0])
+		return s
+	}
+
+	for _, c := range chain {
+		name := c.Fun.(*ast.SelectorExpr).Sel.Name
+		switch name {
+		case "Select":
+			kind = "SELECT"
+			columns = append(columns, strs(c.Args)...)
+		case "Columns":
+			columns = append(columns, strs(c.Args)...)
+		case "Insert", "Replace":
+			kind, table = strings.ToUpper(name), first(c.Args)
+		case "Update":
+			kind, table = "UPDATE", first(c.Args)
+		case "Delete":
+			kind, table = "DELETE", first(c.Args)
+		case "From", "Into", "Table":
+			table = first(c.Args)
+		case "Join", "LeftJoin", "RightJoin", "InnerJoin", "CrossJoin":
+			join := strings.ToUpper(strings.TrimSuffix(name, "Join"))
+			if join != "" {
+				join += " "
+			}
+			joins = append(joins, join+"JOIN "+first(c.Args))
+		case "Where":
+			where = append(where, g.squirrelPredicate(c.Args)...)
+		case "Having":
+			having = append(having, g.squirrelPredicate(c.Args)...)
+		case "GroupBy":
+			groupBy = append(groupBy, strs(c.Args)...)
+		case "OrderBy":
+			orderBy = append(orderBy, strs(c.Args)...)
+		case "Limit", "Offset":
+			value := "?"
+			if len(c.Args) > 0 {
+				if s, ok := g.eval(c.Args[0]); ok {
+					value = s
+				}
+			}
+			if name == "Limit" {
+				limit = value
+			} else {
+				offset = value
+			}
+		case "Set":
+			if col := first(c.Args); col != "" {
+				sets = append(sets, col+" = ?")
+			}
+		case "Values":
+			rows++
+		}
+	}
+	if kind == "" || (table == "" && kind != "SELECT") {
+		return ""
+	}
+
+	var sql []string
+	switch kind {
+	case "SELECT":
+		sql = append(sql, "SELECT "+strings.Join(columns, ", "))
+		if table != "" {
+			sql = append(sql, "FROM "+table)
+		}
+		sql = append(sql, joins...)
+	case "INSERT", "REPLACE":
+		if rows == 0 {
+			rows = 1
+		}
+		marks := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+		values := strings.TrimSuffix(strings.Repeat("("+marks+"), ", rows), ", ")
+		return fmt.Sprintf("%s INTO %s (%s) VALUES %s", kind, table, strings.Join(columns, ", "), values)
+	case "UPDATE":
+		sql = append(sql, "UPDATE "+table, "SET "+strings.Join(sets, ", "))
+	case "DELETE":
+		sql = append(sql, "DELETE FROM "+table)
+	}
+	if len(where) > 0 {
+		sql = append(sql, "WHERE "+strings.Join(where, " AND "))
+	}
+	if len(groupBy) > 0 {
+		sql = append(sql, "GROUP BY "+strings.Join(groupBy, ", "))
+	}
+	if len(having) > 0 {
+		sql = append(sql, "HAVING "+strings.Join(having, " AND "))
+	}
+	if len(orderBy) > 0 {
+		sql = append(sql, "ORDER BY "+strings.Join(orderBy, ", "))
+	}
+	if limit != "" {
+		sql = append(sql, "LIMIT "+limit)
+	}
+	if offset != "" {
+		sql = append(sql, "OFFSET "+offset)
+	}
+	return strings.Join(sql, " ")
+}
+
+// squirrelPredicate 还原 Where, Having 中的条件，支持字符串及 squirrel.Eq{"col": v} 等形式
+func (g *goExtractor) squirrelPredicate(args []ast.Expr) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	if s, ok := g.eval(args[0]); ok {
+		if strings.TrimSpace(s) == "" {
+			return nil
+		}
+		return []string{"(" + s + ")"}
+	}
+
+	lit, ok := args[0].(*ast.CompositeLit)
+	if !ok {
+		return nil
+	}
+	var op string
+	if sel, ok := lit.Type.(*ast.SelectorExpr); ok {
+		op = goSquirrelOperators[sel.Sel.Name]
+	}
+	if op == "" {
+		return nil
+	}
+	var preds []string
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		if col, ok := g.eval(kv.Key); ok {
+			preds = append(preds, col+" "+op+" ?")
+		}
+	}
+	return preds
+}
+
+// goPlaceholders 将 $1, :name 等占位符转换为 ?，引号中的内容不转换
+func goPlaceholders(sql string) string {
+	var buf strings.Builder
+	var quote byte
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		if quote != 0 {
+			buf.WriteByte(c)
+			if c == '\\' && i+1 < len(sql) {
+				i++
+				buf.WriteByte(sql[i])
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '\'', '"', '`':
+			quote = c
+		case '$':
+			if m := goDollarParamRe.FindString(sql[i:]); m != "" {
+				buf.WriteByte('?')
+				i += len(m) - 1
+				continue
+			}
+		case ':':
+			// 跳过 PostgreSQL 的 :: 类型转换及 MySQL 的 := 赋值
+			if i+1 < len(sql) && sql[i+1] == ':' {
+				buf.WriteString("::")
+				i++
+				continue
+			}
+			if m := goNamedParamRe.FindString(sql[i:]); m != "" {
+				buf.WriteByte('?')
+				i += len(m) - 1
+				continue
+			}
+		}
+		buf.WriteByte(c)
+	}
+	return buf.String()
+}
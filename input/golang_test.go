@@ -0,0 +1,69 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package input
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/laojianzi/soar/ast"
+	"github.com/laojianzi/soar/common"
+)
+
+func TestParseGo(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	stmts, err := ReadFiles("go", "testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range stmts {
+		if _, err := ast.TiParse(stmt.SQL, "", ""); err != nil {
+			t.Errorf("%s: %s, Error: %v", stmt, stmt.SQL, err)
+		}
+	}
+
+	err = common.GoldenDiff(func() {
+		for _, stmt := range stmts {
+			fmt.Println(stmt)
+			fmt.Println(stmt.SQL)
+		}
+	}, t.Name(), update)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = ParseGo("bad.go", []byte("package")); err == nil {
+		t.Error("want syntax error")
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestGoPlaceholders(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	cases := map[string]string{
+		"SELECT * FROM t WHERE a = $1 AND b = $12":         "SELECT * FROM t WHERE a = ? AND b = ?",
+		"SELECT * FROM t WHERE a = :a AND b = :user.name":  "SELECT * FROM t WHERE a = ? AND b = ?",
+		"SELECT '10:30', '$1', \"a:b\" FROM t WHERE a = ?": "SELECT '10:30', '$1', \"a:b\" FROM t WHERE a = ?",
+		"SELECT @a := 1, a::int FROM t":                    "SELECT @a := 1, a::int FROM t",
+	}
+	for sql, want := range cases {
+		if got := goPlaceholders(sql); got != want {
+			t.Errorf("want: %s, got: %s", want, got)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
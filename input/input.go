@@ -0,0 +1,153 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package input
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/laojianzi/soar/common"
+)
+
+// Statement 从其他格式的输入中提取出的 SQL 及其来源
+type Statement struct {
+	File     string   // 来源文件
+	Line     int      // SQL 在来源文件中的行号
+	ID       string   // SQL 在来源中的标识，如 MyBatis 中的 statement id
+	Variant  string   // 同一来源展开为多条 SQL 时的区分，如 MyBatis 动态 SQL 的 all, minimal
+	Database string   // SQL 执行时使用的库，为空时根据 USE 语句判断
+	Session  string   // SQL 所属的会话，同一会话中的 SQL 按顺序进行事务分析，为空时所有 SQL 属于同一会话
+	SQL      string   // 预处理语句保留 ? 占位符
+	Params   []string // 预处理语句执行时绑定的参数，为 SQL 中的字面量
+}
+
+// Name 返回 SQL 在来源中的名称，如：selectUser(all)
+func (s Statement) Name() string {
+	if s.Variant == "" {
+		return s.ID
+	}
+	return s.ID + "(" + s.Variant + ")"
+}
+
+// String 返回 SQL 的来源，如：UserMapper.xml:12 selectUser(all)
+func (s Statement) String() string {
+	src := fmt.Sprintf("%s:%d", s.File, s.Line)
+	if name := s.Name(); name != "" {
+		src += " " + name
+	}
+	return src
+}
+
+// parseFunc 将单个文件的内容解析为 SQL
+type parseFunc func(file string, data []byte) ([]Statement, error)
+
+// Formats 支持的输入格式，sql 格式直接按照分隔符切分，不需要解析
+var Formats = map[string]struct {
+	Parser     parseFunc
+	Extensions []string // 指定目录时读取的文件扩展名
+}{
+	"mybatis":     {Parser: ParseMyBatis, Extensions: []string{".xml"}},
+	"go":          {Parser: ParseGo, Extensions: []string{".go"}},
+	"general-log": {Parser: ParseGeneralLog, Extensions: []string{".log"}},
+	"binlog":      {Parser: ParseBinlog, Extensions: []string{".sql", ".txt"}},
+	"pcap":        {Parser: ParsePcap, Extensions: []string{".pcap", ".pcapng", ".cap"}},
+}
+
+// Parse 按照指定的格式解析单个文件的内容
+func Parse(format, file string, data []byte) ([]Statement, error) {
+	f, ok := Formats[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported input format: %s", format)
+	}
+	return f.Parser(file, data)
+}
+
+// ReadFiles 按照指定的格式读取文件，path 为目录时读取目录下所有对应扩展名的文件
+// 单个文件解析失败时只记录日志，不影响其他文件
+func ReadFiles(format, path string) ([]Statement, error) {
+	f, ok := Formats[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported input format: %s", format)
+	}
+
+	var files []string
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// 跳过 vendor 及隐藏目录
+			if file != path && (info.Name() == "vendor" || strings.HasPrefix(info.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// 直接指定的文件不检查扩展名
+		if file == path {
+			files = append(files, file)
+			return nil
+		}
+		for _, ext := range f.Extensions {
+			if strings.EqualFold(filepath.Ext(file), ext) {
+				files = append(files, file)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	parse := f.Parser
+	if format == "go" {
+		// 同一目录下的 Go 文件共享包级别的常量及变量定义，只在本次读取中缓存
+		packages := make(goPackages)
+		parse = func(file string, data []byte) ([]Statement, error) {
+			return parseGo(file, data, packages)
+		}
+	}
+
+	var stmts []Statement
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		res, err := parse(file, data)
+		if err != nil {
+			common.Log.Warning("input.ReadFiles %s Error: %v", file, err)
+			continue
+		}
+		stmts = append(stmts, res...)
+	}
+	return stmts, nil
+}
+
+// Join 将提取出的 SQL 使用分隔符拼接，作为待评审的 SQL 按顺序逐条评审
+func Join(stmts []Statement, delimiter string) string {
+	var buf []string
+	for _, stmt := range stmts {
+		buf = append(buf, stmt.SQL+delimiter)
+	}
+	return strings.Join(buf, "\n")
+}
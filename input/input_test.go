@@ -0,0 +1,72 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package input
+
+import (
+	"flag"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/laojianzi/soar/common"
+)
+
+var update = flag.Bool("update", false, "update .golden files")
+
+func TestMain(m *testing.M) {
+	// 初始化 init
+	if common.DevPath == "" {
+		_, file, _, _ := runtime.Caller(0)
+		common.DevPath, _ = filepath.Abs(filepath.Dir(filepath.Join(file, ".."+string(filepath.Separator))))
+	}
+	common.BaseDir = common.DevPath
+	err := common.ParseConfig("")
+	common.LogIfError(err, "init ParseConfig")
+	common.Log.Debug("input_test init")
+
+	// 分割线
+	flag.Parse()
+	m.Run()
+}
+
+func TestReadFiles(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	// 目录下只读取对应扩展名的文件
+	stmts, err := ReadFiles("mybatis", "testdata")
+	if err != nil {
+		t.Error(err)
+	}
+	for _, stmt := range stmts {
+		if filepath.Ext(stmt.File) != ".xml" {
+			t.Errorf("unexpected file: %s", stmt.File)
+		}
+	}
+
+	if _, err = ReadFiles("unknown", "testdata"); err == nil {
+		t.Error("want unsupported input format error")
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestJoin(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	stmts := []Statement{{SQL: "SELECT 1"}, {SQL: "SELECT 'a;b'"}}
+	if got := Join(stmts, ";"); got != "SELECT 1;\nSELECT 'a;b';" {
+		t.Errorf("got: %s", got)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
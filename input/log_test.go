@@ -0,0 +1,66 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package input
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/laojianzi/soar/ast"
+	"github.com/laojianzi/soar/common"
+)
+
+func TestParseGeneralLog(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	stmts, err := ReadFiles("general-log", "testdata/general.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = common.GoldenDiff(func() {
+		for _, stmt := range stmts {
+			fmt.Printf("%s database: %s, session: %s, params: %v\n", stmt, stmt.Database, stmt.Session, stmt.Params)
+			fmt.Println(stmt.SQL)
+		}
+	}, t.Name(), update)
+	if err != nil {
+		t.Error(err)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestParseBinlog(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	stmts, err := ReadFiles("binlog", "testdata/binlog.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range stmts {
+		if _, err := ast.TiParse(stmt.SQL, "", ""); err != nil {
+			t.Errorf("%s: %s, Error: %v", stmt, stmt.SQL, err)
+		}
+	}
+	err = common.GoldenDiff(func() {
+		for _, stmt := range stmts {
+			fmt.Printf("%s database: %s, session: %s\n", stmt, stmt.Database, stmt.Session)
+			fmt.Println(stmt.SQL)
+		}
+	}, t.Name(), update)
+	if err != nil {
+		t.Error(err)
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
@@ -0,0 +1,340 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package input
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/laojianzi/soar/common"
+)
+
+// mybatisMaxIncludeDepth <include> 嵌套的最大深度，防止循环引用
+const mybatisMaxIncludeDepth = 10
+
+var (
+	mybatisParamRe    = regexp.MustCompile(`#\{\s*([^},\s]+)\s*(,[^}]*)?\}`)
+	mybatisRawParamRe = regexp.MustCompile(`\$\{\s*([^}\s]+)\s*\}`)
+	mybatisJdbcTypeRe = regexp.MustCompile(`(?i)jdbcType\s*=\s*(\w+)`)
+	mybatisJavaTypeRe = regexp.MustCompile(`(?i)javaType\s*=\s*([\w.]+)`)
+)
+
+// mybatisStatements MyBatis mapper 中的 SQL 语句元素
+var mybatisStatements = map[string]bool{"select": true, "insert": true, "update": true, "delete": true}
+
+// xmlNode mapper XML 中的元素或文本
+type xmlNode struct {
+	name     string // 元素名，文本节点为空
+	attrs    map[string]string
+	text     string
+	line     int
+	children []*xmlNode
+}
+
+// parseXML 将 XML 解析为树，记录每个元素的起始行号
+func parseXML(data []byte) (*xmlNode, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+
+	root := &xmlNode{}
+	stack := []*xmlNode{root}
+	for {
+		offset := d.InputOffset()
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		parent := stack[len(stack)-1]
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{
+				name:  t.Name.Local,
+				attrs: make(map[string]string),
+				line:  bytes.Count(data[:offset], []byte("\n")) + 1,
+			}
+			for _, attr := range t.Attr {
+				node.attrs[attr.Name.Local] = attr.Value
+			}
+			parent.children = append(parent.children, node)
+			stack = append(stack, node)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			parent.children = append(parent.children, &xmlNode{text: string(t)})
+		}
+	}
+	return root, nil
+}
+
+// find 查找第一个指定名称的子元素
+func (n *xmlNode) find(name string) *xmlNode {
+	for _, child := range n.children {
+		if child.name == name {
+			return child
+		}
+		if found := child.find(name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// mybatisMapper 单个 mapper 文件
+type mybatisMapper struct {
+	namespace string
+	fragments map[string]*xmlNode // <sql> 定义的可复用片段
+}
+
+// ParseMyBatis 解析 MyBatis mapper XML，将动态 SQL 展开为具体的 SQL
+// 每条语句展开为包含所有分支的 all 及不包含可选条件的 minimal 两种，两者相同时只输出一条
+func ParseMyBatis(file string, data []byte) ([]Statement, error) {
+	root, err := parseXML(data)
+	if err != nil {
+		return nil, err
+	}
+	mapperNode := root.find("mapper")
+	if mapperNode == nil {
+		return nil, fmt.Errorf("%s is not a mybatis mapper file", file)
+	}
+
+	mapper := &mybatisMapper{
+		namespace: mapperNode.attrs["namespace"],
+		fragments: make(map[string]*xmlNode),
+	}
+	for _, child := range mapperNode.children {
+		if child.name == "sql" {
+			mapper.fragments[child.attrs["id"]] = child
+		}
+	}
+
+	var stmts []Statement
+	for _, child := range mapperNode.children {
+		if !mybatisStatements[strings.ToLower(child.name)] {
+			continue
+		}
+		all := mybatisSQL(mapper.expand(child, false, nil, 0))
+		minimal := mybatisSQL(mapper.expand(child, true, nil, 0))
+		if all == "" {
+			common.Log.Debug("ParseMyBatis %s %s is empty", file, child.attrs["id"])
+			continue
+		}
+
+		stmt := Statement{File: file, Line: child.line, ID: child.attrs["id"], SQL: all}
+		if all == minimal || minimal == "" {
+			stmts = append(stmts, stmt)
+			continue
+		}
+		stmt.Variant = "all"
+		stmts = append(stmts, stmt)
+		stmt.Variant, stmt.SQL = "minimal", minimal
+		stmts = append(stmts, stmt)
+	}
+	return stmts, nil
+}
+
+// expand 展开动态 SQL 标签，minimal 为 true 时去掉 <if> 等可选条件
+// props 为 <include> 中 <property> 定义的变量
+func (m *mybatisMapper) expand(node *xmlNode, minimal bool, props map[string]string, depth int) string {
+	if node.name == "" {
+		return mybatisRawParamRe.ReplaceAllStringFunc(node.text, func(s string) string {
+			name := mybatisRawParamRe.FindStringSubmatch(s)[1]
+			if value, ok := props[name]; ok {
+				return value
+			}
+			return s
+		})
+	}
+
+	body := func(n *xmlNode) string {
+		var buf []string
+		for _, child := range n.children {
+			buf = append(buf, m.expand(child, minimal, props, depth))
+		}
+		return strings.Join(buf, " ")
+	}
+
+	switch node.name {
+	case "if":
+		if minimal {
+			return ""
+		}
+		return body(node)
+	case "choose":
+		// all 取第一个 <when>，minimal 取 <otherwise>
+		for _, child := range node.children {
+			if (!minimal && child.name == "when") || (minimal && child.name == "otherwise") {
+				return body(child)
+			}
+		}
+		return ""
+	case "where":
+		return trimSQL(body(node), "WHERE", "", "AND |OR ", "")
+	case "set":
+		return trimSQL(body(node), "SET", "", ",", ",")
+	case "trim":
+		return trimSQL(body(node), node.attrs["prefix"], node.attrs["suffix"],
+			node.attrs["prefixOverrides"], node.attrs["suffixOverrides"])
+	case "foreach":
+		// 集合展开为两个元素，minimal 展开为一个元素
+		times := 2
+		if minimal {
+			times = 1
+		}
+		var items []string
+		for i := 0; i < times; i++ {
+			items = append(items, body(node))
+		}
+		return node.attrs["open"] + strings.Join(items, node.attrs["separator"]) + node.attrs["close"]
+	case "include":
+		refid := strings.TrimPrefix(node.attrs["refid"], m.namespace+".")
+		fragment, ok := m.fragments[refid]
+		if !ok || depth >= mybatisMaxIncludeDepth {
+			common.Log.Warning("mybatis include refid %s not found", node.attrs["refid"])
+			return ""
+		}
+		merged := make(map[string]string)
+		for k, v := range props {
+			merged[k] = v
+		}
+		for _, child := range node.children {
+			if child.name == "property" {
+				merged[child.attrs["name"]] = child.attrs["value"]
+			}
+		}
+		var buf []string
+		for _, child := range fragment.children {
+			buf = append(buf, m.expand(child, minimal, merged, depth+1))
+		}
+		return strings.Join(buf, " ")
+	case "bind", "selectKey", "property":
+		return ""
+	}
+	return body(node)
+}
+
+// trimSQL 实现 <trim> 标签，内容为空时不添加前后缀
+// overrides 为 | 分隔的多个需要去掉的前后缀，不区分大小写
+func trimSQL(sql, prefix, suffix, prefixOverrides, suffixOverrides string) string {
+	sql = strings.Join(strings.Fields(sql), " ")
+	for _, o := range splitOverrides(prefixOverrides) {
+		if len(sql) >= len(o) && strings.EqualFold(sql[:len(o)], o) {
+			sql = strings.TrimSpace(sql[len(o):])
+			break
+		}
+	}
+	for _, o := range splitOverrides(suffixOverrides) {
+		if len(sql) >= len(o) && strings.EqualFold(sql[len(sql)-len(o):], o) {
+			sql = strings.TrimSpace(sql[:len(sql)-len(o)])
+			break
+		}
+	}
+	if sql == "" {
+		return ""
+	}
+	return " " + prefix + " " + sql + " " + suffix + " "
+}
+
+// splitOverrides 拆分 prefixOverrides, suffixOverrides，保留首尾的空格用于区分 AND 与 ANDROID 这样的前缀
+func splitOverrides(overrides string) []string {
+	var res []string
+	for _, o := range strings.Split(overrides, "|") {
+		word := strings.Join(strings.Fields(o), " ")
+		if word == "" {
+			continue
+		}
+		if strings.TrimLeft(o, " \t\r\n") != o {
+			word = " " + word
+		}
+		if strings.TrimRight(o, " \t\r\n") != o {
+			word += " "
+		}
+		res = append(res, word)
+	}
+	return res
+}
+
+// mybatisSQL 将 #{} 参数替换为对应类型的值，${} 替换为参数名，合并多余的空白字符
+func mybatisSQL(sql string) string {
+	sql = mybatisParamRe.ReplaceAllStringFunc(sql, func(s string) string {
+		m := mybatisParamRe.FindStringSubmatch(s)
+		return mybatisParamValue(m[1], m[2])
+	})
+	sql = mybatisRawParamRe.ReplaceAllStringFunc(sql, func(s string) string {
+		name := mybatisRawParamRe.FindStringSubmatch(s)[1]
+		return name[strings.LastIndex(name, ".")+1:]
+	})
+	sql = strings.Join(strings.Fields(sql), " ")
+	return strings.TrimSpace(strings.TrimSuffix(sql, ";"))
+}
+
+// mybatisParamValue 根据 jdbcType, javaType 或参数名推断参数类型，返回对应类型的值
+func mybatisParamValue(name, options string) string {
+	const (
+		number   = "1"
+		datetime = "'2006-01-02 15:04:05'"
+		str      = "'x'"
+	)
+
+	if m := mybatisJdbcTypeRe.FindStringSubmatch(options); m != nil {
+		switch strings.ToUpper(m[1]) {
+		case "TINYINT", "SMALLINT", "INTEGER", "BIGINT", "BIT", "BOOLEAN",
+			"FLOAT", "REAL", "DOUBLE", "NUMERIC", "DECIMAL":
+			return number
+		case "DATE":
+			return "'2006-01-02'"
+		case "TIME":
+			return "'15:04:05'"
+		case "TIMESTAMP":
+			return datetime
+		}
+		return str
+	}
+	if m := mybatisJavaTypeRe.FindStringSubmatch(options); m != nil {
+		javaType := strings.ToLower(m[1][strings.LastIndex(m[1], ".")+1:])
+		switch javaType {
+		case "int", "integer", "long", "short", "byte", "double", "float", "bigdecimal", "biginteger", "boolean":
+			return number
+		case "date", "localdatetime", "timestamp":
+			return datetime
+		}
+		return str
+	}
+
+	// 没有指定类型时根据参数名推断
+	name = name[strings.LastIndex(name, ".")+1:]
+	lower := strings.ToLower(name)
+	switch {
+	case name == "id" || strings.HasSuffix(name, "Id") || strings.HasSuffix(name, "ID") || strings.HasSuffix(lower, "_id"):
+		return number
+	case lower == "limit" || lower == "offset" || lower == "size" || lower == "pagesize" || lower == "count":
+		return number
+	case strings.Contains(lower, "time") || strings.Contains(lower, "date") || strings.HasPrefix(lower, "gmt"):
+		return datetime
+	}
+	return str
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package input
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/laojianzi/soar/ast"
+	"github.com/laojianzi/soar/common"
+)
+
+func TestParseMyBatis(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	stmts, err := ReadFiles("mybatis", "testdata/UserMapper.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range stmts {
+		if _, err := ast.TiParse(stmt.SQL, "", ""); err != nil {
+			t.Errorf("%s: %s, Error: %v", stmt, stmt.SQL, err)
+		}
+	}
+
+	err = common.GoldenDiff(func() {
+		for _, stmt := range stmts {
+			fmt.Println(stmt)
+			fmt.Println(stmt.SQL)
+		}
+	}, t.Name(), update)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = ParseMyBatis("config.xml", []byte("<configuration></configuration>")); err == nil {
+		t.Error("want not a mapper file error")
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestMybatisParamValue(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	cases := map[string]string{
+		"#{id}":                           "1",
+		"#{user.roleId}":                  "1",
+		"#{name}":                         "'x'",
+		"#{name, jdbcType=INTEGER}":       "1",
+		"#{day,jdbcType=DATE}":            "'2006-01-02'",
+		"#{gmtCreate}":                    "'2006-01-02 15:04:05'",
+		"#{amount,javaType=BigDecimal}":   "1",
+		"#{flag,javaType=java.lang.Long}": "1",
+	}
+	for param, want := range cases {
+		if got := mybatisSQL(param); got != want {
+			t.Errorf("%s want: %s, got: %s", param, want, got)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
@@ -0,0 +1,671 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package input
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/laojianzi/soar/common"
+
+	"github.com/percona/go-mysql/query"
+)
+
+// MySQL 客户端/服务器协议
+// https://dev.mysql.com/doc/dev/mysql-server/latest/PAGE_PROTOCOL.html
+const (
+	comQuit        = 0x01
+	comInitDB      = 0x02
+	comQuery       = 0x03
+	comStmtPrepare = 0x16
+	comStmtExecute = 0x17
+	comStmtClose   = 0x19
+
+	clientConnectWithDB            = 0x00000008
+	clientCompress                 = 0x00000020
+	clientSSL                      = 0x00000800
+	clientSecureConnection         = 0x00008000
+	clientPluginAuthLenencData     = 0x00200000
+	clientQueryAttributes          = 0x08000000
+	stmtExecuteParameterCountAvail = 0x08
+
+	// 单个 MySQL 包的最大长度，超过该长度的数据会拆分为多个包
+	mysqlMaxPacketSize = 0xffffff
+)
+
+// MySQL 协议中的字段类型
+const (
+	mysqlTypeDecimal    = 0x00
+	mysqlTypeTiny       = 0x01
+	mysqlTypeShort      = 0x02
+	mysqlTypeLong       = 0x03
+	mysqlTypeFloat      = 0x04
+	mysqlTypeDouble     = 0x05
+	mysqlTypeNull       = 0x06
+	mysqlTypeTimestamp  = 0x07
+	mysqlTypeLongLong   = 0x08
+	mysqlTypeInt24      = 0x09
+	mysqlTypeDate       = 0x0a
+	mysqlTypeTime       = 0x0b
+	mysqlTypeDateTime   = 0x0c
+	mysqlTypeYear       = 0x0d
+	mysqlTypeNewDecimal = 0xf6
+)
+
+// mysqlPrepared COM_STMT_PREPARE 预处理的语句
+type mysqlPrepared struct {
+	sql    string
+	params int
+	types  []byte // 参数类型，每个参数两个字节，只在第一次执行或重新绑定时发送
+}
+
+// mysqlCommand 客户端发送的请求及其响应时间
+type mysqlCommand struct {
+	frame    int
+	client   string
+	database string
+	sql      string
+	params   []string // 预处理语句执行时绑定的参数
+	start    time.Duration
+	end      time.Duration // 最后一个响应包的时间，没有抓到响应时为 0
+	failed   bool          // 服务端返回了 ERR 包
+	prepare  bool          // COM_STMT_PREPARE 请求，需要从响应中获取 statement id
+}
+
+// mysqlConn 一个 MySQL 连接的解析状态
+type mysqlConn struct {
+	client, server string
+	streams        [2]tcpStream // 0 为客户端发往服务端，1 为服务端发往客户端
+	bufs           [2][]byte
+	database       string
+	capabilities   uint32
+	handshake      bool // 是否已经收到 HandshakeResponse
+	broken         bool // 使用 SSL, 压缩协议等无法解析的连接
+	stmts          map[uint32]*mysqlPrepared
+	pending        *mysqlCommand // 等待响应的请求
+}
+
+// pcapQuery 按 fingerprint 聚合后的 SQL 及其执行统计
+type pcapQuery struct {
+	stmt   Statement // 第一次出现的 SQL
+	count  int
+	failed int
+	timed  int // 抓到响应的次数
+	total  time.Duration
+	max    time.Duration
+}
+
+// pcapDecoder 从抓包中解析 MySQL 请求
+type pcapDecoder struct {
+	file    string
+	conns   map[string]*mysqlConn // key 为客户端 ip:port 及服务端 ip:port
+	queries map[string]*pcapQuery // key 为 database 及 fingerprint
+	order   []*pcapQuery
+}
+
+// ParsePcap 解析 tcpdump, Wireshark 等抓取的 MySQL 流量，重组 TCP 流后解析 COM_QUERY, COM_STMT_PREPARE,
+// COM_STMT_EXECUTE 及 COM_INIT_DB 请求，预处理语句记录第一次执行时绑定的参数
+// 相同 fingerprint 的 SQL 聚合为一条，记录执行次数及响应时间，按总响应时间从高到低排序
+// 使用 SSL 或压缩协议的连接无法解析
+func ParsePcap(file string, data []byte) ([]Statement, error) {
+	packets, err := readPcap(data)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &pcapDecoder{
+		file:    file,
+		conns:   make(map[string]*mysqlConn),
+		queries: make(map[string]*pcapQuery),
+	}
+	for _, packet := range packets {
+		seg, ok := decodeTCP(packet)
+		if !ok {
+			continue
+		}
+		d.addSegment(packet, seg)
+	}
+	// 抓包结束时未关闭的连接
+	var keys []string
+	for key := range d.conns {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		d.finish(d.conns[key])
+	}
+
+	sort.SliceStable(d.order, func(i, j int) bool {
+		return d.order[i].total > d.order[j].total
+	})
+	var stmts []Statement
+	for _, q := range d.order {
+		stmt := q.stmt
+		stmt.Variant = q.stats()
+		stmts = append(stmts, stmt)
+	}
+	return stmts, nil
+}
+
+// stats 返回 SQL 的执行统计，如：calls 3, avg 1.2ms, max 2ms
+func (q *pcapQuery) stats() string {
+	stats := []string{fmt.Sprintf("calls %d", q.count)}
+	if q.timed > 0 {
+		stats = append(stats,
+			"avg "+(q.total/time.Duration(q.timed)).Round(time.Microsecond).String(),
+			"max "+q.max.Round(time.Microsecond).String(),
+		)
+	}
+	if q.failed > 0 {
+		stats = append(stats, fmt.Sprintf("errors %d", q.failed))
+	}
+	return strings.Join(stats, ", ")
+}
+
+// addSegment 将 TCP 报文添加到所属的连接
+func (d *pcapDecoder) addSegment(packet pcapPacket, seg tcpSegment) {
+	conn := d.conns[seg.src+" "+seg.dst]
+	dir := 0
+	if conn == nil {
+		conn = d.conns[seg.dst+" "+seg.src]
+		dir = 1
+	}
+	if conn == nil {
+		if !seg.syn && len(seg.payload) == 0 {
+			return
+		}
+		// 发起 SYN 的为客户端，抓包开始时连接已经建立的，端口号小的为服务端
+		client, server := seg.src, seg.dst
+		if seg.syn && seg.ack || !seg.syn && pcapPort(seg.src) < pcapPort(seg.dst) {
+			client, server = seg.dst, seg.src
+		}
+		conn = &mysqlConn{client: client, server: server, stmts: make(map[uint32]*mysqlPrepared)}
+		d.conns[client+" "+server] = conn
+		dir = 0
+		if client != seg.src {
+			dir = 1
+		}
+	}
+
+	data, skipped := conn.streams[dir].add(seg)
+	if skipped {
+		// 丢包后无法确定 MySQL 包的边界
+		common.Log.Warning("input.ParsePcap %s frame %d: packet lost, skip buffered data", d.file, packet.frame)
+		conn.bufs[dir] = nil
+	}
+	if conn.broken {
+		return
+	}
+	conn.bufs[dir] = append(conn.bufs[dir], data...)
+	d.readPackets(conn, dir, packet)
+
+	if seg.fin || seg.rst {
+		d.finish(conn)
+		delete(d.conns, conn.client+" "+conn.server)
+	}
+}
+
+// pcapPort 返回 ip:port 中的端口号
+func pcapPort(addr string) int {
+	port, _ := strconv.Atoi(addr[strings.LastIndex(addr, ":")+1:])
+	return port
+}
+
+// readPackets 从连接的缓存中读取完整的 MySQL 包
+func (d *pcapDecoder) readPackets(conn *mysqlConn, dir int, packet pcapPacket) {
+	buf := conn.bufs[dir]
+	for !conn.broken {
+		// 超过 16MB 的数据拆分为多个包，需要拼接
+		var payload []byte
+		var seq byte
+		n := 0
+		for {
+			if len(buf)-n < 4 {
+				conn.bufs[dir] = buf
+				return
+			}
+			length := int(buf[n]) | int(buf[n+1])<<8 | int(buf[n+2])<<16
+			if len(buf)-n-4 < length {
+				conn.bufs[dir] = buf
+				return
+			}
+			if n == 0 {
+				seq = buf[3]
+			}
+			payload = append(payload, buf[n+4:n+4+length]...)
+			n += 4 + length
+			if length < mysqlMaxPacketSize {
+				break
+			}
+		}
+		buf = buf[n:]
+		if dir == 0 {
+			d.clientPacket(conn, seq, payload, packet)
+		} else {
+			d.serverPacket(conn, seq, payload, packet)
+		}
+	}
+	conn.bufs[dir] = nil
+}
+
+// clientPacket 处理客户端发送的包
+func (d *pcapDecoder) clientPacket(conn *mysqlConn, seq byte, payload []byte, packet pcapPacket) {
+	if seq != 0 {
+		// 序号为 1 的第一个包为 HandshakeResponse，其余为认证过程中的包
+		if seq == 1 && !conn.handshake {
+			conn.handshake = true
+			d.handshakeResponse(conn, payload)
+		}
+		return
+	}
+	if len(payload) == 0 {
+		return
+	}
+
+	d.finishCommand(conn)
+	cmd := &mysqlCommand{frame: packet.frame, client: conn.client, database: conn.database, start: packet.ts}
+	switch payload[0] {
+	case comQuit:
+		conn.broken = true
+	case comInitDB:
+		conn.database = string(payload[1:])
+	case comQuery:
+		cmd.sql = conn.querySQL(payload[1:])
+		if db, ok := useDatabase(cmd.sql); ok {
+			conn.database = db
+			return
+		}
+		conn.pending = cmd
+	case comStmtPrepare:
+		cmd.sql, cmd.prepare = string(payload[1:]), true
+		conn.pending = cmd
+	case comStmtExecute:
+		if len(payload) < 10 {
+			return
+		}
+		stmt, ok := conn.stmts[binary.LittleEndian.Uint32(payload[1:])]
+		if !ok {
+			// 抓包开始前预处理的语句
+			common.Log.Debug("input.ParsePcap %s frame %d: unknown statement id", d.file, packet.frame)
+			return
+		}
+		cmd.sql, cmd.params = stmt.sql, conn.executeParams(stmt, payload[1:])
+		conn.pending = cmd
+	case comStmtClose:
+		if len(payload) >= 5 {
+			delete(conn.stmts, binary.LittleEndian.Uint32(payload[1:]))
+		}
+	}
+}
+
+// serverPacket 处理服务端返回的包
+func (d *pcapDecoder) serverPacket(conn *mysqlConn, seq byte, payload []byte, packet pcapPacket) {
+	cmd := conn.pending
+	if cmd == nil || seq == 0 {
+		return
+	}
+	cmd.end = packet.ts
+	if seq != 1 || len(payload) == 0 {
+		return
+	}
+	switch {
+	case payload[0] == 0xff:
+		cmd.failed = true
+	case cmd.prepare && payload[0] == 0x00 && len(payload) >= 9:
+		// COM_STMT_PREPARE_OK
+		conn.stmts[binary.LittleEndian.Uint32(payload[1:])] = &mysqlPrepared{
+			sql:    cmd.sql,
+			params: int(binary.LittleEndian.Uint16(payload[7:])),
+		}
+	}
+}
+
+// handshakeResponse 解析 HandshakeResponse41 中的 capability flags 及连接时指定的库
+func (d *pcapDecoder) handshakeResponse(conn *mysqlConn, payload []byte) {
+	if len(payload) < 32 {
+		return
+	}
+	conn.capabilities = binary.LittleEndian.Uint32(payload)
+	if conn.capabilities&clientSSL != 0 || conn.capabilities&clientCompress != 0 {
+		common.Log.Warning("input.ParsePcap %s: connection %s uses SSL or compression, skipped", d.file, conn.client)
+		conn.broken = true
+		return
+	}
+	if conn.capabilities&clientConnectWithDB == 0 {
+		return
+	}
+
+	r := &mysqlReader{data: payload[32:]}
+	r.nulString() // username
+	switch {
+	case conn.capabilities&clientPluginAuthLenencData != 0:
+		r.lenencString()
+	case conn.capabilities&clientSecureConnection != 0:
+		r.bytes(int(r.byte()))
+	default:
+		r.nulString()
+	}
+	if db := r.nulString(); !r.err {
+		conn.database = db
+	}
+}
+
+// querySQL 返回 COM_QUERY 中的 SQL，使用 query attributes 时跳过其中的属性
+func (conn *mysqlConn) querySQL(payload []byte) string {
+	if conn.capabilities&clientQueryAttributes == 0 {
+		return string(payload)
+	}
+	r := &mysqlReader{data: payload}
+	count := r.lenencCount()
+	r.lenencInt() // parameter_set_count，总是为 1
+	if count > 0 {
+		r.bytes((count + 7) / 8)
+		if r.byte() == 1 {
+			types := make([]byte, 0, count*2)
+			for i := 0; i < count && !r.err; i++ {
+				types = append(types, r.bytes(2)...)
+				r.lenencString() // 属性名
+			}
+			for i := 0; i < count && !r.err; i++ {
+				r.value(types[i*2], types[i*2+1])
+			}
+		}
+	}
+	return string(r.data)
+}
+
+// executeParams 返回 COM_STMT_EXECUTE 中绑定的参数，参数按顺序对应预处理语句中的 ?
+func (conn *mysqlConn) executeParams(stmt *mysqlPrepared, payload []byte) []string {
+	r := &mysqlReader{data: payload}
+	r.bytes(4) // statement id
+	flags := r.byte()
+	r.bytes(4) // iteration count
+	params := stmt.params
+	withNames := false
+	if conn.capabilities&clientQueryAttributes != 0 && (params > 0 || flags&stmtExecuteParameterCountAvail != 0) {
+		params, withNames = r.lenencCount(), true
+	}
+	if params == 0 || r.err {
+		return nil
+	}
+
+	nulls := r.bytes((params + 7) / 8)
+	if r.byte() == 1 {
+		stmt.types = stmt.types[:0]
+		for i := 0; i < params && !r.err; i++ {
+			stmt.types = append(stmt.types, r.bytes(2)...)
+			if withNames {
+				r.lenencString()
+			}
+		}
+	}
+	if r.err || len(stmt.types) < params*2 {
+		return nil
+	}
+
+	values := make([]string, 0, params)
+	for i := 0; i < params; i++ {
+		if nulls[i/8]&(1<<(uint(i)%8)) != 0 {
+			values = append(values, "NULL")
+			continue
+		}
+		values = append(values, r.value(stmt.types[i*2], stmt.types[i*2+1]))
+	}
+	if r.err {
+		return nil
+	}
+	// query attributes 的参数在预处理语句的参数之后
+	if len(values) > stmt.params {
+		values = values[:stmt.params]
+	}
+	return values
+}
+
+// finishCommand 请求的响应结束，记录执行统计
+func (d *pcapDecoder) finishCommand(conn *mysqlConn) {
+	cmd := conn.pending
+	conn.pending = nil
+	if cmd == nil || cmd.prepare {
+		return
+	}
+	sql := strings.TrimSpace(cmd.sql)
+	sql = strings.TrimSpace(strings.TrimSuffix(sql, ";"))
+	if sql == "" {
+		return
+	}
+
+	fingerprint := query.Fingerprint(sql)
+	key := cmd.database + "\x00" + fingerprint
+	q, ok := d.queries[key]
+	if !ok {
+		q = &pcapQuery{stmt: Statement{
+			File:     d.file,
+			Line:     cmd.frame,
+			ID:       cmd.client,
+			Database: cmd.database,
+			// 聚合后的 SQL 不再有执行顺序，每条 SQL 单独进行事务分析
+			Session: query.Id(fingerprint),
+			SQL:     sql,
+			Params:  cmd.params,
+		}}
+		d.queries[key] = q
+		d.order = append(d.order, q)
+	}
+	q.count++
+	if cmd.failed {
+		q.failed++
+	}
+	if cmd.end > cmd.start {
+		latency := cmd.end - cmd.start
+		q.timed++
+		q.total += latency
+		if latency > q.max {
+			q.max = latency
+		}
+	}
+}
+
+// finish 连接关闭或抓包结束
+func (d *pcapDecoder) finish(conn *mysqlConn) {
+	d.finishCommand(conn)
+	conn.broken = true
+}
+
+// useDatabase 判断 SQL 是否为 USE 语句，返回切换的库
+func useDatabase(sql string) (string, bool) {
+	if m := generalLogUseRe.FindStringSubmatch(sql); m != nil {
+		return m[1], true
+	}
+	return "", false
+}
+
+// mysqlReader 按照 MySQL 协议读取数据，数据不足时设置 err 并返回零值
+type mysqlReader struct {
+	data []byte
+	err  bool
+}
+
+// bytes 读取 n 个字节，数据不足时返回 nil，n 可能来自报文中的长度，不能按 n 分配内存
+func (r *mysqlReader) bytes(n int) []byte {
+	if n < 0 || n > len(r.data) {
+		r.err, r.data = true, nil
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// fixed 读取定长整数等固定长度的 n 个字节，数据不足时返回零值，避免调用方越界
+func (r *mysqlReader) fixed(n int) []byte {
+	if b := r.bytes(n); b != nil {
+		return b
+	}
+	return make([]byte, n)
+}
+
+// byte 读取 1 个字节
+func (r *mysqlReader) byte() byte {
+	return r.fixed(1)[0]
+}
+
+// nulString 读取以 0 结尾的字符串
+func (r *mysqlReader) nulString() string {
+	for i, c := range r.data {
+		if c == 0 {
+			s := string(r.data[:i])
+			r.data = r.data[i+1:]
+			return s
+		}
+	}
+	r.err, r.data = true, nil
+	return ""
+}
+
+// lenencInt 读取 length-encoded integer
+func (r *mysqlReader) lenencInt() uint64 {
+	switch c := r.byte(); c {
+	case 0xfc:
+		return uint64(binary.LittleEndian.Uint16(r.fixed(2)))
+	case 0xfd:
+		b := r.fixed(3)
+		return uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16
+	case 0xfe:
+		return binary.LittleEndian.Uint64(r.fixed(8))
+	default:
+		return uint64(c)
+	}
+}
+
+// lenencCount 读取 length-encoded integer 表示的元素数量，每个元素至少占 1 个字节
+// 超过剩余数据的长度时设置 err 并返回 0，避免调用方按异常的数量分配内存
+func (r *mysqlReader) lenencCount() int {
+	n := r.lenencInt()
+	if r.err || n > uint64(len(r.data)) {
+		r.err, r.data = true, nil
+		return 0
+	}
+	return int(n)
+}
+
+// lenencString 读取 length-encoded string
+func (r *mysqlReader) lenencString() []byte {
+	n := r.lenencInt()
+	if n > uint64(len(r.data)) {
+		r.err, r.data = true, nil
+		return nil
+	}
+	return r.bytes(int(n))
+}
+
+// value 按照字段类型读取 COM_STMT_EXECUTE 中的参数，返回 SQL 中的字面量
+func (r *mysqlReader) value(typ, flags byte) string {
+	unsigned := flags&0x80 != 0
+	switch typ {
+	case mysqlTypeNull:
+		return "NULL"
+	case mysqlTypeTiny:
+		b := r.byte()
+		if unsigned {
+			return strconv.FormatUint(uint64(b), 10)
+		}
+		return strconv.FormatInt(int64(int8(b)), 10)
+	case mysqlTypeShort, mysqlTypeYear:
+		v := binary.LittleEndian.Uint16(r.fixed(2))
+		if unsigned || typ == mysqlTypeYear {
+			return strconv.FormatUint(uint64(v), 10)
+		}
+		return strconv.FormatInt(int64(int16(v)), 10)
+	case mysqlTypeLong, mysqlTypeInt24:
+		v := binary.LittleEndian.Uint32(r.fixed(4))
+		if unsigned {
+			return strconv.FormatUint(uint64(v), 10)
+		}
+		return strconv.FormatInt(int64(int32(v)), 10)
+	case mysqlTypeLongLong:
+		v := binary.LittleEndian.Uint64(r.fixed(8))
+		if unsigned {
+			return strconv.FormatUint(v, 10)
+		}
+		return strconv.FormatInt(int64(v), 10)
+	case mysqlTypeFloat:
+		return strconv.FormatFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(r.fixed(4)))), 'g', -1, 32)
+	case mysqlTypeDouble:
+		return strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(r.fixed(8))), 'g', -1, 64)
+	case mysqlTypeDate, mysqlTypeDateTime, mysqlTypeTimestamp:
+		b := r.bytes(int(r.byte()))
+		var year uint16
+		var month, day, hour, minute, second byte
+		var micro uint32
+		if len(b) >= 4 {
+			year, month, day = binary.LittleEndian.Uint16(b), b[2], b[3]
+		}
+		if len(b) >= 7 {
+			hour, minute, second = b[4], b[5], b[6]
+		}
+		if len(b) >= 11 {
+			micro = binary.LittleEndian.Uint32(b[7:])
+		}
+		if typ == mysqlTypeDate {
+			return fmt.Sprintf("'%04d-%02d-%02d'", year, month, day)
+		}
+		v := fmt.Sprintf("'%04d-%02d-%02d %02d:%02d:%02d", year, month, day, hour, minute, second)
+		if micro > 0 {
+			v += fmt.Sprintf(".%06d", micro)
+		}
+		return v + "'"
+	case mysqlTypeTime:
+		b := r.bytes(int(r.byte()))
+		var sign string
+		var days, micro uint32
+		var hour, minute, second byte
+		if len(b) >= 8 {
+			if b[0] == 1 {
+				sign = "-"
+			}
+			days, hour, minute, second = binary.LittleEndian.Uint32(b[1:]), b[5], b[6], b[7]
+		}
+		if len(b) >= 12 {
+			micro = binary.LittleEndian.Uint32(b[8:])
+		}
+		v := fmt.Sprintf("'%s%02d:%02d:%02d", sign, days*24+uint32(hour), minute, second)
+		if micro > 0 {
+			v += fmt.Sprintf(".%06d", micro)
+		}
+		return v + "'"
+	case mysqlTypeDecimal, mysqlTypeNewDecimal:
+		return string(r.lenencString())
+	default:
+		// VARCHAR, BLOB, JSON 等字符串类型
+		return quoteString(r.lenencString())
+	}
+}
+
+// quoteString 将字符串转换为 SQL 中的字面量，非 UTF-8 的二进制数据转换为十六进制
+func quoteString(b []byte) string {
+	if !utf8.Valid(b) {
+		return "0x" + hex.EncodeToString(b)
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\x00", `\0`, "\n", `\n`, "\r", `\r`).Replace(string(b)) + "'"
+}
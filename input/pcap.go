@@ -0,0 +1,366 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package input
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+// pcap, pcapng 文件格式
+// https://wiki.wireshark.org/Development/LibpcapFileFormat
+// https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html
+const (
+	pcapMagic       = 0xa1b2c3d4 // 微秒精度
+	pcapMagicNano   = 0xa1b23c4d // 纳秒精度
+	pcapngBlockSHB  = 0x0a0d0d0a // Section Header Block
+	pcapngBlockIDB  = 0x00000001 // Interface Description Block
+	pcapngBlockSPB  = 0x00000003 // Simple Packet Block
+	pcapngBlockEPB  = 0x00000006 // Enhanced Packet Block
+	pcapngByteOrder = 0x1a2b3c4d
+)
+
+// 支持的链路层类型
+// https://www.tcpdump.org/linktypes.html
+const (
+	linkTypeNull     = 0   // BSD loopback
+	linkTypeEthernet = 1   // Ethernet
+	linkTypeRaw      = 101 // 不含链路层头的 IP 包
+	linkTypeLoop     = 108 // OpenBSD loopback
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL      = 113 // tcpdump -i any
+	linkTypeSLL2     = 276 // tcpdump -i any, libpcap 1.10 及以上版本
+)
+
+// pcapPacket 抓包文件中的一个数据包
+type pcapPacket struct {
+	frame    int           // 包序号，从 1 开始，与 Wireshark 中的 No. 一致
+	ts       time.Duration // 抓包时间
+	linkType uint32
+	data     []byte
+}
+
+// tcpSegment 从数据包中解析出的 TCP 报文
+type tcpSegment struct {
+	src, dst string // ip:port
+	seq      uint32
+	syn, ack bool
+	fin, rst bool
+	payload  []byte
+}
+
+// readPcap 读取 pcap 或 pcapng 格式的抓包文件
+func readPcap(data []byte) ([]pcapPacket, error) {
+	if len(data) < 24 {
+		return nil, errors.New("pcap: file too short")
+	}
+	if binary.LittleEndian.Uint32(data) == pcapngBlockSHB {
+		return readPcapng(data)
+	}
+
+	var order binary.ByteOrder
+	var nano bool
+	switch {
+	case binary.LittleEndian.Uint32(data) == pcapMagic:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(data) == pcapMagic:
+		order = binary.BigEndian
+	case binary.LittleEndian.Uint32(data) == pcapMagicNano:
+		order, nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(data) == pcapMagicNano:
+		order, nano = binary.BigEndian, true
+	default:
+		return nil, errors.New("pcap: unknown file format")
+	}
+	linkType := order.Uint32(data[20:]) & 0x0fffffff
+
+	var packets []pcapPacket
+	for off := 24; off+16 <= len(data); {
+		sec, frac := order.Uint32(data[off:]), order.Uint32(data[off+4:])
+		capLen := int(order.Uint32(data[off+8:]))
+		off += 16
+		if capLen > len(data)-off {
+			// 抓包被中止时最后一个包可能不完整
+			break
+		}
+		ts := time.Duration(sec) * time.Second
+		if nano {
+			ts += time.Duration(frac)
+		} else {
+			ts += time.Duration(frac) * time.Microsecond
+		}
+		packets = append(packets, pcapPacket{
+			frame:    len(packets) + 1,
+			ts:       ts,
+			linkType: linkType,
+			data:     data[off : off+capLen],
+		})
+		off += capLen
+	}
+	return packets, nil
+}
+
+// pcapngInterface pcapng 中的网卡信息
+type pcapngInterface struct {
+	linkType uint32
+	tsresol  byte // 时间精度，最高位为 0 时为 10^-n 秒，为 1 时为 2^-n 秒
+}
+
+// readPcapng 读取 pcapng 格式的抓包文件，Wireshark 默认保存为该格式
+func readPcapng(data []byte) ([]pcapPacket, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	var ifaces []pcapngInterface
+	var packets []pcapPacket
+	for off := 0; off+12 <= len(data); {
+		blockType := order.Uint32(data[off:])
+		if blockType == pcapngBlockSHB {
+			// 每个 Section 的字节序可能不同
+			if binary.BigEndian.Uint32(data[off+8:]) == pcapngByteOrder {
+				order = binary.BigEndian
+			} else {
+				order = binary.LittleEndian
+			}
+			ifaces = nil
+		}
+		blockLen := int(order.Uint32(data[off+4:]))
+		if blockLen < 12 || blockLen > len(data)-off {
+			break
+		}
+		body := data[off+8 : off+blockLen-4]
+		off += blockLen
+
+		switch blockType {
+		case pcapngBlockIDB:
+			if len(body) < 8 {
+				continue
+			}
+			iface := pcapngInterface{linkType: uint32(order.Uint16(body)), tsresol: 6}
+			for opt := body[8:]; len(opt) >= 4; {
+				code, optLen := order.Uint16(opt), int(order.Uint16(opt[2:]))
+				if code == 0 || 4+optLen > len(opt) {
+					break
+				}
+				// if_tsresol
+				if code == 9 && optLen == 1 {
+					iface.tsresol = opt[4]
+				}
+				opt = opt[4+(optLen+3)/4*4:]
+			}
+			ifaces = append(ifaces, iface)
+		case pcapngBlockEPB:
+			if len(body) < 20 {
+				continue
+			}
+			id := int(order.Uint32(body))
+			capLen := int(order.Uint32(body[12:]))
+			if id >= len(ifaces) || capLen > len(body)-20 {
+				continue
+			}
+			ts := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			packets = append(packets, pcapPacket{
+				frame:    len(packets) + 1,
+				ts:       pcapngTimestamp(ts, ifaces[id].tsresol),
+				linkType: ifaces[id].linkType,
+				data:     body[20 : 20+capLen],
+			})
+		case pcapngBlockSPB:
+			// Simple Packet Block 没有时间戳
+			if len(body) < 4 || len(ifaces) == 0 {
+				continue
+			}
+			packets = append(packets, pcapPacket{
+				frame:    len(packets) + 1,
+				linkType: ifaces[0].linkType,
+				data:     body[4:],
+			})
+		}
+	}
+	if len(ifaces) == 0 {
+		return nil, errors.New("pcapng: no interface description block")
+	}
+	return packets, nil
+}
+
+// pcapngTimestamp 按照网卡的时间精度转换时间戳
+func pcapngTimestamp(ts uint64, tsresol byte) time.Duration {
+	if tsresol&0x80 != 0 {
+		return time.Duration(float64(ts) / math.Pow(2, float64(tsresol&0x7f)) * float64(time.Second))
+	}
+	if tsresol <= 9 {
+		return time.Duration(ts * uint64(math.Pow10(9-int(tsresol))))
+	}
+	return time.Duration(ts / uint64(math.Pow10(int(tsresol)-9)))
+}
+
+// decodeTCP 解析链路层及 IP 层，返回 TCP 报文，非 TCP 的数据包返回 false
+func decodeTCP(packet pcapPacket) (tcpSegment, bool) {
+	data := packet.data
+	switch packet.linkType {
+	case linkTypeNull, linkTypeLoop:
+		if len(data) < 4 {
+			return tcpSegment{}, false
+		}
+		data = data[4:]
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return tcpSegment{}, false
+		}
+		etherType := binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+		// 802.1Q VLAN
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return tcpSegment{}, false
+		}
+	case linkTypeSLL:
+		if len(data) < 16 {
+			return tcpSegment{}, false
+		}
+		data = data[16:]
+	case linkTypeSLL2:
+		if len(data) < 20 {
+			return tcpSegment{}, false
+		}
+		data = data[20:]
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+	default:
+		return tcpSegment{}, false
+	}
+	if len(data) == 0 {
+		return tcpSegment{}, false
+	}
+	var src, dst net.IP
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return tcpSegment{}, false
+		}
+		ihl := int(data[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(data[2:]))
+		// 不处理 IP 分片
+		fragment := binary.BigEndian.Uint16(data[6:])
+		if data[9] != 6 || fragment&0x3fff != 0 || ihl < 20 || total < ihl || total > len(data) {
+			return tcpSegment{}, false
+		}
+		src, dst = net.IP(data[12:16]), net.IP(data[16:20])
+		data = data[ihl:total]
+	case 6:
+		if len(data) < 40 {
+			return tcpSegment{}, false
+		}
+		total := 40 + int(binary.BigEndian.Uint16(data[4:]))
+		// 不处理扩展头
+		if data[6] != 6 || total > len(data) {
+			return tcpSegment{}, false
+		}
+		src, dst = net.IP(data[8:24]), net.IP(data[24:40])
+		data = data[40:total]
+	default:
+		return tcpSegment{}, false
+	}
+
+	if len(data) < 20 {
+		return tcpSegment{}, false
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || offset > len(data) {
+		return tcpSegment{}, false
+	}
+	flags := data[13]
+	return tcpSegment{
+		src:     net.JoinHostPort(src.String(), strconv.Itoa(int(binary.BigEndian.Uint16(data)))),
+		dst:     net.JoinHostPort(dst.String(), strconv.Itoa(int(binary.BigEndian.Uint16(data[2:])))),
+		seq:     binary.BigEndian.Uint32(data[4:]),
+		fin:     flags&0x01 != 0,
+		syn:     flags&0x02 != 0,
+		rst:     flags&0x04 != 0,
+		ack:     flags&0x10 != 0,
+		payload: data[offset:],
+	}, true
+}
+
+// tcpStream 单个方向的 TCP 流重组，按照 seq 将乱序、重传的报文还原为有序的字节流
+type tcpStream struct {
+	started bool
+	next    uint32            // 下一个期望的 seq
+	pending map[uint32][]byte // 乱序到达的报文
+}
+
+// tcpStreamMaxPending 乱序报文的最大缓存数，丢包时超过该数量后跳过缺失的数据
+const tcpStreamMaxPending = 256
+
+// tcpStreamWindow 接收窗口大小，seq 与期望值相差超过该值的报文视为损坏或重传的报文
+const tcpStreamWindow = 1 << 30
+
+// add 添加一个报文，返回可以按顺序读取的数据，skipped 为 true 时表示因丢包跳过了部分数据
+func (s *tcpStream) add(seg tcpSegment) (data []byte, skipped bool) {
+	if seg.syn {
+		s.started, s.next = true, seg.seq+1
+		return nil, false
+	}
+	if len(seg.payload) == 0 {
+		return nil, false
+	}
+	if !s.started {
+		// 抓包开始时连接已经建立，从第一个报文开始读取
+		s.started, s.next = true, seg.seq
+	}
+	if s.pending == nil {
+		s.pending = make(map[uint32][]byte)
+	}
+	s.pending[seg.seq] = seg.payload
+
+	for progress := true; progress; {
+		progress = false
+		for seq, payload := range s.pending {
+			// seq 在 next 之后且在接收窗口内的是乱序到达的报文，等待前面的数据
+			ahead := seq - s.next
+			if ahead != 0 && ahead < tcpStreamWindow {
+				continue
+			}
+			delete(s.pending, seq)
+			progress = true
+			// behind 为该报文与 next 重叠的字节数，超出接收窗口的报文按重传丢弃
+			behind := int64(s.next - seq)
+			if behind > tcpStreamWindow || behind >= int64(len(payload)) {
+				continue
+			}
+			data = append(data, payload[behind:]...)
+			s.next += uint32(int64(len(payload)) - behind)
+		}
+		if !progress && len(s.pending) > tcpStreamMaxPending {
+			// 丢包，跳到最早的乱序报文
+			var earliest uint32
+			first := true
+			for seq := range s.pending {
+				if first || int32(seq-earliest) < 0 {
+					earliest, first = seq, false
+				}
+			}
+			s.next, skipped, progress = earliest, true, true
+		}
+	}
+	return data, skipped
+}
@@ -0,0 +1,288 @@
+/*
+ * Copyright 2018 Xiaomi, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package input
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/laojianzi/soar/common"
+)
+
+// testPacket 测试用的 TCP 报文
+type testPacket struct {
+	ts       time.Duration
+	src, dst string
+	seq      uint32
+	flags    byte
+	payload  []byte
+}
+
+// testCapture 构造测试用的 MySQL 流量
+type testCapture struct {
+	packets []testPacket
+	seqs    map[string]uint32
+	ts      time.Duration
+}
+
+func (c *testCapture) send(src, dst string, flags byte, payload []byte) {
+	if c.seqs == nil {
+		c.seqs = make(map[string]uint32)
+	}
+	c.ts += time.Millisecond
+	seq := c.seqs[src]
+	c.packets = append(c.packets, testPacket{ts: c.ts, src: src, dst: dst, seq: seq, flags: flags, payload: payload})
+	c.seqs[src] = seq + uint32(len(payload))
+	if flags&0x02 != 0 {
+		c.seqs[src]++
+	}
+}
+
+func (c *testCapture) mysql(src, dst string, seq byte, payload []byte) {
+	c.send(src, dst, 0x18, mysqlTestPacket(seq, payload))
+}
+
+func mysqlTestPacket(seq byte, payload []byte) []byte {
+	return append([]byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}, payload...)
+}
+
+// frame 构造 Ethernet + IPv4 + TCP 数据包
+func (p testPacket) frame() []byte {
+	addr := func(s string) (net.IP, uint16) {
+		host, port, _ := net.SplitHostPort(s)
+		var n uint16
+		fmt.Sscan(port, &n)
+		return net.ParseIP(host).To4(), n
+	}
+	srcIP, srcPort := addr(p.src)
+	dstIP, dstPort := addr(p.dst)
+
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp, srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], p.seq)
+	tcp[12], tcp[13] = 5<<4, p.flags
+	tcp = append(tcp, p.payload...)
+
+	ip := make([]byte, 20)
+	ip[0], ip[9] = 0x45, 6
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+	copy(ip[12:], srcIP)
+	copy(ip[16:], dstIP)
+
+	eth := make([]byte, 14)
+	binary.BigEndian.PutUint16(eth[12:], 0x0800)
+	return append(append(eth, ip...), tcp...)
+}
+
+func (c *testCapture) pcap() []byte {
+	var buf bytes.Buffer
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header, pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeEthernet)
+	buf.Write(header)
+	for _, p := range c.packets {
+		frame := p.frame()
+		binary.Write(&buf, binary.LittleEndian, []uint32{
+			uint32(p.ts / time.Second), uint32(p.ts % time.Second / time.Microsecond), uint32(len(frame)), uint32(len(frame)),
+		})
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
+
+func (c *testCapture) pcapng() []byte {
+	var buf bytes.Buffer
+	block := func(typ uint32, body []byte) {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		binary.Write(&buf, binary.LittleEndian, []uint32{typ, uint32(12 + len(body))})
+		buf.Write(body)
+		binary.Write(&buf, binary.LittleEndian, uint32(12+len(body)))
+	}
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb, pcapngByteOrder)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint64(shb[8:], math.MaxUint64)
+	block(pcapngBlockSHB, shb)
+	// if_tsresol = 9，纳秒精度
+	block(pcapngBlockIDB, []byte{1, 0, 0, 0, 0, 0, 0, 0, 9, 0, 1, 0, 9, 0, 0, 0, 0, 0, 0, 0})
+	for _, p := range c.packets {
+		frame := p.frame()
+		epb := make([]byte, 20)
+		binary.LittleEndian.PutUint32(epb[4:], uint32(uint64(p.ts)>>32))
+		binary.LittleEndian.PutUint32(epb[8:], uint32(uint64(p.ts)))
+		binary.LittleEndian.PutUint32(epb[12:], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(epb[16:], uint32(len(frame)))
+		block(pcapngBlockEPB, append(epb, frame...))
+	}
+	return buf.Bytes()
+}
+
+// mysqlTestCapture 构造包含 COM_QUERY, COM_STMT_PREPARE, COM_STMT_EXECUTE, COM_INIT_DB 的流量
+func mysqlTestCapture() *testCapture {
+	client, server, other := "10.0.0.2:52344", "10.0.0.1:3306", "10.0.0.3:40000"
+	c := &testCapture{seqs: map[string]uint32{client: 1000, server: 5000}}
+
+	// 三次握手及认证，HandshakeResponse 中指定了 sakila 库
+	c.send(client, server, 0x02, nil)
+	c.send(server, client, 0x12, nil)
+	c.mysql(server, client, 0, append([]byte{10}, "8.0.23\x00"...))
+	handshake := []byte{0x08, 0x82, 0x20, 0x00, 0, 0, 0, 1, 45}
+	handshake = append(handshake, make([]byte, 23)...)
+	handshake = append(handshake, "app\x00"...)
+	handshake = append(handshake, 20)
+	handshake = append(handshake, make([]byte, 20)...)
+	handshake = append(handshake, "sakila\x00"...)
+	c.mysql(client, server, 1, handshake)
+	c.mysql(server, client, 2, []byte{0, 0, 0, 2, 0, 0, 0})
+
+	c.mysql(client, server, 0, append([]byte{comQuery}, "SELECT * FROM film WHERE film_id = 1"...))
+	c.mysql(server, client, 1, []byte{1})
+	c.mysql(server, client, 2, []byte{0xfe, 0, 0, 2, 0})
+
+	// 同一个请求拆分为两个报文，乱序到达并且有重传
+	req := mysqlTestPacket(0, append([]byte{comQuery}, "select * from film where film_id = 2;"...))
+	c.send(client, server, 0x18, req[:10])
+	c.send(client, server, 0x18, req[10:])
+	c.packets[len(c.packets)-1], c.packets[len(c.packets)-2] = c.packets[len(c.packets)-2], c.packets[len(c.packets)-1]
+	c.packets = append(c.packets, c.packets[len(c.packets)-1])
+	c.mysql(server, client, 1, []byte{1})
+	c.ts += 3 * time.Millisecond
+	c.mysql(server, client, 2, []byte{0xfe, 0, 0, 2, 0})
+
+	// 预处理语句，第一次执行时发送参数类型，第二次执行复用参数类型
+	c.mysql(client, server, 0, append([]byte{comStmtPrepare}, "SELECT title FROM film WHERE film_id = ? AND rental_rate > ? AND last_update < ? AND title = ? AND special_features = '?'"...))
+	c.mysql(server, client, 1, []byte{0, 1, 0, 0, 0, 1, 0, 4, 0, 0, 0, 0})
+	execute := []byte{comStmtExecute, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0x00, 1,
+		mysqlTypeLongLong, 0, mysqlTypeDouble, 0, mysqlTypeDateTime, 0, 0xfd, 0}
+	execute = append(execute, 5, 0, 0, 0, 0, 0, 0, 0)
+	execute = append(execute, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(execute[len(execute)-8:], math.Float64bits(2.99))
+	execute = append(execute, 7, 0xd6, 0x07, 1, 2, 15, 4, 5)
+	execute = append(execute, 4, 'i', 't', '\'', 's')
+	c.mysql(client, server, 0, execute)
+	c.mysql(server, client, 1, []byte{1})
+	execute = []byte{comStmtExecute, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0x02, 0}
+	execute = append(execute, 0xfa, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	execute = append(execute, 4, 0xd6, 0x07, 1, 2)
+	execute = append(execute, 0)
+	c.mysql(client, server, 0, execute)
+	c.mysql(server, client, 1, append([]byte{0xff, 0x1e, 0x05}, "#HY000Query execution was interrupted"...))
+
+	// USE 切换库
+	c.mysql(client, server, 0, append([]byte{comQuery}, "use `employees`"...))
+	c.mysql(server, client, 1, []byte{0, 0, 0, 2, 0, 0, 0})
+	c.mysql(client, server, 0, append([]byte{comQuery}, "SELECT COUNT(*) FROM employees"...))
+	c.mysql(server, client, 1, []byte{1})
+	c.mysql(client, server, 0, []byte{comQuit})
+	c.send(client, server, 0x11, nil)
+
+	// 抓包开始时已经建立的连接，没有响应的请求不计算响应时间
+	c.seqs[other] = 7000
+	c.mysql(other, server, 0, append([]byte{comInitDB}, "sakila"...))
+	c.mysql(server, other, 1, []byte{0, 0, 0, 2, 0, 0, 0})
+	c.mysql(other, server, 0, append([]byte{comQuery}, "SELECT * FROM film WHERE film_id = 3"...))
+	return c
+}
+
+func TestParsePcap(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	c := mysqlTestCapture()
+	stmts, err := ParsePcap("mysql.pcap", c.pcap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = common.GoldenDiff(func() {
+		for _, stmt := range stmts {
+			fmt.Printf("%s database: %s, params: %v\n", stmt, stmt.Database, stmt.Params)
+			fmt.Println(stmt.SQL)
+		}
+	}, t.Name(), update)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// pcapng 格式的解析结果应该一致
+	ngStmts, err := ParsePcap("mysql.pcap", c.pcapng())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stmts, ngStmts) {
+		t.Errorf("pcapng want: %v, got: %v", stmts, ngStmts)
+	}
+
+	if _, err = ParsePcap("mysql.pcap", []byte("select 1")); err == nil {
+		t.Error("want error for non pcap file")
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
+
+func TestMySQLReaderMalformed(t *testing.T) {
+	common.Log.Debug("Entering function: %s", common.GetFunctionName())
+	conn := &mysqlConn{capabilities: clientQueryAttributes}
+
+	// 0xfe 开头的 length-encoded integer 表示超大的属性数量或参数数量，不能按其分配内存
+	huge := []byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}
+	if sql := conn.querySQL(append(append([]byte{}, huge...), 0x01, 0x00, 0x01)); sql != "" {
+		t.Errorf("querySQL want empty, got: %q", sql)
+	}
+	payload := append([]byte{1, 0, 0, 0, stmtExecuteParameterCountAvail, 1, 0, 0, 0}, huge...)
+	if params := conn.executeParams(&mysqlPrepared{params: 1}, payload); params != nil {
+		t.Errorf("executeParams want nil, got: %v", params)
+	}
+
+	// 报文被截断
+	r := &mysqlReader{data: []byte{0xfd, 0x01}}
+	if n := r.lenencCount(); n != 0 || !r.err {
+		t.Errorf("lenencCount want 0 with err, got: %d, %v", n, r.err)
+	}
+	r = &mysqlReader{data: []byte{0x05, 'a'}}
+	if b := r.lenencString(); b != nil || !r.err {
+		t.Errorf("lenencString want nil with err, got: %q, %v", b, r.err)
+	}
+	r = &mysqlReader{data: []byte{0x01}}
+	if b := r.bytes(1 << 40); b != nil || !r.err {
+		t.Errorf("bytes want nil with err, got: %v, %v", b, r.err)
+	}
+
+	// seq 与期望值相差 2^31 或超出接收窗口的报文按重传丢弃，不能越界
+	seqCases := map[uint32]string{
+		0:                                "",
+		0x80000000 - tcpStreamWindow - 1: "",
+		0x80000000 + 0x7fffffff:          "",
+		0x80000000 - 2:                   "c",
+		0x80000000:                       "abc",
+	}
+	for seq, want := range seqCases {
+		s := &tcpStream{started: true, next: 0x80000000}
+		if data, _ := s.add(tcpSegment{seq: seq, payload: []byte("abc")}); string(data) != want {
+			t.Errorf("seq %d want: %q, got: %q", seq, want, data)
+		}
+	}
+	common.Log.Debug("Exiting function: %s", common.GetFunctionName())
+}
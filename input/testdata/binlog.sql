@@ -0,0 +1,58 @@
+/*!50530 SET @@SESSION.PSEUDO_SLAVE_MODE=1*/;
+DELIMITER /*!*/;
+# at 4
+#210601 10:00:00 server id 1  end_log_pos 125 CRC32 0x5e3c42a1 	Start: binlog v 4, server v 8.0.23 created 210601 10:00:00
+ROLLBACK/*!*/;
+# at 234
+#210601 10:00:00 server id 1  end_log_pos 313 CRC32 0x1a2b3c4d 	Query	thread_id=10	exec_time=0	error_code=0
+SET TIMESTAMP=1622512800/*!*/;
+SET @@session.pseudo_thread_id=10/*!*/;
+SET @@session.sql_mode=1168113696/*!*/;
+/*!\C utf8mb4 *//*!*/;
+BEGIN
+/*!*/;
+# at 313
+#210601 10:00:00 server id 1  end_log_pos 377 CRC32 0x2b3c4d5e 	Table_map: `sakila`.`film` mapped to number 100
+# Columns(`film_id` SMALLINT UNSIGNED NOT NULL,
+#         `title` VARCHAR(128) CHARSET utf8mb4 COLLATE utf8mb4_0900_ai_ci,
+#         `rating` ENUM('G','PG'))
+# at 377
+#210601 10:00:00 server id 1  end_log_pos 480 CRC32 0x3c4d5e6f 	Update_rows: table id 100 flags: STMT_END_F
+### UPDATE `sakila`.`film`
+### WHERE
+###   @1=1 /* SHORTINT meta=0 nullable=0 is_null=0 */
+###   @2='ACADEMY DINOSAUR' /* VARSTRING(512) meta=512 nullable=1 is_null=0 */
+###   @3=NULL /* ENUM(1) meta=63233 nullable=1 is_null=1 */
+### SET
+###   @1=1 /* SHORTINT meta=0 nullable=0 is_null=0 */
+###   @2='ACADEMY' /* VARSTRING(512) meta=512 nullable=1 is_null=0 */
+###   @3=1 /* ENUM(1) meta=63233 nullable=1 is_null=0 */
+### UPDATE `sakila`.`film`
+### WHERE
+###   @1=2
+###   @2='ACE GOLDFINGER'
+###   @3=2
+### SET
+###   @1=2
+###   @2='ACE'
+###   @3=2
+# at 480
+#210601 10:00:00 server id 1  end_log_pos 540 CRC32 0x4d5e6f70 	Table_map: `sakila`.`actor` mapped to number 101
+# at 540
+#210601 10:00:00 server id 1  end_log_pos 600 CRC32 0x5e6f7081 	Write_rows: table id 101 flags: STMT_END_F
+### INSERT INTO `sakila`.`actor`
+### SET
+###   @1=201
+###   @2='PENELOPE'
+# at 600
+#210601 10:00:00 server id 1  end_log_pos 631 CRC32 0x6f708192 	Xid = 123
+COMMIT/*!*/;
+# at 631
+#210601 10:00:01 server id 1  end_log_pos 760 CRC32 0x708192a3 	Query	thread_id=11	exec_time=0	error_code=0	Xid = 130
+use `employees`/*!*/;
+SET TIMESTAMP=1622512801/*!*/;
+ALTER TABLE employees ADD COLUMN nickname varchar(32)
+/*!*/;
+SET @@SESSION.GTID_NEXT= 'AUTOMATIC' /* added by mysqlbinlog */ /*!*/;
+DELIMITER ;
+# End of log file
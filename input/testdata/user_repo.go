@@ -0,0 +1,85 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	userTable   = "user"
+	userColumns = "id, name, status"
+	selectUser  = "SELECT " + userColumns + " FROM " + userTable
+)
+
+type UserRepo struct {
+	db  *sql.DB
+	dbx *sqlx.DB
+}
+
+func (r *UserRepo) GetByID(ctx context.Context, id int64) error {
+	row := r.db.QueryRowContext(ctx, selectUser+" WHERE id = ?", id)
+	return row.Err()
+}
+
+func (r *UserRepo) ListByStatus(status int, limit int) error {
+	query := fmt.Sprintf("SELECT * FROM %s WHERE status = $1 ORDER BY id LIMIT %d", userTable, limit)
+	_, err := r.db.Query(query, status)
+	return err
+}
+
+func (r *UserRepo) Rename(id int64, name string) error {
+	_, err := r.dbx.NamedExec(`UPDATE user SET name = :name, update_time = '2021-01-01 00:00:00' WHERE id = :id`,
+		map[string]interface{}{"id": id, "name": name})
+	return err
+}
+
+func (r *UserRepo) Names(ids []int64) error {
+	var names []string
+	query, args, err := sqlx.In("SELECT name FROM user WHERE id IN (?)", ids)
+	if err != nil {
+		return err
+	}
+	return r.dbx.Select(&names, r.dbx.Rebind(query), args...)
+}
+
+func (r *UserRepo) Search(name string) error {
+	query := "SELECT id FROM user WHERE 1 = 1"
+	if name != "" {
+		query += " AND name = ?"
+	}
+	_, err := r.db.Query(query, name)
+	return err
+}
+
+func (r *UserRepo) Builder(status int) (string, []interface{}, error) {
+	return sq.Select("id", "name").
+		From(userTable).
+		LeftJoin("dept d ON d.id = user.dept_id").
+		Where(sq.Eq{"status": status}).
+		Where("create_time > ?", "2021-01-01").
+		OrderBy("id DESC").
+		Limit(10).
+		ToSql()
+}
+
+func (r *UserRepo) Insert(name string) error {
+	_, err := sq.Insert(userTable).Columns("name", "status").Values(name, 1).RunWith(r.db).Exec()
+	return err
+}
+
+func (r *UserRepo) Cache(key string) error {
+	// 不是 SQL 的字符串不提取
+	_, err := r.db.Exec(key)
+	_ = fmt.Sprintf("get %s", key)
+	return err
+}
+
+func (r *UserRepo) Dept(id int64) error {
+	// 常量定义在同一个包的其他文件中
+	_, err := r.db.Query(selectDept+" WHERE id = ?", id)
+	return err
+}
@@ -0,0 +1,7 @@
+package repo
+
+// 其他文件中使用的常量
+const (
+	deptTable  = "dept"
+	selectDept = "SELECT id, name FROM " + deptTable
+)
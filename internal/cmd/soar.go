@@ -31,6 +31,7 @@ import (
 	"github.com/laojianzi/soar/common"
 	"github.com/laojianzi/soar/database"
 	"github.com/laojianzi/soar/env"
+	"github.com/laojianzi/soar/input"
 )
 
 // Execute is the actuator entry for soar
@@ -43,9 +44,11 @@ func Execute() {
 	lineCounter := 1                                          // 行计数器
 	var alterSQLs []string                                    // 待评审的 SQL 中所有 ALTER 请求
 	alterTableTimes := make(map[string]int)                   // 待评审的 SQL 中同一经表 ALTER 请求计数器
+	trxs := make(map[string]*advisor.TrxAnalyzer)             // 待评审的 SQL 中跨语句的事务分析, key 为 SQL 所属的会话
 	suggestMerged := make(map[string]map[string]advisor.Rule) // 优化建议去重, key 为 sql 的 fingerprint.ID
 	var suggestStr []string                                   // string 形式格式化之后的优化建议，用于 -report-type json
 	tables := make(map[string][]string)                       // SQL 使用的库表名
+	rewriteReports := make([]ast.RewriteReport, 0)            // SQL 重写报告，用于 -rewrite-report-type json
 
 	// 配置文件&命令行参数解析
 	initConfig()
@@ -74,20 +77,38 @@ func Execute() {
 		shutdown(vEnv, rEnv)
 	})
 
-	// 对指定的库表进行索引重复检查
+	// 对指定的库表进行索引检查，包括重复、冗余、未使用及散粒度过低的索引
 	if common.Config.ReportType == "duplicate-key-checker" {
 		dupKeySuggest := advisor.DuplicateKeyChecker(rEnv)
 		_, str := advisor.FormatSuggest("", currentDB, common.Config.ReportType, dupKeySuggest)
 		if str == "" {
-			fmt.Printf("%s/%s 未发现重复索引\n", common.Config.OnlineDSN.Addr, common.Config.OnlineDSN.Schema)
+			fmt.Printf("%s/%s 未发现需要优化的索引\n", common.Config.OnlineDSN.Addr, common.Config.OnlineDSN.Schema)
 		} else {
 			fmt.Println(str)
 		}
 		return
 	}
 
+	// 对指定库中的所有表进行表结构审查
+	if common.Config.ReportType == "schema-audit" {
+		fmt.Println(advisor.FormatSchemaAudit(advisor.SchemaAuditChecker(rEnv)))
+		return
+	}
+
+	// 对比两个库的表结构，生成变更 SQL
+	if common.Config.ReportType == "schema-diff" {
+		schemaDiff(rEnv)
+		return
+	}
+
+	// 导出库表结构及统计信息快照
+	if common.Config.ReportType == "schema-dump" {
+		schemaDump(rEnv)
+		return
+	}
+
 	// 读入待优化 SQL ，当配置文件或命令行参数未指定 SQL 时从管道读取
-	buf := initQuery(common.Config.Query)
+	buf, sources := initInput(common.Config.Query)
 	lineCounter += ast.LeftNewLines([]byte(buf))
 	buf = strings.TrimSpace(buf)
 
@@ -99,6 +120,12 @@ func Execute() {
 		os.Exit(0)
 	}
 
+	// 从 mapper 文件等输入中提取的 SQL 逐条切分，切分出的每条 SQL 都对应其来源，不使用拼接后的 SQL
+	var source *input.Statement
+	if len(sources) > 0 {
+		buf = ""
+	}
+
 	// 逐条SQL给出优化建议
 	for ; ; sqlCounter++ {
 		var id string                                     // fingerprint.ID
@@ -108,7 +135,14 @@ func Execute() {
 		proSuggest := make(map[string]advisor.Rule)       // Profiling 信息
 		traceSuggest := make(map[string]advisor.Rule)     // Trace 信息
 		mysqlSuggest := make(map[string]advisor.Rule)     // MySQL 返回的 ERROR 信息
+		var trxSuggest map[string]advisor.Rule            // 事务分析建议
+		var trx *advisor.TrxAnalyzer                      // 当前 SQL 所属会话的事务分析
 
+		for buf == "" && len(sources) > 0 {
+			source = &sources[0]
+			sources = sources[1:]
+			buf = strings.TrimSpace(source.SQL)
+		}
 		if buf == "" {
 			common.Log.Debug("Ending, buf: '%s', sql: '%s'", buf, sql)
 			break
@@ -136,12 +170,15 @@ func Execute() {
 			continue
 		}
 		common.Log.Debug("main loop SQL: %s", sql)
-
 		// +++++++++++++++++++++小工具集[开始]+++++++++++++++++++++++{
 		fingerprint := strings.TrimSpace(query.Fingerprint(sql))
 		// SQL 签名
 		id = query.Id(fingerprint)
 		currentDB = env.CurrentDB(sql, currentDB)
+		// general log, binlog 等输入中记录了 SQL 执行时使用的库，多个连接交错执行时不能依赖 USE 语句判断
+		if source != nil && source.Database != "" {
+			currentDB = source.Database
+		}
 		switch common.Config.ReportType {
 		case "fingerprint":
 			// SQL 指纹
@@ -180,9 +217,24 @@ func Execute() {
 			common.LogIfWarn(err, "")
 			continue
 		default:
+			// 切换到来源中记录的库
+			if source != nil && source.Database != "" && source.Database != rEnv.Database {
+				vEnv.BuildVirtualEnv(rEnv, fmt.Sprintf("USE `%s`", source.Database))
+			}
+			// 事务分析依赖上下文，BEGIN, COMMIT 等语句的 fingerprint 重复也需要分析
+			// 不同会话的 SQL 交错出现时按会话分别分析
+			var session string
+			if source != nil {
+				session = source.Session
+			}
+			if trx = trxs[session]; trx == nil {
+				trx = advisor.NewTrxAnalyzer()
+				trxs[session] = trx
+			}
+			trxSuggest = trx.Check(sql)
 			// 建议去重，减少评审整个文件耗时
 			// TODO: 由于 a = 11 和 a = '11' 的 fingerprint 相同，这里一旦跳过即无法检查有些建议了，如： ARG.003
-			if _, ok := suggestMerged[id]; ok {
+			if _, ok := suggestMerged[id]; ok && len(trxSuggest) == 0 {
 				// `use ?` 不可以去重，去重后将导致无法切换数据库
 				if !strings.HasPrefix(fingerprint, "use") {
 					continue
@@ -242,21 +294,55 @@ func Execute() {
 				}
 			}
 		}
+		// 依赖上下文的事务分析建议
+		for item, r := range trxSuggest {
+			if !advisor.IsIgnoreRule(item) {
+				heuristicSuggest[item] = r
+			}
+		}
 		common.Log.Debug("end of heuristic advisor Query: %s", q.Query)
 		// +++++++++++++++++++++启发式规则建议[结束]+++++++++++++++++++++++}
 
+		// +++++++++++++++++++++预处理语句[开始]+++++++++++++++++++++++{
+		// 带 ? 占位符的 SQL 无法 EXPLAIN，也无法检查隐式类型转换
+		// 使用执行时绑定的参数，或根据列的数据类型生成的值替换占位符后再进行索引建议及 EXPLAIN
+		bq := q
+		if q.Stmt != nil && !common.Config.TestDSN.Disable {
+			if params := advisor.FindParams(q.Stmt); len(params) > 0 && vEnv.BuildVirtualEnv(rEnv, q.Query) {
+				var values []string
+				if source != nil && len(source.Params) == len(params) {
+					values = source.Params
+				} else {
+					values = advisor.ParamValues(q.Stmt, params, vEnv)
+				}
+				bound, err := advisor.NewQuery4Audit(ast.BindParams(q.Query, values))
+				if err == nil {
+					bq = bound
+				} else {
+					common.Log.Warn("bind params Error: %v, Query: %s", err, bound.Query)
+				}
+				common.Log.Debug("bind params Query: %s", bq.Query)
+			}
+		}
+		// +++++++++++++++++++++预处理语句[结束]+++++++++++++++++++++++}
+
 		// +++++++++++++++++++++索引优化建议[开始]+++++++++++++++++++++++{
 		// 如果配置了索引建议过滤规则，不进行索引优化建议
 		// 在配置文件 ignore-rules 中添加 'IDX.*' 即可屏蔽索引优化建议
 		common.Log.Debug("start of index advisor Query: %s", q.Query)
 		if !advisor.IsIgnoreRule("IDX.") {
-			if vEnv.BuildVirtualEnv(rEnv, q.Query) {
-				idxAdvisor, err := advisor.NewAdvisor(vEnv, *rEnv, *q)
+			if vEnv.BuildVirtualEnv(rEnv, bq.Query) {
+				// 线上环境负载过高跳过了数据采样
+				if vEnv.ServerBusy != nil {
+					mysqlSuggest["ERR.004"] = advisor.RuleMySQLError("ERR.004", vEnv.ServerBusy)
+					vEnv.ServerBusy = nil
+				}
+				idxAdvisor, err := advisor.NewAdvisor(vEnv, *rEnv, *bq)
 				if err != nil || (idxAdvisor == nil && vEnv.Error == nil) {
 					if idxAdvisor == nil {
 						// 如果 SQL 是 DDL 语句，则返回的 idxAdvisor 为 nil，可以忽略不处理
 						// TODO alter table add index 语句检查索引是否已经存在
-						common.Log.Debug("idxAdvisor by pass Query: %s", q.Query)
+						common.Log.Debug("idxAdvisor by pass Query: %s", bq.Query)
 					} else {
 						common.Log.Warning("advisor.NewAdvisor Error: %v", err)
 					}
@@ -264,9 +350,14 @@ func Execute() {
 					// 创建环境时没有出现错误，生成索引建议
 					if vEnv.Error == nil {
 						idxSuggest = idxAdvisor.IndexAdvise().Format()
+						// 线上环境负载过高跳过了散粒度计算，索引建议可能不准确
+						if vEnv.ServerBusy != nil {
+							mysqlSuggest["ERR.004"] = advisor.RuleMySQLError("ERR.004", vEnv.ServerBusy)
+							vEnv.ServerBusy = nil
+						}
 
 						// 依赖数据字典的启发式建议
-						for i, r := range idxAdvisor.HeuristicCheck(*q) {
+						for i, r := range idxAdvisor.HeuristicCheck(*bq) {
 							heuristicSuggest[i] = r
 						}
 					} else {
@@ -289,7 +380,7 @@ func Execute() {
 					}
 				}
 			} else {
-				common.Log.Error("vEnv.BuildVirtualEnv Error: prepare SQL '%s' in vEnv failed.", q.Query)
+				common.Log.Error("vEnv.BuildVirtualEnv Error: prepare SQL '%s' in vEnv failed.", bq.Query)
 			}
 		}
 		common.Log.Debug("end of index advisor Query: %s", q.Query)
@@ -301,14 +392,24 @@ func Execute() {
 		if !common.Config.OnlineDSN.Disable && !common.Config.TestDSN.Disable {
 			// 因为 EXPLAIN 依赖数据库环境，所以把这段逻辑放在启发式建议和索引建议后面
 			if common.Config.Explain {
-				// 执行 EXPLAIN
-				explainInfo, err := rEnv.Explain(q.Query,
-					database.ExplainType[common.Config.ExplainType],
-					database.ExplainFormatType[common.Config.ExplainFormat])
-				if err != nil {
-					// 线上环境执行失败才到测试环境 EXPLAIN，比如在用户提供建表语句及查询语句的场景
-					common.Log.Warn("rEnv.Explain Warn: %v", err)
-					explainInfo, err = vEnv.Explain(q.Query,
+				// 执行 EXPLAIN，使用快照时线上环境不可用，直接在测试环境 EXPLAIN
+				var explainInfo *database.ExplainInfo
+				var err error
+				if vEnv.Snapshot == nil {
+					explainInfo, err = rEnv.Explain(bq.Query,
+						database.ExplainType[common.Config.ExplainType],
+						database.ExplainFormatType[common.Config.ExplainFormat])
+					if err != nil {
+						// 线上环境执行失败才到测试环境 EXPLAIN，比如在用户提供建表语句及查询语句的场景
+						common.Log.Warn("rEnv.Explain Warn: %v", err)
+						// 线上环境负载过高跳过了 EXPLAIN
+						if _, ok := err.(*database.ServerBusyError); ok {
+							mysqlSuggest["ERR.004"] = advisor.RuleMySQLError("ERR.004", err)
+						}
+					}
+				}
+				if explainInfo == nil {
+					explainInfo, err = vEnv.Explain(bq.Query,
 						database.ExplainType[common.Config.ExplainType],
 						database.ExplainFormatType[common.Config.ExplainFormat])
 					if err != nil {
@@ -320,8 +421,14 @@ func Execute() {
 				// 分析 EXPLAIN 结果
 				if explainInfo != nil {
 					expSuggest = advisor.ExplainAdvisor(explainInfo)
+					// 事务中的加锁读及批量更新结合 EXPLAIN 结果检查
+					for item, r := range trx.CheckExplain(explainInfo) {
+						if !advisor.IsIgnoreRule(item) {
+							heuristicSuggest[item] = r
+						}
+					}
 				} else {
-					common.Log.Warn("rEnv&vEnv.Explain explainInfo nil, SQL: %s", q.Query)
+					common.Log.Warn("rEnv&vEnv.Explain explainInfo nil, SQL: %s", bq.Query)
 				}
 			}
 		}
@@ -331,7 +438,7 @@ func Execute() {
 		// +++++++++++++++++++++ Profiling [开始]+++++++++++++++++++++++++{
 		common.Log.Debug("start of profiling Query: %s", q.Query)
 		if common.Config.Profiling {
-			res, err := vEnv.Profiling(q.Query)
+			res, err := vEnv.Profiling(bq.Query)
 			if err == nil {
 				proSuggest["PRO.001"] = advisor.Rule{
 					Item:     "PRO.001",
@@ -348,7 +455,7 @@ func Execute() {
 		// +++++++++++++++++++++ Trace [开始]+++++++++++++++++++++++++{
 		common.Log.Debug("start of trace Query: %s", q.Query)
 		if common.Config.Trace {
-			res, err := vEnv.Trace(q.Query)
+			res, err := vEnv.Trace(bq.Query)
 			if err == nil {
 				traceSuggest["TRA.001"] = advisor.Rule{
 					Item:     "TRA.001",
@@ -390,11 +497,34 @@ func Execute() {
 					os.Exit(1)
 				}
 				// SQL 转写需要的源信息采集，如果没有配置环境则只做有限改写
-				meta := ast.GetMeta(rw.Stmt, nil)
+				var meta common.Meta
+				if rw.Stmt != nil {
+					meta = ast.GetMeta(rw.Stmt, nil)
+				} else {
+					meta = ast.GetTiMeta(rw.TiStmt, nil)
+				}
 				rw.Columns = vEnv.GenTableColumns(meta)
+				rw.UniqueKeys = vEnv.GenTableUniqueKeys(meta)
 				// 执行定义好的 SQL 重写规则
 				rw.Rewrite()
-				fmt.Println(strings.TrimSpace(rw.NewSQL))
+				report := rw.Report(id)
+				// 在测试环境中验证重写前后的查询结果是否一致
+				if common.Config.RewriteVerify {
+					report.Verify = vEnv.VerifyRewrite(sql, rw.NewSQL).String()
+				}
+				switch common.Config.RewriteReportType {
+				case "markdown":
+					fmt.Println(report.Markdown())
+				case "html":
+					fmt.Println(common.Markdown2HTML(report.Markdown()))
+				case "json":
+					rewriteReports = append(rewriteReports, report)
+				default:
+					fmt.Println(strings.TrimSpace(rw.NewSQL))
+					if report.Verify != "" {
+						fmt.Println(report.Verify)
+					}
+				}
 			}
 		}
 		common.Log.Debug("end of rewrite Query: %s", q.Query)
@@ -420,7 +550,9 @@ func Execute() {
 					continue
 				}
 
-				if common.Config.Query != "" {
+				if source != nil {
+					fmt.Printf("%s:%d:[%s] %s\n", source.File, source.Line, source.Name(), s)
+				} else if common.Config.Query != "" {
 					if _, err = os.Stat(common.Config.Query); err == nil {
 						fmt.Printf("%s:%d:%s\n", common.Config.Query, lineCounter, s)
 					} else {
@@ -432,18 +564,43 @@ func Execute() {
 			}
 			lineCounter += lc - llc
 		case "html":
+			if source != nil {
+				str = fmt.Sprintf("> %s\n\n", source) + str
+			}
 			fmt.Println(common.Markdown2HTML(str))
 		default:
+			if source != nil {
+				fmt.Printf("> %s\n\n", source)
+			}
 			fmt.Println(str)
 		}
 		common.Log.Debug("end of print suggestions, Query: %s", q.Query)
 		// +++++++++++++++++++++打印单条 SQL 优化建议[结束]++++++++++++++++++++++++++}
 	}
 
+	// 以 JSON 格式输出 SQL 重写报告，合并后的 ALTER 语句作为单独的报告一起输出，保证输出为合法的 JSON
+	rewriteJSON := common.Config.ReportType == "rewrite" && common.Config.RewriteReportType == "json"
+	if rewriteJSON {
+		if ast.RewriteRuleMatch("mergealter") {
+			for _, report := range ast.MergeAlterReports(alterSQLs...) {
+				report.ID = query.Id(strings.TrimSpace(query.Fingerprint(report.NewSQL)))
+				rewriteReports = append(rewriteReports, report)
+			}
+		}
+		js, err := json.MarshalIndent(rewriteReports, "", "  ")
+		if err == nil {
+			fmt.Println(string(js))
+		} else {
+			common.Log.Error("RewriteReport json.Marshal Error: %v", err)
+		}
+	}
+
 	// 同一张表的多条 ALTER 语句合并为一条
 	if ast.RewriteRuleMatch("mergealter") {
-		for _, v := range ast.MergeAlterTables(alterSQLs...) {
-			fmt.Println(strings.TrimSpace(v))
+		if !rewriteJSON {
+			for _, v := range ast.MergeAlterTables(alterSQLs...) {
+				fmt.Println(strings.TrimSpace(v))
+			}
 		}
 		return
 	}
@@ -28,6 +28,7 @@ import (
 	"github.com/laojianzi/soar/common"
 	"github.com/laojianzi/soar/database"
 	"github.com/laojianzi/soar/env"
+	"github.com/laojianzi/soar/input"
 )
 
 // initConfig load config from default->file->cmdFlag
@@ -166,6 +167,12 @@ func reportTool(sql string, bom []byte) (isContinue bool) {
 		// HTML 格式输入 CSS 加载
 		fmt.Println(common.MarkdownHTMLHeader())
 		return true
+	case "rewrite":
+		// 以 HTML 格式输出重写报告时加载 CSS
+		if common.Config.RewriteReportType == "html" {
+			fmt.Println(common.MarkdownHTMLHeader())
+		}
+		return true
 	case "md2html":
 		// markdown2html 转换小工具
 		fmt.Println(common.MarkdownHTMLHeader())
@@ -231,6 +238,152 @@ func initQuery(query string) string {
 	return query
 }
 
+// initInput 读入待优化 SQL，-input-format 不为 sql 时从 mapper 文件等输入中提取 SQL
+// 返回拼接后的 SQL 及提取出的 SQL，拼接后的 SQL 只用于小工具，评审时逐条切分提取出的 SQL 以保留其来源
+func initInput(query string) (string, []input.Statement) {
+	if common.Config.InputFormat == "sql" {
+		return initQuery(query), nil
+	}
+
+	var stmts []input.Statement
+	var err error
+	if _, statErr := os.Stat(query); query != "" && statErr == nil {
+		stmts, err = input.ReadFiles(common.Config.InputFormat, query)
+	} else {
+		file := "stdin"
+		if query != "" {
+			file = "null"
+		}
+		stmts, err = input.Parse(common.Config.InputFormat, file, []byte(initQuery(query)))
+	}
+	if err != nil {
+		common.Log.Critical("initInput Error: %v", err)
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	return input.Join(stmts, common.Config.Delimiter), stmts
+}
+
+// schemaDump 导出线上环境库表结构及统计信息快照，指定 -schema-snapshot 时写入文件，否则输出到标准输出
+func schemaDump(rEnv *database.Connector) {
+	if common.Config.OnlineDSN.Disable {
+		common.Log.Error("schemaDump, OnlineDSN: %s is disable", common.Config.OnlineDSN.Addr)
+		fmt.Println("online-dsn:", common.Config.OnlineDSN.Addr, "is disable, please check log.")
+		return
+	}
+
+	snapshot, err := rEnv.DumpSchema()
+	if err != nil {
+		common.Log.Error("schemaDump, DumpSchema Error: %s", err.Error())
+		fmt.Println(err.Error())
+		return
+	}
+
+	buf, err := snapshot.Marshal(common.Config.SchemaSnapshot)
+	if err != nil {
+		common.Log.Error("schemaDump, Marshal Error: %s", err.Error())
+		return
+	}
+	if common.Config.SchemaSnapshot == "" {
+		fmt.Println(string(buf))
+		return
+	}
+	err = ioutil.WriteFile(common.Config.SchemaSnapshot, buf, 0644)
+	if err != nil {
+		common.Log.Error("schemaDump, WriteFile Error: %s", err.Error())
+		fmt.Println(err.Error())
+	}
+}
+
+// loadSchemaSource 加载表结构，source 为目录或 .sql 文件时读取建表语句，为 .json, .yaml, .yml 文件时读取快照，否则作为 DSN 连接数据库
+func loadSchemaSource(source string) (*database.SchemaSnapshot, error) {
+	if fi, err := os.Stat(source); err == nil {
+		switch strings.ToLower(filepath.Ext(source)) {
+		case ".json", ".yaml", ".yml":
+			if !fi.IsDir() {
+				return database.LoadSchemaSnapshot(source)
+			}
+		}
+		return database.LoadSchemaDDL(source)
+	}
+
+	conn, err := database.NewConnector(common.ParseDSN(source, nil))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Conn.Close()
+	return conn.DumpSchemaDDL()
+}
+
+// schemaDiff 对比两个库的表结构，输出变更 SQL 及 ALTER 语句的执行建议
+func schemaDiff(rEnv *database.Connector) {
+	if common.Config.SchemaDiffTo == "" {
+		fmt.Println("schema-diff-to is empty, please specify the target schema.")
+		return
+	}
+
+	var from *database.SchemaSnapshot
+	var err error
+	if common.Config.SchemaDiffFrom == "" {
+		if common.Config.OnlineDSN.Disable {
+			common.Log.Error("schemaDiff, OnlineDSN: %s is disable", common.Config.OnlineDSN.Addr)
+			fmt.Println("online-dsn:", common.Config.OnlineDSN.Addr, "is disable, please check log.")
+			return
+		}
+		from, err = rEnv.DumpSchemaDDL()
+	} else {
+		from, err = loadSchemaSource(common.Config.SchemaDiffFrom)
+	}
+	if err != nil {
+		common.Log.Error("schemaDiff, load schema-diff-from Error: %s", err.Error())
+		fmt.Println(err.Error())
+		return
+	}
+	to, err := loadSchemaSource(common.Config.SchemaDiffTo)
+	if err != nil {
+		common.Log.Error("schemaDiff, load schema-diff-to Error: %s", err.Error())
+		fmt.Println(err.Error())
+		return
+	}
+
+	// 变更前的表结构来自数据库或快照时按其版本预估 Online DDL 的影响
+	if from.Version > 0 {
+		common.Config.OnlineDSN.Version = from.Version
+	}
+
+	sqls, err := advisor.SchemaDiff(from, to)
+	if err != nil {
+		common.Log.Error("schemaDiff, SchemaDiff Error: %s", err.Error())
+		fmt.Println(err.Error())
+		return
+	}
+	if len(sqls) == 0 {
+		fmt.Println("表结构一致，不需要变更")
+		return
+	}
+
+	fmt.Printf("# Schema Diff\n\n```sql\n%s\n```\n\n", strings.Join(sqls, "\n"))
+	var skipped int
+	for _, sql := range sqls {
+		// 未开启 -schema-diff-allow-drop 时注释掉的删除语句
+		if strings.HasPrefix(sql, advisor.SchemaDiffDropComment) {
+			skipped++
+			continue
+		}
+		suggest := advisor.SchemaDiffSuggest(from, sql)
+		if len(suggest) == 0 {
+			continue
+		}
+		_, str := advisor.FormatSuggest(sql, from.Database, "markdown", suggest)
+		fmt.Println(str)
+	}
+	if skipped > 0 {
+		fmt.Printf("## 删除表及删除列的语句未生效\n\n"+
+			"%d 条删除表或删除列的语句以注释的形式输出，删除后数据无法恢复。列改名且定义同时发生变化时也会生成删除旧列的语句，"+
+			"请确认旧列中的数据已经迁移，确认无误后指定 -schema-diff-allow-drop 生成可执行的删除语句。\n", skipped)
+	}
+}
+
 func shutdown(vEnv *env.VirtualEnv, rEnv *database.Connector) {
 	if common.Config.DropTestTemporary {
 		vEnv.CleanUp()